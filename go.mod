@@ -8,6 +8,8 @@ require (
 	github.com/rekby/mbr v0.0.0-20151216101307-8c28b6465703
 	github.com/ulikunitz/xz v0.5.5
 	github.com/zclconf/go-cty v1.7.0
+	golang.org/x/crypto v0.0.0-20201208171446-5f87f3452ae9
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
 	gopkg.in/h2non/filetype.v1 v1.0.5
 )
 
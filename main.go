@@ -1,12 +1,40 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/hashicorp/packer-plugin-sdk/plugin"
 	"github.com/solo-io/packer-builder-arm-image/pkg/builder"
 	"github.com/solo-io/packer-builder-arm-image/pkg/postprocessor"
 )
 
 func main() {
+	// checks the host, for the first build on it
+	if len(os.Args) == 2 && os.Args[1] == "doctor" {
+		if !builder.Doctor(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// packer >= 1.7 starts multi component plugins with a command, like `describe`.
+	if len(os.Args) > 1 {
+		pps := plugin.NewSet()
+		pps.RegisterBuilder(plugin.DEFAULT_NAME, builder.NewBuilder())
+		pps.RegisterPostProcessor("flasher", postprocessor.NewFlasher())
+		pps.RegisterPostProcessor("imager", postprocessor.NewImager())
+		pps.RegisterPostProcessor("mender", postprocessor.NewMender())
+		pps.RegisterPostProcessor("swupdate", postprocessor.NewSWUpdate())
+		pps.RegisterPostProcessor("delta", postprocessor.NewDelta())
+		pps.RegisterPostProcessor("upload", postprocessor.NewUpload())
+		if err := pps.Run(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	server, err := plugin.Server()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,204 @@
+package builder
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/image/utils"
+)
+
+const binfmtName = "packer-builder-arm-image"
+
+// registration returns the line to write to /proc/sys/fs/binfmt_misc/register.
+func (e BinfmtEntry) registration() string {
+	return fmt.Sprintf(":%s:M::%s:%s:%s:%s", e.Name, e.Magic, e.Mask, e.Interpreter, e.Flags)
+}
+
+// fixBinary tells if the kernel opens the interpreter when it is registered, so the host path
+// works in the chroot as is.
+func (e BinfmtEntry) fixBinary() bool {
+	return strings.Contains(e.Flags, "F")
+}
+
+var binfmtNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func validateBinfmtEntry(e BinfmtEntry) []error {
+	var errs []error
+	if !binfmtNameRegexp.MatchString(e.Name) {
+		errs = append(errs, fmt.Errorf("invalid binfmt_entries name %q", e.Name))
+	}
+	if e.Magic == "" || strings.Contains(e.Magic, ":") || strings.Contains(e.Mask, ":") {
+		errs = append(errs, fmt.Errorf("binfmt entry %s needs a magic, and magic and mask can't contain ':' (use \\x3a)", e.Name))
+	}
+	if strings.Trim(e.Flags, "POCF") != "" {
+		errs = append(errs, fmt.Errorf("binfmt entry %s has unknown flags %q, must be some of P, O, C, F", e.Name, e.Flags))
+	}
+	if e.Interpreter == "" {
+		errs = append(errs, fmt.Errorf("binfmt entry %s needs an interpreter", e.Name))
+	}
+	return errs
+}
+
+// ELF magics of the architectures qemu-user emulates, as in qemu's qemu-binfmt-conf.sh.
+// keyed by the architecture in the qemu binary name.
+var qemuBinfmtMagic = map[string][2]string{
+	"arm": {`\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"armeb": {`\x7fELF\x01\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`},
+	"aarch64": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"aarch64_be": {`\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`},
+	"riscv64": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+}
+
+// qemuArch returns the architecture of a qemu-user binary from its name,
+// like aarch64 for /usr/bin/qemu-aarch64-static.
+func qemuArch(qemuBinary string) string {
+	name := filepath.Base(qemuBinary)
+	name = strings.TrimSuffix(name, "-static")
+	return strings.TrimPrefix(name, "qemu-")
+}
+
+// imageArchOf returns the image_arch of a qemu-user binary, like arm64 for qemu-aarch64-static.
+func imageArchOf(qemuBinary string) string {
+	if arch := qemuArch(qemuBinary); arch != "aarch64" {
+		return arch
+	}
+	return "arm64"
+}
+
+// hostRunsNatively tells if the host runs the binaries qemuBinary emulates without it: arm64
+// hosts run arm and arm64 binaries.
+func hostRunsNatively(qemuBinary string) bool {
+	arch := imageArchOf(qemuBinary)
+	switch runtime.GOARCH {
+	case "arm64":
+		return arch == "arm64" || arch == "arm"
+	case "arm", "riscv64":
+		return arch == runtime.GOARCH
+	}
+	return false
+}
+
+// needsQemu tells if the build runs the binaries of the image with qemu_binary: not when it runs
+// none, with inject_files, or when the host runs them natively.
+func (c *Config) needsQemu() bool {
+	return !c.InjectFiles && !hostRunsNatively(c.QemuBinary)
+}
+
+// imageTypeArgs returns the default qemu_args of an image type, unless image_arch is another
+// architecture than the one of the image type, which the arguments, like a cpu, are for.
+func (c *Config) imageTypeArgs(imageType utils.KnownImageType) []string {
+	qemu, ok := c.qemuBinaryOf(imageType)
+	if !ok {
+		qemu = "qemu-arm-static"
+	}
+	if c.ImageArch != "" && imageArchOf(qemu) != c.ImageArch {
+		return nil
+	}
+	return c.qemuArgsOf(imageType)
+}
+
+// qemuBinfmtEntry returns the registration of a qemu binary placed at interpreter in the chroot.
+func qemuBinfmtEntry(name, interpreter string) (BinfmtEntry, bool) {
+	magic, ok := qemuBinfmtMagic[qemuArch(interpreter)]
+	if !ok {
+		return BinfmtEntry{}, false
+	}
+	return BinfmtEntry{Name: name, Magic: magic[0], Mask: magic[1], Interpreter: interpreter}, true
+}
+
+// unescapeBinfmt returns the bytes of a magic or mask with \x escapes.
+func unescapeBinfmt(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b = append(b, byte(v))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// binfmtRegistration is an entry of /proc/sys/fs/binfmt_misc, as the kernel shows it.
+type binfmtRegistration struct {
+	Name        string
+	Enabled     bool
+	Interpreter string
+	Flags       string
+	Offset      int
+	Magic, Mask []byte
+}
+
+// parseBinfmtRegistration parses the content of a /proc/sys/fs/binfmt_misc entry.
+func parseBinfmtRegistration(name, data string) binfmtRegistration {
+	r := binfmtRegistration{Name: name}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			value = fields[1]
+		}
+		switch fields[0] {
+		case "enabled":
+			r.Enabled = true
+		case "interpreter":
+			r.Interpreter = value
+		case "flags:":
+			r.Flags = value
+		case "offset":
+			r.Offset, _ = strconv.Atoi(value)
+		case "magic":
+			r.Magic, _ = hex.DecodeString(value)
+		case "mask":
+			r.Mask, _ = hex.DecodeString(value)
+		}
+	}
+	return r
+}
+
+// runs tells if the registration matches binaries starting with header, the magic of an entry
+// with its mask applied.
+func (r binfmtRegistration) runs(header []byte) bool {
+	if !r.Enabled || r.Magic == nil || r.Offset+len(r.Magic) > len(header) {
+		return false
+	}
+	for i, m := range r.Magic {
+		mask := byte(0xff)
+		if i < len(r.Mask) {
+			mask = r.Mask[i]
+		}
+		if header[r.Offset+i]&mask != m&mask {
+			return false
+		}
+	}
+	return true
+}
+
+// binfmtHeader returns the start of the binaries an entry is for: its magic, with its mask
+// applied.
+func (e BinfmtEntry) binfmtHeader() []byte {
+	header := unescapeBinfmt(e.Magic)
+	mask := unescapeBinfmt(e.Mask)
+	for i := range header {
+		if i < len(mask) {
+			header[i] &= mask[i]
+		}
+	}
+	return header
+}
@@ -0,0 +1,101 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// btrfsRootSubvolumes are the subvolumes distributions keep the root filesystem in, when the
+// default subvolume of the filesystem is its top level, like root on Fedora and @ on Ubuntu.
+var btrfsRootSubvolumes = []string{"@", "root", "@rootfs"}
+
+// mountBtrfsSubvolumes completes the btrfs root filesystem mounted at mntpnt. When the default
+// subvolume isn't the root filesystem, the root subvolume is mounted instead. Then the
+// subvolumes fstab mounts from the same filesystem, like @/home and @/var on openSUSE, are
+// mounted where they belong so provisioning writes to them rather than to the directories they
+// hide. The snapper snapshots are left out.
+func (s *stepMountImage) mountBtrfsSubvolumes(ctx context.Context, state multistep.StateBag, dev, mntpnt string, info *utils.BlkidInfo, mounts []string) error {
+	ui := state.Get("ui").(packer.Ui)
+
+	if _, err := os.Stat(filepath.Join(mntpnt, "etc/fstab")); os.IsNotExist(err) {
+		for _, subvol := range btrfsRootSubvolumes {
+			if _, err := os.Stat(filepath.Join(mntpnt, subvol, "etc/fstab")); err != nil {
+				continue
+			}
+			ui.Message(fmt.Sprintf("Mounting subvolume %s of %s as root", subvol, dev))
+			if err := run(ctx, state, "umount "+mntpnt); err != nil {
+				return err
+			}
+			if err := run(ctx, state, fmt.Sprintf("mount -o %s %s %s", shellQuote("subvol="+subvol), dev, mntpnt)); err != nil {
+				s.mountpoints = s.mountpoints[:len(s.mountpoints)-1]
+				return err
+			}
+			break
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(mntpnt, "etc/fstab"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entries, err := utils.ParseFstab(data)
+	if err != nil {
+		return err
+	}
+
+	mounted := make(map[string]bool)
+	for _, mnt := range mounts {
+		if mnt != "" {
+			mounted[path.Clean(mnt)] = true
+		}
+	}
+	for _, entry := range entries {
+		subvol, ok := entry.Option("subvol")
+		if entry.VfsType != "btrfs" || !ok || !sameFilesystem(entry.Spec, dev, info) {
+			continue
+		}
+		if _, noauto := entry.Option("noauto"); noauto {
+			continue
+		}
+		file := path.Clean(entry.File)
+		if file == "/" || file == "/.snapshots" || mounted[file] {
+			continue
+		}
+
+		dir := filepath.Join(mntpnt, file)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		ui.Message(fmt.Sprintf("Mounting subvolume %s at %s", subvol, file))
+		if err := run(ctx, state, fmt.Sprintf("mount -o %s %s %s", shellQuote("subvol="+subvol), dev, dir)); err != nil {
+			return err
+		}
+		s.mountpoints = append(s.mountpoints, dir)
+	}
+	return nil
+}
+
+// sameFilesystem tells if the fstab spec refers to the filesystem on dev.
+func sameFilesystem(spec, dev string, info *utils.BlkidInfo) bool {
+	switch {
+	case spec == dev:
+		return true
+	case info.UUID() != "" && spec == "UUID="+info.UUID():
+		return true
+	case info.Label() != "" && spec == "LABEL="+info.Label():
+		return true
+	case info.PartUUID() != "" && spec == "PARTUUID="+info.PartUUID():
+		return true
+	}
+	return false
+}
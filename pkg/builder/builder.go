@@ -1,16 +1,23 @@
-//go:generate mapstructure-to-hcl2 -type Config
+//go:generate mapstructure-to-hcl2 -type Config,BinfmtEntry,BootloaderImage,NewPartition,OstreeCommit,EfiSystemPartition,ABPartitions,ImageFile,DmVerity,FitImage
 
 package builder
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
-	"runtime"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
@@ -21,6 +28,8 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 	"github.com/solo-io/packer-builder-arm-image/pkg/image"
 	"github.com/solo-io/packer-builder-arm-image/pkg/image/utils"
+	osutils "github.com/solo-io/packer-builder-arm-image/pkg/utils"
+	"github.com/solo-io/packer-builder-arm-image/pkg/version"
 
 	getter "github.com/hashicorp/go-getter/v2"
 )
@@ -29,13 +38,71 @@ const BuilderId = "yuval-k.arm-image"
 
 var (
 	knownTypes = map[utils.KnownImageType][]string{
-		utils.RaspberryPi: {"/boot", "/"},
-		utils.BeagleBone:  {"/"},
-		utils.Kali:        {"/root", "/"},
+		utils.RaspberryPi:      {"/boot", "/"},
+		utils.RaspberryPiArm64: {"/boot", "/"},
+		utils.BeagleBone:       {"/"},
+		utils.Kali:             {"/root", "/"},
+		// the boot and root partitions of the OS selected with noobs_os
+		utils.Noobs: {"/boot", "/"},
+		// the ESP, the /boot partition and the root filesystem, on LVM for Fedora Server
+		utils.Fedora: {"/boot/efi", "/boot", "/"},
+		// mounted with knownPartitionMounts
+		utils.OpenSUSE: nil,
+		// the layout rootfs archives are unpacked to
+		utils.ArchLinuxArm:   {"/boot", "/"},
+		utils.ArchLinuxArm64: {"/boot", "/"},
+		// the layout of the sdimage-bootpart wks, see wks_file for others
+		utils.Yocto:      {"/boot", "/"},
+		utils.YoctoArm64: {"/boot", "/"},
+		// found from the filesystems of the mapped partitions, see buildrootMounts
+		utils.Buildroot:      {"/boot", "/"},
+		utils.BuildrootArm64: {"/boot", "/"},
+		// mounted with knownPartitionMounts
+		utils.HomeAssistant:      nil,
+		utils.HomeAssistantArm64: nil,
+	}
+	// partition_mounts of image types whose layout varies between releases
+	knownPartitionMounts = map[utils.KnownImageType]map[string]string{
+		// the labels kiwi gives the partitions of openSUSE images, which may have swap in between
+		utils.OpenSUSE: {"LABEL=EFI": "/boot/efi", "LABEL=ROOT": "/"},
+		// the first system slot, partition 3 of both the GPT and the MBR layouts, is mounted
+		// where Home Assistant OS mounts the boot, overlay and data partitions
+		utils.HomeAssistant:      homeAssistantMounts,
+		utils.HomeAssistantArm64: homeAssistantMounts,
+	}
+	homeAssistantMounts = map[string]string{"LABEL=hassos-boot": "/mnt/boot", "3": "/",
+		"LABEL=hassos-overlay": "/mnt/overlay", "LABEL=hassos-data": "/mnt/data"}
+	// image types whose default image_mounts are found once the image is mapped, from the
+	// mapped partitions
+	knownMountResolvers = map[utils.KnownImageType]func(blkid blkidFunc, partitions []string) ([]string, error){
+		utils.Buildroot:      buildrootMounts,
+		utils.BuildrootArm64: buildrootMounts,
+		// images detected once mounted, see stepDetectImageType
+		utils.Unknown: layoutMounts,
 	}
 	knownArgs = map[utils.KnownImageType][]string{
 		utils.BeagleBone: {"-cpu", "cortex-a8"},
 	}
+	// qemu binaries of image types that don't run 32 bit arm binaries
+	knownQemuBinaries = map[utils.KnownImageType]string{
+		utils.RaspberryPiArm64:   "qemu-aarch64-static",
+		utils.Fedora:             "qemu-aarch64-static",
+		utils.OpenSUSE:           "qemu-aarch64-static",
+		utils.ArchLinuxArm64:     "qemu-aarch64-static",
+		utils.YoctoArm64:         "qemu-aarch64-static",
+		utils.BuildrootArm64:     "qemu-aarch64-static",
+		utils.HomeAssistantArm64: "qemu-aarch64-static",
+	}
+	// qemu binaries of the image_arch values, the binfmt_misc registration follows from them
+	imageArchQemuBinaries = map[string]string{
+		"arm":     "qemu-arm-static",
+		"arm64":   "qemu-aarch64-static",
+		"riscv64": "qemu-riscv64-static",
+	}
+
+	// where the kernel command line is, see findCmdline
+	defaultCmdlineFiles = []string{"/boot/firmware/cmdline.txt", "/boot/cmdline.txt"}
+	knownCmdlineFiles   = map[utils.KnownImageType][]string{}
 
 	defaultBase = [][]string{
 		{"proc", "proc", "/proc"},
@@ -43,12 +110,22 @@ var (
 		{"bind", "/dev", "/dev"},
 		{"devpts", "devpts", "/dev/pts"},
 		{"binfmt_misc", "binfmt_misc", "/proc/sys/fs/binfmt_misc"},
+		// systemd-tmpfiles and package scripts expect them to be empty and writable
+		{"tmpfs", "tmpfs", "/run"},
+		{"tmpfs", "tmpfs", "/tmp"},
 	}
 	resolvConfBindMount = []string{"bind", "/etc/resolv.conf", "/etc/resolv.conf"}
 
 	defaultChrootTypes = map[utils.KnownImageType][][]string{
 		utils.Unknown: defaultBase,
 	}
+
+	// early cleanup keys that tear down the chroot and unmount the image, in order.
+	unmountCleanupKeys = []string{"suppress_services_cleanup", "register_binfmt_cleanup", "qemu_user_static_cleanup",
+		"mount_extra_cleanup", "mount_image_cleanup"}
+	// early cleanup keys that also unmap the image, so the image file can be worked on.
+	unmapCleanupKeys = []string{"suppress_services_cleanup", "register_binfmt_cleanup", "qemu_user_static_cleanup",
+		"mount_extra_cleanup", "mount_image_cleanup", "activate_lvm_cleanup", "map_image_cleanup"}
 )
 
 type ResolvConfBehavior string
@@ -60,38 +137,344 @@ const (
 	Delete   ResolvConfBehavior = "delete"
 )
 
+type SwapPartitionBehavior string
+
+const (
+	SwapRelocate SwapPartitionBehavior = "relocate"
+	SwapDrop     SwapPartitionBehavior = "drop"
+)
+
+type EfiBootloader string
+
+const (
+	EfiGrub        EfiBootloader = "grub"
+	EfiSystemdBoot EfiBootloader = "systemd-boot"
+	EfiNone        EfiBootloader = "none"
+)
+
+type SelinuxRelabel string
+
+const (
+	SelinuxAuto        SelinuxRelabel = "auto"
+	SelinuxAutorelabel SelinuxRelabel = "autorelabel"
+	SelinuxSetfiles    SelinuxRelabel = "setfiles"
+	SelinuxOff         SelinuxRelabel = "off"
+)
+
+// BinfmtEntry is a binfmt_misc registration, see
+// https://www.kernel.org/doc/html/latest/admin-guide/binfmt-misc.html
+type BinfmtEntry struct {
+	// The name of the entry in /proc/sys/fs/binfmt_misc.
+	Name string `mapstructure:"name"`
+	// The bytes to match at the start of the binary, with \x escapes. for example: `\x7fELF\x01\x01`
+	Magic string `mapstructure:"magic"`
+	// The mask applied to the bytes before comparing them with magic, with \x escapes. Optional
+	Mask string `mapstructure:"mask"`
+	// The host path of the interpreter, it is copied to the root of the chroot. With the F flag it is
+	// opened when registered instead, and not copied.
+	Interpreter string `mapstructure:"interpreter"`
+	// binfmt_misc flags, some of P, O, C and F.
+	Flags string `mapstructure:"flags"`
+}
+
+// BootloaderImage is a bootloader binary written at a fixed offset of the image.
+type BootloaderImage struct {
+	// Path of the binary on the host.
+	File string `mapstructure:"file"`
+	// Offset in the image to write it at, in bytes or as a size like "32K".
+	Offset string `mapstructure:"offset"`
+
+	offset uint64
+}
+
+// ImageFile is a file of the host copied into the image before provisioning.
+type ImageFile struct {
+	// The file or directory to copy. The content of directories is copied, recursively.
+	Source string `mapstructure:"source"`
+	// Where to copy it in the image. Files are copied into the directory when it ends with a slash.
+	Destination string `mapstructure:"destination"`
+	// The octal mode of the copied files, like 0600. Defaults to the mode of the source.
+	Mode string `mapstructure:"mode"`
+	// The owner of what is copied, a user of the image with an optional group like pi:video, or
+	// numeric ids. Defaults to root.
+	Owner string `mapstructure:"owner"`
+
+	mode os.FileMode
+}
+
+// NewPartition is a partition added after the last partition of the image.
+type NewPartition struct {
+	// The size of the partition, in bytes or as a size like "1G". Rounded up to 1MiB.
+	Size string `mapstructure:"size"`
+	// The filesystem to create: ext4, vfat or swap. Defaults to ext4.
+	Filesystem string `mapstructure:"filesystem"`
+	// The label of the filesystem. Optional, required with partition_mounts to mount it.
+	Label string `mapstructure:"label"`
+	// Where the partition is mounted, during the build and in the fstab entry added for it.
+	// Leave it empty to not mount it. Swap partitions get an fstab entry regardless.
+	Mountpoint string `mapstructure:"mountpoint"`
+	// The mount options of the fstab entry. Defaults to defaults.
+	MountOptions string `mapstructure:"mount_options"`
+
+	size uint64
+	// an EFI system partition, of efi_system_partition
+	esp bool
+	// the B root slot of ab_partitions, sized like the root partition and copied from it
+	abSlot bool
+}
+
+// ABPartitions lays out the image with two root filesystem slots and a data partition, for
+// A/B updates.
+type ABPartitions struct {
+	// The size of the data partition. Defaults to 1G.
+	DataSize string `mapstructure:"data_size"`
+	// Where the data partition is mounted. Defaults to /data.
+	DataMountpoint string `mapstructure:"data_mountpoint"`
+	// The u-boot environment file written in the chroot, with the slots and their PARTUUIDs.
+	// Defaults to uboot.env in the mount point of the first partition, like /boot/uboot.env. Set
+	// it to "-" to not write one.
+	BootEnv string `mapstructure:"boot_env"`
+	// The size of the u-boot environment, CONFIG_ENV_SIZE of the u-boot build. Defaults to 16384.
+	BootEnvSize int `mapstructure:"boot_env_size"`
+	// More variables of the u-boot environment, like the bootcmd running the A/B boot script.
+	BootEnvVars map[string]string `mapstructure:"boot_env_vars"`
+}
+
+// EfiSystemPartition is an EFI system partition added to the image, for boards that boot with
+// UEFI firmware.
+type EfiSystemPartition struct {
+	// The size of the partition. Defaults to 256M.
+	Size string `mapstructure:"size"`
+	// Where the partition is mounted. Defaults to /boot/efi.
+	Mountpoint string `mapstructure:"mountpoint"`
+	// The bootloader installed to the partition after provisioning: grub, with grub-install in
+	// the chroot, systemd-boot, copying its binary from the chroot, or none. Defaults to grub.
+	Bootloader EfiBootloader `mapstructure:"bootloader"`
+	// Files of the chroot to copy to the partition after provisioning, as [source, destination]
+	// pairs, like `[["/usr/lib/u-boot/dtb/board.dtb", "/dtb/board.dtb"]]`.
+	Files [][]string `mapstructure:"files"`
+}
+
+// OstreeCommit is a commit of the provisioned root filesystem to an OSTree repository.
+type OstreeCommit struct {
+	// The repository, created in archive mode when missing. Required.
+	Repo string `mapstructure:"repo"`
+	// The branch of the commit, like acme/stable/aarch64/iot. Required.
+	Branch string `mapstructure:"branch"`
+	// The subject of the commit. Defaults to the name of the build.
+	Subject string `mapstructure:"subject"`
+	// Metadata strings of the commit, like `{"version": "1.2.0"}`.
+	Metadata map[string]string `mapstructure:"metadata"`
+	// A GPG key id to sign the commit with.
+	GpgSign string `mapstructure:"gpg_sign"`
+}
+
+// DmVerity is a dm-verity hash tree of a partition of the finished image, for verified boot.
+type DmVerity struct {
+	// The partition to protect, selected like in partition_mounts: a number, LABEL= or
+	// PARTLABEL=. Its filesystem must be ext or squashfs. Defaults to the partition mounted at /.
+	Partition string `mapstructure:"partition"`
+	// The partition to write the hash tree to, selected the same way. By default the hash tree
+	// follows the filesystem in the protected partition, which must leave room for it.
+	HashPartition string `mapstructure:"hash_partition"`
+	// The hash algorithm. Defaults to sha256.
+	Hash string `mapstructure:"hash"`
+	// Where to write the root hash, a path in the chroot on another partition than the protected
+	// one, like /boot/roothash. Optional, the root hash is in the manifest either way.
+	RootHashFile string `mapstructure:"root_hash_file"`
+}
+
+// FitImage is a U-Boot FIT image of the kernel, device tree and initrd of the image, created
+// after provisioning.
+type FitImage struct {
+	// The kernel, a path in the chroot. Globs like /boot/vmlinuz-* pick the last match, in
+	// sorted order. Required.
+	Kernel string `mapstructure:"kernel"`
+	// The device tree blob, a path or glob in the chroot. Required.
+	Dtb string `mapstructure:"dtb"`
+	// The initrd, a path or glob in the chroot. Optional.
+	Initrd string `mapstructure:"initrd"`
+	// The FIT architecture, like arm, arm64 or riscv. Defaults to the architecture of qemu_binary.
+	Arch string `mapstructure:"arch"`
+	// The load address of the kernel, like 0x80080000. Required.
+	LoadAddress string `mapstructure:"load_address"`
+	// The entry point of the kernel. Defaults to the load address.
+	EntryPoint string `mapstructure:"entry_point"`
+	// The compression of the kernel as it is in the image, like none or gzip. Defaults to none.
+	Compression string `mapstructure:"compression"`
+	// Where to write the FIT image, a path in the chroot. Defaults to /boot/image.fit.
+	Output string `mapstructure:"output"`
+	// A host directory with the signing key, key_name.key and key_name.crt. The configuration
+	// is signed when set.
+	KeyDir string `mapstructure:"key_dir"`
+	// The name of the key in key_dir. Required with key_dir.
+	KeyName string `mapstructure:"key_name"`
+	// The signature algorithm. Defaults to sha256,rsa2048.
+	SignatureAlgo string `mapstructure:"signature_algo"`
+	// A host U-Boot control device tree to add the public key to, marked required, so U-Boot
+	// only boots FIT images signed with the key. Optional.
+	UbootDtb string `mapstructure:"uboot_dtb"`
+}
+
 type Config struct {
 	packer_common_common.PackerConfig `mapstructure:",squash"`
 	// While arm image are not ISOs, we resuse the ISO logic as it basically has no ISO specific code.
 	// Provide the arm image in the iso_url fields.
 	packer_common_commonsteps.ISOConfig `mapstructure:",squash"`
+	// How many times a failed download of the source image is retried. http downloads resume
+	// where they stopped. Defaults to 3, -1 doesn't retry.
+	DownloadRetries int `mapstructure:"download_retries"`
+	// The wait before the first retry, doubled for each next one up to 5m. Defaults to 10s
+	DownloadRetryBackoff time.Duration `mapstructure:"download_retry_backoff"`
+	// With several http iso_urls, download from the one that sends the start of the image the
+	// fastest, falling back to the next fastest ones. Defaults to true; set it to false to try
+	// them in order.
+	ProbeMirrors config.Trilean `mapstructure:"probe_mirrors"`
+	// Pull oci:// iso_urls from, and push oci_push to, a registry served over http rather than
+	// https, like a local registry:2 container.
+	OciPlainHTTP bool `mapstructure:"oci_plain_http"`
+	// Serve http_directory over HTTP while provisioning, like other builders do, see stepHTTPServer.
+	packer_common_commonsteps.HTTPConfig `mapstructure:",squash"`
+
+	// A block device to use as the source image instead of iso_url, like /dev/sdb or /dev/mmcblk0,
+	// to turn a hand-tuned card into a reproducible image. The device is copied, not modified,
+	// and none of its partitions can be mounted during the build.
+	SourceDevice string `mapstructure:"source_device"`
+
+	// A removable block device, like /dev/sdb, the finished image is written to at the end of the
+	// build. It is unmounted first and read back to verify it was written correctly.
+	OutputDevice string `mapstructure:"output_device"`
+
+	// Keep the image sparse: the source image is copied without its zero blocks and, once
+	// provisioning is done, the zero blocks of the image are turned into holes. The image
+	// then takes a fraction of its size on disk.
+	SparseOutput bool `mapstructure:"sparse_output"`
+
+	// Write a bmaptool block map of the image to <image>.bmap, so only the blocks holding data
+	// are written when flashing with bmaptool. Worth it for images with large holes, like the
+	// unused space of target_image_size.
+	Bmap bool `mapstructure:"bmap"`
 
 	// Lets you prefix all builder commands, such as with ssh for a remote build host. Defaults to "".
 	// Copied from other builders :)
 	CommandWrapper string `mapstructure:"command_wrapper"`
 
+	// Lets you prefix the provisioner commands run inside the chroot, for example with
+	// `sudo -u pi {{.Command}}`. `{{.Command}}` runs the chroot_execute_command with the shell of the
+	// chroot, so chroot_env is kept. The commands of the builder itself aren't wrapped, and
+	// command_wrapper still applies to the host side chroot invocation. Defaults to "{{.Command}}".
+	ChrootCommandWrapper string `mapstructure:"chroot_command_wrapper"`
+
 	// Output directory, where the final image will be stored.
 	// Deprecated - Use OutputFile instead
 	OutputDir string `mapstructure:"output_directory"`
 
-	// Output filename, where the final image will be stored
+	// Output filename, where the final image will be stored. Besides the usual template functions,
+	// like `{{build_name}}` and `{{isotime "2006-01-02"}}`, it can use `{{.SourceName}}`, the name of
+	// the source image without its extensions, `{{.ImageType}}` and `{{.PluginVersion}}`.
+	// `{{.ImageType}}` is empty when the image type is only detected during the build.
 	OutputFile string `mapstructure:"output_filename"`
 
+	// Delete the image and the files written next to it by a previous build, like packer's
+	// -force flag does. Otherwise the build fails if the files it writes exist.
+	Overwrite bool `mapstructure:"overwrite"`
+
+	// Keep the image when the build fails, to inspect what the provisioners did. Its path is
+	// printed at the end of the build. Failed builds delete their image otherwise, which older
+	// versions of the builder didn't: set it to keep their behavior.
+	KeepImageOnError bool `mapstructure:"keep_image_on_error"`
+	// Resume a failed build from mounting the image, with the image the build had prepared, instead
+	// of copying the source image again. Builds with resume keep their image when they fail,
+	// with the state to resume them next to it. The image is prepared again when the source
+	// or the options preparing it changed.
+	Resume bool `mapstructure:"resume"`
+
 	// Image type. this is used to deduce other settings like image mounts and qemu args.
 	// If not provided, we will try to deduce it from the image url. (see autoDetectType())
+	// Failing that, it is detected from /etc/os-release once the image is mounted, which then
+	// picks the default qemu_binary and qemu_args. image mounts must be provided in that case.
 	// For list of valid values, see: pkg/image/utils/images.go
 	ImageType utils.KnownImageType `mapstructure:"image_type"`
 
+	// JSON files, or directories of *.json files, describing image types that can then be used
+	// as image_type, or are detected from the image url. See imageProfile in image_profile.go
+	// for the format.
+	ImageProfiles []string `mapstructure:"image_profiles"`
+
 	// Where to mounts the image partitions in the chroot.
 	// first entry is the mount point of the first partition. etc..
+	// LVM physical volumes are replaced by the logical volumes of their volume group, sorted by name.
+	// Use "skip" (or "") for partitions that should not be mounted, like swap or recovery partitions.
 	ImageMounts []string `mapstructure:"image_mounts"`
 
+	// Where to mount the image partitions in the chroot, by partition instead of by position.
+	// Keys are partition numbers, LABEL=<filesystem label>, PARTLABEL=<gpt partition name>
+	// or LV=<volume group>/<logical volume> for LVM logical volumes;
+	// values are mount points, or "skip". Partitions that are not listed or are marked as
+	// "skip" are not mounted; "skip" wins if a partition is matched by more than one key.
+	// Use this instead of `image_mounts` for images with firmware or reserved partitions.
+	// for example: `{"1": "/boot", "LABEL=rootfs": "/"}`
+	PartitionMounts map[string]string `mapstructure:"partition_mounts"`
+
+	// The .wks file a Yocto .wic image was made with, to mount its partitions where the part lines
+	// of the .wks mount them, found by their partition number. Only used when neither
+	// image_mounts nor partition_mounts are set.
+	WksFile string `mapstructure:"wks_file"`
+
+	// The size of the FAT boot partition of images built from a rootfs archive, an iso_url like
+	// ArchLinuxARM-rpi-aarch64-latest.tar.gz. Such images are created blank, with the boot partition
+	// mounted at /boot and an ext4 root partition filling target_image_size, and the archive is
+	// unpacked to them before provisioning. Defaults to 200M
+	BootPartitionSize string `mapstructure:"boot_partition_size"`
+
+	// Unpack squashfs partitions, like the root filesystem of OpenWrt or Home Assistant OS, to a
+	// scratch directory instead of mounting them read-only, and pack them again with the same
+	// compression and block size once provisioned. Partitions too small for the repacked
+	// filesystem are grown. Needs squashfs-tools.
+	RepackSquashfs bool `mapstructure:"repack_squashfs"`
+
+	// The partition holding the upper directory of the overlay a read-only root filesystem is
+	// booted with, like the rootfs_data partition of OpenWrt, as a partition number,
+	// LABEL=<label> or PARTLABEL=<label>. The root filesystem is then provisioned through an
+	// overlay with that upper directory, so the changes take effect on the device. Defaults to
+	// a partition labeled rootfs_data or overlay, if any; set it to "none" to provision through
+	// a throwaway overlay instead.
+	RootOverlayPartition string `mapstructure:"root_overlay_partition"`
+	// The upper directory of the overlay, relative to the root of root_overlay_partition. The
+	// work directory is next to it, named work. Defaults to upper
+	RootOverlayUpperdir string `mapstructure:"root_overlay_upperdir"`
+
+	// For NOOBS/PINN images, the installed OS to provision. Either its name as listed in
+	// installed_os.json on the settings partition, or its 1 based index. Defaults to the first one.
+	NoobsOS string `mapstructure:"noobs_os"`
+
+	// Build without root: the partitions are mounted with fuse2fs and fusefat instead of kpartx
+	// and mount, and the provisioners run with proot instead of chroot and binfmt_misc. Only ext
+	// and FAT partitions listed in image_mounts can be mounted, and the image can't be resized,
+	// shrunk, converted to GPT, encrypted or verified.
+	Rootless bool `mapstructure:"rootless"`
+	// How rootless builds access the image: `fuse` (the default) mounts ext and FAT partitions
+	// with fuse2fs and fusefat, `guestfs` mounts any filesystem libguestfs knows in a small
+	// appliance VM started by guestfish, and runs the provisioners there, for hosts without loop
+	// devices or /dev/fuse. Setting it implies rootless.
+	RootlessBackend string `mapstructure:"rootless_backend"`
+	// How the partitions of the image are mapped to devices: `kpartx` (the default) maps them with
+	// device mapper, `losetup` attaches each partition to a loop device of its own at its offset,
+	// for hosts without device mapper, like many containers.
+	PartitionMapper string `mapstructure:"partition_mapper"`
+	// Only write the files of file provisioners into the image, with debugfs and mtools, without
+	// mounting it or running anything in it, so it needs neither root nor qemu. Commands can't
+	// run, and only ext and FAT partitions listed in image_mounts can be written to. Paths on ext
+	// partitions can't have double quotes or newlines.
+	InjectFiles bool `mapstructure:"inject_files"`
+
 	// The path where the volume will be mounted. This is where the chroot environment will be.
 	// Will be a temporary directory if left unspecified.
 	MountPath string `mapstructure:"mount_path"`
 
 	// What directories mount from the host to the chroot.
-	// leave it empty for reasonable defaults.
+	// leave it empty for reasonable defaults: /proc, /sys, /dev, /dev/pts and binfmt_misc from the
+	// host, and tmpfs on /run and /tmp.
 	// array of triplets: [type, device, mntpoint].
 	ChrootMounts [][]string `mapstructure:"chroot_mounts"`
 
@@ -102,22 +485,356 @@ type Config struct {
 	// for example: `["bind", "/run/systemd", "/run/systemd"]`
 	AdditionalChrootMounts [][]string `mapstructure:"additional_chroot_mounts"`
 
+	// Files of the host to copy into the image before provisioning, for assets that don't need a
+	// file provisioner, like `[{"source": "wpa_supplicant.conf", "destination": "/etc/wpa_supplicant/", "mode": "0600"}]`.
+	ImageFiles []ImageFile `mapstructure:"image_files"`
+
+	// Files of the host to copy into the boot partition once provisioned, like overlays, kernels
+	// or config fragments. Keys are paths in the partition, values the files or directories to
+	// copy, for example `{"overlays/my.dtbo": "build/my.dtbo"}`. The boot partition is the first
+	// FAT partition, wherever it's mounted in the chroot.
+	ExtraBootFiles map[string]string `mapstructure:"extra_boot_files"`
+
+	// Let packages installed in the chroot start their services. By default a policy-rc.d that
+	// denies starting services is installed and start-stop-daemon is diverted while provisioning,
+	// as daemons usually hang or fail under qemu-user.
+	AllowServiceStart bool `mapstructure:"allow_service_start"`
+
+	// A caching proxy for the package managers of the chroot, like an apt-cacher-ng instance at
+	// `http://10.0.2.2:3142`. apt and dnf are configured to use it while provisioning, and the
+	// configuration is removed once provisioned.
+	PackageProxy string `mapstructure:"package_proxy"`
+
+	// Environment variables exported for every command run in the chroot, including the ones
+	// of non-shell provisioners. for example: `{"TZ": "UTC"}`. PATH defaults to the usual
+	// directories, HOME to /root and DEBIAN_FRONTEND to noninteractive, unless set here.
+	ChrootEnv map[string]string `mapstructure:"chroot_env"`
+	// How provisioner commands run in the chroot, so templates need no chroot specific
+	// execute_command. `{{.Vars}}` are the chroot_env assignments and `{{.Command}}` the command of
+	// the provisioner. Defaults to "export {{.Vars}}; {{.Command}}".
+	ChrootExecuteCommand string `mapstructure:"chroot_execute_command"`
+	// The shell commands run with in the chroot, the provisioners' ones included, like `/bin/busybox sh`.
+	// Defaults to /bin/sh, or, for images without it, the first of bash, dash, ash and busybox sh they have.
+	ChrootShell string `mapstructure:"chroot_shell"`
+
 	// Can be one of: off, copy-host, bind-host, delete. Defaults to off
 	ResolvConf ResolvConfBehavior `mapstructure:"resolv-conf"`
 
 	// Should the last partition be extended? this only works for the last partition in the
 	// dos partition table, and ext filesystem
 	LastPartitionExtraSize uint64 `mapstructure:"last_partition_extra_size"`
-	// The target size of the final image. The last partiation will be extended to
-	// fill up this much room. I.e. if the generated image is 256MB and TargetImageSize
-	// is set to 384MB the last partition will be extended with an additional 128MB.
-	TargetImageSize uint64 `mapstructure:"target_image_size"`
+	// The target size of the final image. The image file is grown to this size and the last
+	// partition and its filesystem are extended to fill it. I.e. if the generated image is 256MB
+	// and TargetImageSize is set to 384MB the last partition will be extended with an additional 128MB.
+	// A number of bytes, or a size with a unit like "4G" or "512MiB" (powers of 1024).
+	// KB, MB, GB and TB are powers of 1000 like sd card capacities, so "8GB" fits an 8GB card.
+	TargetImageSize string `mapstructure:"target_image_size"`
+	// Grow the last partition to target_image_size or by last_partition_extra_size. Defaults to
+	// true when either is set; set it to false to only resize the filesystem, for example when
+	// the partition table was already changed by an external tool.
+	ResizePartition config.Trilean `mapstructure:"resize_partition"`
+	// The number of the partition to grow instead of the last one, for layouts with root before
+	// a data partition. The partitions after it are moved towards the end of the image, with
+	// their data; they keep their numbers, so their PARTUUIDs don't change. Only primary MBR
+	// partitions can be grown.
+	ResizePartitionNumber int `mapstructure:"resize_partition_number"`
+	// Grow the filesystem of the last partition to fill it. Defaults to true when the partition
+	// is grown; set it to false to leave that to the OS on first boot, or to true to grow the
+	// filesystem without growing the partition.
+	ResizeFilesystem config.Trilean `mapstructure:"resize_filesystem"`
+	// What to do when the last partition is a swap partition placed after root, as the
+	// partition before it is the one that gets extended. Can be one of: relocate, drop.
+	// relocate moves the swap partition to the end of the image and recreates it with the same
+	// UUID and label. drop deletes the swap partition and its fstab entry. Defaults to relocate
+	SwapPartition SwapPartitionBehavior `mapstructure:"swap_partition"`
+	// Convert the MBR partition table of the image to GPT, for boards that boot with UEFI like
+	// the Raspberry Pi 4 with the EDK2 firmware. Partitions keep their place, the FAT boot
+	// partition is marked as EFI system partition and the PARTUUIDs in fstab and cmdline.txt
+	// are updated to the new GPT ones. Needs sgdisk.
+	ConvertToGpt bool `mapstructure:"convert_to_gpt"`
+	// The partition to mark as EFI system partition with convert_to_gpt. Defaults to the
+	// partition of efi_system_partition, or else the first FAT partition.
+	GptEspPartition int `mapstructure:"gpt_esp_partition"`
+
+	// A bootloader binary to write into the image at uboot_offset, for boards that load u-boot
+	// (or its SPL) from fixed sectors like Odroid, Rock64 and Orange Pi. Shorthand for a single
+	// uboot_binaries entry.
+	UbootBinary string `mapstructure:"uboot_binary"`
+	// The offset of uboot_binary, in bytes or as a size like "8M".
+	UbootOffset string `mapstructure:"uboot_offset"`
+	// Bootloader binaries to write into the image, for example for Rockchip:
+	// `[{"file": "idbloader.img", "offset": "32K"}, {"file": "u-boot.itb", "offset": "8M"}]`
+	// They are written before the partitions are mapped, and can't overlap the partition table
+	// or a partition.
+	UbootBinaries []BootloaderImage `mapstructure:"uboot_binaries"`
+
+	// Partitions to add after the last partition of the image, once it is grown, for example
+	// `[{"size": "1G", "label": "data", "mountpoint": "/data"}]`. The image file grows by their
+	// size, they are formatted before mounting and get an fstab entry by PARTUUID.
+	// Only MBR images with enough free primary partition entries are supported.
+	AddPartitions []NewPartition `mapstructure:"add_partitions"`
+
+	// Add an EFI system partition after the last partition, for arm64 boards booting with UEFI
+	// firmware. It is a FAT32 partition mounted at /boot/efi, with the bootloader installed to it
+	// once provisioned. Implies convert_to_gpt, which gives it the ESP type GUID.
+	EfiSystemPartition *EfiSystemPartition `mapstructure:"efi_system_partition"`
+
+	// Lay out the image with two root slots and a data partition, for robust OTA updates. A copy
+	// of the provisioned root partition is added after it as slot B, then the data partition.
+	// The root partition must be the last one, and should be mounted by PARTUUID in fstab.
+	ABPartitions *ABPartitions `mapstructure:"ab_partitions"`
+
+	// Also write each partition with a filesystem to its own file next to the image, for OTA
+	// updates and factory programmers that flash partitions on their own. They are named after
+	// their mount point and filesystem, like <image>.boot.vfat and <image>.rootfs.ext4, or
+	// <image>.p3.ext4 when not mounted. The artifact lists them in its partition_files state.
+	ExportPartitions bool `mapstructure:"export_partitions"`
 
-	// Qemu binary to use. default is qemu-arm-static
+	// Also archive the provisioned filesystems of the image to this path, with numeric owners,
+	// xattrs and ACLs, for container imports, OSTree and image assembly tools. The compression
+	// follows the extension, like rootfs.tar.gz or rootfs.tar.zst. The artifact exposes the
+	// path as its rootfs_tarball state.
+	RootfsTarball string `mapstructure:"rootfs_tarball"`
+
+	// Also commit the provisioned filesystems to a branch of an OSTree repository, for ostree
+	// based distribution. The tree should follow the ostree layout, with the OS in /usr.
+	OstreeCommit *OstreeCommit `mapstructure:"ostree_commit"`
+
+	// Also import the provisioned filesystems as a container image, so CI can run container tests
+	// against the rootfs that ships. It is imported to the docker daemon as container_image, like
+	// acme/rootfs:1.2, unless container_oci_layout is set.
+	ContainerImage string `mapstructure:"container_image"`
+	// Write the container image as an OCI image layout in this directory instead, tagged with the
+	// tag of container_image or latest.
+	ContainerOCILayout string `mapstructure:"container_oci_layout"`
+	// The platform of the container image, like linux/arm/v7. Defaults to the architecture of
+	// qemu_binary.
+	ContainerPlatform string `mapstructure:"container_platform"`
+
+	// Build against a qcow2 overlay of the source image, kept in this directory: the source is
+	// converted to a qcow2 base once, each build writes to a fresh overlay attached with
+	// qemu-nbd, and only the finished image is written out raw. Iterating on provisioners then
+	// skips copying the whole source image. The image file can't be edited before it is
+	// mounted, so the image can't be grown or repartitioned.
+	QcowCache string `mapstructure:"qcow_cache"`
+
+	// Shrink the last partition and the image file after provisioning, down to the minimum size
+	// of its filesystem, so it can be grown generously with target_image_size for the build and
+	// still ship small. Only ext filesystems in the last partition of an MBR table are supported.
+	// Combine it with first_boot_resize to use the whole card once flashed.
+	ShrinkImage bool `mapstructure:"shrink_image"`
+	// Free space to keep in the shrunk filesystem, as a size like target_image_size. Defaults to 0
+	ShrinkFreeSpace string `mapstructure:"shrink_free_space"`
+	// Grow the root filesystem on the first boot of the image instead of at build time, so a
+	// small image expands to fill whatever card it is flashed to. On Raspberry Pi OS this
+	// re-enables raspi-config's init_resize.sh, on other systemd images a one-shot service
+	// is installed that grows the root partition and filesystem and then disables itself.
+	FirstBootResize bool `mapstructure:"first_boot_resize"`
+
+	// How to fix the SELinux labels of the files provisioning created or changed, on images with
+	// SELinux enabled in /etc/selinux/config like Fedora and CentOS. autorelabel creates
+	// /.autorelabel so the image relabels itself and reboots on its first boot, setfiles labels
+	// the mounted tree from the host after provisioning, with the file_contexts of the image's
+	// policy, so the first boot is a normal one. Needs setfiles on the host. off leaves the
+	// labels as they are. Defaults to auto, which is autorelabel once SELinux is detected.
+	SelinuxRelabel SelinuxRelabel `mapstructure:"selinux_relabel"`
+
+	// Encrypt the root partition with LUKS2 after provisioning. crypttab, fstab and the kernel
+	// command line are updated to unlock it as encrypt_root_mapper_name, and the initramfs is
+	// rebuilt in the chroot with the cryptsetup hooks. Only ext filesystems are supported.
+	EncryptRoot bool `mapstructure:"encrypt_root"`
+	// The passphrase of the LUKS key slot. One of encrypt_root_passphrase and
+	// encrypt_root_keyfile is required with encrypt_root.
+	EncryptRootPassphrase string `mapstructure:"encrypt_root_passphrase"`
+	// Path to a key file on the host, used instead of a passphrase for the LUKS key slot.
+	EncryptRootKeyfile string `mapstructure:"encrypt_root_keyfile"`
+	// The device mapper name of the unlocked root partition. Defaults to cryptroot
+	EncryptRootMapperName string `mapstructure:"encrypt_root_mapper_name"`
+
+	// Relabel the filesystems of partitions once provisioned, like `{"1": "firmware", "2": "rootfs"}`.
+	// Keys select the partitions like in partition_mounts. The LABEL= references to their old
+	// labels in fstab and the kernel command line are updated. ext, vfat, xfs, btrfs and swap
+	// filesystems can be relabeled.
+	FilesystemLabels map[string]string `mapstructure:"filesystem_labels"`
+	// Set the UUIDs of the filesystems of partitions once provisioned, selected like in
+	// filesystem_labels, so builds from the same inputs give the same image, like
+	// `{"2": "5f3c1a2e-8b4d-4c6e-9f10-2a3b4c5d6e7f", "1": "1234-ABCD"}`. vfat filesystems take a
+	// volume id. The UUID= references to the old UUIDs in fstab and the kernel command line are
+	// updated.
+	FilesystemUUIDs map[string]string `mapstructure:"filesystem_uuids"`
+
+	// Protect a partition, usually a read-only root filesystem, with a dm-verity hash tree once
+	// provisioned. The root hash is in the manifest and the dm_verity_root_hash artifact state.
+	// For example: `{"hash_partition": "3", "root_hash_file": "/boot/roothash"}`.
+	DmVerity *DmVerity `mapstructure:"dm_verity"`
+
+	// Assemble the kernel, device tree and initrd into a U-Boot FIT image after provisioning,
+	// signed for verified boot when key_dir is set. See FitImage.
+	FitImage *FitImage `mapstructure:"fit_image"`
+
+	// Compress the final image with xz, the artifact is then output_filename with a .xz
+	// extension. This is the format balenaEtcher and Raspberry Pi Imager flash directly.
+	// The uncompressed size and sha256 are recorded in the artifact for publishing.
+	OutputXz bool `mapstructure:"output_xz"`
+
+	// Check the filesystems of the image partitions before mounting them, with e2fsck -p for ext
+	// filesystems and fsck.vfat -a for FAT ones, so damaged images fail with a clear error.
+	FsckPartitions bool `mapstructure:"fsck_partitions"`
+
+	// Write build metadata into the image after provisioning: the build name and time, the
+	// sha256 of the builder configuration, the source image url and checksum and the packer and
+	// plugin versions, as VAR="value" lines like os-release.
+	BuildInfo bool `mapstructure:"build_info"`
+	// Where to write the build metadata in the image. Defaults to /etc/packer-build-info
+	BuildInfoFile string `mapstructure:"build_info_file"`
+
+	// Write a JSON manifest of the final image next to it, as <artifact>.manifest.json: the
+	// partition table, the type, UUID and label of each filesystem, partition offsets and sizes
+	// and the image checksum. The artifact exposes it as the manifest and manifest_json state.
+	Manifest bool `mapstructure:"manifest"`
+
+	// Write an SBOM of the packages installed in the image after provisioning, listed by dpkg,
+	// rpm or apk in the chroot: spdx for an SPDX 2.3 document or cyclonedx for a CycloneDX 1.5
+	// one. The artifact exposes its path as the sbom state.
+	Sbom string `mapstructure:"sbom"`
+	// Where to write the SBOM. Defaults to output_filename with a .spdx.json or .cdx.json extension.
+	SbomFile string `mapstructure:"sbom_file"`
+
+	// Write a SLSA provenance statement of the artifact next to it, as <artifact>.intoto.jsonl:
+	// the source image url and checksum, the sha256 of the template, the plugin and packer
+	// versions and the build parameters, in a DSSE envelope. The artifact exposes its path as
+	// the provenance state.
+	Provenance bool `mapstructure:"provenance"`
+	// A PEM ed25519, ECDSA or RSA private key to sign the provenance statement with. Without
+	// it, the envelope has no signature.
+	ProvenanceKey string `mapstructure:"provenance_key"`
+
+	// Push the artifact to an OCI registry once built, with oras, like ghcr.io/acme/acme-os:1.2:
+	// the image, with its manifest, bmap, SBOM and provenance when they are written. The artifact
+	// exposes the reference as the oci_reference state.
+	OciPush string `mapstructure:"oci_push"`
+
+	// Validate the final image once the build is done with it: the image is mapped again
+	// read-only and the filesystems of all its partitions are checked with e2fsck -n and
+	// fsck.vfat -n, failing the build if one is damaged.
+	VerifyImage bool `mapstructure:"verify_image"`
+
+	// Boot the finished image under qemu-system and fail the build unless it reaches a login
+	// prompt (or an ssh banner, see boot_test_ssh_port) in time. The image is booted from a
+	// temporary qcow2 overlay and isn't modified. Needs qemu-system and qemu-img.
+	BootTest bool `mapstructure:"boot_test"`
+	// The kernel to boot, required with boot_test.
+	BootTestKernel string `mapstructure:"boot_test_kernel"`
+	// The device tree to pass to the kernel. Optional
+	BootTestDtb string `mapstructure:"boot_test_dtb"`
+	// The qemu machine. Defaults to virt. raspi machines (like raspi3b) boot from an emulated sd card,
+	// others from a virtio disk.
+	BootTestMachine string `mapstructure:"boot_test_machine"`
+	// The qemu-system binary. Defaults to qemu-system-aarch64 or qemu-system-arm, following qemu_binary.
+	BootTestQemu string `mapstructure:"boot_test_qemu"`
+	// The kernel command line. Defaults to the root partition on the disk and a serial console
+	// on ttyAMA0. It and boot_test_args can use {{.HTTPIP}} and {{.HTTPPort}}, the address of the
+	// http_directory server from the guest with qemu user networking.
+	BootTestCmdline string `mapstructure:"boot_test_cmdline"`
+	// More qemu-system arguments, for example to forward the ssh port:
+	// `["-netdev", "user,id=net0,hostfwd=tcp:127.0.0.1:2222-:22", "-device", "virtio-net-device,netdev=net0"]`
+	BootTestArgs []string `mapstructure:"boot_test_args"`
+	// A regular expression matched against the serial console. Defaults to `login:`
+	BootTestExpect string `mapstructure:"boot_test_expect"`
+	// A local port, forwarded to the ssh port of the image with boot_test_args. The boot
+	// succeeds once it answers with an ssh banner.
+	BootTestSSHPort int `mapstructure:"boot_test_ssh_port"`
+	// How long to wait for the image to boot. Defaults to 5m
+	BootTestTimeout time.Duration `mapstructure:"boot_test_timeout"`
+
+	// Fail a build step, provisioning included, that runs for longer than this, like `30m`. Host
+	// commands, including the unmounts of the cleanup, are stopped after this long too.
+	StepTimeout time.Duration `mapstructure:"step_timeout"`
+	// Fail the build if it runs for longer than this, like `2h`. The image is still unmounted
+	// and unmapped.
+	BuildTimeout time.Duration `mapstructure:"build_timeout"`
+
+	// Commands to run on the host after the image partitions are mapped, right before they are
+	// mounted. The template variables {{.ImageFile}} and {{.Partitions}} (the space separated
+	// partition devices) are available, and {{.HTTPIP}} and {{.HTTPPort}} with http_directory. Commands are wrapped with command_wrapper.
+	PreMountCommands []string `mapstructure:"pre_mount_commands"`
+	// Commands to run on the host after the provisioners, while the image is still mounted.
+	// {{.MountPath}} is available in addition to the pre_mount_commands variables.
+	PostProvisionCommands []string `mapstructure:"post_provision_commands"`
+	// Commands to run on the host once the image partitions are unmounted, but still mapped.
+	// The pre_mount_commands variables are available.
+	PostUmountCommands []string `mapstructure:"post_umount_commands"`
+
+	// The architecture of the image: arm, arm64 or riscv64. It picks the qemu binary, and with it
+	// the binfmt_misc registration, and the default qemu_args of the image type only apply when
+	// the image type is of this architecture. Defaults to the architecture of the image type.
+	ImageArch string `mapstructure:"image_arch"`
+	// Qemu binary to use. default is the one of image_arch, or qemu-arm-static, or
+	// qemu-aarch64-static for 64 bit image types like raspberrypi-arm64.
 	QemuBinary string `mapstructure:"qemu_binary"`
+	// More qemu binaries to copy to the chroot and register with binfmt_misc, for images that run
+	// binaries of several architectures, like a 64 bit kernel with a 32 bit userland. For example:
+	// `["qemu-aarch64-static"]`. Supported are arm, armeb, aarch64, aarch64_be and riscv64
+	// binaries, named like qemu-<arch>-static. qemu_args only apply to qemu_binary.
+	AdditionalQemuBinaries []string `mapstructure:"additional_qemu_binaries"`
+	// Additional binfmt_misc registrations, for targets qemu_binary and additional_qemu_binaries
+	// don't cover, like armel or mips binaries, or a custom ABI. They are registered on arm hosts too.
+	BinfmtEntries []BinfmtEntry `mapstructure:"binfmt_entries"`
+	// Don't register anything with binfmt_misc, for hosts where builds aren't allowed to write to
+	// it: check that the host already runs the binaries of qemu_binary, additional_qemu_binaries
+	// and binfmt_entries, registered by systemd-binfmt for example, and fail before provisioning
+	// if it doesn't. qemu_binary then only tells the architecture, and qemu_args can't be used.
+	RequirePreregisteredBinfmt bool `mapstructure:"require_preregistered_binfmt"`
 	// Arguments to qemu binary. default depends on the image type. see init() function above.
+	// Arguments are interpolated when qemu is installed in the chroot, with {{.MountPath}},
+	// {{.Partitions}}, {{.RootPartition}}, {{.ImageType}} and {{.CPU}}, the cpu of the image type defaults.
 	QemuArgs []string `mapstructure:"qemu_args"`
 
+	// Run the build in a Vagrant VM, for hosts that can't build images, like macOS. The current
+	// directory is synced to the VM, where vagrant_template is built with packer.
+	Vagrant bool `mapstructure:"vagrant"`
+	// The template built in the VM, relative to the current directory. Its output_filename must be
+	// relative too, so the image is written to the synced directory.
+	VagrantTemplate string `mapstructure:"vagrant_template"`
+	// The build of vagrant_template to run. Defaults to the name of this build.
+	VagrantOnly string `mapstructure:"vagrant_only"`
+	// The box of the VM. Defaults to bento/ubuntu-22.04.
+	VagrantBox string `mapstructure:"vagrant_box"`
+	// The vagrant provider, like libvirt or qemu. Defaults to the vagrant default.
+	VagrantProvider string `mapstructure:"vagrant_provider"`
+	// A linux build of this plugin, relative to the current directory, to install in the VM.
+	// Defaults to go installing the version of this plugin in the VM.
+	VagrantPlugin string `mapstructure:"vagrant_plugin"`
+	// Memory of the VM in MB. Defaults to 4096.
+	VagrantMemory int `mapstructure:"vagrant_memory"`
+	// CPUs of the VM. Defaults to 2.
+	VagrantCpus int `mapstructure:"vagrant_cpus"`
+	// Destroy the VM after the build, rather than halting it for the next one.
+	VagrantDestroy bool `mapstructure:"vagrant_destroy"`
+
+	// a checksum go-getter can't verify, see stepVerifyChecksum
+	blake2Checksum string
+	// target_image_size in bytes
+	targetImageSize uint64
+	// sha256 of the builder configuration, for build_info
+	configHash string
+	// shrink_free_space in bytes
+	shrinkFreeSpace uint64
+	// resize_partition and resize_filesystem with their defaults applied
+	resizePartition  bool
+	resizeFilesystem bool
+	// the image type is detected after mounting, see stepDetectImageType
+	detectImageType bool
+	// iso_url is a rootfs archive rather than an image, see isRootfsArchive
+	rootfsArchive bool
+	// image_mounts are the defaults of the image type
+	defaultImageMounts bool
+	// qemu_binary and qemu_args are defaults that the detected image type can change
+	defaultQemuBinary bool
+	defaultQemuArgs   bool
+	// the image types of image_profiles, see imageProfile
+	profiles []imageProfile
+
 	ctx interpolate.Context
 }
 
@@ -135,26 +852,184 @@ func (b *Builder) autoDetectType() utils.KnownImageType {
 		return ""
 	}
 	url := b.config.ISOUrls[0]
+	for _, profile := range b.config.profiles {
+		if profile.matches(url) {
+			return utils.KnownImageType(profile.Name)
+		}
+	}
 	return utils.GuessImageType(url)
 }
 
+// outputFilenameTemplate is the data output_filename is rendered with.
+type outputFilenameTemplate struct {
+	ImageType     string
+	SourceName    string
+	PluginVersion string
+}
+
+// sourceName is the name of the source image, without the extensions of archives and images.
+func (b *Builder) sourceName() string {
+	var name string
+	if b.config.SourceDevice != "" {
+		name = filepath.Base(b.config.SourceDevice)
+	} else if len(b.config.ISOUrls) > 0 {
+		name = b.config.ISOUrls[0]
+		if u, err := url.Parse(name); err == nil && u.Path != "" {
+			name = u.Path
+		}
+		name = path.Base(name)
+	}
+	for {
+		ext := filepath.Ext(name)
+		switch ext {
+		case ".zip", ".xz", ".gz", ".bz2", ".img", ".raw", ".qcow2", ".vmdk", ".vdi", ".vhdx":
+			name = strings.TrimSuffix(name, ext)
+			continue
+		}
+		return name
+	}
+}
+
+// renderMountTemplates renders image_mounts, partition_mounts, chroot_mounts and
+// additional_chroot_mounts. Unlike other options they can read the environment, mount points and
+// host paths are often parameterized by it, like `{{env "HOME"}}/cache`.
+func (b *Builder) renderMountTemplates() error {
+	ictx := b.config.ctx
+	ictx.EnableEnv = true
+	render := func(option string, v *string) error {
+		var err error
+		if *v, err = interpolate.Render(*v, &ictx); err != nil {
+			return fmt.Errorf("error rendering %s: %s", option, err)
+		}
+		return nil
+	}
+
+	for i := range b.config.ImageMounts {
+		if err := render("image_mounts", &b.config.ImageMounts[i]); err != nil {
+			return err
+		}
+	}
+	if b.config.PartitionMounts != nil {
+		mounts := make(map[string]string, len(b.config.PartitionMounts))
+		for k, v := range b.config.PartitionMounts {
+			if err := render("partition_mounts", &k); err != nil {
+				return err
+			}
+			if err := render("partition_mounts", &v); err != nil {
+				return err
+			}
+			mounts[k] = v
+		}
+		b.config.PartitionMounts = mounts
+	}
+	for option, mounts := range map[string][][]string{
+		"chroot_mounts":            b.config.ChrootMounts,
+		"additional_chroot_mounts": b.config.AdditionalChrootMounts,
+	} {
+		for _, mount := range mounts {
+			for i := range mount {
+				if err := render(option, &mount[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (b *Builder) ConfigSpec() hcldec.ObjectSpec {
 	return b.config.FlatMapstructure().HCL2Spec()
 }
 
 func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 	err := config.Decode(&b.config, &config.DecodeOpts{
-		Interpolate:       true,
-		InterpolateFilter: &interpolate.RenderFilter{},
+		Interpolate:        true,
+		InterpolateContext: &b.config.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			// rendered for every command
+			Exclude: []string{
+				"command_wrapper",
+				"chroot_command_wrapper",
+				"chroot_execute_command",
+				"pre_mount_commands",
+				"post_provision_commands",
+				"post_umount_commands",
+				"qemu_args",
+				"boot_test_cmdline",
+				"boot_test_args",
+				// rendered once the image type is known
+				"output_filename",
+				// rendered with env enabled
+				"image_mounts",
+				"partition_mounts",
+				"chroot_mounts",
+				"additional_chroot_mounts",
+			},
+		},
 	}, cfgs...)
 	if err != nil {
 		return nil, nil, err
 	}
+	if b.config.vagrantHost() {
+		return nil, nil, b.prepareVagrant()
+	}
 	var errs *packer.MultiError
 	var warnings []string
-	isoWarnings, isoErrs := b.config.ISOConfig.Prepare(&b.config.ctx)
-	warnings = append(warnings, isoWarnings...)
-	errs = packer.MultiErrorAppend(errs, isoErrs...)
+	if err := checkLinuxHost(); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+	switch wslVersion() {
+	case 1:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("WSL1 distros have no loop devices, convert this one to WSL2 with wsl --set-version <distro> 2"))
+	case 2:
+		warnings = append(warnings, b.prepareWSL()...)
+	}
+	if err := b.renderMountTemplates(); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+	if raw, err := json.Marshal(cfgs); err == nil {
+		b.config.configHash = fmt.Sprintf("%x", sha256.Sum256(raw))
+	}
+	if isBlake2Checksum(b.config.ISOChecksum) {
+		// go-getter only knows md5, sha1, sha256 and sha512, verify it after downloading instead
+		b.config.blake2Checksum = b.config.ISOChecksum
+		b.config.ISOChecksum = "none"
+	}
+	if b.config.OutputDevice != "" && !strings.HasPrefix(b.config.OutputDevice, "/dev/") {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("output_device must be a device path, like /dev/sdb"))
+	}
+	if b.config.SourceDevice != "" {
+		if len(b.config.ISOUrls) > 0 || b.config.RawSingleISOUrl != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("only one of source_device and iso_url can be set"))
+		}
+		if b.config.ISOChecksum != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("iso_checksum can't be used with source_device"))
+		}
+		if info, err := os.Stat(b.config.SourceDevice); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_device: %s", err))
+		} else if info.Mode()&os.ModeDevice == 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_device %s is not a block device", b.config.SourceDevice))
+		}
+	} else {
+		isoWarnings, isoErrs := b.config.ISOConfig.Prepare(&b.config.ctx)
+		if b.config.blake2Checksum != "" {
+			// drop the warning about not having a checksum
+			isoWarnings = nil
+		}
+		warnings = append(warnings, isoWarnings...)
+		errs = packer.MultiErrorAppend(errs, isoErrs...)
+	}
+
+	errs = packer.MultiErrorAppend(errs, b.config.HTTPConfig.Prepare(&b.config.ctx)...)
+	if b.config.HTTPDir != "" && b.config.InjectFiles {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds don't run commands, http_directory can't be used"))
+	}
+
+	for i, u := range b.config.ISOUrls {
+		if b.config.ISOUrls[i], err = absoluteFileURL(u); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
 
 	if b.config.OutputFile == "" {
 		if b.config.OutputDir != "" {
@@ -165,17 +1040,309 @@ func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 		}
 	}
 
+	if b.config.TargetImageSize != "" {
+		size, err := osutils.ParseSize(b.config.TargetImageSize)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("target_image_size: %s", err))
+		}
+		// whole sectors only
+		b.config.targetImageSize = size &^ (1<<SectorShift - 1)
+	}
+
+	if b.config.ShrinkFreeSpace != "" {
+		if b.config.shrinkFreeSpace, err = osutils.ParseSize(b.config.ShrinkFreeSpace); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("shrink_free_space: %s", err))
+		}
+	}
+	if b.config.UbootBinary != "" {
+		b.config.UbootBinaries = append(b.config.UbootBinaries, BootloaderImage{File: b.config.UbootBinary, Offset: b.config.UbootOffset})
+	} else if b.config.UbootOffset != "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("uboot_offset requires uboot_binary"))
+	}
+	for i, blob := range b.config.UbootBinaries {
+		if _, err := os.Stat(blob.File); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("uboot binary: %s", err))
+		}
+		if blob.Offset == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("uboot binary %s needs an offset", blob.File))
+			continue
+		}
+		if b.config.UbootBinaries[i].offset, err = osutils.ParseSize(blob.Offset); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("offset of uboot binary %s: %s", blob.File, err))
+		}
+	}
+
+	if b.config.BuildInfo {
+		if b.config.BuildInfoFile == "" {
+			b.config.BuildInfoFile = "/etc/packer-build-info"
+		}
+		if !filepath.IsAbs(b.config.BuildInfoFile) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("build_info_file must be an absolute path"))
+		}
+	}
+
+	if b.config.BootTest {
+		if b.config.BootTestKernel == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("boot_test requires boot_test_kernel"))
+		}
+		if b.config.BootTestMachine == "" {
+			b.config.BootTestMachine = "virt"
+		}
+		if b.config.BootTestExpect == "" {
+			b.config.BootTestExpect = "login:"
+		}
+		if _, err := regexp.Compile(b.config.BootTestExpect); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("boot_test_expect: %s", err))
+		}
+		if b.config.BootTestTimeout == 0 {
+			b.config.BootTestTimeout = 5 * time.Minute
+		}
+	}
+
+	switch {
+	case b.config.DownloadRetries == 0:
+		b.config.DownloadRetries = 3
+	case b.config.DownloadRetries < 0:
+		b.config.DownloadRetries = 0
+	}
+	if b.config.DownloadRetryBackoff < 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("download_retry_backoff can't be negative"))
+	} else if b.config.DownloadRetryBackoff == 0 {
+		b.config.DownloadRetryBackoff = 10 * time.Second
+	}
+	for _, u := range b.config.ISOUrls {
+		if isOCIURL(u) && !strings.Contains(ociReference(u), "/") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("%s is not an OCI reference, like oci://ghcr.io/acme/acme-os:1.2", u))
+		}
+		if isCloudURL(u) {
+			if _, err := getterURL(u); err != nil {
+				errs = packer.MultiErrorAppend(errs, err)
+			}
+		}
+	}
+	if b.config.OciPush != "" {
+		b.config.OciPush = ociReference(b.config.OciPush)
+		if !strings.Contains(b.config.OciPush, "/") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("oci_push %s is not an OCI reference, like ghcr.io/acme/acme-os:1.2", b.config.OciPush))
+		}
+	}
+
+	if b.config.StepTimeout < 0 || b.config.BuildTimeout < 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("step_timeout and build_timeout can't be negative"))
+	}
+
+	if ab := b.config.ABPartitions; ab != nil {
+		if ab.DataSize == "" {
+			ab.DataSize = "1G"
+		}
+		if ab.DataMountpoint == "" {
+			ab.DataMountpoint = "/data"
+		}
+		if ab.BootEnvSize == 0 {
+			ab.BootEnvSize = 0x4000
+		}
+		// the size of slot B is the one of the root partition, known once the image is grown
+		b.config.AddPartitions = append(b.config.AddPartitions,
+			NewPartition{Size: "1", Filesystem: "ext4", abSlot: true},
+			NewPartition{Size: ab.DataSize, Filesystem: "ext4", Label: "data", Mountpoint: ab.DataMountpoint})
+	}
+
+	if esp := b.config.EfiSystemPartition; esp != nil {
+		if esp.Size == "" {
+			esp.Size = "256M"
+		}
+		if esp.Mountpoint == "" {
+			esp.Mountpoint = "/boot/efi"
+		}
+		switch esp.Bootloader {
+		case "":
+			esp.Bootloader = EfiGrub
+		case EfiGrub, EfiSystemdBoot, EfiNone:
+		default:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("efi_system_partition bootloader must be grub, systemd-boot or none, not %q", esp.Bootloader))
+		}
+		for _, f := range esp.Files {
+			if len(f) != 2 || !filepath.IsAbs(f[0]) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("efi_system_partition files must be [source, destination] pairs, with an absolute source in the chroot"))
+				break
+			}
+		}
+		b.config.AddPartitions = append(b.config.AddPartitions, NewPartition{Size: esp.Size, Filesystem: "vfat", Label: "EFI",
+			Mountpoint: esp.Mountpoint, MountOptions: "umask=0077", esp: true})
+		b.config.ConvertToGpt = true
+	}
+
+	if b.config.ShrinkImage && b.config.ConvertToGpt {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("shrink_image only supports MBR partition tables, it can't be used with convert_to_gpt"))
+	}
+	if b.config.GptEspPartition < 0 || b.config.GptEspPartition > 4 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("gpt_esp_partition must be a primary partition number"))
+	}
+	if b.config.ShrinkImage && b.config.EncryptRoot {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("shrink_image can't shrink an encrypted root partition"))
+	}
+
+	if len(b.config.ISOUrls) > 0 && b.config.SourceDevice == "" {
+		b.config.rootfsArchive = isRootfsArchive(b.config.ISOUrls[0])
+	}
+	if b.config.rootfsArchive {
+		switch {
+		case b.config.Rootless || b.config.InjectFiles || b.config.QcowCache != "":
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootfs archives can't be used with rootless, inject_files or qcow_cache"))
+		case len(b.config.ImageMounts) > 0 || len(b.config.PartitionMounts) > 0:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("images of rootfs archives are mounted with their own layout, image_mounts and partition_mounts can't be set"))
+		}
+		if b.config.targetImageSize == 0 {
+			b.config.targetImageSize = 4 << 30
+		}
+		if b.config.BootPartitionSize == "" {
+			b.config.BootPartitionSize = "200M"
+		}
+		bootSize, err := osutils.ParseSize(b.config.BootPartitionSize)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("boot_partition_size: %s", err))
+		}
+		// the root partition starts after the first MiB and the boot partition, rounded up to 1MiB
+		bootSize = (bootSize + 1<<20 - 1) &^ (1<<20 - 1)
+		if rootSize := int64(b.config.targetImageSize) - 1<<20 - int64(bootSize); rootSize < 1<<30 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("target_image_size leaves less than 1G to the root partition of the rootfs archive"))
+		} else {
+			b.config.AddPartitions = append([]NewPartition{
+				{Size: b.config.BootPartitionSize, Filesystem: "vfat", Label: "BOOT", Mountpoint: "/boot"},
+				{Size: fmt.Sprintf("%dM", rootSize>>20), Filesystem: "ext4", Label: "ROOT", Mountpoint: "/"},
+			}, b.config.AddPartitions...)
+		}
+	}
+
+	growing := (b.config.LastPartitionExtraSize > 0 || b.config.targetImageSize > 0) && !b.config.rootfsArchive
+	if b.config.ResizePartition.True() && !growing {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("resize_partition requires target_image_size or last_partition_extra_size"))
+	}
+	if b.config.ResizePartitionNumber < 0 || b.config.ResizePartitionNumber > 4 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("resize_partition_number must be the number of a primary partition, 1 to 4"))
+	}
+	switch b.config.RootlessBackend {
+	case "":
+		b.config.RootlessBackend = RootlessFuse
+	case RootlessFuse, RootlessGuestfs:
+		b.config.Rootless = true
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootless_backend must be %s or %s", RootlessFuse, RootlessGuestfs))
+	}
+	switch b.config.PartitionMapper {
+	case "":
+		b.config.PartitionMapper = MapperKpartx
+	case MapperKpartx, MapperLosetup:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("partition_mapper must be %s or %s", MapperKpartx, MapperLosetup))
+	}
+	if b.config.Rootless {
+		switch {
+		case growing || b.config.ResizeFilesystem.True():
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootless builds can't resize the image"))
+		case len(b.config.PartitionMounts) > 0:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootless builds need image_mounts, not partition_mounts"))
+		case b.config.ShrinkImage || b.config.ConvertToGpt || b.config.EncryptRoot || b.config.VerifyImage:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootless builds can't use shrink_image, convert_to_gpt, encrypt_root or verify_image"))
+		case len(b.config.AdditionalQemuBinaries) > 0 || len(b.config.BinfmtEntries) > 0 || b.config.RequirePreregisteredBinfmt:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootless builds run a single qemu binary, without binfmt_misc"))
+		}
+		growing = false
+	}
+	if b.config.RootlessBackend == RootlessGuestfs {
+		switch {
+		case b.config.rootfsArchive || b.config.ABPartitions != nil || b.config.EfiSystemPartition != nil:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("guestfs builds can't unpack rootfs archives or use ab_partitions or efi_system_partition"))
+		case b.config.BuildInfo || b.config.FirstBootResize || b.config.RootfsTarball != "" || b.config.OstreeCommit != nil || b.config.ContainerImage != "" || b.config.ContainerOCILayout != "" ||
+			len(b.config.ImageFiles) > 0 || len(b.config.ExtraBootFiles) > 0 || b.config.PackageProxy != "" || b.config.FitImage != nil || b.config.Sbom != "" ||
+			len(b.config.PostProvisionCommands) > 0:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("guestfs builds don't mount the image on the host for build_info, first_boot_resize, rootfs_tarball, ostree_commit, container_image, "+
+				"image_files, extra_boot_files, package_proxy, fit_image, sbom or post_provision_commands"))
+		case b.config.ResolvConf == CopyHost || b.config.ResolvConf == Delete:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("guestfs builds use the network of the appliance, resolv-conf can't be %s or %s", CopyHost, Delete))
+		}
+	}
+	if b.config.InjectFiles {
+		switch {
+		case b.config.Rootless:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files can't be used with rootless"))
+		case growing || b.config.ResizeFilesystem.True():
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds can't resize the image"))
+		case len(b.config.PartitionMounts) > 0:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds need image_mounts, not partition_mounts"))
+		case b.config.ShrinkImage || b.config.ConvertToGpt || b.config.EncryptRoot || b.config.VerifyImage:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds can't use shrink_image, convert_to_gpt, encrypt_root or verify_image"))
+		case b.config.BuildInfo || b.config.FirstBootResize || b.config.RootfsTarball != "" || b.config.OstreeCommit != nil || b.config.ContainerImage != "" || b.config.ContainerOCILayout != "" ||
+			len(b.config.PreMountCommands) > 0 || len(b.config.PostProvisionCommands) > 0:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds don't mount the image for build_info, first_boot_resize, rootfs_tarball, ostree_commit, container_image, pre_mount_commands or post_provision_commands"))
+		}
+		growing = false
+	}
+	switch b.config.SelinuxRelabel {
+	case "":
+		b.config.SelinuxRelabel = SelinuxAuto
+	case SelinuxAuto, SelinuxOff:
+	case SelinuxAutorelabel, SelinuxSetfiles:
+		if b.config.InjectFiles {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds don't mount the image for selinux_relabel"))
+		} else if b.config.RootlessBackend == RootlessGuestfs {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("guestfs builds don't mount the image on the host for selinux_relabel"))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown selinux_relabel. must be one of: %v", []SelinuxRelabel{SelinuxAuto, SelinuxAutorelabel, SelinuxSetfiles, SelinuxOff}))
+	}
+	if b.config.Resume {
+		b.config.KeepImageOnError = true
+	}
+	if b.config.RepackSquashfs && (b.config.Rootless || b.config.InjectFiles || b.config.QcowCache != "") {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("repack_squashfs can't be used with rootless, inject_files or qcow_cache"))
+	}
+	if b.config.QcowCache != "" {
+		switch {
+		case b.config.Rootless || b.config.InjectFiles:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("qcow_cache can't be used with rootless or inject_files"))
+		case growing:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("qcow_cache builds can't grow the image"))
+		case len(b.config.AddPartitions) > 0 || b.config.ConvertToGpt || len(b.config.UbootBinaries) > 0 || b.config.ShrinkImage:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("qcow_cache builds can't use add_partitions, convert_to_gpt, uboot_binaries or shrink_image"))
+		}
+		growing = false
+	}
+	b.config.resizePartition = growing && !b.config.ResizePartition.False()
+	b.config.resizeFilesystem = b.config.ResizeFilesystem.True() || (b.config.resizePartition && !b.config.ResizeFilesystem.False())
+
 	if b.config.LastPartitionExtraSize > 0 {
 		warnings = append(warnings, "last_partition_extra_size is deprecated, use target_image_size to grow your image")
 	}
 
+	switch b.config.SwapPartition {
+	case "":
+		b.config.SwapPartition = SwapRelocate
+	case SwapRelocate, SwapDrop:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown swap_partition. must be one of: %v", []SwapPartitionBehavior{SwapRelocate, SwapDrop}))
+	}
+
+	b.config.profiles = nil
+	if len(b.config.ImageProfiles) > 0 {
+		profiles, err := loadImageProfiles(b.config.ImageProfiles)
+		if err == nil {
+			err = checkImageProfiles(profiles)
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		} else {
+			b.config.profiles = profiles
+		}
+	}
+
 	if b.config.ChrootMounts == nil {
 		b.config.ChrootMounts = make([][]string, 0)
 	}
 
 	if len(b.config.ChrootMounts) == 0 {
 		b.config.ChrootMounts = defaultChrootTypes[utils.Unknown]
-		if imageDefaults, ok := defaultChrootTypes[b.config.ImageType]; ok {
+		if imageDefaults, ok := b.config.chrootMountsOf(b.config.ImageType); ok {
 			b.config.ChrootMounts = imageDefaults
 		}
 	}
@@ -188,74 +1355,435 @@ func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 		b.config.ChrootMounts = append(b.config.ChrootMounts, resolvConfBindMount)
 	}
 
-	if b.config.CommandWrapper == "" {
-		b.config.CommandWrapper = "{{.Command}}"
-	}
-
-	if b.config.ImageType == "" {
-		// defaults...
-		b.config.ImageType = b.autoDetectType()
-	} else {
-		if _, ok := knownTypes[b.config.ImageType]; !ok {
-
-			var validvalues []utils.KnownImageType
-			for k := range knownTypes {
-				validvalues = append(validvalues, k)
+	for i, f := range b.config.ImageFiles {
+		if _, err := os.Stat(f.Source); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_files: %s", err))
+		}
+		if !filepath.IsAbs(f.Destination) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_files destination %q must be an absolute path", f.Destination))
+		}
+		if f.Mode != "" {
+			mode, err := strconv.ParseUint(f.Mode, 8, 32)
+			if err != nil || mode > 07777 {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_files mode %q must be an octal mode, like 0644", f.Mode))
 			}
-			errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown image_type. must be one of: %v", validvalues))
-			b.config.ImageType = ""
+			b.config.ImageFiles[i].mode = os.FileMode(mode)
 		}
 	}
-	if b.config.ImageType != "" {
-		if len(b.config.ImageMounts) == 0 {
-			b.config.ImageMounts = knownTypes[b.config.ImageType]
+	if len(b.config.ImageFiles) > 0 && b.config.InjectFiles {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds don't mount the image for image_files, use file provisioners"))
+	}
+
+	for name, src := range b.config.ExtraBootFiles {
+		if _, err := os.Stat(src); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("extra_boot_files: %s", err))
 		}
-		if len(b.config.QemuArgs) == 0 {
-			b.config.QemuArgs = knownArgs[b.config.ImageType]
+		if clean := filepath.Clean(name); filepath.IsAbs(name) || clean == "." || strings.HasPrefix(clean, "..") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("extra_boot_files path %q must be relative to the boot partition", name))
 		}
 	}
+	if len(b.config.ExtraBootFiles) > 0 && b.config.InjectFiles {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds don't mount the image for extra_boot_files, use file provisioners"))
+	}
 
-	if len(b.config.ImageMounts) == 0 {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("no image mounts provided. Please set the image mounts or image type."))
+	if b.config.PackageProxy != "" {
+		if u, err := url.Parse(b.config.PackageProxy); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("package_proxy must be an http url, like http://10.0.2.2:3142"))
+		}
+		if b.config.InjectFiles {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("inject_files builds don't run package managers, package_proxy can't be used"))
+		}
 	}
 
-	if b.config.QemuBinary == "" {
-		b.config.QemuBinary = "qemu-arm-static"
+	for name := range b.config.ChrootEnv {
+		if !envNameRegexp.MatchString(name) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("invalid chroot_env variable name %q", name))
+		}
 	}
-	// convert to full path
-	path, err := exec.LookPath(b.config.QemuBinary)
-	if err != nil {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("qemu binary not found."))
-	} else {
-		if !strings.Contains(path, "qemu-") {
-			warnings = append(warnings, "binary doesn't look like qemu-user")
+	if b.config.ChrootEnv == nil {
+		b.config.ChrootEnv = map[string]string{}
+	}
+	for name, value := range defaultChrootEnv {
+		if _, ok := b.config.ChrootEnv[name]; !ok {
+			b.config.ChrootEnv[name] = value
 		}
-		b.config.QemuBinary = path
+	}
+	if b.config.ChrootShell != "" && !strings.HasPrefix(b.config.ChrootShell, "/") {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("chroot_shell must start with the absolute path of the shell, like /bin/busybox sh"))
 	}
 
-	if errs != nil && len(errs.Errors) > 0 {
-		return nil, warnings, errs
+	if b.config.CommandWrapper == "" {
+		b.config.CommandWrapper = "{{.Command}}"
+	}
+	if b.config.ChrootCommandWrapper == "" {
+		b.config.ChrootCommandWrapper = "{{.Command}}"
+	}
+	if b.config.ChrootExecuteCommand == "" {
+		b.config.ChrootExecuteCommand = "export {{.Vars}}; {{.Command}}"
 	}
-	return nil, warnings, nil
-}
 
-type wrappedCommandTemplate struct {
-	Command string
-}
+	for i, mnt := range b.config.ImageMounts {
+		if mnt == skipMount {
+			b.config.ImageMounts[i] = ""
+		}
+	}
+
+	if len(b.config.PartitionMounts) > 0 {
+		if len(b.config.ImageMounts) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("only one of image_mounts and partition_mounts can be set"))
+		}
+		errs = packer.MultiErrorAppend(errs, validatePartitionMounts(b.config.PartitionMounts)...)
+	}
+
+	if b.config.RootOverlayPartition != "" && b.config.RootOverlayPartition != noRootOverlay {
+		if _, err := parsePartitionSelector(b.config.RootOverlayPartition); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("root_overlay_partition: %s", err))
+		}
+	}
+	if b.config.RootOverlayUpperdir == "" {
+		b.config.RootOverlayUpperdir = "upper"
+	}
+	if filepath.IsAbs(b.config.RootOverlayUpperdir) || strings.HasPrefix(filepath.Clean(b.config.RootOverlayUpperdir), "..") {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("root_overlay_upperdir must be relative to the root of the overlay partition"))
+	}
+
+	if b.config.WksFile != "" && len(b.config.ImageMounts) == 0 && len(b.config.PartitionMounts) == 0 {
+		if b.config.Rootless || b.config.InjectFiles {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("wks_file mounts partitions by number, set image_mounts for rootless and inject_files builds"))
+		} else if mounts, err := wksPartitionMounts(b.config.WksFile); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("wks_file: %s", err))
+		} else {
+			b.config.PartitionMounts = mounts
+		}
+	}
+
+	if b.config.ImageType == "" {
+		// defaults...
+		b.config.ImageType = b.autoDetectType()
+	} else {
+		if !b.config.isKnownImageType(b.config.ImageType) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown image_type. must be one of: %v", b.config.knownImageTypes()))
+			b.config.ImageType = ""
+		}
+	}
+	// the urls of .wic and Buildroot images don't tell their architecture
+	b.config.detectImageType = b.config.ImageType == "" || b.config.ImageType == utils.Yocto || b.config.ImageType == utils.Buildroot
+
+	b.config.ctx.Data = &outputFilenameTemplate{
+		ImageType:     string(b.config.ImageType),
+		SourceName:    b.sourceName(),
+		PluginVersion: version.String(),
+	}
+	if b.config.OutputFile, err = interpolate.Render(b.config.OutputFile, &b.config.ctx); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("error rendering output_filename: %s", err))
+	}
+	b.config.defaultQemuArgs = len(b.config.QemuArgs) == 0
+	if b.config.ImageType != "" {
+		if len(b.config.ImageMounts) == 0 && len(b.config.PartitionMounts) == 0 && !b.config.rootfsArchive {
+			// copied, as followFstab may move them
+			b.config.ImageMounts = append([]string(nil), b.config.imageMountsOf(b.config.ImageType)...)
+			b.config.defaultImageMounts = true
+			if mounts, ok := knownPartitionMounts[b.config.ImageType]; ok && !b.config.InjectFiles {
+				b.config.PartitionMounts = make(map[string]string)
+				for k, v := range mounts {
+					b.config.PartitionMounts[k] = v
+				}
+			}
+		}
+		if len(b.config.QemuArgs) == 0 {
+			b.config.QemuArgs = b.config.imageTypeArgs(b.config.ImageType)
+		}
+	}
+
+	if len(b.config.ImageMounts) == 0 && len(b.config.PartitionMounts) == 0 && !b.config.rootfsArchive {
+		if b.config.ImageType == "" && !b.config.Rootless && !b.config.InjectFiles {
+			// found from the partitions and the fstab of the image, see layoutMounts
+			b.config.defaultImageMounts = true
+		} else {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("no image mounts provided. Please set the image mounts or image type."))
+		}
+	}
+
+	for i := range b.config.AddPartitions {
+		errs = packer.MultiErrorAppend(errs, b.prepareNewPartition(&b.config.AddPartitions[i])...)
+	}
+	if len(b.config.AddPartitions) > 0 && (b.config.Rootless || b.config.InjectFiles || b.config.ShrinkImage) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("add_partitions, efi_system_partition and ab_partitions can't be used with rootless, inject_files or shrink_image"))
+	}
+
+	if c := b.config.OstreeCommit; c != nil {
+		if c.Repo == "" || c.Branch == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("ostree_commit needs a repo and a branch"))
+		}
+		if c.Subject == "" {
+			c.Subject = b.config.PackerConfig.PackerBuildName
+		}
+	}
+	if b.config.ContainerPlatform != "" {
+		if _, ok := osutils.ParseOCIPlatform(b.config.ContainerPlatform); !ok {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("container_platform should look like linux/arm64, not %s", b.config.ContainerPlatform))
+		}
+	}
+
+	if b.config.ImageType == utils.Noobs && b.config.NoobsOS == "" {
+		b.config.NoobsOS = "1"
+	}
+
+	if b.config.EncryptRoot {
+		if (b.config.EncryptRootPassphrase == "") == (b.config.EncryptRootKeyfile == "") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("encrypt_root requires exactly one of encrypt_root_passphrase and encrypt_root_keyfile"))
+		}
+		if b.config.EncryptRootKeyfile != "" {
+			if _, err := os.Stat(b.config.EncryptRootKeyfile); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("encrypt_root_keyfile: %s", err))
+			}
+		}
+		if b.config.FirstBootResize {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("first_boot_resize can't grow an encrypted root partition"))
+		}
+		if b.config.EncryptRootMapperName == "" {
+			b.config.EncryptRootMapperName = "cryptroot"
+		}
+	}
+
+	for selector, label := range b.config.FilesystemLabels {
+		if _, err := parsePartitionSelector(selector); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("filesystem_labels: %s", err))
+		}
+		if label == "" || strings.ContainsAny(label, " \t\n,\"'=/") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("filesystem_labels: label %q of partition %s must be a non-empty word", label, selector))
+		}
+	}
+	if len(b.config.FilesystemLabels) > 0 && (b.config.Rootless || b.config.InjectFiles || b.config.EncryptRoot) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("filesystem_labels can't be used with rootless, inject_files or encrypt_root"))
+	}
+	for selector, uuid := range b.config.FilesystemUUIDs {
+		if _, err := parsePartitionSelector(selector); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("filesystem_uuids: %s", err))
+		}
+		if !filesystemUUIDRegexp.MatchString(uuid) && !fatVolumeIDRegexp.MatchString(uuid) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("filesystem_uuids: %q of partition %s must be a UUID, or a volume id like 1234-ABCD for vfat", uuid, selector))
+		}
+	}
+	if len(b.config.FilesystemUUIDs) > 0 && (b.config.Rootless || b.config.InjectFiles || b.config.EncryptRoot) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("filesystem_uuids can't be used with rootless, inject_files or encrypt_root"))
+	}
+
+	if v := b.config.DmVerity; v != nil {
+		for _, selector := range []string{v.Partition, v.HashPartition} {
+			if selector == "" {
+				continue
+			}
+			if _, err := parsePartitionSelector(selector); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("dm_verity: %s", err))
+			}
+		}
+		if v.RootHashFile != "" && !filepath.IsAbs(v.RootHashFile) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("dm_verity root_hash_file %q must be an absolute path", v.RootHashFile))
+		}
+		if v.Hash == "" {
+			v.Hash = "sha256"
+		}
+		if b.config.Rootless || b.config.InjectFiles || b.config.EncryptRoot || b.config.ShrinkImage ||
+			b.config.RepackSquashfs || b.config.FirstBootResize {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("dm_verity can't be used with rootless, inject_files, encrypt_root, shrink_image, repack_squashfs or first_boot_resize"))
+		}
+	}
+
+	if f := b.config.FitImage; f != nil {
+		if f.Kernel == "" || f.Dtb == "" || f.LoadAddress == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("fit_image kernel, dtb and load_address are required"))
+		}
+		for _, addr := range []string{f.LoadAddress, f.EntryPoint} {
+			if _, err := strconv.ParseUint(addr, 0, 64); addr != "" && err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("fit_image address %q is not a number", addr))
+			}
+		}
+		if f.EntryPoint == "" {
+			f.EntryPoint = f.LoadAddress
+		}
+		if f.Compression == "" {
+			f.Compression = "none"
+		}
+		if f.Output == "" {
+			f.Output = "/boot/image.fit"
+		}
+		if f.SignatureAlgo == "" {
+			f.SignatureAlgo = "sha256,rsa2048"
+		}
+		if (f.KeyDir == "") != (f.KeyName == "") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("fit_image key_dir and key_name go together"))
+		}
+		if f.UbootDtb != "" && f.KeyDir == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("fit_image uboot_dtb needs key_dir"))
+		}
+		for _, path := range []string{f.KeyDir, f.UbootDtb} {
+			if _, err := os.Stat(path); path != "" && err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("fit_image: %s", err))
+			}
+		}
+		if b.config.InjectFiles {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("fit_image can't be used with inject_files"))
+		}
+	}
+
+	switch b.config.Sbom {
+	case "":
+	case SbomSpdx, SbomCycloneDX:
+		if b.config.SbomFile == "" {
+			ext := ".spdx.json"
+			if b.config.Sbom == SbomCycloneDX {
+				ext = ".cdx.json"
+			}
+			b.config.SbomFile = b.config.OutputFile + ext
+		}
+		if b.config.InjectFiles {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("sbom needs a chroot to query the packages, it can't be used with inject_files"))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("sbom must be %s or %s", SbomSpdx, SbomCycloneDX))
+	}
+
+	if b.config.ProvenanceKey != "" {
+		if !b.config.Provenance {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("provenance_key needs provenance"))
+		}
+		if data, err := ioutil.ReadFile(b.config.ProvenanceKey); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("provenance_key: %s", err))
+		} else if _, err := osutils.ParsePrivateKey(data); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("provenance_key %s: %s", b.config.ProvenanceKey, err))
+		}
+	}
+
+	if b.config.ImageArch != "" {
+		qemu, ok := imageArchQemuBinaries[b.config.ImageArch]
+		switch {
+		case !ok:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_arch must be one of arm, arm64 or riscv64"))
+		case b.config.QemuBinary == "":
+			b.config.QemuBinary = qemu
+		case qemuArch(b.config.QemuBinary) != qemuArch(qemu):
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("qemu_binary %s doesn't run %s binaries of image_arch", b.config.QemuBinary, b.config.ImageArch))
+		}
+	}
+	if b.config.QemuBinary == "" {
+		b.config.defaultQemuBinary = true
+		b.config.QemuBinary = "qemu-arm-static"
+		if qemu, ok := b.config.qemuBinaryOf(b.config.ImageType); ok {
+			b.config.QemuBinary = qemu
+		}
+	}
+	// convert to full path
+	path, err := exec.LookPath(b.config.QemuBinary)
+	if err != nil {
+		if !b.config.RequirePreregisteredBinfmt && b.config.needsQemu() {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("qemu binary not found."))
+		}
+	} else {
+		if !strings.Contains(path, "qemu-") {
+			warnings = append(warnings, "binary doesn't look like qemu-user")
+		}
+		b.config.QemuBinary = path
+	}
+
+	if b.config.RequirePreregisteredBinfmt && !b.config.defaultQemuArgs {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("qemu_args can't be passed to the preregistered qemu of require_preregistered_binfmt"))
+	}
+
+	for i, qemu := range b.config.AdditionalQemuBinaries {
+		path, err := exec.LookPath(qemu)
+		if (b.config.RequirePreregisteredBinfmt || !b.config.needsQemu()) && err != nil {
+			path, err = qemu, nil
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("additional qemu binary %s not found.", qemu))
+			continue
+		}
+		if _, ok := qemuBinfmtMagic[qemuArch(path)]; !ok {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown architecture %q of additional qemu binary %s", qemuArch(path), qemu))
+		}
+		if filepath.Base(path) == filepath.Base(b.config.QemuBinary) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("additional qemu binary %s is already the qemu_binary", qemu))
+		}
+		b.config.AdditionalQemuBinaries[i] = path
+	}
+
+	names := map[string]bool{binfmtName: true}
+	for _, qemu := range b.config.AdditionalQemuBinaries {
+		names[binfmtName+"-"+qemuArch(qemu)] = true
+	}
+	for i, entry := range b.config.BinfmtEntries {
+		errs = packer.MultiErrorAppend(errs, validateBinfmtEntry(entry)...)
+		if names[entry.Name] {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("binfmt entry name %s is used more than once", entry.Name))
+		}
+		names[entry.Name] = true
+		if entry.Interpreter == "" {
+			continue
+		}
+		path, err := exec.LookPath(entry.Interpreter)
+		if b.config.RequirePreregisteredBinfmt && err != nil {
+			path, err = entry.Interpreter, nil
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("interpreter %s of binfmt entry %s not found.", entry.Interpreter, entry.Name))
+			continue
+		}
+		b.config.BinfmtEntries[i].Interpreter = path
+	}
+
+	if b.config.BootTest && b.config.BootTestQemu == "" {
+		b.config.BootTestQemu = "qemu-system-arm"
+		if arch := qemuArch(b.config.QemuBinary); arch == "aarch64" || arch == "riscv64" {
+			b.config.BootTestQemu = "qemu-system-" + arch
+		}
+	}
+
+	if err := checkHostTools(b.config.requiredHostTools()); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return nil, warnings, errs
+	}
+	return []string{"MountPath"}, warnings, nil
+}
+
+type wrappedCommandTemplate struct {
+	Command string
+}
+
+type chrootExecuteCommandTemplate struct {
+	Vars    string
+	Command string
+}
 
 func init() {
 	// HACK: go-getter automatically decompress, which hurts caching.
 	// additionally, we use native binaries to decompress which is faster anyway.
 	// disable decompressors:
 	getter.Decompressors = map[string]getter.Decompressor{}
+	useResumingHTTPClient()
 }
 
 func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
+	if b.config.vagrantHost() {
+		return b.runVagrant(ctx, ui)
+	}
+	started := time.Now()
 
 	wrappedCommand := func(command string) (string, error) {
 		b.config.ctx.Data = &wrappedCommandTemplate{Command: command}
 		return interpolate.Render(b.config.CommandWrapper, &b.config.ctx)
 	}
+	wrappedChrootCommand := func(command string) (string, error) {
+		b.config.ctx.Data = &wrappedCommandTemplate{Command: command}
+		return interpolate.Render(b.config.ChrootCommandWrapper, &b.config.ctx)
+	}
+	chrootExecuteCommand := func(command string) (string, error) {
+		b.config.ctx.Data = &chrootExecuteCommandTemplate{Vars: chrootEnvVars(b.config.ChrootEnv), Command: command}
+		return interpolate.Render(b.config.ChrootExecuteCommand, &b.config.ctx)
+	}
 
 	state := new(multistep.BasicStateBag)
 	state.Put("config", &b.config)
@@ -263,60 +1791,305 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 	state.Put("hook", hook)
 	state.Put("ui", ui)
 	state.Put("wrappedCommand", packer_common_common.CommandWrapper(wrappedCommand))
+	state.Put("wrappedChrootCommand", packer_common_common.CommandWrapper(wrappedChrootCommand))
+	state.Put("chrootExecuteCommand", packer_common_common.CommandWrapper(chrootExecuteCommand))
 
-	steps := []multistep.Step{
-		&packer_common_commonsteps.StepDownload{
-			Checksum:    b.config.ISOChecksum,
-			Description: "Image",
-			ResultKey:   "iso_path",
-			Url:         b.config.ISOUrls,
-			Extension:   b.config.TargetExtension,
-			TargetPath:  b.config.TargetPath,
-		},
-		&stepCopyImage{FromKey: "iso_path", ResultKey: "imagefile", ImageOpener: image.NewImageOpener(ui)},
+	download := &packer_common_commonsteps.StepDownload{
+		Checksum:    b.config.ISOChecksum,
+		Description: "Image",
+		ResultKey:   "iso_path",
+		Url:         append([]string{}, b.config.ISOUrls...),
+		Extension:   b.config.TargetExtension,
+		TargetPath:  b.config.TargetPath,
+	}
+
+	if b.config.rootfsArchive {
+		// downloaded as is, rather than unpacked to a directory by go-getter
+		for i, u := range download.Url {
+			if !isTorrentURL(u) && !isOCIURL(u) {
+				download.Url[i] = keepArchive(u)
+			}
+		}
+	}
+
+	// the http server serves provisioning, resumed builds included
+	var httpSteps []multistep.Step
+	if b.config.HTTPDir != "" {
+		httpSteps = append(httpSteps,
+			&packer_common_commonsteps.StepHTTPServer{HTTPDir: b.config.HTTPDir, HTTPPortMin: b.config.HTTPPortMin,
+				HTTPPortMax: b.config.HTTPPortMax, HTTPAddress: b.config.HTTPAddress},
+			&stepHTTPAddress{},
+		)
+	}
+
+	prepareOutput := &stepPrepareOutput{OutputFile: b.config.OutputFile, Files: outputFiles(&b.config),
+		Force: b.config.PackerForce || b.config.Overwrite}
+	steps := append([]multistep.Step{prepareOutput}, httpSteps...)
+	if b.config.SourceDevice != "" {
+		steps = append(steps,
+			&stepSourceDevice{Device: b.config.SourceDevice, ResultKey: "iso_path"},
+		)
+	} else {
+		steps = append(steps,
+			&stepMountSource{Download: download},
+			&stepTorrentDownload{Download: download, KeepArchive: b.config.rootfsArchive},
+			&stepOciPull{Download: download, PlainHTTP: b.config.OciPlainHTTP, KeepArchive: b.config.rootfsArchive},
+			&stepCloudDownload{Download: download, KeepArchive: b.config.rootfsArchive},
+		)
+		if !b.config.ProbeMirrors.False() {
+			steps = append(steps,
+				&stepProbeMirrors{Download: download},
+			)
+		}
+		steps = append(steps,
+			&stepRetryDownload{Download: download, Retries: b.config.DownloadRetries, Backoff: b.config.DownloadRetryBackoff},
+		)
+	}
+
+	if b.config.blake2Checksum != "" {
+		steps = append(steps,
+			&stepVerifyChecksum{FromKey: "iso_path", Checksum: b.config.blake2Checksum, Url: b.config.ISOUrls[0]},
+		)
 	}
 
-	if b.config.LastPartitionExtraSize > 0 || b.config.TargetImageSize > 0 {
+	if b.config.QcowCache != "" {
+		steps = append(steps,
+			&stepQcowOverlay{FromKey: "iso_path", ResultKey: "imagefile"},
+		)
+	} else if b.config.rootfsArchive {
+		steps = append(steps,
+			&stepCreateImage{ResultKey: "imagefile"},
+		)
+	} else {
+		steps = append(steps,
+			&stepCopyImage{FromKey: "iso_path", ResultKey: "imagefile", ImageOpener: image.NewImageOpener(ui)},
+		)
+	}
+
+	if b.config.resizePartition {
 		steps = append(steps,
 			&stepResizeLastPart{FromKey: "imagefile"},
 		)
 	}
 
-	steps = append(steps,
-		&stepMapImage{ImageKey: "imagefile", ResultKey: "partitions"},
-	)
-	if b.config.LastPartitionExtraSize > 0 || b.config.TargetImageSize > 0 {
+	if len(b.config.AddPartitions) > 0 {
 		steps = append(steps,
-			&stepResizeFs{PartitionsKey: "partitions"},
+			&stepAddPartitions{FromKey: "imagefile"},
 		)
 	}
 
-	steps = append(steps,
-		&stepMountImage{PartitionsKey: "partitions", ResultKey: "mount_path", MountPath: b.config.MountPath},
-		&StepMountExtra{ChrootKey: "mount_path"},
-	)
+	if b.config.ConvertToGpt {
+		steps = append(steps,
+			&stepConvertToGpt{FromKey: "imagefile"},
+		)
+	}
 
-	if b.config.ResolvConf == CopyHost || b.config.ResolvConf == Delete {
+	if len(b.config.UbootBinaries) > 0 {
 		steps = append(steps,
-			&stepHandleResolvConf{ChrootKey: "mount_path", Delete: b.config.ResolvConf == Delete})
+			&stepWriteBootloader{FromKey: "imagefile"},
+		)
+	}
+
+	resuming := false
+	if b.config.Resume {
+		path := resumeStatePath(b.config.OutputFile)
+		resumed, err := loadResumeState(&b.config)
+		if err == nil && (b.config.PackerForce || b.config.Overwrite) {
+			err = fmt.Errorf("-force and overwrite delete the image of the failed build")
+		}
+		if err == nil {
+			resuming = true
+			// the failed build prepared the image already
+			steps = append([]multistep.Step{prepareOutput}, httpSteps...)
+			steps = append(steps, &stepResume{Path: path, Resumed: resumed})
+		} else {
+			if !os.IsNotExist(err) {
+				ui.Message(fmt.Sprintf("Not resuming the previous build: %v", err))
+			}
+			steps = append(steps, &stepResume{Path: path})
+		}
+	}
+
+	if b.config.InjectFiles {
+		steps = append(steps,
+			&stepInjectFiles{ImageKey: "imagefile"},
+		)
+	} else if b.config.RootlessBackend == RootlessGuestfs {
+		steps = append(steps,
+			&stepHookCommands{Commands: b.config.PreMountCommands, Description: "pre-mount commands"},
+			&stepGuestfishProvision{ImageKey: "imagefile"},
+		)
+	} else {
+		steps = b.chrootSteps(steps, resuming)
 	}
 
-	native := runtime.GOARCH == "arm" || runtime.GOARCH == "arm64"
-	if !native {
+	if len(b.config.FilesystemLabels) > 0 {
 		steps = append(steps,
-			&stepQemuUserStatic{ChrootKey: "mount_path", PathToQemuInChrootKey: "qemuInChroot", Args: Args{Args: b.config.QemuArgs}},
-			&stepRegisterBinFmt{QemuPathKey: "qemuInChroot"},
+			&stepEarlyCleanup{Keys: unmountCleanupKeys},
+			&stepRelabelFilesystems{},
 		)
 	}
 
-	steps = append(steps,
-		&StepChrootProvision{ChrootKey: "mount_path"},
-	)
+	if len(b.config.FilesystemUUIDs) > 0 {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmountCleanupKeys},
+			&stepSetFilesystemUUIDs{},
+		)
+	}
+
+	if len(b.config.PostUmountCommands) > 0 {
+		steps = append(steps,
+			&stepHookCommands{Commands: b.config.PostUmountCommands, Description: "post-umount commands"},
+		)
+	}
+
+	if b.config.RepackSquashfs {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepRepackSquashfs{ImageKey: "imagefile"},
+		)
+	}
+
+	if b.config.DmVerity != nil {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmountCleanupKeys},
+			&stepDmVerity{PartitionsKey: "partitions", Verity: *b.config.DmVerity},
+		)
+	}
+
+	if b.config.QcowCache != "" {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepCommitOverlay{FromKey: "imagefile", ResultKey: "imagefile"},
+		)
+	}
+
+	if b.config.ShrinkImage {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmountCleanupKeys},
+			&stepShrinkFs{PartitionsKey: "partitions"},
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepShrinkPartition{FromKey: "imagefile"},
+		)
+	}
+
+	if b.config.ABPartitions != nil {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepCopyRootSlot{ImageKey: "imagefile"},
+		)
+	}
+
+	if b.config.VerifyImage {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepMapImage{ImageKey: "imagefile", ResultKey: "verify_partitions", ReadOnly: true},
+			&stepFsck{PartitionsKey: "verify_partitions", ReadOnly: true},
+			&stepEarlyCleanup{Keys: []string{"map_image_cleanup"}},
+		)
+	}
+
+	if b.config.BootTest {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepBootTest{ImageKey: "imagefile"},
+		)
+	}
+
+	if b.config.SparseOutput {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepSparsifyImage{ImageKey: "imagefile"},
+		)
+	}
+
+	if b.config.ExportPartitions {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepExportPartitions{ImageKey: "imagefile"},
+		)
+	}
+
+	if b.config.Manifest {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepCollectManifest{ImageKey: "imagefile", Compressed: b.config.OutputXz},
+		)
+	}
 
-	b.runner = &multistep.BasicRunner{Steps: steps}
+	if b.config.Bmap {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepCreateBmap{ImageKey: "imagefile"},
+		)
+	}
+
+	if b.config.OutputXz {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepCompressImage{FromKey: "imagefile", ResultKey: "artifact_image"},
+		)
+	}
+
+	if b.config.Manifest {
+		artifactKey := "imagefile"
+		if b.config.OutputXz {
+			artifactKey = "artifact_image"
+		}
+		steps = append(steps,
+			&stepWriteManifest{ImageKey: artifactKey},
+		)
+	}
+
+	if b.config.Provenance {
+		artifactKey := "imagefile"
+		if b.config.OutputXz {
+			artifactKey = "artifact_image"
+		}
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepProvenance{ImageKey: artifactKey, Key: b.config.ProvenanceKey, Started: started},
+		)
+	}
+
+	if b.config.OciPush != "" {
+		artifactKey := "imagefile"
+		if b.config.OutputXz {
+			artifactKey = "artifact_image"
+		}
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepOciPush{ImageKey: artifactKey, Reference: b.config.OciPush, PlainHTTP: b.config.OciPlainHTTP},
+		)
+	}
+
+	if b.config.OutputDevice != "" {
+		artifactKey := "imagefile"
+		if b.config.OutputXz {
+			artifactKey = "artifact_image"
+		}
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmapCleanupKeys},
+			&stepFlashDevice{ImageKey: artifactKey, Device: b.config.OutputDevice},
+		)
+	}
+
+	timings := newStepTimings()
+	b.runner = &multistep.BasicRunner{Steps: timeSteps(steps, timings, b.config.StepTimeout)}
+
+	if b.config.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.config.BuildTimeout)
+		defer cancel()
+	}
 
 	// Executes the steps
 	b.runner.Run(ctx, state)
+	timings.report(ui)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("build timed out after %v", b.config.BuildTimeout)
+	}
 
 	if rawErr, ok := state.GetOk("error"); ok {
 		return nil, rawErr.(error)
@@ -328,19 +2101,374 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 		return nil, errors.New("step canceled or halted")
 	}
 
-	return &Artifact{image: state.Get("imagefile").(string)}, nil
+	artifact := &Artifact{image: state.Get("imagefile").(string), timings: timings.JSON()}
+	if compressed, ok := state.GetOk("artifact_image"); ok {
+		artifact.image = compressed.(string)
+		artifact.compressed = state.Get("compressed_image").(*compressedImage)
+	}
+	if manifest, ok := state.GetOk("manifest_file"); ok {
+		artifact.manifest = manifest.(string)
+	}
+	if bmap, ok := state.GetOk("bmap_file"); ok {
+		artifact.bmap = bmap.(string)
+	}
+	if partitions, ok := state.GetOk("partition_files"); ok {
+		artifact.partitions = partitions.([]string)
+	}
+	if tarball, ok := state.GetOk("rootfs_tarball"); ok {
+		artifact.tarball = tarball.(string)
+	}
+	if sbom, ok := state.GetOk("sbom_file"); ok {
+		artifact.sbom = sbom.(string)
+	}
+	if provenance, ok := state.GetOk("provenance_file"); ok {
+		artifact.provenance = provenance.(string)
+	}
+	if ref, ok := state.GetOk("oci_reference"); ok {
+		artifact.ociReference = ref.(string)
+	}
+	if verity, ok := state.GetOk("dm_verity"); ok {
+		artifact.verityRootHash = verity.(*dmVerityInfo).RootHash
+	}
+	if files, ok := state.GetOk("artifact_files"); ok {
+		artifact.files = files.([]string)
+	}
+	return artifact, nil
+}
+
+// chrootSteps mounts the image and provisions it in a chroot, up to unmounting it. Resumed
+// builds skip the steps finishing the preparation of the image, the failed build ran them.
+func (b *Builder) chrootSteps(steps []multistep.Step, resumed bool) []multistep.Step {
+	if b.config.Rootless {
+		steps = append(steps,
+			&stepHookCommands{Commands: b.config.PreMountCommands, Description: "pre-mount commands"},
+			&stepUserMountImage{ImageKey: "imagefile", ResultKey: "mount_path", MountPath: b.config.MountPath},
+		)
+	} else {
+		steps = b.mountSteps(steps, resumed)
+	}
+
+	if b.config.rootfsArchive && !resumed {
+		steps = append(steps,
+			&stepUnpackRootfsArchive{ChrootKey: "mount_path", FromKey: "iso_path"},
+		)
+	}
+
+	if b.config.ConvertToGpt && !resumed {
+		steps = append(steps,
+			&stepUpdatePartuuids{ChrootKey: "mount_path"},
+		)
+	}
+
+	if len(b.config.AddPartitions) > 0 && !resumed {
+		steps = append(steps,
+			&stepNewPartitionsFstab{ChrootKey: "mount_path"},
+		)
+	}
+
+	steps = append(steps,
+		&stepChrootShell{ChrootKey: "mount_path", Shell: b.config.ChrootShell},
+	)
+
+	if b.config.detectImageType {
+		steps = append(steps,
+			&stepDetectImageType{ChrootKey: "mount_path"},
+		)
+	}
+
+	if b.config.SwapPartition == SwapDrop && b.config.resizePartition && !resumed {
+		steps = append(steps,
+			&stepRemoveSwapFstab{ChrootKey: "mount_path"},
+		)
+	}
+
+	if b.config.ResolvConf == CopyHost || b.config.ResolvConf == Delete {
+		steps = append(steps,
+			&stepHandleResolvConf{ChrootKey: "mount_path", Delete: b.config.ResolvConf == Delete})
+	}
+
+	if len(b.config.ImageFiles) > 0 {
+		steps = append(steps,
+			&stepCopyImageFiles{ChrootKey: "mount_path", Files: b.config.ImageFiles},
+		)
+	}
+
+	native := hostRunsNatively(b.config.QemuBinary)
+	if b.config.Rootless {
+		if !native {
+			steps = append(steps,
+				&stepPrepareProot{ChrootKey: "mount_path"},
+			)
+		}
+	} else if b.config.RequirePreregisteredBinfmt {
+		if !native || len(b.config.BinfmtEntries) > 0 {
+			steps = append(steps,
+				&stepCheckBinfmt{ChrootKey: "mount_path", Native: native},
+			)
+		}
+	} else if !native {
+		steps = append(steps,
+			&stepQemuUserStatic{ChrootKey: "mount_path", PathToQemuInChrootKey: "qemuInChroot",
+				AdditionalBinaries: b.config.AdditionalQemuBinaries, AdditionalPathsToQemuInChrootKey: "additionalQemuInChroot"},
+			&stepRegisterBinFmt{QemuPathKey: "qemuInChroot", AdditionalQemuPathsKey: "additionalQemuInChroot",
+				ChrootKey: "mount_path", Entries: b.config.BinfmtEntries},
+		)
+	} else if len(b.config.BinfmtEntries) > 0 {
+		steps = append(steps,
+			&stepRegisterBinFmt{ChrootKey: "mount_path", Entries: b.config.BinfmtEntries},
+		)
+	}
+
+	if !b.config.AllowServiceStart {
+		steps = append(steps,
+			&stepSuppressServices{ChrootKey: "mount_path"},
+		)
+	}
+
+	if b.config.PackageProxy != "" {
+		steps = append(steps,
+			&stepPackageProxy{ChrootKey: "mount_path", Proxy: b.config.PackageProxy},
+		)
+	}
+
+	steps = append(steps,
+		&StepChrootProvision{ChrootKey: "mount_path"},
+	)
+
+	if b.config.PackageProxy != "" {
+		// before anything archives the tree
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: []string{"package_proxy_cleanup"}},
+		)
+	}
+
+	if b.config.BuildInfo {
+		steps = append(steps,
+			&stepWriteBuildInfo{ChrootKey: "mount_path"},
+		)
+	}
+
+	if ab := b.config.ABPartitions; ab != nil && ab.BootEnv != "-" {
+		steps = append(steps,
+			&stepWriteBootEnv{ChrootKey: "mount_path", Partitions: *ab},
+		)
+	}
+
+	if b.config.EfiSystemPartition != nil {
+		steps = append(steps,
+			&stepInstallEfiBootloader{ChrootKey: "mount_path", Partition: *b.config.EfiSystemPartition},
+		)
+	}
+
+	if b.config.FitImage != nil {
+		steps = append(steps,
+			&stepFitImage{ChrootKey: "mount_path", Fit: *b.config.FitImage},
+		)
+	}
+
+	if len(b.config.ExtraBootFiles) > 0 {
+		steps = append(steps,
+			&stepCopyBootFiles{ChrootKey: "mount_path", Files: b.config.ExtraBootFiles},
+		)
+	}
+
+	steps = append(steps,
+		&stepHookCommands{Commands: b.config.PostProvisionCommands, Description: "post-provision commands", ChrootKey: "mount_path"},
+	)
+
+	if len(b.config.FilesystemLabels) > 0 {
+		steps = append(steps,
+			&stepFilesystemLabels{ChrootKey: "mount_path", PartitionsKey: "partitions", Labels: b.config.FilesystemLabels},
+		)
+	}
+
+	if len(b.config.FilesystemUUIDs) > 0 {
+		steps = append(steps,
+			&stepFilesystemUUIDs{ChrootKey: "mount_path", PartitionsKey: "partitions", UUIDs: b.config.FilesystemUUIDs},
+		)
+	}
+
+	if b.config.Sbom != "" {
+		steps = append(steps,
+			&stepSbom{ChrootKey: "mount_path", Format: b.config.Sbom, File: b.config.SbomFile},
+		)
+	}
+
+	if b.config.FirstBootResize {
+		steps = append(steps,
+			&stepFirstBootResize{ChrootKey: "mount_path"},
+		)
+	}
+
+	if b.config.SelinuxRelabel != SelinuxOff {
+		steps = append(steps,
+			&stepSelinuxRelabel{ChrootKey: "mount_path", Mode: b.config.SelinuxRelabel},
+		)
+	}
+
+	if b.config.RootfsTarball != "" {
+		steps = append(steps,
+			&stepRootfsTarball{ChrootKey: "mount_path", Tarball: b.config.RootfsTarball},
+		)
+	}
+
+	if b.config.OstreeCommit != nil {
+		steps = append(steps,
+			&stepOstreeCommit{ChrootKey: "mount_path", Commit: *b.config.OstreeCommit},
+		)
+	}
+
+	if b.config.ContainerImage != "" || b.config.ContainerOCILayout != "" {
+		steps = append(steps,
+			&stepContainerImage{ChrootKey: "mount_path"},
+		)
+	}
+
+	if b.config.EncryptRoot {
+		steps = append(steps,
+			&stepPrepareEncryptRoot{ChrootKey: "mount_path"},
+		)
+	}
+
+	if b.config.EncryptRoot || len(b.config.PostUmountCommands) > 0 {
+		steps = append(steps,
+			&stepEarlyCleanup{Keys: unmountCleanupKeys},
+		)
+	}
+
+	if b.config.EncryptRoot {
+		steps = append(steps,
+			&stepEncryptRoot{},
+		)
+	}
+	return steps
+}
+
+// prepareNewPartition validates an add_partitions entry, and mounts it with image_mounts or
+// partition_mounts.
+func (b *Builder) prepareNewPartition(p *NewPartition) []error {
+	var errs []error
+	size, err := osutils.ParseSize(p.Size)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("size of new partition: %s", err))
+	}
+	// rounded up to 1MiB
+	p.size = (size + 1<<20 - 1) &^ (1<<20 - 1)
+	if p.size == 0 {
+		errs = append(errs, fmt.Errorf("new partitions need a size"))
+	}
+
+	switch p.Filesystem {
+	case "":
+		p.Filesystem = "ext4"
+	case "ext4", "vfat", "swap":
+	default:
+		errs = append(errs, fmt.Errorf("filesystem of new partition must be ext4, vfat or swap, not %q", p.Filesystem))
+	}
+	if p.Mountpoint != "" && (!filepath.IsAbs(p.Mountpoint) || p.Filesystem == "swap") {
+		errs = append(errs, fmt.Errorf("mountpoint of new partition must be an absolute path, and swap partitions aren't mounted"))
+	}
+	if p.MountOptions == "" {
+		p.MountOptions = "defaults"
+	}
+
+	mnt := p.Mountpoint
+	if len(b.config.PartitionMounts) > 0 {
+		if mnt != "" {
+			if p.Label == "" {
+				errs = append(errs, fmt.Errorf("new partitions mounted with partition_mounts need a label"))
+			}
+			b.config.PartitionMounts["LABEL="+p.Label] = mnt
+		}
+	} else {
+		// the defaults of the image type are shared
+		b.config.ImageMounts = append(b.config.ImageMounts[:len(b.config.ImageMounts):len(b.config.ImageMounts)], mnt)
+	}
+	return errs
+}
+
+// mountSteps maps the partitions of the image, resizes their filesystems and mounts them.
+// Resumed builds don't resize or format them again.
+func (b *Builder) mountSteps(steps []multistep.Step, resumed bool) []multistep.Step {
+	if b.config.QcowCache != "" {
+		steps = append(steps,
+			&stepNbdMapImage{ImageKey: "imagefile", ResultKey: "partitions"},
+		)
+	} else {
+		steps = append(steps,
+			&stepMapImage{ImageKey: "imagefile", ResultKey: "partitions"},
+		)
+	}
+	if b.config.resizeFilesystem && !resumed {
+		steps = append(steps,
+			&stepResizeFs{PartitionsKey: "partitions"},
+		)
+	}
+	if b.config.resizePartition && !resumed {
+		steps = append(steps,
+			&stepRecreateSwap{PartitionsKey: "partitions"},
+		)
+	}
+	if len(b.config.AddPartitions) > 0 && !resumed {
+		steps = append(steps,
+			&stepFormatNewPartitions{PartitionsKey: "partitions"},
+		)
+	}
+	if b.config.ImageType == utils.Noobs {
+		steps = append(steps,
+			&stepSelectNoobsOS{PartitionsKey: "partitions", OS: b.config.NoobsOS},
+		)
+	}
+
+	steps = append(steps,
+		&stepActivateLvm{PartitionsKey: "partitions"},
+		&stepHookCommands{Commands: b.config.PreMountCommands, Description: "pre-mount commands"},
+	)
+	if b.config.FsckPartitions {
+		steps = append(steps,
+			&stepFsck{PartitionsKey: "partitions"},
+		)
+	}
+	steps = append(steps,
+		&stepMountImage{PartitionsKey: "partitions", ResultKey: "mount_path", MountPath: b.config.MountPath},
+		&StepMountExtra{ChrootKey: "mount_path"},
+	)
+	return steps
 }
 
 type Artifact struct {
 	image string
+	// sizes and hashes of the compressed image, when output_xz is set
+	compressed *compressedImage
+	// the manifest file, when manifest is set
+	manifest string
+	// the block map, when bmap is set
+	bmap string
+	// how long the steps took, as a JSON object of seconds by step name
+	timings string
+	// the partitions exported, when export_partitions is set
+	partitions []string
+	// the archive of the root filesystem, when rootfs_tarball is set
+	tarball string
+	// the root hash of the dm-verity hash tree, when dm_verity is set
+	verityRootHash string
+	// the SBOM, when sbom is set
+	sbom string
+	// the provenance statement, when provenance is set
+	provenance string
+	// the reference the artifact was pushed to, when oci_push is set
+	ociReference string
+	// the files written next to the image, like the manifest, bmap and exported partitions
+	files []string
 }
 
 func (a *Artifact) BuilderId() string {
 	return BuilderId
 }
 
+// Files returns the image first, then the other files the build wrote.
 func (a *Artifact) Files() []string {
-	return []string{a.image}
+	return append([]string{a.image}, a.files...)
 }
 
 func (a *Artifact) Id() string {
@@ -351,10 +2479,72 @@ func (a *Artifact) String() string {
 	return a.image
 }
 
+// State exposes the sizes and hashes of a compressed image, named like the matching
+// Raspberry Pi Imager os_list fields: extract_size, extract_sha256, image_download_size
+// and image_download_sha256. manifest is the path of the image manifest and manifest_json
+// its content. bmap is the path of the block map. step_timings is a JSON object of the seconds
+// each step took, like {"Download": 12.5, "CopyImage": 30.1}. partition_files are the paths of
+// the exported partitions, rootfs_tarball the archive of the root filesystem, sbom the path of
+// the SBOM, provenance the path of the provenance statement and oci_reference the registry
+// reference the artifact was pushed to.
 func (a *Artifact) State(name string) interface{} {
+	if name == "rootfs_tarball" && a.tarball != "" {
+		return a.tarball
+	}
+	if name == "provenance" && a.provenance != "" {
+		return a.provenance
+	}
+	if name == "oci_reference" && a.ociReference != "" {
+		return a.ociReference
+	}
+	if name == "sbom" && a.sbom != "" {
+		return a.sbom
+	}
+	if name == "bmap" && a.bmap != "" {
+		return a.bmap
+	}
+	if name == "partition_files" && len(a.partitions) > 0 {
+		return a.partitions
+	}
+	if name == "step_timings" {
+		return a.timings
+	}
+	if name == "dm_verity_root_hash" && a.verityRootHash != "" {
+		return a.verityRootHash
+	}
+	if a.manifest != "" {
+		switch name {
+		case "manifest":
+			return a.manifest
+		case "manifest_json":
+			data, err := ioutil.ReadFile(a.manifest)
+			if err != nil {
+				return nil
+			}
+			return string(data)
+		}
+	}
+	if a.compressed == nil {
+		return nil
+	}
+	switch name {
+	case "extract_size":
+		return a.compressed.ExtractSize
+	case "extract_sha256":
+		return a.compressed.ExtractSha256
+	case "image_download_size":
+		return a.compressed.DownloadSize
+	case "image_download_sha256":
+		return a.compressed.DownloadSha256
+	}
 	return nil
 }
 
 func (a *Artifact) Destroy() error {
+	for _, f := range a.files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return os.Remove(a.image)
 }
@@ -0,0 +1,185 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// runBuild prepares and runs a build of config, and returns its error and what it said.
+func runBuild(t *testing.T, config map[string]interface{}) (error, string) {
+	var out bytes.Buffer
+	ui := &packer.BasicUi{Reader: new(bytes.Buffer), Writer: &out, ErrorWriter: &out}
+	b := NewBuilder()
+	if _, _, err := b.Prepare(config); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	_, err := b.Run(context.Background(), ui, &packer.MockHook{})
+	return err, out.String()
+}
+
+func TestResumeFailedBuild(t *testing.T) {
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skip("losetup not found")
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("PACKER_CACHE_DIR", filepath.Join(dir, "cache"))
+	defer os.Unsetenv("PACKER_CACHE_DIR")
+	// without a partition table, so the build fails once the image is prepared
+	source := filepath.Join(dir, "source.img")
+	if err := ioutil.WriteFile(source, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "output", "image")
+	config := map[string]interface{}{
+		"iso_url":                      source,
+		"iso_checksum":                 "none",
+		"image_type":                   "raspberrypi",
+		"output_filename":              output,
+		"require_preregistered_binfmt": true,
+		"resume":                       true,
+		"partition_mapper":             "losetup",
+	}
+
+	err, out := runBuild(t, config)
+	if err == nil {
+		t.Fatalf("the build of an image without partitions succeeded: %s", out)
+	}
+	for _, f := range []string{output, resumeStatePath(output)} {
+		if _, err := os.Stat(f); err != nil {
+			t.Fatalf("the failed build didn't keep %s: %v", f, err)
+		}
+	}
+
+	err, out = runBuild(t, config)
+	if err == nil {
+		t.Fatalf("the resumed build of an image without partitions succeeded: %s", out)
+	}
+	if strings.Contains(out, "Output file exists") {
+		t.Fatalf("the resumed build failed on the output of the failed build: %s", out)
+	}
+	if !strings.Contains(out, "Resuming the failed build") || strings.Contains(out, "Copying source image") {
+		t.Fatalf("the build was not resumed: %s", out)
+	}
+	if _, err := os.Stat(resumeStatePath(output)); err != nil {
+		t.Fatalf("the resumed build didn't keep its state: %v", err)
+	}
+}
+
+func TestArtifactFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "image.img")
+	written := []string{image + ".manifest.json", image + ".bmap", image + ".boot.vfat"}
+	for _, f := range append([]string{image}, written...) {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := &Artifact{image: image, files: written}
+	files := a.Files()
+	if len(files) != 4 || files[0] != image {
+		t.Fatalf("Files() = %v, want the image and then %v", files, written)
+	}
+	if err := a.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s was not destroyed", f)
+		}
+	}
+}
+
+// prepareErrors prepares a raspberrypi build with config on top, and returns its errors but the
+// ones about tools missing on the host.
+func prepareErrors(t *testing.T, config map[string]interface{}) (*Builder, []string) {
+	raw := map[string]interface{}{
+		"iso_url":         "/tmp/source.img",
+		"iso_checksum":    "none",
+		"image_type":      "raspberrypi",
+		"output_filename": "/tmp/output/image",
+	}
+	for k, v := range config {
+		raw[k] = v
+	}
+	b := NewBuilder()
+	_, _, err := b.Prepare(raw)
+	if err == nil {
+		return b, nil
+	}
+	merr, ok := err.(*packer.MultiError)
+	if !ok {
+		t.Fatalf("Prepare: %v", err)
+	}
+	var errs []string
+	for _, err := range merr.Errors {
+		if msg := err.Error(); !strings.HasPrefix(msg, "host tools not found") && !strings.HasPrefix(msg, "qemu binary not found") {
+			errs = append(errs, msg)
+		}
+	}
+	return b, errs
+}
+
+func TestPrepare(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  map[string]interface{}
+		wantErr string
+		check   func(*Config) bool
+	}{
+		{name: "defaults", check: func(c *Config) bool {
+			return c.RootlessBackend == RootlessFuse && c.PartitionMapper == MapperKpartx && !c.Rootless
+		}},
+		{name: "resume keeps the image", config: map[string]interface{}{"resume": true}, check: func(c *Config) bool { return c.KeepImageOnError }},
+		{name: "guestfs implies rootless", config: map[string]interface{}{"rootless_backend": "guestfs"}, check: func(c *Config) bool { return c.Rootless }},
+		{name: "unknown rootless_backend", config: map[string]interface{}{"rootless_backend": "nbd"}, wantErr: "rootless_backend must be"},
+		{name: "unknown partition_mapper", config: map[string]interface{}{"partition_mapper": "dmsetup"}, wantErr: "partition_mapper must be"},
+		{name: "resize_partition_number", config: map[string]interface{}{"resize_partition_number": 5}, wantErr: "resize_partition_number must be"},
+		{name: "output_device", config: map[string]interface{}{"output_device": "sdb"}, wantErr: "output_device must be a device path"},
+		{name: "no root in partition_mounts", config: map[string]interface{}{"partition_mounts": map[string]string{"1": "/boot"}}, wantErr: "exactly one partition at /"},
+		{name: "bad partition selector", config: map[string]interface{}{"partition_mounts": map[string]string{"UUID=1234": "/"}}, wantErr: "invalid partition"},
+		{name: "rootless shrink", config: map[string]interface{}{"rootless": true, "shrink_image": true}, wantErr: "rootless builds can't use shrink_image"},
+		{name: "rootless partition_mounts", config: map[string]interface{}{"rootless": true, "partition_mounts": map[string]string{"2": "/"}}, wantErr: "rootless builds need image_mounts"},
+		{name: "inject_files rootless", config: map[string]interface{}{"inject_files": true, "rootless": true}, wantErr: "inject_files can't be used with rootless"},
+		{name: "inject_files selinux", config: map[string]interface{}{"inject_files": true, "selinux_relabel": "setfiles"}, wantErr: "inject_files builds don't mount the image for selinux_relabel"},
+		{name: "guestfs build_info", config: map[string]interface{}{"rootless_backend": "guestfs", "build_info": true}, wantErr: "guestfs builds don't mount the image on the host"},
+		{name: "guestfs resolv-conf", config: map[string]interface{}{"rootless_backend": "guestfs", "resolv-conf": "copy-host"}, wantErr: "resolv-conf can't be"},
+		{name: "guestfs selinux", config: map[string]interface{}{"rootless_backend": "guestfs", "selinux_relabel": "autorelabel"}, wantErr: "guestfs builds don't mount the image on the host for selinux_relabel"},
+		{name: "unknown selinux_relabel", config: map[string]interface{}{"selinux_relabel": "always"}, wantErr: "unknown selinux_relabel"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, errs := prepareErrors(t, tc.config)
+			if tc.wantErr == "" {
+				if len(errs) > 0 {
+					t.Fatalf("Prepare: %v", errs)
+				}
+				if tc.check != nil && !tc.check(&b.config) {
+					t.Fatalf("unexpected config %+v", b.config)
+				}
+				return
+			}
+			for _, err := range errs {
+				if strings.Contains(err, tc.wantErr) {
+					return
+				}
+			}
+			t.Fatalf("Prepare errors %v, want %q", errs, tc.wantErr)
+		})
+	}
+}
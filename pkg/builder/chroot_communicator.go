@@ -0,0 +1,135 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/packer-plugin-sdk/chroot"
+	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// hostCommandPrefix marks the commands to run on the host instead of in the chroot, for
+// provisioners with an execute_command override like `host: {{.Vars}} .{{.Path}}`. They run
+// from the mount path of the image, which is also exported as IMAGE_MOUNT_PATH.
+const hostCommandPrefix = "host:"
+
+// defaultChrootEnv is exported for the commands run in the chroot, unless chroot_env sets the
+// variables: the PATH of the host often doesn't suit the image, and package managers must not
+// prompt.
+var defaultChrootEnv = map[string]string{
+	"PATH":            "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME":            "/root",
+	"DEBIAN_FRONTEND": "noninteractive",
+}
+
+// chrootCommunicator is the chroot communicator, with commands run with chroot_execute_command
+// and wrapped with chroot_command_wrapper. The host side is wrapped by the embedded Communicator.
+type chrootCommunicator struct {
+	*chroot.Communicator
+	ChrootCmdWrapper packer_common_common.CommandWrapper
+	// renders chroot_execute_command, which exports chroot_env
+	ExecuteCommand packer_common_common.CommandWrapper
+	// the shell commands run with, see stepChrootShell
+	Shell string
+	// run the commands with proot instead of chroot, for rootless builds
+	Rootless  bool
+	ProotQemu string
+}
+
+func (c *chrootCommunicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	if strings.HasPrefix(cmd.Command, hostCommandPrefix) {
+		return c.startOnHost(cmd)
+	}
+	command, err := c.ExecuteCommand(cmd.Command)
+	if err != nil {
+		return err
+	}
+	// the wrapper gets a command of its own, so what it runs it with, like sudo, keeps chroot_env
+	if cmd.Command, err = c.ChrootCmdWrapper(fmt.Sprintf("%s -c %s", c.Shell, shellQuote(command))); err != nil {
+		return err
+	}
+	if c.Rootless {
+		command, err = c.CmdWrapper(prootCommand(c.Chroot, c.ProotQemu, c.Shell, cmd.Command))
+	} else {
+		// like the embedded Communicator, which always runs /bin/sh
+		command, err = c.CmdWrapper(chrootCommand(c.Chroot, c.Shell, cmd.Command))
+	}
+	if err != nil {
+		return err
+	}
+	return startLocal(command, cmd)
+}
+
+func (c *chrootCommunicator) startOnHost(cmd *packer.RemoteCmd) error {
+	command := fmt.Sprintf("export IMAGE_MOUNT_PATH=%s; cd %s && %s",
+		shellQuote(c.Chroot), shellQuote(c.Chroot), strings.TrimPrefix(cmd.Command, hostCommandPrefix))
+	command, err := c.CmdWrapper(command)
+	if err != nil {
+		return err
+	}
+	return startLocal(command, cmd)
+}
+
+// startLocal starts a host command for cmd, and reports its exit status once done.
+func startLocal(command string, cmd *packer.RemoteCmd) error {
+	localCmd := packer_common_common.ShellCommand(command)
+	localCmd.Stdin = cmd.Stdin
+	localCmd.Stdout = cmd.Stdout
+	localCmd.Stderr = cmd.Stderr
+	log.Printf("Executing: %s %#v", localCmd.Path, localCmd.Args)
+	if err := localCmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		exitStatus := 0
+		if err := localCmd.Wait(); err != nil {
+			exitStatus = 1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+					exitStatus = status.ExitStatus()
+				}
+			}
+		}
+		log.Printf("Execution exited with '%d': '%s'", exitStatus, cmd.Command)
+		cmd.SetExited(exitStatus)
+	}()
+	return nil
+}
+
+// chrootEnvPrefix returns the shell command that exports env, in a stable order.
+func chrootEnvPrefix(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	return "export " + chrootEnvVars(env) + "; "
+}
+
+// chrootEnvVars returns the shell assignments of env, in a stable order.
+func chrootEnvVars(env map[string]string) string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]string, len(names))
+	for i, name := range names {
+		vars[i] = name + "=" + shellQuote(env[name])
+	}
+	return strings.Join(vars, " ")
+}
+
+// shellQuote single quotes s for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/chroot"
+	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// chrootEnvValues are chroot_env values the host shell must not expand.
+var chrootEnvValues = []string{"$HOME", "`id -u`", "$(id -u)", `a "quoted" 'value'`, `back\slash`}
+
+func noWrapper(command string) (string, error) {
+	return command, nil
+}
+
+func TestRunInChrootEnv(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot needs root")
+	}
+	dir, err := ioutil.TempDir("", "chroot-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, value := range chrootEnvValues {
+		t.Run(value, func(t *testing.T) {
+			out := filepath.Join(dir, "out")
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packer.TestUi(t))
+			state.Put("config", &Config{ChrootEnv: map[string]string{"VALUE": value}})
+			state.Put("wrappedCommand", packer_common_common.CommandWrapper(noWrapper))
+			if err := runInChroot(context.Background(), state, "/", `printf %s "$VALUE" > `+shellQuote(out)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != value {
+				t.Errorf("VALUE is %q in the chroot, want %q", got, value)
+			}
+		})
+	}
+}
+
+func TestChrootCommunicatorEnv(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot needs root")
+	}
+	for _, value := range chrootEnvValues {
+		t.Run(value, func(t *testing.T) {
+			env := map[string]string{"VALUE": value}
+			comm := &chrootCommunicator{
+				Communicator:     &chroot.Communicator{Chroot: "/", CmdWrapper: noWrapper},
+				ChrootCmdWrapper: noWrapper,
+				ExecuteCommand: func(command string) (string, error) {
+					return chrootEnvPrefix(env) + command, nil
+				},
+				Shell: "/bin/sh",
+			}
+			var stdout, stderr bytes.Buffer
+			cmd := &packer.RemoteCmd{Command: `printf %s "$VALUE"`, Stdout: &stdout, Stderr: &stderr}
+			if err := comm.Start(context.Background(), cmd); err != nil {
+				t.Fatal(err)
+			}
+			if status := cmd.Wait(); status != 0 {
+				t.Fatalf("exit status %d: %s", status, stderr.String())
+			}
+			if stdout.String() != value {
+				t.Errorf("VALUE is %q in the chroot, want %q", stdout.String(), value)
+			}
+		})
+	}
+}
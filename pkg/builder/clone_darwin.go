@@ -0,0 +1,11 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+)
+
+// cloneFile fails on macOS, where builds run in a Vagrant VM, so the image is copied.
+func cloneFile(dst, src *os.File) error {
+	return fmt.Errorf("reflinks are only supported on linux")
+}
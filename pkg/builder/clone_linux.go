@@ -0,0 +1,12 @@
+package builder
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile shares the blocks of src with dst, see stepCopyImage.reflink.
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,128 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// doctorMinFreeSpace is the free space builds of common images need, for the copy of the image
+// and the downloads cache.
+const doctorMinFreeSpace = 8 << 30
+
+// doctorCheck is a check of the host, returning a description of what was found, or an error
+// telling how to fix it.
+type doctorCheck struct {
+	Name  string
+	Check func() (string, error)
+}
+
+// doctorChecks are the checks of Doctor: most builds that fail on a new host fail for one of them.
+var doctorChecks = []doctorCheck{
+	{"root privileges", func() (string, error) {
+		if os.Geteuid() != 0 {
+			return "", fmt.Errorf("mapping and mounting images needs root, run packer with sudo")
+		}
+		return "running as root", nil
+	}},
+	{"WSL", func() (string, error) {
+		switch wslVersion() {
+		case 1:
+			return "", fmt.Errorf("WSL1 distros have no loop devices, convert this one to WSL2 with wsl --set-version <distro> 2")
+		case 2:
+			if !udevRunning() {
+				return "WSL2 without udev, partitions are mapped with losetup", nil
+			}
+			return "WSL2", nil
+		}
+		return "not a WSL distro", nil
+	}},
+	{"loop devices", func() (string, error) {
+		if _, err := os.Stat("/dev/loop-control"); err != nil {
+			return "", fmt.Errorf("%s, load the loop module with modprobe loop, or run containers with --privileged", err)
+		}
+		return "/dev/loop-control", nil
+	}},
+	{"device mapper", func() (string, error) {
+		if _, err := os.Stat("/dev/mapper/control"); err != nil {
+			return "", fmt.Errorf("%s, kpartx needs it, load the dm_mod module with modprobe dm_mod or set partition_mapper to losetup", err)
+		}
+		return "/dev/mapper/control", nil
+	}},
+	{"binfmt_misc", func() (string, error) {
+		filesystems, err := ioutil.ReadFile("/proc/filesystems")
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(string(filesystems), "binfmt_misc") {
+			return "", fmt.Errorf("the kernel has no binfmt_misc support, load the binfmt_misc module with modprobe binfmt_misc")
+		}
+		status, err := ioutil.ReadFile("/proc/sys/fs/binfmt_misc/status")
+		if os.IsNotExist(err) {
+			return "supported, mounted in the chroot by the build", nil
+		} else if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(string(status)) != "enabled" {
+			return "", fmt.Errorf("binfmt_misc is disabled, enable it with echo 1 > /proc/sys/fs/binfmt_misc/status")
+		}
+		return "enabled", nil
+	}},
+	{"host tools", func() (string, error) {
+		tools := []string{"kpartx", "losetup", "mount", "umount", "blkid", "e2fsck", "resize2fs"}
+		if err := checkHostTools(tools); err != nil {
+			return "", err
+		}
+		return strings.Join(tools, ", "), nil
+	}},
+	{"qemu", func() (string, error) {
+		var found []string
+		for _, qemu := range []string{"qemu-arm-static", "qemu-aarch64-static"} {
+			if lookHostTool(qemu) {
+				found = append(found, qemu)
+			}
+		}
+		if len(found) == 0 {
+			if hostRunsNatively("qemu-arm-static") {
+				return fmt.Sprintf("not needed, %s hosts run arm binaries", runtime.GOARCH), nil
+			}
+			return "", fmt.Errorf("no qemu-user-static binary found, install qemu-user-static")
+		}
+		return strings.Join(found, ", "), nil
+	}},
+	{"free disk space", func() (string, error) {
+		var report []string
+		for _, dir := range []string{".", os.TempDir()} {
+			var st syscall.Statfs_t
+			if err := syscall.Statfs(dir, &st); err != nil {
+				return "", err
+			}
+			free := uint64(st.Bavail) * uint64(st.Bsize)
+			if free < doctorMinFreeSpace {
+				return "", fmt.Errorf("%d MiB free in %s, images and their copies need %d MiB", free>>20, dir, doctorMinFreeSpace>>20)
+			}
+			report = append(report, fmt.Sprintf("%d MiB in %s", free>>20, dir))
+		}
+		return strings.Join(report, ", "), nil
+	}},
+}
+
+// Doctor checks the host can run builds, and writes a report of the checks to w. It returns
+// whether all of them passed.
+func Doctor(w io.Writer) bool {
+	ok := true
+	for _, check := range doctorChecks {
+		found, err := check.Check()
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "FAIL %s: %s\n", check.Name, err)
+			continue
+		}
+		fmt.Fprintf(w, "PASS %s: %s\n", check.Name, found)
+	}
+	return ok
+}
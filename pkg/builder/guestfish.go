@@ -0,0 +1,365 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	osutils "github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// guestfishCommandPath is where the commands of provisioners are written in the image to run them.
+const guestfishCommandPath = "/packer-command"
+
+var guestfishPidRegexp = regexp.MustCompile(`GUESTFISH_PID=(\d+)`)
+
+// stepGuestfishProvision runs the provisioners of guestfs builds in a libguestfs appliance, a
+// small VM guestfish starts in the background. The partitions of image_mounts are mounted in the
+// appliance, files are copied in and out with guestfish, and commands run from the image with
+// guestfish command, through the qemu binary of the image for foreign binaries. Nothing is mounted
+// on the host, so neither root, loop devices, /dev/fuse nor binfmt_misc are needed.
+//
+// Produces:
+//
+//	mount_image_cleanup CleanupFunc - To perform early cleanup
+type stepGuestfishProvision struct {
+	ImageKey string
+
+	session *guestfish
+}
+
+func (s *stepGuestfishProvision) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	hook := state.Get("hook").(packer.Hook)
+	ui := state.Get("ui").(packer.Ui)
+	config := state.Get("config").(*Config)
+	imagefile := state.Get(s.ImageKey).(string)
+
+	ui.Say("Starting the libguestfs appliance")
+	var err error
+	s.session, err = startGuestfish(ctx, state, imagefile)
+	if err == nil {
+		state.Put("mount_image_cleanup", s)
+		err = s.session.mount(ctx, ui, imagefile, config.ImageMounts)
+	}
+	var qemu []string
+	if err == nil && !hostRunsNatively(config.QemuBinary) {
+		qemu, err = s.session.installQemu(ctx, state)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error preparing the image in the libguestfs appliance: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if config.ChrootShell == "" {
+		config.ChrootShell = defaultChrootShell
+	}
+	comm := &guestfishCommunicator{
+		session:        s.session,
+		ExecuteCommand: state.Get("chrootExecuteCommand").(packer_common_common.CommandWrapper),
+		Shell:          config.ChrootShell,
+		Qemu:           qemu,
+	}
+	log.Println("Running the provision hook")
+	hookData := packer_common_commonsteps.PopulateProvisionHookData(state)
+	if err := hook.Run(ctx, packer.HookProvision, ui, comm, hookData); err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	if err := s.CleanupFunc(state); err != nil {
+		err := fmt.Errorf("Error closing the libguestfs appliance: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepGuestfishProvision) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+// CleanupFunc removes what the build put in the image, unmounts the partitions and shuts the
+// appliance down, which writes everything back to the image.
+func (s *stepGuestfishProvision) CleanupFunc(state multistep.StateBag) error {
+	if s.session == nil {
+		return nil
+	}
+	session := s.session
+	s.session = nil
+	return session.close(context.TODO())
+}
+
+// guestfish is a guestfish session listening in the background, run with command_wrapper.
+type guestfish struct {
+	state multistep.StateBag
+	pid   string
+	// the files the build put in the image, removed before closing the session
+	installed []string
+}
+
+// startGuestfish starts a guestfish session on imagefile, with the network enabled for the
+// package managers of provisioners, and launches its appliance.
+func startGuestfish(ctx context.Context, state multistep.StateBag, imagefile string) (*guestfish, error) {
+	out, err := runCommandOutput(ctx, state, fmt.Sprintf("guestfish --listen --network --rw -a %s --format=raw", shellQuote(imagefile)))
+	if err != nil {
+		return nil, err
+	}
+	match := guestfishPidRegexp.FindStringSubmatch(out)
+	if match == nil {
+		return nil, fmt.Errorf("no GUESTFISH_PID in the guestfish output: %s", out)
+	}
+	g := &guestfish{state: state, pid: match[1]}
+	if _, err := g.run(ctx, "run"); err != nil {
+		g.close(ctx)
+		return nil, err
+	}
+	return g, nil
+}
+
+// guestfishCommand is the host command that runs args as a guestfish command of session pid.
+// They are passed as arguments, so guestfish doesn't parse their spaces and quotes.
+func guestfishCommand(pid string, args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return fmt.Sprintf("guestfish --remote=%s -- %s", pid, strings.Join(quoted, " "))
+}
+
+// run runs a guestfish command in the session and returns what it printed.
+func (g *guestfish) run(ctx context.Context, args ...string) (string, error) {
+	return runCommandOutput(ctx, g.state, guestfishCommand(g.pid, args...))
+}
+
+// mount mounts the partitions of image_mounts in the appliance, which sees the image as
+// /dev/sda. / is mounted before /boot.
+func (g *guestfish) mount(ctx context.Context, ui packer.Ui, imagefile string, mounts []string) error {
+	table, err := osutils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return fmt.Errorf("error reading the partition table: %s", err)
+	}
+	if len(table.Partitions) != len(mounts) {
+		return fmt.Errorf("the image has %d partitions but image_mounts has %d", len(table.Partitions), len(mounts))
+	}
+	order := make([]int, len(mounts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return mounts[order[i]] < mounts[order[j]] })
+
+	for _, i := range order {
+		mnt := mounts[i]
+		if mnt == "" || mnt == skipMount {
+			continue
+		}
+		number := table.Partitions[i].Number()
+		ui.Message(fmt.Sprintf("Mounting partition %d on %s", number, mnt))
+		if mnt != "/" {
+			if _, err := g.run(ctx, "mkdir-p", mnt); err != nil {
+				return err
+			}
+		}
+		if _, err := g.run(ctx, "mount", fmt.Sprintf("/dev/sda%d", number), mnt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installQemu copies the qemu binary of the image into it, as the appliance has no
+// binfmt_misc, and returns the command line foreign binaries are run with.
+func (g *guestfish) installQemu(ctx context.Context, state multistep.StateBag) ([]string, error) {
+	config := state.Get("config").(*Config)
+	qemu, err := exec.LookPath(config.QemuBinary)
+	if err != nil {
+		return nil, fmt.Errorf("qemu_binary %s: %s", config.QemuBinary, err)
+	}
+	args, err := renderQemuArgs(state, "")
+	if err != nil {
+		return nil, fmt.Errorf("error rendering qemu_args: %s", err)
+	}
+	// the root directory is guaranteed to exist, like for stepQemuUserStatic
+	inImage := "/" + filepath.Base(qemu)
+	if _, err := g.run(ctx, "upload", qemu, inImage); err != nil {
+		return nil, err
+	}
+	g.installed = append(g.installed, inImage)
+	if _, err := g.run(ctx, "chmod", "0755", inImage); err != nil {
+		return nil, err
+	}
+	return append([]string{inImage}, args...), nil
+}
+
+// close removes what the build installed in the image and shuts the appliance down.
+func (g *guestfish) close(ctx context.Context) error {
+	for _, f := range g.installed {
+		g.run(ctx, "rm-f", f)
+	}
+	g.installed = nil
+	if _, err := g.run(ctx, "umount-all"); err != nil {
+		g.run(ctx, "exit")
+		return err
+	}
+	_, err := g.run(ctx, "exit")
+	return err
+}
+
+// guestfishCommunicator runs the provisioners of guestfs builds in the appliance of a guestfish
+// session. Commands are written to a script in the image, run with guestfish command, so their
+// output is only shown once they are done.
+type guestfishCommunicator struct {
+	session *guestfish
+	// renders chroot_execute_command, which exports chroot_env
+	ExecuteCommand packer_common_common.CommandWrapper
+	// the shell command line commands run with, chroot_shell
+	Shell string
+	// the qemu command line foreign binaries run with, if any
+	Qemu []string
+}
+
+func (c *guestfishCommunicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	script, err := c.ExecuteCommand(cmd.Command)
+	if err != nil {
+		return err
+	}
+	if err := c.upload(guestfishCommandPath, strings.NewReader(script), 0700); err != nil {
+		return err
+	}
+	// guestfish splits the command line on spaces
+	argv := append(append(append([]string{}, c.Qemu...), strings.Fields(c.Shell)...), guestfishCommandPath)
+	for _, arg := range argv {
+		if strings.ContainsAny(arg, " \t\n\"'") {
+			return fmt.Errorf("guestfs builds can't run commands with %q, arguments of the qemu command line can't have spaces or quotes", arg)
+		}
+	}
+
+	go func() {
+		stdout := cmd.Stdout
+		if stdout == nil {
+			stdout = ioutil.Discard
+		}
+		exitStatus := 0
+		if err := runCommandTo(ctx, c.session.state, guestfishCommand(c.session.pid, "command", strings.Join(argv, " ")), stdout); err != nil {
+			// guestfish doesn't tell the exit status of the command
+			exitStatus = 1
+			if cmd.Stderr != nil {
+				fmt.Fprintln(cmd.Stderr, err)
+			}
+		}
+		c.session.run(context.TODO(), "rm-f", guestfishCommandPath)
+		log.Printf("Execution exited with '%d': '%s'", exitStatus, cmd.Command)
+		cmd.SetExited(exitStatus)
+	}()
+	return nil
+}
+
+// upload writes r to the file p of the image, owned by root with mode.
+func (c *guestfishCommunicator) upload(p string, r io.Reader, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile("", "guestfish")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	if _, err := c.session.run(ctx, "mkdir-p", path.Dir(p)); err != nil {
+		return err
+	}
+	if _, err := c.session.run(ctx, "upload", tmp.Name(), p); err != nil {
+		return err
+	}
+	_, err = c.session.run(ctx, "chmod", fmt.Sprintf("0%o", mode), p)
+	return err
+}
+
+func (c *guestfishCommunicator) Upload(dst string, r io.Reader, fi *os.FileInfo) error {
+	mode := os.FileMode(0644)
+	if fi != nil {
+		mode = (*fi).Mode().Perm()
+	}
+	return c.upload(path.Clean("/"+dst), r, mode)
+}
+
+func (c *guestfishCommunicator) UploadDir(dst string, src string, exclude []string) error {
+	// like cp -R, src/ copies the contents of src
+	if !strings.HasSuffix(src, "/") {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+	return filepath.Walk(src, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, local)
+		if err != nil {
+			return err
+		}
+		target := path.Clean("/" + path.Join(dst, filepath.ToSlash(rel)))
+		if info.IsDir() {
+			_, err := c.session.run(context.TODO(), "mkdir-p", target)
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			log.Printf("Skipping %s, only regular files can be copied to the image", local)
+			return nil
+		}
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.upload(target, f, info.Mode().Perm())
+	})
+}
+
+func (c *guestfishCommunicator) Download(src string, w io.Writer) error {
+	tmp, err := ioutil.TempFile("", "guestfish")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err := c.session.run(context.TODO(), "download", path.Clean("/"+src), tmp.Name()); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (c *guestfishCommunicator) DownloadDir(src string, dst string, exclude []string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	_, err := c.session.run(context.TODO(), "copy-out", path.Clean("/"+src), dst)
+	return err
+}
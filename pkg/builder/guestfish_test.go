@@ -0,0 +1,39 @@
+package builder
+
+import (
+	"testing"
+)
+
+func TestGuestfishCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"run"}, want: "guestfish --remote=42 -- 'run'"},
+		{args: []string{"mount", "/dev/sda2", "/"}, want: "guestfish --remote=42 -- 'mount' '/dev/sda2' '/'"},
+		{args: []string{"upload", "/tmp/with space", "/opt/$HOME`id`"}, want: "guestfish --remote=42 -- 'upload' '/tmp/with space' '/opt/$HOME`id`'"},
+		{args: []string{"mkdir-p", "/opt/it's"}, want: `guestfish --remote=42 -- 'mkdir-p' '/opt/it'"'"'s'`},
+	} {
+		if got := guestfishCommand("42", tc.args...); got != tc.want {
+			t.Errorf("guestfishCommand(%q) = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestGuestfishPid(t *testing.T) {
+	for _, tc := range []struct {
+		out, want string
+	}{
+		{out: "GUESTFISH_PID=1234; export GUESTFISH_PID\n", want: "1234"},
+		{out: "", want: ""},
+		{out: "GUESTFISH_PID=; export GUESTFISH_PID\n", want: ""},
+	} {
+		var got string
+		if match := guestfishPidRegexp.FindStringSubmatch(tc.out); match != nil {
+			got = match[1]
+		}
+		if got != tc.want {
+			t.Errorf("pid of %q = %q, want %q", tc.out, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package builder
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hostToolPackages are the Debian packages of the host tools builds run.
+var hostToolPackages = map[string]string{
+	"kpartx":      "kpartx",
+	"losetup":     "util-linux",
+	"mount":       "mount",
+	"umount":      "mount",
+	"blkid":       "util-linux",
+	"mkswap":      "util-linux",
+	"sfdisk":      "fdisk",
+	"e2fsck":      "e2fsprogs",
+	"resize2fs":   "e2fsprogs",
+	"dumpe2fs":    "e2fsprogs",
+	"debugfs":     "e2fsprogs",
+	"mkfs.ext4":   "e2fsprogs",
+	"fsck.vfat":   "dosfstools",
+	"mkfs.vfat":   "dosfstools",
+	"sgdisk":      "gdisk",
+	"mount.nfs":   "nfs-common",
+	"mount.cifs":  "cifs-utils",
+	"unsquashfs":  "squashfs-tools",
+	"mksquashfs":  "squashfs-tools",
+	"cryptsetup":  "cryptsetup",
+	"veritysetup": "cryptsetup-bin",
+	"qemu-img":    "qemu-utils",
+	"qemu-nbd":    "qemu-utils",
+	"tar":         "tar",
+	"ostree":      "ostree",
+	"docker":      "docker.io",
+	"proot":       "proot",
+	"fuse2fs":     "fuse2fs",
+	"fusefat":     "fusefat",
+	"guestfish":   "libguestfs-tools",
+	"mkimage":     "u-boot-tools",
+	"dtc":         "device-tree-compiler",
+	"aria2c":      "aria2",
+	"az":          "azure-cli",
+
+	"qemu-system-arm":     "qemu-system-arm",
+	"qemu-system-aarch64": "qemu-system-arm",
+	"qemu-system-riscv64": "qemu-system-misc",
+}
+
+// sbinDirs are searched too, they are often not in the PATH of users running packer with sudo
+// as the command_wrapper.
+var sbinDirs = []string{"/usr/sbin", "/sbin"}
+
+// requiredHostTools returns the host tools the steps of the build run, for the features that are
+// enabled. Tools that are only needed for some filesystems, like fatresize or xfs_growfs, are
+// checked once the filesystems are known.
+func (c *Config) requiredHostTools() []string {
+	var tools []string
+	// torrents are skipped without aria2c when other urls can be downloaded instead
+	torrentsOnly := true
+	for _, u := range c.ISOUrls {
+		torrentsOnly = torrentsOnly && isTorrentURL(u)
+	}
+	for _, u := range c.ISOUrls {
+		switch lower := strings.ToLower(u); {
+		case strings.HasPrefix(lower, "nfs://"):
+			tools = append(tools, "mount", "umount", "mount.nfs")
+		case strings.HasPrefix(lower, "smb://"):
+			tools = append(tools, "mount", "umount", "mount.cifs")
+		case isTorrentURL(u) && torrentsOnly:
+			tools = append(tools, "aria2c")
+		case isTorrentURL(u):
+		case isOCIURL(u):
+			tools = append(tools, "oras")
+		case isAzureCLIURL(u):
+			tools = append(tools, "az")
+		}
+	}
+	if c.rootfsArchive {
+		tools = append(tools, "tar")
+	}
+	if c.QcowCache != "" {
+		tools = append(tools, "qemu-img", "qemu-nbd")
+	}
+	if c.resizePartition {
+		tools = append(tools, "mkswap")
+	}
+	if c.resizeFilesystem {
+		tools = append(tools, "e2fsck", "resize2fs")
+	}
+	for _, p := range c.AddPartitions {
+		switch p.Filesystem {
+		case "vfat":
+			tools = append(tools, "mkfs.vfat")
+		case "swap":
+			tools = append(tools, "mkswap")
+		default:
+			tools = append(tools, "mkfs.ext4")
+		}
+	}
+	if c.ConvertToGpt {
+		tools = append(tools, "sgdisk")
+	}
+
+	switch {
+	case c.InjectFiles:
+		tools = append(tools, "debugfs", "blkid")
+	case c.Rootless && c.RootlessBackend == RootlessGuestfs:
+		tools = append(tools, "guestfish")
+	case c.Rootless:
+		tools = append(tools, "proot", "blkid", "fuse2fs", "fusefat")
+	case c.PartitionMapper == MapperLosetup:
+		tools = append(tools, "losetup", "mount", "umount", "blkid")
+	default:
+		tools = append(tools, "kpartx", "losetup", "mount", "umount", "blkid")
+	}
+
+	if c.RepackSquashfs {
+		tools = append(tools, "unsquashfs", "mksquashfs", "sfdisk")
+	}
+	if c.EncryptRoot {
+		tools = append(tools, "cryptsetup", "e2fsck", "resize2fs")
+	}
+	if c.DmVerity != nil {
+		tools = append(tools, "veritysetup", "dumpe2fs", "mount", "umount")
+	}
+	if c.FitImage != nil {
+		tools = append(tools, "mkimage", "dtc")
+	}
+	if c.OstreeCommit != nil {
+		tools = append(tools, "ostree")
+	}
+	if c.ContainerImage != "" {
+		tools = append(tools, "docker")
+	}
+	if c.ShrinkImage {
+		tools = append(tools, "e2fsck", "resize2fs", "dumpe2fs")
+	}
+	if c.FsckPartitions || c.VerifyImage {
+		tools = append(tools, "e2fsck", "fsck.vfat")
+	}
+	if c.VerifyImage && c.PartitionMapper != MapperLosetup {
+		tools = append(tools, "kpartx")
+	}
+	if c.OciPush != "" {
+		tools = append(tools, "oras")
+	}
+	if c.BootTest {
+		tools = append(tools, "qemu-img", c.BootTestQemu)
+	}
+	return tools
+}
+
+// lookHostTool finds a host tool in the PATH or the sbin directories.
+func lookHostTool(tool string) bool {
+	if _, err := exec.LookPath(tool); err == nil {
+		return true
+	}
+	for _, dir := range sbinDirs {
+		if _, err := exec.LookPath(filepath.Join(dir, tool)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHostTools returns an error listing the missing tools and the packages to install, so a
+// build doesn't fail half way through for a missing tool.
+func checkHostTools(tools []string) error {
+	missing := map[string]bool{}
+	packages := map[string]bool{}
+	for _, tool := range tools {
+		if missing[tool] || lookHostTool(tool) {
+			continue
+		}
+		missing[tool] = true
+		if pkg, ok := hostToolPackages[filepath.Base(tool)]; ok {
+			packages[pkg] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("host tools not found: %s. Install them with: apt-get install %s",
+		strings.Join(sortedKeys(missing), ", "), strings.Join(sortedKeys(packages), " "))
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
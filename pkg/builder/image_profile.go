@@ -0,0 +1,193 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/image/utils"
+)
+
+// imageProfile describes an image type in an image_profiles file, so boards can be supported
+// without adding them to knownTypes. The profiles are kept on the Config they are loaded for,
+// and looked up before the built-in image types. for example:
+//
+//	{
+//	  "name": "odroid-c4",
+//	  "url_patterns": ["odroid-c4", "odroidc4"],
+//	  "image_mounts": ["/boot", "/"],
+//	  "qemu_binary": "qemu-aarch64-static",
+//	  "cmdline_files": ["/boot/boot.ini"]
+//	}
+type imageProfile struct {
+	// the image_type value of the profile
+	Name string `json:"name"`
+	// the profile is picked when the image url contains one of these and image_type is not set
+	UrlPatterns []string `json:"url_patterns"`
+	// the default image_mounts
+	ImageMounts []string `json:"image_mounts"`
+	// the default chroot_mounts, the builder defaults if empty
+	ChrootMounts [][]string `json:"chroot_mounts"`
+	// the default qemu_binary
+	QemuBinary string `json:"qemu_binary"`
+	// the default qemu_args
+	QemuArgs []string `json:"qemu_args"`
+	// where the kernel command line is in the image, the first one found is used
+	CmdlineFiles []string `json:"cmdline_files"`
+}
+
+// loadImageProfiles reads the profiles in paths, which are either json files or directories
+// of json files.
+func loadImageProfiles(paths []string) ([]imageProfile, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	var profiles []imageProfile
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var profile imageProfile
+		if err := json.Unmarshal(data, &profile); err != nil {
+			return nil, fmt.Errorf("error parsing image profile %s: %v", file, err)
+		}
+		if err := profile.validate(); err != nil {
+			return nil, fmt.Errorf("invalid image profile %s: %v", file, err)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func (p imageProfile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(p.ImageMounts) == 0 {
+		return fmt.Errorf("image_mounts is required")
+	}
+	for _, m := range p.ChrootMounts {
+		if len(m) != 3 {
+			return fmt.Errorf("chroot_mounts entries must be triplets of [type, device, mntpoint]")
+		}
+	}
+	return nil
+}
+
+// matches tells if the image url is of this profile.
+func (p imageProfile) matches(url string) bool {
+	for _, pattern := range p.UrlPatterns {
+		if strings.Contains(url, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkImageProfiles returns an error if profiles define an image type twice, or a built-in one.
+func checkImageProfiles(profiles []imageProfile) error {
+	names := map[string]bool{}
+	for _, p := range profiles {
+		if _, ok := knownTypes[utils.KnownImageType(p.Name)]; ok || names[p.Name] {
+			return fmt.Errorf("image type %s of the image profile is already defined", p.Name)
+		}
+		names[p.Name] = true
+	}
+	return nil
+}
+
+// profileOf returns the image profile of imageType, if it is one.
+func (c *Config) profileOf(imageType utils.KnownImageType) (imageProfile, bool) {
+	for _, p := range c.profiles {
+		if utils.KnownImageType(p.Name) == imageType {
+			return p, true
+		}
+	}
+	return imageProfile{}, false
+}
+
+// isKnownImageType tells if imageType is an image profile or a built-in image type.
+func (c *Config) isKnownImageType(imageType utils.KnownImageType) bool {
+	if _, ok := c.profileOf(imageType); ok {
+		return true
+	}
+	_, ok := knownTypes[imageType]
+	return ok
+}
+
+// knownImageTypes returns the image types image_type can be.
+func (c *Config) knownImageTypes() []utils.KnownImageType {
+	var types []utils.KnownImageType
+	for k := range knownTypes {
+		types = append(types, k)
+	}
+	for _, p := range c.profiles {
+		types = append(types, utils.KnownImageType(p.Name))
+	}
+	return types
+}
+
+// imageMountsOf returns the default image_mounts of an image type.
+func (c *Config) imageMountsOf(imageType utils.KnownImageType) []string {
+	if p, ok := c.profileOf(imageType); ok {
+		return p.ImageMounts
+	}
+	return knownTypes[imageType]
+}
+
+// qemuBinaryOf returns the qemu binary of an image type, if it has its own.
+func (c *Config) qemuBinaryOf(imageType utils.KnownImageType) (string, bool) {
+	if p, ok := c.profileOf(imageType); ok {
+		return p.QemuBinary, p.QemuBinary != ""
+	}
+	qemu, ok := knownQemuBinaries[imageType]
+	return qemu, ok
+}
+
+// qemuArgsOf returns the default qemu_args of an image type.
+func (c *Config) qemuArgsOf(imageType utils.KnownImageType) []string {
+	if p, ok := c.profileOf(imageType); ok {
+		return p.QemuArgs
+	}
+	return knownArgs[imageType]
+}
+
+// chrootMountsOf returns the default chroot_mounts of an image type, if it has its own.
+func (c *Config) chrootMountsOf(imageType utils.KnownImageType) ([][]string, bool) {
+	if p, ok := c.profileOf(imageType); ok {
+		return p.ChrootMounts, len(p.ChrootMounts) > 0
+	}
+	mounts, ok := defaultChrootTypes[imageType]
+	return mounts, ok
+}
+
+// cmdlineFilesOf returns where the kernel command line of an image type may be.
+func (c *Config) cmdlineFilesOf(imageType utils.KnownImageType) []string {
+	if p, ok := c.profileOf(imageType); ok && len(p.CmdlineFiles) > 0 {
+		return p.CmdlineFiles
+	}
+	if files, ok := knownCmdlineFiles[imageType]; ok {
+		return files
+	}
+	return defaultCmdlineFiles
+}
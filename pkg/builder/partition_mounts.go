@@ -0,0 +1,288 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// skipMount marks a partition in image_mounts or partition_mounts that should not be mounted,
+// like swap, recovery or vendor blob partitions.
+const skipMount = "skip"
+
+// partitionSelector identifies an image partition in partition_mounts, either by its
+// number in the partition table, its filesystem LABEL, its GPT PARTLABEL or, for LVM
+// logical volumes, its vg/lv name.
+type partitionSelector struct {
+	Number    int
+	Label     string
+	PartLabel string
+	LV        string
+}
+
+func parsePartitionSelector(key string) (partitionSelector, error) {
+	switch {
+	case strings.HasPrefix(key, "LABEL="):
+		if label := strings.TrimPrefix(key, "LABEL="); label != "" {
+			return partitionSelector{Label: label}, nil
+		}
+	case strings.HasPrefix(key, "PARTLABEL="):
+		if label := strings.TrimPrefix(key, "PARTLABEL="); label != "" {
+			return partitionSelector{PartLabel: label}, nil
+		}
+	case strings.HasPrefix(key, "LV="):
+		if lv := strings.TrimPrefix(key, "LV="); strings.Count(lv, "/") == 1 {
+			return partitionSelector{LV: lv}, nil
+		}
+	default:
+		if n, err := strconv.Atoi(key); err == nil && n > 0 {
+			return partitionSelector{Number: n}, nil
+		}
+	}
+	return partitionSelector{}, fmt.Errorf("invalid partition %q, must be a partition number, LABEL=<label>, PARTLABEL=<label> or LV=<vg>/<lv>", key)
+}
+
+func (p partitionSelector) String() string {
+	switch {
+	case p.Label != "":
+		return "LABEL=" + p.Label
+	case p.PartLabel != "":
+		return "PARTLABEL=" + p.PartLabel
+	case p.LV != "":
+		return "LV=" + p.LV
+	}
+	return strconv.Itoa(p.Number)
+}
+
+// matches tells if the selector matches a partition. logical volumes have no number
+// and an lv of the form vg/lv, partitions have an empty lv.
+func (p partitionSelector) matches(number int, lv string, info *utils.BlkidInfo) bool {
+	switch {
+	case p.LV != "":
+		return lv == p.LV
+	case p.Label != "":
+		return info.Label() == p.Label
+	case p.PartLabel != "":
+		return info.PartLabel() == p.PartLabel
+	}
+	return p.Number == number
+}
+
+func validatePartitionMounts(partitionMounts map[string]string) []error {
+	var errs []error
+	roots := 0
+	for k, v := range partitionMounts {
+		if _, err := parsePartitionSelector(k); err != nil {
+			errs = append(errs, err)
+		}
+		if v != "" && v != skipMount && !filepath.IsAbs(v) {
+			errs = append(errs, fmt.Errorf("mount point %q of partition %s must be an absolute path", v, k))
+		}
+		if v == "/" {
+			roots++
+		}
+	}
+	if roots != 1 {
+		errs = append(errs, fmt.Errorf("partition_mounts must mount exactly one partition at /"))
+	}
+	return errs
+}
+
+// resolvePartitionMounts matches the mapped partitions against partition_mounts and returns
+// the mount point of each partition. Partitions that are not selected or are skipped get an
+// empty mount point.
+func resolvePartitionMounts(blkid blkidFunc, partitionMounts map[string]string, partitions []string) ([]string, error) {
+	mounts := make([]string, len(partitions))
+	matchedBy := make([]string, len(partitions))
+	skipped := make([]bool, len(partitions))
+	infos := make([]*utils.BlkidInfo, len(partitions))
+
+	for key, mnt := range partitionMounts {
+		selector, err := parsePartitionSelector(key)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for i, part := range partitions {
+			number := 0
+			lv, isLV := logicalVolumeName(part)
+			if !isLV {
+				number, err = partitionNumber(part)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if (selector.Label != "" || selector.PartLabel != "") && infos[i] == nil {
+				infos[i], err = blkid(part)
+				if err != nil {
+					return nil, fmt.Errorf("error running blkid on %s: %v", part, err)
+				}
+			}
+			if !selector.matches(number, lv, infos[i]) {
+				continue
+			}
+			if found {
+				return nil, fmt.Errorf("more than one partition matches %s", selector)
+			}
+			found = true
+			// skipping a partition wins over any other selector matching it
+			if mnt == skipMount {
+				skipped[i] = true
+				mounts[i] = ""
+				continue
+			}
+			if skipped[i] {
+				continue
+			}
+			if matchedBy[i] != "" && mounts[i] != mnt {
+				return nil, fmt.Errorf("partition %s is selected by both %s and %s", part, matchedBy[i], selector)
+			}
+			mounts[i] = mnt
+			matchedBy[i] = selector.String()
+		}
+		if !found {
+			return nil, fmt.Errorf("no partition matches %s", selector)
+		}
+	}
+	return mounts, nil
+}
+
+// wksPartitionMounts returns the partition_mounts of the partitions the part lines of a .wks file
+// mount, by partition number.
+func wksPartitionMounts(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	wks, err := utils.ParseWks(data)
+	if err != nil {
+		return nil, err
+	}
+	if root := wks.Root(); root == nil || root.Number == 0 {
+		return nil, fmt.Errorf("no partition of %s is mounted at /", file)
+	}
+	mounts := make(map[string]string)
+	for _, p := range wks.Partitions {
+		if p.Number != 0 && filepath.IsAbs(p.Mountpoint) {
+			mounts[strconv.Itoa(p.Number)] = p.Mountpoint
+		}
+	}
+	return mounts, nil
+}
+
+// buildrootMounts mounts the images genimage makes for Buildroot: the first ext partition at /,
+// and a FAT partition before it at /boot. Bootloaders written at an offset, like the SPL of
+// sunxi boards, aren't partitions. Other partitions are left unmounted.
+func buildrootMounts(blkid blkidFunc, partitions []string) ([]string, error) {
+	mounts := make([]string, len(partitions))
+	boot := -1
+	for i, p := range partitions {
+		info, err := blkid(p)
+		if err != nil {
+			return nil, fmt.Errorf("error running blkid on %s: %v", p, err)
+		}
+		switch fstype := info.Type(); {
+		case fstype == "vfat" && boot < 0:
+			boot = i
+		case strings.HasPrefix(fstype, "ext"):
+			if boot >= 0 {
+				mounts[boot] = "/boot"
+			}
+			mounts[i] = "/"
+			return mounts, nil
+		}
+	}
+	return nil, fmt.Errorf("no ext partition to mount at /")
+}
+
+// layoutMounts finds the default image_mounts of images whose type is unknown: the first Linux
+// filesystem is mounted at /, and a FAT partition before it at /boot, until stepMountImage reads
+// the fstab of the image, see followFstab.
+func layoutMounts(blkid blkidFunc, partitions []string) ([]string, error) {
+	mounts := make([]string, len(partitions))
+	boot := -1
+	for i, p := range partitions {
+		info, err := blkid(p)
+		if err != nil {
+			return nil, fmt.Errorf("error running blkid on %s: %v", p, err)
+		}
+		switch fstype := info.Type(); {
+		case fstype == "vfat" && boot < 0:
+			boot = i
+		case strings.HasPrefix(fstype, "ext"), fstype == "btrfs", fstype == "xfs", fstype == "f2fs":
+			if boot >= 0 {
+				mounts[boot] = "/boot"
+			}
+			mounts[i] = "/"
+			return mounts, nil
+		}
+	}
+	return nil, fmt.Errorf("no Linux filesystem to mount at /, set image_mounts or partition_mounts")
+}
+
+// fstabMounts returns where the fstab of the image mounted at rootDir mounts partitions, by
+// partition. Partitions are found by their UUID, LABEL, PARTUUID or PARTLABEL, device names
+// aren't the ones of the host.
+func fstabMounts(blkid blkidFunc, rootDir string, partitions []string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rootDir, "/etc/fstab"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := utils.ParseFstab(data)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := map[string]string{}
+	for _, p := range partitions {
+		info, err := blkid(p)
+		if err != nil {
+			return nil, fmt.Errorf("error running blkid on %s: %v", p, err)
+		}
+		for _, e := range entries {
+			if e.VfsType != "swap" && e.File != "/" && strings.HasPrefix(e.File, "/") && fstabRefersTo(e.Spec, info) {
+				mounts[p] = filepath.Clean(e.File)
+				break
+			}
+		}
+	}
+	return mounts, nil
+}
+
+// fstabRefersTo tells if the spec of an fstab entry is the partition blkid reported info of.
+func fstabRefersTo(spec string, info *utils.BlkidInfo) bool {
+	refs := []struct {
+		prefix, value string
+		// UUIDs are hexadecimal, in either case
+		fold bool
+	}{
+		{"UUID=", info.UUID(), true},
+		{"/dev/disk/by-uuid/", info.UUID(), true},
+		{"PARTUUID=", info.PartUUID(), true},
+		{"/dev/disk/by-partuuid/", info.PartUUID(), true},
+		{"LABEL=", info.Label(), false},
+		{"/dev/disk/by-label/", info.Label(), false},
+		{"PARTLABEL=", info.PartLabel(), false},
+		{"/dev/disk/by-partlabel/", info.PartLabel(), false},
+	}
+	for _, ref := range refs {
+		if !strings.HasPrefix(spec, ref.prefix) {
+			continue
+		}
+		value := strings.Trim(strings.TrimPrefix(spec, ref.prefix), `"`)
+		if ref.fold {
+			return ref.value != "" && strings.EqualFold(value, ref.value)
+		}
+		return ref.value != "" && value == ref.value
+	}
+	return false
+}
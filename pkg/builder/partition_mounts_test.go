@@ -0,0 +1,146 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// fakeBlkid reports the blkid values of partitions by device.
+func fakeBlkid(values map[string]map[string]string) blkidFunc {
+	return func(dev string) (*utils.BlkidInfo, error) {
+		v, ok := values[dev]
+		if !ok {
+			return nil, fmt.Errorf("no such device %s", dev)
+		}
+		return &utils.BlkidInfo{Values: v}, nil
+	}
+}
+
+var testPartitions = []string{"/dev/mapper/loop0p1", "/dev/mapper/loop0p2", "/dev/mapper/loop0p3"}
+
+var testBlkid = fakeBlkid(map[string]map[string]string{
+	"/dev/mapper/loop0p1": {"TYPE": "vfat", "LABEL": "boot", "UUID": "1234-ABCD", "PARTUUID": "deadbeef-01"},
+	"/dev/mapper/loop0p2": {"TYPE": "ext4", "LABEL": "rootfs", "UUID": "0b7d4b36-1c2e-4f5a-9b3c-2a1d6e8f9c01", "PARTUUID": "deadbeef-02", "PARTLABEL": "root"},
+	"/dev/mapper/loop0p3": {"TYPE": "ext4", "LABEL": "data", "UUID": "5e8a1c2d-3b4f-4a6e-8c9d-0f1e2d3c4b5a", "PARTUUID": "deadbeef-03"},
+})
+
+func TestResolvePartitionMounts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mounts  map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "numbers", mounts: map[string]string{"1": "/boot", "2": "/"}, want: []string{"/boot", "/", ""}},
+		{name: "labels", mounts: map[string]string{"LABEL=boot": "/boot", "LABEL=rootfs": "/", "LABEL=data": "/data"}, want: []string{"/boot", "/", "/data"}},
+		{name: "partlabel", mounts: map[string]string{"PARTLABEL=root": "/"}, want: []string{"", "/", ""}},
+		{name: "same mount twice", mounts: map[string]string{"2": "/", "LABEL=rootfs": "/"}, want: []string{"", "/", ""}},
+		{name: "skip wins", mounts: map[string]string{"2": "/", "3": "/data", "LABEL=data": "skip"}, want: []string{"", "/", ""}},
+		{name: "conflicting selectors", mounts: map[string]string{"2": "/", "LABEL=rootfs": "/root"}, wantErr: true},
+		{name: "no match", mounts: map[string]string{"LABEL=missing": "/"}, wantErr: true},
+		{name: "number out of range", mounts: map[string]string{"4": "/"}, wantErr: true},
+		{name: "invalid selector", mounts: map[string]string{"UUID=1234": "/"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolvePartitionMounts(testBlkid, tc.mounts, testPartitions)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("resolvePartitionMounts(%v) = %v, want an error", tc.mounts, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("resolvePartitionMounts(%v) = %q, want %q", tc.mounts, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDefaultMounts(t *testing.T) {
+	blkid := fakeBlkid(map[string]map[string]string{
+		"/dev/vfat":  {"TYPE": "vfat"},
+		"/dev/vfat2": {"TYPE": "vfat"},
+		"/dev/ext4":  {"TYPE": "ext4"},
+		"/dev/btrfs": {"TYPE": "btrfs"},
+		"/dev/swap":  {"TYPE": "swap"},
+		"/dev/raw":   {},
+	})
+	for _, tc := range []struct {
+		name                    string
+		partitions              []string
+		buildroot, layout       []string
+		buildrootErr, layoutErr bool
+	}{
+		{name: "boot and root", partitions: []string{"/dev/vfat", "/dev/ext4"},
+			buildroot: []string{"/boot", "/"}, layout: []string{"/boot", "/"}},
+		{name: "bootloader partition first", partitions: []string{"/dev/raw", "/dev/vfat", "/dev/vfat2", "/dev/ext4", "/dev/swap"},
+			buildroot: []string{"", "/boot", "", "/", ""}, layout: []string{"", "/boot", "", "/", ""}},
+		{name: "root only", partitions: []string{"/dev/swap", "/dev/ext4"},
+			buildroot: []string{"", "/"}, layout: []string{"", "/"}},
+		{name: "btrfs root", partitions: []string{"/dev/vfat", "/dev/btrfs"},
+			buildrootErr: true, layout: []string{"/boot", "/"}},
+		{name: "no root", partitions: []string{"/dev/vfat", "/dev/swap"},
+			buildrootErr: true, layoutErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := buildrootMounts(blkid, tc.partitions)
+			if tc.buildrootErr != (err != nil) || !reflect.DeepEqual(got, tc.buildroot) && err == nil {
+				t.Errorf("buildrootMounts(%v) = %q, %v, want %q", tc.partitions, got, err, tc.buildroot)
+			}
+			got, err = layoutMounts(blkid, tc.partitions)
+			if tc.layoutErr != (err != nil) || !reflect.DeepEqual(got, tc.layout) && err == nil {
+				t.Errorf("layoutMounts(%v) = %q, %v, want %q", tc.partitions, got, err, tc.layout)
+			}
+		})
+	}
+}
+
+func TestFstabMounts(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		fstab string
+		want  map[string]string
+	}{
+		{name: "uuid and label",
+			fstab: "UUID=0B7D4B36-1C2E-4F5A-9B3C-2A1D6E8F9C01 / ext4 defaults 0 1\n" +
+				"LABEL=boot /boot/firmware vfat defaults 0 2\n" +
+				"/dev/disk/by-uuid/5e8a1c2d-3b4f-4a6e-8c9d-0f1e2d3c4b5a /data/ ext4 defaults 0 2\n",
+			want: map[string]string{"/dev/mapper/loop0p1": "/boot/firmware", "/dev/mapper/loop0p3": "/data"}},
+		{name: "partuuid",
+			fstab: "PARTUUID=deadbeef-01 /boot vfat defaults 0 2\nPARTUUID=deadbeef-02 / ext4 defaults 0 1\n",
+			want:  map[string]string{"/dev/mapper/loop0p1": "/boot"}},
+		{name: "device names and swap aren't followed",
+			fstab: "/dev/mmcblk0p1 /boot vfat defaults 0 2\nLABEL=data none swap sw 0 0\nproc /proc proc defaults 0 0\n",
+			want:  map[string]string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fstab")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "etc", "fstab"), []byte(tc.fstab), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := fstabMounts(testBlkid, dir, testPartitions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("fstabMounts() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
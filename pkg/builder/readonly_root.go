@@ -0,0 +1,108 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+)
+
+// readOnlyFilesystems are the filesystems of root partitions that can't be written to, like the
+// system slots of Home Assistant OS.
+var readOnlyFilesystems = map[string]bool{"squashfs": true, "erofs": true}
+
+// the labels of the partitions read-only root filesystems are overlaid with at boot, like the
+// rootfs_data partition of OpenWrt
+var knownOverlayLabels = map[string]bool{"rootfs_data": true, "overlay": true}
+
+// noRootOverlay turns off finding the overlay partition, see root_overlay_partition
+const noRootOverlay = "none"
+
+// mountReadOnlyRoot mounts a read-only root filesystem under an overlay at mntpnt, so the chroot
+// can be set up and provisioned. The upper directory of the overlay is the one of the overlay
+// partition, when the image has one, so what provisioners write lands where the device finds it
+// at boot. Otherwise it is on a tmpfs and what is written to the root filesystem itself is
+// discarded at unmount; only the partitions mounted on top of it, like the data partition, keep
+// what provisioners write.
+func (s *stepMountImage) mountReadOnlyRoot(ctx context.Context, state multistep.StateBag, dev, fstype, mntpnt, overlay, upperdir string) error {
+	dir, err := ioutil.TempDir("", "packer-overlay")
+	if err != nil {
+		return err
+	}
+	s.overlayDirs = append(s.overlayDirs, dir)
+
+	top := dir
+	if overlay == "" {
+		if err := run(ctx, state, "mount -t tmpfs tmpfs "+dir); err != nil {
+			return err
+		}
+		s.mountpoints = append(s.mountpoints, dir)
+	} else {
+		top = filepath.Join(dir, "overlay")
+		if err := os.Mkdir(top, 0755); err != nil {
+			return err
+		}
+		if err := run(ctx, state, fmt.Sprintf("mount %s %s", overlay, top)); err != nil {
+			return err
+		}
+		s.mountpoints = append(s.mountpoints, top)
+	}
+	lower, upper := filepath.Join(dir, "lower"), filepath.Join(top, upperdir)
+	work := filepath.Join(filepath.Dir(upper), "work")
+	for _, d := range []string{lower, upper, work} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := run(ctx, state, fmt.Sprintf("mount -t %s -o ro %s %s", fstype, dev, lower)); err != nil {
+		return err
+	}
+	s.mountpoints = append(s.mountpoints, lower)
+	if err := run(ctx, state, fmt.Sprintf("mount -t overlay overlay -o lowerdir=%s,upperdir=%s,workdir=%s %s", lower, upper, work, mntpnt)); err != nil {
+		return err
+	}
+	s.mountpoints = append(s.mountpoints, mntpnt)
+	return nil
+}
+
+// rootOverlayPartition returns the partition holding the upper directory of the overlay of a
+// read-only root filesystem: the one root_overlay_partition selects, or else the one labeled like
+// a known overlay partition. It returns "" when there is none.
+func rootOverlayPartition(blkid blkidFunc, config *Config, partitions []string) (string, error) {
+	switch config.RootOverlayPartition {
+	case noRootOverlay:
+		return "", nil
+	case "":
+		for _, p := range partitions {
+			info, err := blkid(p)
+			if err != nil {
+				return "", fmt.Errorf("error running blkid on %s: %v", p, err)
+			}
+			if knownOverlayLabels[info.Label()] {
+				return p, nil
+			}
+		}
+		return "", nil
+	}
+	mounts, err := resolvePartitionMounts(blkid, map[string]string{config.RootOverlayPartition: "overlay"}, partitions)
+	if err != nil {
+		return "", err
+	}
+	for i, mnt := range mounts {
+		if mnt != "" {
+			return partitions[i], nil
+		}
+	}
+	return "", nil
+}
+
+// removeOverlayDir removes the directory of an overlay of mountReadOnlyRoot, once unmounted.
+func removeOverlayDir(dir string) {
+	os.Remove(filepath.Join(dir, "lower"))
+	os.Remove(filepath.Join(dir, "overlay"))
+	os.Remove(dir)
+}
@@ -0,0 +1,297 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	osutils "github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// Rootless builds mount the partitions with fuse2fs and fusefat, straight from the image file.
+// The chroot commands run with proot, which runs the foreign binaries through qemu by itself, so
+// no loop device, mount or binfmt_misc registration needs root. The guestfs backend mounts
+// nothing on the host, see stepGuestfishProvision.
+
+// Backends of rootless builds.
+const (
+	RootlessFuse    = "fuse"
+	RootlessGuestfs = "guestfs"
+)
+
+// prootCommand is the host command that runs cmds with shell in the image mounted at root. qemu
+// is the qemu command line foreign binaries are run with, if any.
+func prootCommand(root, qemu, shell, cmds string) string {
+	var qemuOpt string
+	if qemu != "" {
+		qemuOpt = "-q " + shellQuote(qemu) + " "
+	}
+	return fmt.Sprintf("proot -0 -r %s %s-b /dev -b /proc -b /sys -w / %s -c %s",
+		shellQuote(root), qemuOpt, shell, shellQuote(cmds))
+}
+
+// prootQemu is the qemu command line of rootless builds, set by stepPrepareProot.
+func prootQemu(state multistep.StateBag) string {
+	if qemu, ok := state.GetOk("proot_qemu"); ok {
+		return qemu.(string)
+	}
+	return ""
+}
+
+// stepPrepareProot renders the qemu command line proot runs the binaries of the image with.
+type stepPrepareProot struct {
+	ChrootKey string
+}
+
+func (s *stepPrepareProot) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	chrootDir := state.Get(s.ChrootKey).(string)
+
+	args, err := renderQemuArgs(state, chrootDir)
+	if err != nil {
+		err := fmt.Errorf("Error rendering qemu_args: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("proot_qemu", strings.Join(append([]string{config.QemuBinary}, args...), " "))
+	return multistep.ActionContinue
+}
+
+func (s *stepPrepareProot) Cleanup(state multistep.StateBag) {}
+
+// stepUserMountImage mounts the partitions of the image without root. fuse2fs mounts ext
+// filesystems at their offset in the image. fusefat can't, so FAT partitions are copied to a
+// file that is mounted, and copied back into the image once unmounted.
+//
+// Produces:
+//
+//	boot_mount string - Where the first FAT partition is mounted in the chroot, if any
+//	mount_image_cleanup CleanupFunc - To perform early cleanup
+type stepUserMountImage struct {
+	ImageKey  string
+	ResultKey string
+	MountPath string
+
+	imagefile string
+	mounts    []*userMount
+	// the first FAT partition, 1 based, and its mount point
+	bootNumber int
+	bootMount  string
+}
+
+type userMount struct {
+	path string
+	fuse *exec.Cmd
+	// the FAT partition copied out of the image, and where it goes back
+	extracted      string
+	offset, length int64
+}
+
+func (s *stepUserMountImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	s.imagefile = state.Get(s.ImageKey).(string)
+
+	if err := s.mount(ui, config); err != nil {
+		err := fmt.Errorf("Error mounting image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put(s.ResultKey, s.MountPath)
+	if s.bootMount != "" {
+		state.Put("boot_mount", s.bootMount)
+	}
+	state.Put("mount_image_cleanup", s)
+	return multistep.ActionContinue
+}
+
+func (s *stepUserMountImage) mount(ui packer.Ui, config *Config) error {
+	table, err := osutils.ReadPartitionTable(s.imagefile)
+	if err != nil {
+		return fmt.Errorf("error reading the partition table: %s", err)
+	}
+	if len(table.Partitions) != len(config.ImageMounts) {
+		return fmt.Errorf("the image has %d partitions but image_mounts has %d", len(table.Partitions), len(config.ImageMounts))
+	}
+
+	if s.MountPath != "" {
+		if err := os.MkdirAll(s.MountPath, os.ModePerm); err != nil {
+			return err
+		}
+	} else {
+		tempDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			return err
+		}
+		s.MountPath = tempDir
+	}
+
+	// / is mounted before /boot
+	order := make([]int, len(table.Partitions))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return config.ImageMounts[order[i]] < config.ImageMounts[order[j]] })
+
+	for _, i := range order {
+		mnt := config.ImageMounts[i]
+		if mnt == "" || mnt == skipMount {
+			continue
+		}
+		p := table.Partitions[i]
+		m := &userMount{
+			path:   filepath.Join(s.MountPath, mnt),
+			offset: int64(p.Start * table.SectorSize),
+			length: int64(p.Size * table.SectorSize),
+		}
+
+		info, err := osutils.ProbeBlkid(s.imagefile, uint64(m.offset), uint64(m.length))
+		if err != nil {
+			return fmt.Errorf("error running blkid on partition %d: %s", i+1, err)
+		}
+		ui.Message(fmt.Sprintf("Mounting partition %d (%s) on %s", i+1, info.Type(), mnt))
+		switch info.Type() {
+		case "ext2", "ext3", "ext4":
+			m.fuse = exec.Command("fuse2fs", "-f", "-o", fmt.Sprintf("fakeroot,offset=%d", m.offset), s.imagefile, m.path)
+		case "vfat":
+			if m.extracted, err = s.extract(m); err != nil {
+				return err
+			}
+			m.fuse = exec.Command("fusefat", "-f", "-o", "rw+", m.extracted, m.path)
+			if s.bootNumber == 0 || i+1 < s.bootNumber {
+				s.bootNumber, s.bootMount = i+1, mnt
+			}
+		default:
+			return fmt.Errorf("rootless builds can't mount the %q filesystem of partition %d", info.Type(), i+1)
+		}
+
+		s.mounts = append(s.mounts, m)
+		if err := m.fuse.Start(); err != nil {
+			err = fmt.Errorf("error starting %s: %s", m.fuse.Path, err)
+			m.fuse = nil
+			return err
+		}
+		if err := waitMounted(m.path, 10*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract copies the partition of m out of the image.
+func (s *stepUserMountImage) extract(m *userMount) (string, error) {
+	img, err := os.Open(s.imagefile)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(s.imagefile), "partition")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, io.NewSectionReader(img, m.offset, m.length)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeBack copies an extracted partition back into the image.
+func (s *stepUserMountImage) writeBack(m *userMount) error {
+	part, err := os.Open(m.extracted)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	img, err := os.OpenFile(s.imagefile, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if _, err := img.Seek(m.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(img, io.LimitReader(part, m.length)); err != nil {
+		return err
+	}
+	return img.Sync()
+}
+
+// waitMounted waits for a fuse filesystem started in the foreground to show up at path.
+func waitMounted(path string, timeout time.Duration) error {
+	for start := time.Now(); time.Since(start) < timeout; {
+		mounts, err := ioutil.ReadFile("/proc/self/mounts")
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(mounts), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[1] == path {
+				return nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("%s didn't get mounted", path)
+}
+
+func (s *stepUserMountImage) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *stepUserMountImage) CleanupFunc(state multistep.StateBag) error {
+	if s.MountPath == "" {
+		return nil
+	}
+
+	var umountErr error
+	for i := len(s.mounts) - 1; i >= 0; i-- {
+		m := s.mounts[i]
+		unmounted := false
+		if m.fuse != nil {
+			if err := run(context.TODO(), state, "fusermount -u "+m.path); err != nil {
+				if umountErr == nil {
+					umountErr = err
+				}
+			} else {
+				// the filesystem is only flushed once the fuse process exits
+				m.fuse.Wait()
+				unmounted = true
+			}
+		}
+		if m.extracted != "" {
+			if unmounted {
+				if err := s.writeBack(m); err != nil {
+					umountErr = fmt.Errorf("error writing partition back to the image: %s", err)
+				}
+			}
+			os.Remove(m.extracted)
+		}
+	}
+	s.mounts = nil
+	err := os.Remove(s.MountPath)
+	s.MountPath = ""
+	if umountErr != nil {
+		return umountErr
+	}
+	return err
+}
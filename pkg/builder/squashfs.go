@@ -0,0 +1,220 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// squashfsPartition is a squashfs partition unpacked for provisioning, see repack_squashfs.
+type squashfsPartition struct {
+	Device string
+	// the scratch directory, the filesystem is unpacked to its root subdirectory
+	Dir        string
+	Superblock *utils.SquashfsSuperblock
+}
+
+func (p *squashfsPartition) root() string { return filepath.Join(p.Dir, "root") }
+
+// unpackSquashfs unpacks the squashfs filesystem of dev to a scratch directory and bind mounts
+// it at mntpnt, so it can be provisioned like a writable filesystem. stepRepackSquashfs writes
+// it back once the image is unmounted.
+func (s *stepMountImage) unpackSquashfs(ctx context.Context, state multistep.StateBag, dev, mntpnt string) error {
+	f, err := os.Open(dev)
+	if err != nil {
+		return err
+	}
+	sb, err := utils.ReadSquashfsSuperblock(f, 0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "packer-squashfs")
+	if err != nil {
+		return err
+	}
+	p := &squashfsPartition{Device: dev, Dir: dir, Superblock: sb}
+	s.squashfs = append(s.squashfs, p)
+
+	if err := run(ctx, state, fmt.Sprintf("unsquashfs -no-progress -d %s %s", p.root(), dev)); err != nil {
+		return err
+	}
+	if err := run(ctx, state, fmt.Sprintf("mount --bind %s %s", p.root(), mntpnt)); err != nil {
+		return err
+	}
+	s.mountpoints = append(s.mountpoints, mntpnt)
+	state.Put("squashfs_partitions", s.squashfs)
+	return nil
+}
+
+// stepRepackSquashfs packs the squashfs partitions stepMountImage unpacked again, with their
+// compression and block size, and writes them back to the image. A partition too small for its
+// new filesystem is grown first: the last partition in place, and primary MBR partitions by
+// moving the partitions after them. The image must be unmapped.
+type stepRepackSquashfs struct {
+	ImageKey string
+}
+
+func (s *stepRepackSquashfs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.ImageKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	raw, ok := state.GetOk("squashfs_partitions")
+	if !ok {
+		ui.Say("No squashfs partition to repack")
+		return multistep.ActionContinue
+	}
+	for _, p := range raw.([]*squashfsPartition) {
+		if err := s.repack(ctx, state, imagefile, p); err != nil {
+			err := fmt.Errorf("Error repacking squashfs partition %s: %s", p.Device, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepRepackSquashfs) repack(ctx context.Context, state multistep.StateBag, imagefile string, p *squashfsPartition) error {
+	ui := state.Get("ui").(packer.Ui)
+	number, err := partitionNumber(p.Device)
+	if err != nil {
+		return err
+	}
+
+	fs := filepath.Join(p.Dir, "repacked.squashfs")
+	ui.Say(fmt.Sprintf("Repacking squashfs partition %d with %s compression", number, p.Superblock.Compression))
+	if err := run(ctx, state, fmt.Sprintf("mksquashfs %s %s -noappend -no-progress -comp %s -b %d",
+		p.root(), fs, p.Superblock.Compression, p.Superblock.BlockSize)); err != nil {
+		return err
+	}
+	info, err := os.Stat(fs)
+	if err != nil {
+		return err
+	}
+
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return err
+	}
+	var part *utils.Partition
+	for i := range table.Partitions {
+		if table.Partitions[i].Number() == number {
+			part = &table.Partitions[i]
+		}
+	}
+	if part == nil {
+		return fmt.Errorf("partition %d not found", number)
+	}
+	if size := uint64(info.Size()); size > part.Size*table.SectorSize {
+		ui.Message(fmt.Sprintf("Growing partition %d for the repacked filesystem of %v M", number, size/1024/1024))
+		if err := growSquashfsPartition(ctx, state, imagefile, table, *part, size); err != nil {
+			return err
+		}
+	}
+
+	src, err := os.Open(fs)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(imagefile, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if _, err := dst.Seek(int64(part.Start*table.SectorSize), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, &cancelReader{ctx: ctx, r: src}); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// growSquashfsPartition grows part to hold size bytes, rounded up to 1MiB.
+func growSquashfsPartition(ctx context.Context, state multistep.StateBag, imagefile string, table *utils.PartitionTable, part utils.Partition, size uint64) error {
+	ui := state.Get("ui").(packer.Ui)
+	alignment := uint64(partitionAlignment<<SectorShift) / table.SectorSize
+	sectors := (size + table.SectorSize - 1) / table.SectorSize
+	extra := (sectors - part.Size + alignment - 1) &^ (alignment - 1)
+	last := true
+	for _, other := range table.Partitions {
+		if other.Start > part.Start {
+			last = false
+		}
+	}
+
+	stat, err := os.Stat(imagefile)
+	if err != nil {
+		return err
+	}
+	if table.Label == "gpt" {
+		if !last {
+			return fmt.Errorf("only the last partition of GPT images can be grown")
+		}
+		// room for the backup GPT after the partition
+		end := int64((part.Start+part.Size+extra)*table.SectorSize) + 1<<20
+		if end > stat.Size() {
+			if err := os.Truncate(imagefile, end); err != nil {
+				return err
+			}
+		}
+		if err := run(ctx, state, fmt.Sprintf("sfdisk --relocate gpt-bkp-header %s", imagefile)); err != nil {
+			return err
+		}
+		return run(ctx, state, fmt.Sprintf("echo ', %d' | sfdisk --no-reread --force -N %d %s", part.Size+extra, part.Number(), imagefile))
+	}
+
+	if part.Number() > 4 {
+		return fmt.Errorf("logical partitions can't be grown")
+	}
+	f, err := os.Open(imagefile)
+	if err != nil {
+		return err
+	}
+	mbrp, err := mbr.Read(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	partitions := mbrp.GetAllPartitions()
+	n := part.Number() - 1
+	shift := uint(SectorShift)
+	if table.SectorSize == 4096 {
+		shift = 12
+	}
+	if last {
+		if end := int64((part.Start + part.Size + extra) * table.SectorSize); end > stat.Size() {
+			if err := os.Truncate(imagefile, end); err != nil {
+				return err
+			}
+		}
+		partitions[n].SetLBALen(partitions[n].GetLBALen() + uint32(extra))
+	} else {
+		if err := os.Truncate(imagefile, stat.Size()+int64(extra*table.SectorSize)); err != nil {
+			return err
+		}
+		if err := (&stepResizeLastPart{}).relocateAfter(ui, imagefile, partitions, n, uint32(extra), shift); err != nil {
+			return err
+		}
+	}
+
+	f, err = os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return mbrp.Write(f)
+}
+
+func (s *stepRepackSquashfs) Cleanup(state multistep.StateBag) {}
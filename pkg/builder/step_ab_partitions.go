@@ -0,0 +1,190 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// abSlots returns the B slot stepAddPartitions added, with the root partition it copies as Source.
+func abSlots(state multistep.StateBag) (*addedPartition, bool) {
+	for _, p := range state.Get("added_partitions").([]*addedPartition) {
+		if p.abSlot {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// stepWriteBootEnv writes the u-boot environment of ab_partitions, booting slot A first. The
+// boot script finds the slots in root_a and root_b (PARTUUID=... specs) and part_a and part_b
+// (partition numbers), and counts boots in bootcount against bootlimit while
+// upgrade_available is set.
+type stepWriteBootEnv struct {
+	ChrootKey  string
+	Partitions ABPartitions
+}
+
+func (s *stepWriteBootEnv) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	envFile := s.Partitions.BootEnv
+	if envFile == "" && len(config.ImageMounts) > 0 && config.ImageMounts[0] != "" {
+		envFile = path.Join(config.ImageMounts[0], "uboot.env")
+	}
+	if envFile == "" {
+		ui.Error("ab_partitions needs a boot_env path, the first partition isn't mounted")
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Writing the A/B u-boot environment to %s", envFile))
+	if err := s.write(state, filepath.Join(mountPath, envFile)); err != nil {
+		err := fmt.Errorf("Error writing the u-boot environment: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepWriteBootEnv) write(state multistep.StateBag, envFile string) error {
+	slotB, ok := abSlots(state)
+	if !ok {
+		return fmt.Errorf("no B slot was added")
+	}
+	// read after convert_to_gpt, for the final PARTUUIDs
+	table, err := utils.ReadPartitionTable(state.Get("imagefile").(string))
+	if err != nil {
+		return err
+	}
+
+	vars := map[string]string{
+		"slot":              "a",
+		"part_a":            strconv.Itoa(slotB.Source),
+		"part_b":            strconv.Itoa(slotB.Number),
+		"root_a":            "PARTUUID=" + table.PartUUID(slotB.Source),
+		"root_b":            "PARTUUID=" + table.PartUUID(slotB.Number),
+		"bootcount":         "0",
+		"bootlimit":         "3",
+		"upgrade_available": "0",
+	}
+	for name, value := range s.Partitions.BootEnvVars {
+		vars[name] = value
+	}
+	env, err := utils.UbootEnv(vars, s.Partitions.BootEnvSize)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(envFile, env, 0644)
+}
+
+func (s *stepWriteBootEnv) Cleanup(state multistep.StateBag) {}
+
+// stepCopyRootSlot copies the provisioned root partition to slot B of ab_partitions, and points
+// the root entry of the fstab of slot B to its own PARTUUID. The image must be unmapped.
+type stepCopyRootSlot struct {
+	ImageKey string
+}
+
+func (s *stepCopyRootSlot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.ImageKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	slotB, ok := abSlots(state)
+	if !ok {
+		ui.Error("no B slot was added")
+		return multistep.ActionHalt
+	}
+	ui.Say(fmt.Sprintf("Copying the root partition %d to slot B, partition %d", slotB.Source, slotB.Number))
+	if err := s.copy(ctx, ui, imagefile, slotB); err != nil {
+		err := fmt.Errorf("Error copying the root partition to slot B: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepCopyRootSlot) copy(ctx context.Context, ui packer.Ui, imagefile string, slotB *addedPartition) error {
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return err
+	}
+	var src, dst *utils.Partition
+	for i := range table.Partitions {
+		switch table.Partitions[i].Number() {
+		case slotB.Source:
+			src = &table.Partitions[i]
+		case slotB.Number:
+			dst = &table.Partitions[i]
+		}
+	}
+	if src == nil || dst == nil || src.Size != dst.Size {
+		return fmt.Errorf("partitions %d and %d aren't the same size", slotB.Source, slotB.Number)
+	}
+
+	f, err := os.OpenFile(imagefile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := copyRange(ctx, f, int64(src.Start*table.SectorSize), int64(dst.Start*table.SectorSize), int64(src.Size*table.SectorSize)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// the copy of fstab still mounts slot A as root
+	oldSpec, newSpec := "PARTUUID="+table.PartUUID(slotB.Source), "PARTUUID="+table.PartUUID(slotB.Number)
+	comm := &injectCommunicator{image: imagefile, partitions: []injectPartition{{mnt: "/", offset: int64(dst.Start * table.SectorSize), fs: "ext"}}}
+	var fstab bytes.Buffer
+	if err := comm.Download("/etc/fstab", &fstab); err != nil {
+		return err
+	}
+	if !strings.Contains(fstab.String(), oldSpec) {
+		ui.Message(fmt.Sprintf("fstab doesn't mount %s, slot B will mount the same root as slot A", oldSpec))
+		return nil
+	}
+	updated := strings.Replace(fstab.String(), oldSpec, newSpec, -1)
+	return comm.Upload("/etc/fstab", strings.NewReader(updated), nil)
+}
+
+// copyRange copies size bytes of f from src to dst, which don't overlap. Blocks of zeros are
+// skipped, dst being freshly allocated.
+func copyRange(ctx context.Context, f *os.File, src, dst, size int64) error {
+	buf, zeros := make([]byte, 4<<20), make([]byte, 4<<20)
+	for done := int64(0); done < size; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := buf
+		if size-done < int64(len(chunk)) {
+			chunk = chunk[:size-done]
+		}
+		if _, err := f.ReadAt(chunk, src+done); err != nil {
+			return err
+		}
+		if !bytes.Equal(chunk, zeros[:len(chunk)]) {
+			if _, err := f.WriteAt(chunk, dst+done); err != nil {
+				return err
+			}
+		}
+		done += int64(len(chunk))
+	}
+	return nil
+}
+
+func (s *stepCopyRootSlot) Cleanup(state multistep.StateBag) {}
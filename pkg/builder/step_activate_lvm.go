@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const lvmMemberType = "LVM2_member"
+
+// stepActivateLvm activates the volume groups of the LVM physical volumes in the image, and
+// replaces each of them in the partitions list with the logical volumes of its volume group.
+type stepActivateLvm struct {
+	PartitionsKey string
+	volumeGroups  []string
+}
+
+func (s *stepActivateLvm) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	var result []string
+	activated := make(map[string]bool)
+	blkid := hostBlkid(ctx, state)
+	for _, p := range partitions {
+		info, err := blkid(p)
+		if err != nil {
+			ui.Error(fmt.Sprintf("error running blkid on %s: %v", p, err))
+			return multistep.ActionHalt
+		}
+		if info.Type() != lvmMemberType {
+			result = append(result, p)
+			continue
+		}
+
+		vg, err := lvmOutput(ctx, state, "pvs --noheadings -o vg_name "+p)
+		if err != nil {
+			ui.Error(fmt.Sprintf("error reading volume group of %s: %v", p, err))
+			return multistep.ActionHalt
+		}
+		if len(vg) != 1 {
+			ui.Error(fmt.Sprintf("physical volume %s is not part of a volume group", p))
+			return multistep.ActionHalt
+		}
+		if activated[vg[0]] {
+			// another physical volume of the same volume group
+			continue
+		}
+
+		ui.Say(fmt.Sprintf("Activating LVM volume group %s", vg[0]))
+		if run(ctx, state, "vgchange -ay "+vg[0]) != nil {
+			return multistep.ActionHalt
+		}
+		activated[vg[0]] = true
+		s.volumeGroups = append(s.volumeGroups, vg[0])
+
+		lvs, err := lvmOutput(ctx, state, "lvs --noheadings -o lv_path --sort lv_name "+vg[0])
+		if err != nil {
+			ui.Error(fmt.Sprintf("error listing logical volumes of %s: %v", vg[0], err))
+			return multistep.ActionHalt
+		}
+		ui.Message(fmt.Sprintf("Logical volumes: %v", lvs))
+		result = append(result, lvs...)
+	}
+
+	state.Put(s.PartitionsKey, result)
+	state.Put("activate_lvm_cleanup", s)
+	return multistep.ActionContinue
+}
+
+func (s *stepActivateLvm) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *stepActivateLvm) CleanupFunc(state multistep.StateBag) error {
+	for len(s.volumeGroups) > 0 {
+		last := len(s.volumeGroups) - 1
+		if err := run(context.TODO(), state, "vgchange -an "+s.volumeGroups[last]); err != nil {
+			return err
+		}
+		s.volumeGroups = s.volumeGroups[:last]
+	}
+	return nil
+}
+
+// lvmOutput runs an lvm reporting command, wrapped with command_wrapper, and returns its non
+// empty output lines.
+func lvmOutput(ctx context.Context, state multistep.StateBag, cmd string) ([]string, error) {
+	out, err := runCommandOutput(ctx, state, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// logicalVolumeName returns vg/lv for logical volume devices of the form /dev/<vg>/<lv>.
+func logicalVolumeName(dev string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(dev, "/dev/"), "/")
+	if !strings.HasPrefix(dev, "/dev/") || len(parts) != 2 || parts[0] == "mapper" {
+		return "", false
+	}
+	return parts[0] + "/" + parts[1], true
+}
@@ -0,0 +1,267 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+var newPartitionTypes = map[string]mbr.PartitionType{"ext4": 0x83, "vfat": 0x0c, "swap": mbr.PART_LINUX_SWAP_SOLARIS}
+
+// addedPartition is a partition of add_partitions, once in the partition table.
+type addedPartition struct {
+	NewPartition
+	// 1 based partition number
+	Number int
+	// the partition the B slot of ab_partitions is a copy of
+	Source int
+}
+
+// stepAddPartitions adds the partitions of add_partitions after the last partition, in free
+// primary entries of the MBR, growing the image for them.
+//
+// Produces:
+//
+//	added_partitions []*addedPartition
+type stepAddPartitions struct {
+	FromKey string
+}
+
+func (s *stepAddPartitions) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Adding partitions")
+	added, err := s.add(ui, imagefile, config.AddPartitions)
+	if err != nil {
+		err := fmt.Errorf("Error adding partitions: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("added_partitions", added)
+	return multistep.ActionContinue
+}
+
+func (s *stepAddPartitions) add(ui packer.Ui, imagefile string, partitions []NewPartition) ([]*addedPartition, error) {
+	shift, err := imageSectorShift(imagefile)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mbrp, err := mbr.Read(f)
+	if err != nil {
+		return nil, err
+	}
+	if mbrp.IsGPT() {
+		return nil, fmt.Errorf("only MBR partition tables are supported")
+	}
+
+	// after the boot sector, on the blank images of rootfs archives
+	end := uint32(1)
+	var free []int
+	var last int
+	for i, part := range mbrp.GetAllPartitions() {
+		if part.IsEmpty() {
+			free = append(free, i)
+		} else if part.GetLBALast()+1 > end {
+			end = part.GetLBALast() + 1
+			last = i + 1
+		}
+	}
+	if len(free) < len(partitions) {
+		return nil, fmt.Errorf("%d partitions to add but only %d free primary partition entries", len(partitions), len(free))
+	}
+
+	alignment := uint32(partitionAlignment << SectorShift >> shift)
+	var added []*addedPartition
+	for i, p := range partitions {
+		start := (end + alignment - 1) &^ (alignment - 1)
+		sectors := uint32(p.size >> shift)
+		var source int
+		if p.abSlot {
+			source = last
+			sectors = mbrp.GetPartition(last).GetLBALen()
+			p.size = uint64(sectors) << shift
+		}
+		part := mbrp.GetPartition(free[i] + 1)
+		if p.esp {
+			part.SetType(0xef)
+		} else {
+			part.SetType(newPartitionTypes[p.Filesystem])
+		}
+		part.SetLBAStart(start)
+		part.SetLBALen(sectors)
+		end = start + sectors
+		ui.Message(fmt.Sprintf("Adding %s partition %d of %v M", p.Filesystem, free[i]+1, p.size/1024/1024))
+		added = append(added, &addedPartition{NewPartition: p, Number: free[i] + 1, Source: source})
+		if p.Mountpoint == "/" {
+			// the root partition of a rootfs archive
+			last = free[i] + 1
+		}
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if size := int64(end) << shift; size > stat.Size() {
+		if err := f.Truncate(size); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return added, mbrp.Write(f)
+}
+
+func (s *stepAddPartitions) Cleanup(state multistep.StateBag) {}
+
+// stepFormatNewPartitions creates the filesystems of the partitions stepAddPartitions added.
+type stepFormatNewPartitions struct {
+	PartitionsKey string
+}
+
+func (s *stepFormatNewPartitions) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	added := state.Get("added_partitions").([]*addedPartition)
+	partitions := state.Get(s.PartitionsKey).([]string)
+
+	for _, p := range added {
+		if p.abSlot {
+			// overwritten with the root filesystem once provisioned
+			continue
+		}
+		var dev string
+		for _, candidate := range partitions {
+			if n, err := partitionNumber(candidate); err == nil && n == p.Number {
+				dev = candidate
+			}
+		}
+		if dev == "" {
+			ui.Error(fmt.Sprintf("new partition %d not found in %v", p.Number, partitions))
+			return multistep.ActionHalt
+		}
+
+		cmd := mkfsCommand(p.Filesystem, p.Label)
+		if p.esp {
+			// UEFI firmware only has to support FAT32 on ESPs
+			cmd = strings.Replace(cmd, "mkfs.vfat", "mkfs.vfat -F 32", 1)
+		}
+		ui.Say(fmt.Sprintf("Creating %s filesystem on %s", p.Filesystem, dev))
+		if err := run(ctx, state, cmd+" "+dev); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepFormatNewPartitions) Cleanup(state multistep.StateBag) {}
+
+func mkfsCommand(filesystem, label string) string {
+	switch filesystem {
+	case "vfat":
+		if label != "" {
+			return fmt.Sprintf("mkfs.vfat -n '%s'", label)
+		}
+		return "mkfs.vfat"
+	case "swap":
+		if label != "" {
+			return fmt.Sprintf("mkswap -L '%s'", label)
+		}
+		return "mkswap"
+	default:
+		if label != "" {
+			return fmt.Sprintf("mkfs.ext4 -F -L '%s'", label)
+		}
+		return "mkfs.ext4 -F"
+	}
+}
+
+// stepNewPartitionsFstab adds fstab entries for the partitions stepAddPartitions added, by
+// PARTUUID.
+type stepNewPartitionsFstab struct {
+	ChrootKey string
+}
+
+func (s *stepNewPartitionsFstab) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	added := state.Get("added_partitions").([]*addedPartition)
+	mountPath := state.Get(s.ChrootKey).(string)
+	imagefile := state.Get("imagefile").(string)
+
+	if err := s.addEntries(filepath.Join(mountPath, "/etc/fstab"), imagefile, added); err != nil {
+		err := fmt.Errorf("Error adding fstab entries for the new partitions: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepNewPartitionsFstab) addEntries(fstabPath, imagefile string, added []*addedPartition) error {
+	// read after convert_to_gpt, for the final PARTUUIDs
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(fstabPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the entries replace the ones of the image for the same mount points, like the /dev/mmcblk0p1
+	// /boot entry of rootfs archives
+	mountpoints := make(map[string]bool)
+	for _, p := range added {
+		if p.Mountpoint != "" && p.Filesystem != "swap" {
+			mountpoints[filepath.Clean(p.Mountpoint)] = true
+		}
+	}
+	if data, err = utils.FilterFstab(data, func(e utils.FstabEntry) bool { return mountpoints[filepath.Clean(e.File)] }); err != nil {
+		return err
+	}
+
+	var lines strings.Builder
+	lines.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		lines.WriteString("\n")
+	}
+	for _, p := range added {
+		passNo := "2"
+		if p.Mountpoint == "/" {
+			passNo = "1"
+		}
+		entry := utils.FstabEntry{
+			Spec:    "PARTUUID=" + table.PartUUID(p.Number),
+			File:    p.Mountpoint,
+			VfsType: p.Filesystem,
+			MntOps:  p.MountOptions,
+			Freq:    "0",
+			PassNo:  passNo,
+		}
+		switch {
+		case p.Filesystem == "swap":
+			entry.File, entry.MntOps, entry.PassNo = "none", "sw", "0"
+		case p.Mountpoint == "":
+			continue
+		}
+		lines.WriteString(entry.String() + "\n")
+	}
+	return ioutil.WriteFile(fstabPath, []byte(lines.String()), 0644)
+}
+
+func (s *stepNewPartitionsFstab) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,42 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+)
+
+// stepCreateBmap writes the bmaptool block map of the unmapped raw image next to it. It has
+// to run before compression, bmaptool finds image.img.bmap for image.img.xz too.
+type stepCreateBmap struct {
+	ImageKey string
+}
+
+func (s *stepCreateBmap) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	imagefile := state.Get(s.ImageKey).(string)
+	bmapFile := imagefile + ".bmap"
+
+	ui.Say(fmt.Sprintf("Writing block map to %s", bmapFile))
+	bmap, err := image.CreateBmap(imagefile)
+	if err == nil {
+		err = ioutil.WriteFile(bmapFile, bmap.Marshal(), 0644)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error creating bmap: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Message(fmt.Sprintf("%d of %d blocks hold data", bmap.MappedBlocksCount(), bmap.BlocksCount()))
+
+	state.Put("bmap_file", bmapFile)
+	addArtifactFiles(state, bmapFile)
+	return multistep.ActionContinue
+}
+
+func (s *stepCreateBmap) Cleanup(state multistep.StateBag) {}
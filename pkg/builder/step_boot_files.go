@@ -0,0 +1,104 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepCopyBootFiles copies the files of extra_boot_files into the first FAT partition of the
+// image, wherever image_mounts puts it. It runs once provisioned, so kernel packages upgraded by
+// provisioners don't overwrite custom kernels. FAT has no owners or modes, only content is copied.
+type stepCopyBootFiles struct {
+	ChrootKey string
+	Files     map[string]string
+}
+
+func (s *stepCopyBootFiles) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	bootMount, ok := state.GetOk("boot_mount")
+	if !ok {
+		err := fmt.Errorf("Error copying extra_boot_files: no FAT partition of the image is mounted")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	boot := filepath.Join(mountPath, bootMount.(string))
+
+	ui.Say(fmt.Sprintf("Copying extra_boot_files into the boot partition at %s", bootMount))
+	names := make([]string, 0, len(s.Files))
+	for name := range s.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ui.Message(fmt.Sprintf("Copying %s to %s", s.Files[name], name))
+		if err := copyBootFile(ctx, s.Files[name], filepath.Join(boot, name)); err != nil {
+			err := fmt.Errorf("Error copying %s into the boot partition: %s", s.Files[name], err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+// copyBootFile copies a file, or the content of a directory, to dst. Symlinks are followed, FAT
+// can't store them.
+func copyBootFile(ctx context.Context, src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return copyFileContent(src, dst)
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		return copyFileContent(path, filepath.Join(dst, rel))
+	})
+}
+
+// copyFileContent is copyRegularFile without the chmod, which vfat refuses.
+func copyFileContent(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (s *stepCopyBootFiles) Cleanup(state multistep.StateBag) {}
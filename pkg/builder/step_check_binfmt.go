@@ -0,0 +1,153 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// stepCheckBinfmt checks that binfmt_misc of the host already runs the binaries of the image,
+// instead of registering them, for hosts where builds can't write to binfmt_misc, like hardened
+// CI runners that register qemu with systemd-binfmt. Entries are matched by their magic, not by
+// name. Interpreters of registrations without the F flag are looked up in the chroot, so they
+// are copied there from the host while provisioning.
+//
+// Produces:
+//
+//	register_binfmt_cleanup CleanupFunc - To perform early cleanup
+type stepCheckBinfmt struct {
+	ChrootKey string
+	// the host runs arm binaries, only binfmt_entries are checked
+	Native bool
+
+	copied []string
+}
+
+func (s *stepCheckBinfmt) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	chrootDir := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Checking the binfmt_misc registrations of the host...")
+	state.Put("register_binfmt_cleanup", s)
+	registrations, err := readBinfmtRegistrations()
+	if err != nil {
+		err := fmt.Errorf("Error reading binfmt_misc: %s. require_preregistered_binfmt needs it mounted on the host", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	for _, entry := range preregisteredBinfmtEntries(config, s.Native) {
+		var found *binfmtRegistration
+		for i, r := range registrations {
+			if r.runs(entry.binfmtHeader()) {
+				found = &registrations[i]
+				break
+			}
+		}
+		if found == nil {
+			err := fmt.Errorf("Error: no enabled binfmt_misc registration runs the binaries of %s. "+
+				"require_preregistered_binfmt doesn't register them, register %s on the host, with "+
+				"systemd-binfmt or the qemu-user-static package for example", entry.Name, entry.Interpreter)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		ui.Message(fmt.Sprintf("%s binaries run with %s (%s)", entry.Name, found.Interpreter, found.Name))
+		if err := s.provideInterpreter(ctx, state, chrootDir, *found); err != nil {
+			err := fmt.Errorf("Error copying interpreter %s of binfmt_misc registration %s to the chroot: %s", found.Interpreter, found.Name, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+// provideInterpreter copies the interpreter of a registration without the F flag to the chroot,
+// unless the image has it already.
+func (s *stepCheckBinfmt) provideInterpreter(ctx context.Context, state multistep.StateBag, chrootDir string, r binfmtRegistration) error {
+	if strings.Contains(r.Flags, "F") {
+		return nil
+	}
+	dest := filepath.Join(chrootDir, r.Interpreter)
+	if _, err := os.Lstat(dest); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := run(ctx, state, fmt.Sprintf("cp %s %s", r.Interpreter, dest)); err != nil {
+		return err
+	}
+	s.copied = append(s.copied, dest)
+	return nil
+}
+
+// preregisteredBinfmtEntries returns the entries the host must have: binfmt_entries, and the qemu
+// binaries unless the host runs arm binaries natively. Only their magic and mask matter.
+func preregisteredBinfmtEntries(config *Config, native bool) []BinfmtEntry {
+	var entries []BinfmtEntry
+	if !native {
+		entry, ok := qemuBinfmtEntry(qemuArch(config.QemuBinary), config.QemuBinary)
+		if !ok {
+			// not a qemu binary name we know, assume it runs 32 bit arm binaries
+			entry = BinfmtEntry{Name: "arm", Magic: qemuBinfmtMagic["arm"][0], Mask: qemuBinfmtMagic["arm"][1], Interpreter: config.QemuBinary}
+		}
+		entries = append(entries, entry)
+		for _, qemu := range config.AdditionalQemuBinaries {
+			if entry, ok := qemuBinfmtEntry(qemuArch(qemu), qemu); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return append(entries, config.BinfmtEntries...)
+}
+
+// readBinfmtRegistrations reads the entries of binfmt_misc, failing when it's disabled.
+func readBinfmtRegistrations() ([]binfmtRegistration, error) {
+	status, err := ioutil.ReadFile(filepath.Join(binfmtMiscDir, "status"))
+	if err != nil {
+		return nil, err
+	}
+	if string(status) != "enabled\n" {
+		return nil, fmt.Errorf("binfmt_misc is disabled")
+	}
+	files, err := ioutil.ReadDir(binfmtMiscDir)
+	if err != nil {
+		return nil, err
+	}
+	var registrations []binfmtRegistration
+	for _, f := range files {
+		if f.Name() == "status" || f.Name() == "register" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(binfmtMiscDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		registrations = append(registrations, parseBinfmtRegistration(f.Name(), string(data)))
+	}
+	return registrations, nil
+}
+
+func (s *stepCheckBinfmt) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *stepCheckBinfmt) CleanupFunc(_ multistep.StateBag) error {
+	for _, dest := range s.copied {
+		os.Remove(dest)
+	}
+	s.copied = nil
+	return nil
+}
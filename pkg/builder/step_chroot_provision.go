@@ -9,7 +9,9 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/chroot"
 	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/packerbuilderdata"
 )
 
 // StepChrootProvision provisions the instance within a chroot.
@@ -22,16 +24,29 @@ func (s *StepChrootProvision) Run(ctx context.Context, state multistep.StateBag)
 	mountPath := state.Get(s.ChrootKey).(string)
 	ui := state.Get("ui").(packer.Ui)
 	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
+	config := state.Get("config").(*Config)
 
 	// Create our communicator
-	comm := &chroot.Communicator{
-		Chroot:     mountPath,
-		CmdWrapper: wrappedCommand,
+	comm := &chrootCommunicator{
+		Communicator: &chroot.Communicator{
+			Chroot:     mountPath,
+			CmdWrapper: wrappedCommand,
+		},
+		ChrootCmdWrapper: state.Get("wrappedChrootCommand").(packer_common_common.CommandWrapper),
+		ExecuteCommand:   state.Get("chrootExecuteCommand").(packer_common_common.CommandWrapper),
+		Shell:            chrootShellOf(state),
+		Rootless:         config.Rootless,
+		ProotQemu:        prootQemu(state),
 	}
 
+	// for shell-local provisioners, as {{ build `MountPath` }}
+	generatedData := &packerbuilderdata.GeneratedData{State: state}
+	generatedData.Put("MountPath", mountPath)
+
 	// Provision
 	log.Println("Running the provision hook")
-	if err := hook.Run(ctx, packer.HookProvision, ui, comm, nil); err != nil {
+	hookData := packer_common_commonsteps.PopulateProvisionHookData(state)
+	if err := hook.Run(ctx, packer.HookProvision, ui, comm, hookData); err != nil {
 		state.Put("error", err)
 		return multistep.ActionHalt
 	}
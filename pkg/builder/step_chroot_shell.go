@@ -0,0 +1,80 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// defaultChrootShell is the shell commands run with in the chroot, when the image has it.
+const defaultChrootShell = "/bin/sh"
+
+// chrootShells are the shells looked for in images without /bin/sh, like minimal images with
+// only busybox, in order.
+var chrootShells = []string{defaultChrootShell, "/usr/bin/sh", "/bin/bash", "/usr/bin/bash", "/bin/dash", "/bin/ash", "/bin/busybox sh", "/usr/bin/busybox sh"}
+
+// stepChrootShell picks the shell the commands of the provisioners and of the build run with in
+// the chroot: chroot_shell, or the first of chrootShells the image has.
+//
+// Produces:
+//
+//	chroot_shell string - The shell command line, like /bin/busybox sh
+type stepChrootShell struct {
+	ChrootKey string
+	// chroot_shell
+	Shell string
+}
+
+func (s *stepChrootShell) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	shell := s.Shell
+	if shell == "" {
+		var ok bool
+		if shell, ok = detectChrootShell(mountPath); !ok {
+			ui.Message(fmt.Sprintf("No shell found in the image, commands run with %s. Set chroot_shell to the shell of the image", shell))
+		} else if shell != defaultChrootShell {
+			ui.Message(fmt.Sprintf("The image has no %s, commands run with %s", defaultChrootShell, shell))
+		}
+	} else if !chrootHasExecutable(mountPath, shell) {
+		err := fmt.Errorf("Error: chroot_shell %s is not in the image", shell)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("chroot_shell", shell)
+	return multistep.ActionContinue
+}
+
+func (s *stepChrootShell) Cleanup(state multistep.StateBag) {}
+
+// detectChrootShell returns the first of chrootShells the image mounted at mountPath has, or
+// /bin/sh when it has none.
+func detectChrootShell(mountPath string) (string, bool) {
+	for _, shell := range chrootShells {
+		if chrootHasExecutable(mountPath, shell) {
+			return shell, true
+		}
+	}
+	return defaultChrootShell, false
+}
+
+// chrootHasExecutable tells if the binary of a command line is an executable of the chroot.
+func chrootHasExecutable(mountPath, command string) bool {
+	info, err := os.Stat(resolveInChroot(mountPath, strings.Fields(command)[0]))
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// chrootShellOf returns the shell commands run with in the chroot, /bin/sh until
+// stepChrootShell picked it.
+func chrootShellOf(state multistep.StateBag) string {
+	if shell, ok := state.GetOk("chroot_shell"); ok {
+		return shell.(string)
+	}
+	return defaultChrootShell
+}
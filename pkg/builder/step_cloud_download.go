@@ -0,0 +1,166 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// isCloudURL tells if a source url is an object of a cloud storage bucket: s3://bucket/key,
+// gs://bucket/object or azblob://account/container/blob.
+func isCloudURL(u string) bool {
+	switch lower := strings.ToLower(u); {
+	case strings.HasPrefix(lower, "s3://"), strings.HasPrefix(lower, "gs://"), strings.HasPrefix(lower, "azblob://"):
+		return true
+	}
+	return false
+}
+
+// isAzureCLIURL tells if a source url is an azblob:// blob without a SAS token, downloaded with
+// the az cli rather than over https.
+func isAzureCLIURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && strings.EqualFold(parsed.Scheme, "azblob") && parsed.Query().Get("sig") == ""
+}
+
+// getterURL returns the url go-getter downloads a cloud storage object from: s3 and gs urls
+// become the s3:: and gcs:: urls of its getters, which authenticate like the aws and gcloud clis,
+// and azblob urls with a SAS token the https url of the blob.
+func getterURL(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Host == "" || strings.Trim(parsed.Path, "/") == "" {
+		return "", fmt.Errorf("%s has no bucket or object", u)
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "s3":
+		q := parsed.Query()
+		region := q.Get("region")
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		q.Del("region")
+		host := "s3.amazonaws.com"
+		if region != "" {
+			host = "s3-" + region + ".amazonaws.com"
+		}
+		getter := url.URL{Scheme: "https", Host: host, Path: "/" + parsed.Host + parsed.Path, RawQuery: q.Encode()}
+		return "s3::" + getter.String(), nil
+	case "gs":
+		getter := url.URL{Scheme: "https", Host: "www.googleapis.com", Path: "/storage/v1/" + parsed.Host + parsed.Path, RawQuery: parsed.RawQuery}
+		return "gcs::" + getter.String(), nil
+	case "azblob":
+		getter := url.URL{Scheme: "https", Host: parsed.Host + ".blob.core.windows.net", Path: parsed.Path, RawQuery: parsed.RawQuery}
+		return getter.String(), nil
+	}
+	return u, nil
+}
+
+// stepCloudDownload points the download step to the cloud storage sources, which go-getter
+// doesn't take as is: s3 and gs objects and azblob blobs with a SAS token are downloaded by the
+// download step, see getterURL. Other azblob blobs are downloaded with az storage blob download,
+// as the user logged in with az login, to the packer cache, and verified by the download step
+// like the image of a torrent.
+type stepCloudDownload struct {
+	Download *packer_common_commonsteps.StepDownload
+	// keep the archive of rootfs archive sources, see keepArchive
+	KeepArchive bool
+}
+
+func (s *stepCloudDownload) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	var urls []string
+	var image string
+	for _, source := range s.Download.Url {
+		if !isCloudURL(source) {
+			urls = append(urls, source)
+			continue
+		}
+		if !isAzureCLIURL(source) {
+			u, err := getterURL(source)
+			if err != nil {
+				ui.Error(err.Error())
+				continue
+			}
+			urls = append(urls, u)
+			continue
+		}
+		if image != "" {
+			continue
+		}
+		ui.Say(fmt.Sprintf("Downloading %s", source))
+		var err error
+		if image, err = s.azureDownload(ctx, state, source); err != nil {
+			ui.Error(fmt.Sprintf("Download of %s failed: %s", source, err))
+			continue
+		}
+		ui.Message(fmt.Sprintf("%s => %s", source, image))
+		u := "file://" + image
+		if s.KeepArchive {
+			u = keepArchive(u)
+		}
+		urls = append([]string{u}, urls...)
+	}
+	if len(urls) == 0 {
+		err := fmt.Errorf("Error downloading the image: all cloud storage downloads failed")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.Download.Url = urls
+	return multistep.ActionContinue
+}
+
+// azureDownload downloads the blob at source to the cache, unless a previous build did, and
+// returns its path.
+func (s *stepCloudDownload) azureDownload(ctx context.Context, state multistep.StateBag, source string) (string, error) {
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if parsed.Host == "" || len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("azblob urls are azblob://account/container/blob")
+	}
+
+	dir, err := packer.CachePath(fmt.Sprintf("azblob-%x", sha1.Sum([]byte(source))))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	image := filepath.Join(dir, path.Base(parts[1]))
+	complete := filepath.Join(dir, ".packer-complete")
+	if _, err := os.Stat(complete); err == nil {
+		return image, nil
+	}
+
+	cmd := fmt.Sprintf("az storage blob download --auth-mode login --no-progress --account-name %s --container-name %s --name %s --file %s",
+		shellQuote(parsed.Host), shellQuote(parts[0]), shellQuote(parts[1]), shellQuote(image))
+	if err := runCommand(ctx, state, cmd); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(complete, nil, 0644); err != nil {
+		return "", err
+	}
+	return image, nil
+}
+
+func (s *stepCloudDownload) Cleanup(state multistep.StateBag) {}
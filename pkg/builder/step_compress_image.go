@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+	"github.com/ulikunitz/xz"
+)
+
+// compressedImage records the sizes and hashes image catalogs need to publish a compressed image.
+type compressedImage struct {
+	ExtractSize    int64
+	ExtractSha256  string
+	DownloadSize   int64
+	DownloadSha256 string
+}
+
+// stepCompressImage compresses the unmapped image with xz, replacing it.
+type stepCompressImage struct {
+	FromKey, ResultKey string
+}
+
+func (s *stepCompressImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+	dst := imagefile + ".xz"
+
+	ui.Say(fmt.Sprintf("Compressing image to %s", dst))
+	compressed, err := s.compress(ctx, ui, imagefile, dst)
+	if err != nil {
+		os.Remove(dst)
+		err := fmt.Errorf("Error compressing image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Message(fmt.Sprintf("Compressed %v bytes to %v bytes", compressed.ExtractSize, compressed.DownloadSize))
+
+	if err := os.Remove(imagefile); err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("compressed_image", compressed)
+	state.Put(s.ResultKey, dst)
+	return multistep.ActionContinue
+}
+
+func (s *stepCompressImage) compress(ctx context.Context, ui packer.Ui, src, dst string) (*compressedImage, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	extractHash := sha256.New()
+	downloadHash := sha256.New()
+	downloadSize := utils.NewProgressWriter()
+	compressedOut := io.MultiWriter(out, downloadHash, downloadSize)
+
+	var extractSize int64
+	if _, err := exec.LookPath("xz"); err == nil {
+		// fast path, the xz binary compresses on all cores
+		xzCmd := exec.CommandContext(ctx, "xz", "-T0", "-c")
+		xzCmd.Stdout = compressedOut
+		stdin, err := xzCmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := xzCmd.Start(); err != nil {
+			return nil, err
+		}
+		extractSize, err = utils.CopyWithProgress(ctx, ui, io.MultiWriter(stdin, extractHash), in)
+		stdin.Close()
+		if waitErr := xzCmd.Wait(); err == nil {
+			err = waitErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		xzw, err := xz.NewWriter(compressedOut)
+		if err != nil {
+			return nil, err
+		}
+		extractSize, err = utils.CopyWithProgress(ctx, ui, io.MultiWriter(xzw, extractHash), in)
+		if err != nil {
+			return nil, err
+		}
+		if err := xzw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+	return &compressedImage{
+		ExtractSize:    extractSize,
+		ExtractSha256:  hex.EncodeToString(extractHash.Sum(nil)),
+		DownloadSize:   int64(downloadSize.TotalData()),
+		DownloadSha256: hex.EncodeToString(downloadHash.Sum(nil)),
+	}, nil
+}
+
+func (s *stepCompressImage) Cleanup(state multistep.StateBag) {}
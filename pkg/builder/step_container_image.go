@@ -0,0 +1,98 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// containerPlatforms are the container platforms of the qemu architectures.
+var containerPlatforms = map[string]string{
+	"arm":     "linux/arm/v7",
+	"aarch64": "linux/arm64",
+	"riscv64": "linux/riscv64",
+}
+
+// stepContainerImage imports the provisioned filesystems of the mounted image as a single layer
+// container image, to the docker daemon or as an OCI image layout. The layer is the uncompressed
+// rootfs_tarball when there is one, or an archive made the same way.
+type stepContainerImage struct {
+	ChrootKey string
+}
+
+func (s *stepContainerImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	platform := config.ContainerPlatform
+	if platform == "" {
+		var ok bool
+		if platform, ok = containerPlatforms[qemuArch(config.QemuBinary)]; !ok {
+			platform = containerPlatforms["arm"]
+		}
+	}
+
+	tarball, ok := state.GetOk("rootfs_tarball")
+	if !ok || filepath.Ext(tarball.(string)) != ".tar" {
+		dir, err := ioutil.TempDir("", "container")
+		if err != nil {
+			err := fmt.Errorf("Error creating a temporary directory: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		defer os.RemoveAll(dir)
+		tarball = filepath.Join(dir, "rootfs.tar")
+		ui.Say("Archiving the root filesystem for the container image")
+		if err := run(ctx, state, rootfsTarCommand(state, mountPath, tarball.(string))); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+
+	if config.ContainerOCILayout == "" {
+		ui.Say(fmt.Sprintf("Importing the root filesystem to docker as %s, for %s", config.ContainerImage, platform))
+		cmd := fmt.Sprintf("docker import --platform %s %s %s", shellQuote(platform), shellQuote(tarball.(string)), shellQuote(config.ContainerImage))
+		if err := run(ctx, state, cmd); err != nil {
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Writing the root filesystem as an OCI image layout to %s, for %s", config.ContainerOCILayout, platform))
+	if err := writeOCILayout(config.ContainerOCILayout, tarball.(string), imageTag(config.ContainerImage), platform); err != nil {
+		err := fmt.Errorf("Error writing the OCI image layout: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func writeOCILayout(dir, tarball, tag, platform string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, _ := utils.ParseOCIPlatform(platform)
+	return utils.WriteOCILayout(dir, f, tag, p)
+}
+
+// imageTag returns the tag of an image reference, or latest.
+func imageTag(ref string) string {
+	// the last colon can be the one of a registry port
+	if i := strings.LastIndex(ref, ":"); i >= 0 && !strings.Contains(ref[i:], "/") {
+		return ref[i+1:]
+	}
+	return "latest"
+}
+
+func (s *stepContainerImage) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,197 @@
+package builder
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// the sectors GPT needs at the end of the disk for its backup header and partition entries
+const gptBackupSectors = 33
+
+const espTypeCode = "EF00"
+
+var (
+	fatPartitionTypes = map[mbr.PartitionType]bool{0x01: true, 0x04: true, 0x06: true, 0x0b: true, 0x0c: true, 0x0e: true, 0xef: true}
+	// extended partitions hold logical ones, that can't be mapped to their new PARTUUIDs
+	extendedPartitionTypes = map[mbr.PartitionType]bool{0x05: true, 0x0f: true, 0x85: true}
+)
+
+// stepConvertToGpt converts the MBR partition table of the image to GPT, keeping the partitions
+// where they are, and marks the FAT boot partition as an EFI system partition so UEFI firmware
+// (like the Raspberry Pi 4 EDK2 port) boots from it. The MBR PARTUUIDs change, the old to new
+// mapping is put in partuuid_changes for stepUpdatePartuuids.
+type stepConvertToGpt struct {
+	FromKey string
+}
+
+func (s *stepConvertToGpt) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Converting partition table to GPT")
+	changes, err := s.convert(ctx, state, imagefile, config.GptEspPartition)
+	if err != nil {
+		err := fmt.Errorf("Error converting partition table to GPT: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("partuuid_changes", changes)
+	return multistep.ActionContinue
+}
+
+func (s *stepConvertToGpt) convert(ctx context.Context, state multistep.StateBag, imagefile string, esp int) (map[string]string, error) {
+	ui := state.Get("ui").(packer.Ui)
+
+	f, err := os.OpenFile(imagefile, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mbrp, err := mbr.Read(f)
+	if err != nil {
+		return nil, err
+	}
+	if mbrp.IsGPT() {
+		return nil, fmt.Errorf("the image already has a GPT partition table")
+	}
+	// sgdisk assumes image files have 512 byte sectors
+	if sectorSize, err := utils.SectorSize(f); err != nil {
+		return nil, err
+	} else if sectorSize != 1<<SectorShift {
+		return nil, fmt.Errorf("only images with 512 byte sectors can be converted, this one has %d byte sectors", sectorSize)
+	}
+	signature := make([]byte, 4)
+	if _, err := f.ReadAt(signature, 440); err != nil {
+		return nil, err
+	}
+	diskID := binary.LittleEndian.Uint32(signature)
+
+	var numbers []int
+	var end uint32
+	var firstFat int
+	for i, part := range mbrp.GetAllPartitions() {
+		if part.IsEmpty() {
+			continue
+		}
+		if extendedPartitionTypes[part.GetType()] {
+			return nil, fmt.Errorf("partition %d is an extended partition, only primary partitions are supported", i+1)
+		}
+		// an MBR EFI system partition, like the one of efi_system_partition, wins over FAT ones
+		if esp == 0 && part.GetType() == 0xef {
+			esp = i + 1
+		}
+		if firstFat == 0 && fatPartitionTypes[part.GetType()] {
+			firstFat = i + 1
+		}
+		if part.GetLBAStart() < 2+gptBackupSectors {
+			return nil, fmt.Errorf("partition %d starts before the end of the GPT partition entries", i+1)
+		}
+		if part.GetLBALast()+1 > end {
+			end = part.GetLBALast() + 1
+		}
+		numbers = append(numbers, i+1)
+	}
+
+	if esp == 0 {
+		esp = firstFat
+	}
+
+	// make room for the backup GPT after the last partition
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if minSize := int64(end+gptBackupSectors) << SectorShift; stat.Size() < minSize {
+		size := (int64(end) + partitionAlignment) << SectorShift
+		ui.Message(fmt.Sprintf("Growing image to %v bytes for the backup GPT", size))
+		if err := f.Truncate(size); err != nil {
+			return nil, err
+		}
+	}
+	f.Close()
+
+	if err := run(ctx, state, fmt.Sprintf("sgdisk --mbrtogpt %s", imagefile)); err != nil {
+		return nil, err
+	}
+	if esp != 0 {
+		ui.Message(fmt.Sprintf("Marking partition %d as EFI system partition", esp))
+		if err := run(ctx, state, fmt.Sprintf("sgdisk --typecode=%d:%s %s", esp, espTypeCode, imagefile)); err != nil {
+			return nil, err
+		}
+	}
+
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the GPT partition table: %v", err)
+	}
+	changes := map[string]string{}
+	for _, n := range numbers {
+		uuid := table.PartUUID(n)
+		if uuid == "" {
+			return nil, fmt.Errorf("no unique GUID for partition %d", n)
+		}
+		changes[fmt.Sprintf("%08x-%02x", diskID, n)] = uuid
+	}
+	return changes, nil
+}
+
+func (s *stepConvertToGpt) Cleanup(state multistep.StateBag) {}
+
+// stepUpdatePartuuids replaces the MBR PARTUUIDs stepConvertToGpt changed in fstab and the
+// kernel command line.
+type stepUpdatePartuuids struct {
+	ChrootKey string
+}
+
+func (s *stepUpdatePartuuids) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	changes := state.Get("partuuid_changes").(map[string]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	files := []string{filepath.Join(mountPath, "/etc/fstab")}
+	if cmdline := config.findCmdline(mountPath); cmdline != "" {
+		files = append(files, cmdline)
+	}
+	for _, file := range files {
+		if err := replacePartuuids(file, changes); err != nil {
+			err := fmt.Errorf("Error updating PARTUUIDs in %s: %s", file, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func replacePartuuids(file string, changes map[string]string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	content := string(data)
+	for old, partuuid := range changes {
+		content = strings.ReplaceAll(content, "PARTUUID="+old, "PARTUUID="+partuuid)
+	}
+	if content == string(data) {
+		return nil
+	}
+	return ioutil.WriteFile(file, []byte(content), 0644)
+}
+
+func (s *stepUpdatePartuuids) Cleanup(state multistep.StateBag) {}
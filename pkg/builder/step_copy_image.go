@@ -41,6 +41,24 @@ func (s *stepCopyImage) Run(ctx context.Context, state multistep.StateBag) multi
 }
 
 func (s *stepCopyImage) Cleanup(state multistep.StateBag) {
+	imagefile, ok := state.GetOk(s.ResultKey)
+	if !ok {
+		return
+	}
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if !cancelled && !halted {
+		return
+	}
+
+	config := state.Get("config").(*Config)
+	if config.KeepImageOnError {
+		s.ui.Say(fmt.Sprintf("Build failed, keeping image at %s", imagefile))
+		return
+	}
+	if err := os.Remove(imagefile.(string)); err != nil && !os.IsNotExist(err) {
+		s.ui.Error(fmt.Sprintf("Error removing image of failed build: %v", err))
+	}
 }
 
 func (s *stepCopyImage) copy_progress(ctx context.Context, state multistep.StateBag, dst io.Writer, src image.Image) error {
@@ -71,16 +89,22 @@ func (s *stepCopyImage) copy_progress(ctx context.Context, state multistep.State
 
 func (s *stepCopyImage) copy(ctx context.Context, state multistep.StateBag, src, dir, filename string) error {
 
-	srcf, err := s.ImageOpener.Open(src)
+	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return err
 	}
-	defer srcf.Close()
+	if image.IsRaw(src) {
+		if err := s.reflink(src, filepath.Join(dir, filename)); err == nil {
+			s.ui.Message("Cloned the source image with a reflink.")
+			return s.convertToRaw(ctx, state, filepath.Join(dir, filename))
+		}
+	}
 
-	err = os.MkdirAll(dir, 0755)
+	srcf, err := s.ImageOpener.Open(src)
 	if err != nil {
 		return err
 	}
+	defer srcf.Close()
 
 	dstf, err := os.Create(filepath.Join(dir, filename))
 	if err != nil {
@@ -88,11 +112,60 @@ func (s *stepCopyImage) copy(ctx context.Context, state multistep.StateBag, src,
 	}
 	defer dstf.Close()
 
-	err = s.copy_progress(ctx, state, dstf, srcf)
+	config := state.Get("config").(*Config)
+	if config.SparseOutput {
+		sparse := utils.NewSparseWriter(dstf)
+		err = s.copy_progress(ctx, state, sparse, srcf)
+		if err == nil {
+			err = sparse.Close()
+		}
+	} else {
+		err = s.copy_progress(ctx, state, dstf, srcf)
+	}
+
+	if err != nil {
+		return err
+	}
+	dstf.Close()
+
+	return s.convertToRaw(ctx, state, filepath.Join(dir, filename))
+}
 
+// reflink clones src to dst with FICLONE, which shares the blocks of both files on
+// btrfs and XFS until they are modified. It fails on other filesystems, or when they
+// are different filesystems.
+func (s *stepCopyImage) reflink(src, dst string) error {
+	srcf, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer srcf.Close()
 
-	return nil
+	dstf, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = cloneFile(dstf, srcf)
+	dstf.Close()
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// convertToRaw converts virtual disk images, like the qcow2 images some projects publish, to
+// a raw image the rest of the build can map.
+func (s *stepCopyImage) convertToRaw(ctx context.Context, state multistep.StateBag, imagefile string) error {
+	format, err := image.DiskFormat(imagefile)
+	if err != nil || format == "" {
+		return err
+	}
+
+	s.ui.Say(fmt.Sprintf("Image is a %s disk, converting it to raw.", format))
+	raw := imagefile + ".raw"
+	if err := run(ctx, state, fmt.Sprintf("qemu-img convert -f %s -O raw %s %s", format, imagefile, raw)); err != nil {
+		os.Remove(raw)
+		return fmt.Errorf("error converting %s image, is qemu-img installed? %v", format, err)
+	}
+	return os.Rename(raw, imagefile)
 }
@@ -0,0 +1,160 @@
+package builder
+
+import (
+	"context"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image/utils"
+	osutils "github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// stepDetectImageType picks the image type from the mounted image when neither image_type nor
+// the image url tell it, and applies its qemu defaults unless qemu_binary or qemu_args are set.
+// image_arch sets the qemu binary, and keeps the qemu_args of image types of other architectures.
+// The default mounts of these images follow their fstab, see followFstab.
+type stepDetectImageType struct {
+	ChrootKey string
+}
+
+func (s *stepDetectImageType) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	imageType, release := detectImageType(mountPath)
+	if imageType == utils.Unknown {
+		if release != "" {
+			ui.Say(fmt.Sprintf("Image type of %s is unknown, using the configured defaults", release))
+		} else {
+			ui.Say("Could not detect the image type, using the configured defaults")
+		}
+		return multistep.ActionContinue
+	}
+	ui.Say(fmt.Sprintf("Detected image type %s from %s", imageType, release))
+	config.ImageType = imageType
+
+	if config.defaultQemuArgs {
+		config.QemuArgs = config.imageTypeArgs(imageType)
+	}
+	if qemu, ok := config.qemuBinaryOf(imageType); ok && config.defaultQemuBinary {
+		path, err := exec.LookPath(qemu)
+		if (config.RequirePreregisteredBinfmt || hostRunsNatively(qemu)) && err != nil {
+			// only its architecture matters
+			path, err = qemu, nil
+		}
+		if err != nil {
+			err := fmt.Errorf("Error finding %s for image type %s: %s", qemu, imageType, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		config.QemuBinary = path
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepDetectImageType) Cleanup(state multistep.StateBag) {}
+
+// detectImageType reads os-release and looks for board specific files in the mounted image.
+// it returns the detected type, or Unknown when it is ambiguous, and the name of the os found.
+func detectImageType(mountPath string) (utils.KnownImageType, string) {
+	var release osutils.OsRelease
+	for _, file := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		data, err := ioutil.ReadFile(resolveInChroot(mountPath, file))
+		if err != nil {
+			continue
+		}
+		if release, err = osutils.ParseOsRelease(data); err == nil {
+			break
+		}
+	}
+	if release == nil {
+		return utils.Unknown, ""
+	}
+	name := release["PRETTY_NAME"]
+	if name == "" {
+		name = release.ID()
+	}
+
+	exists := func(paths ...string) bool {
+		for _, path := range paths {
+			if _, err := os.Stat(resolveInChroot(mountPath, path)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case release.Is("kali"):
+		return utils.Kali, name
+	case release.ID() == "raspbian" || (release.Is("debian") && exists("/boot/config.txt", "/boot/firmware/config.txt")):
+		if chrootMachine(mountPath) == elf.EM_AARCH64 {
+			return utils.RaspberryPiArm64, name
+		}
+		return utils.RaspberryPi, name
+	case release.Is("debian") && exists("/etc/dogtag", "/boot/uEnv.txt"):
+		return utils.BeagleBone, name
+	case release.Is("fedora") && chrootMachine(mountPath) == elf.EM_AARCH64:
+		return utils.Fedora, name
+	case release.Is("opensuse") && chrootMachine(mountPath) == elf.EM_AARCH64:
+		return utils.OpenSUSE, name
+	case release.Is("poky"):
+		if chrootMachine(mountPath) == elf.EM_AARCH64 {
+			return utils.YoctoArm64, name
+		}
+		return utils.Yocto, name
+	case release.Is("haos") || release.Is("hassos"):
+		if chrootMachine(mountPath) == elf.EM_AARCH64 {
+			return utils.HomeAssistantArm64, name
+		}
+		return utils.HomeAssistant, name
+	case release.Is("buildroot"):
+		if chrootMachine(mountPath) == elf.EM_AARCH64 {
+			return utils.BuildrootArm64, name
+		}
+		return utils.Buildroot, name
+	case release.Is("archarm"):
+		if chrootMachine(mountPath) == elf.EM_AARCH64 {
+			return utils.ArchLinuxArm64, name
+		}
+		return utils.ArchLinuxArm, name
+	}
+	return utils.Unknown, name
+}
+
+// chrootMachine returns the ELF machine of the shell in the chroot, or EM_NONE if it can't tell.
+func chrootMachine(mountPath string) elf.Machine {
+	shell, _ := detectChrootShell(mountPath)
+	f, err := elf.Open(resolveInChroot(mountPath, strings.Fields(shell)[0]))
+	if err != nil {
+		return elf.EM_NONE
+	}
+	defer f.Close()
+	return f.Machine
+}
+
+// resolveInChroot returns the host path of path in the chroot, following absolute symlinks
+// inside the chroot rather than on the host.
+func resolveInChroot(mountPath, path string) string {
+	for i := 0; i < 16; i++ {
+		hostPath := filepath.Join(mountPath, path)
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return hostPath
+		}
+		if !strings.HasPrefix(target, "/") {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return filepath.Join(mountPath, path)
+}
@@ -0,0 +1,224 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// the data and hash block size of veritysetup
+const verityBlockSize = 4096
+
+// dmVerityInfo is what veritysetup reports of a hash tree, as the manifest lists it. The offset
+// is in bytes, from the start of the hash partition.
+type dmVerityInfo struct {
+	Partition     int    `json:"partition"`
+	HashPartition int    `json:"hash_partition"`
+	HashOffset    uint64 `json:"hash_offset"`
+	DataBlocks    uint64 `json:"data_blocks"`
+	BlockSize     int    `json:"block_size"`
+	Hash          string `json:"hash"`
+	Salt          string `json:"salt"`
+	UUID          string `json:"uuid"`
+	RootHash      string `json:"root_hash"`
+}
+
+// stepDmVerity computes the dm-verity hash tree of a partition once the image is unmounted, for
+// verified boot. The hash tree goes to hash_partition, or after the filesystem of the partition,
+// and the root hash to root_hash_file, on another partition mounted for the time to write it.
+//
+// Produces:
+//
+//	dm_verity *dmVerityInfo - The hash tree written
+type stepDmVerity struct {
+	PartitionsKey string
+	Verity        DmVerity
+}
+
+func (s *stepDmVerity) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	info, err := s.format(ctx, state, partitions)
+	if err == nil && s.Verity.RootHashFile != "" {
+		ui.Message(fmt.Sprintf("Writing the root hash to %s", s.Verity.RootHashFile))
+		err = s.writeRootHash(ctx, state, info.RootHash)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error creating the dm-verity hash tree: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("dm_verity", info)
+	return multistep.ActionContinue
+}
+
+func (s *stepDmVerity) format(ctx context.Context, state multistep.StateBag, partitions []string) (*dmVerityInfo, error) {
+	ui := state.Get("ui").(packer.Ui)
+
+	data, err := s.partition(ctx, state, s.Verity.Partition, partitions)
+	if err != nil {
+		return nil, err
+	}
+	hash := data
+	if s.Verity.HashPartition != "" {
+		if hash, err = s.partition(ctx, state, s.Verity.HashPartition, partitions); err != nil {
+			return nil, err
+		}
+		if hash == data {
+			return nil, fmt.Errorf("hash_partition is the protected partition")
+		}
+	}
+
+	size, err := filesystemSize(ctx, state, data)
+	if err != nil {
+		return nil, err
+	}
+	info := &dmVerityInfo{
+		DataBlocks: (size + verityBlockSize - 1) / verityBlockSize,
+		BlockSize:  verityBlockSize,
+		Hash:       s.Verity.Hash,
+	}
+	args := []string{"format", "--hash=" + s.Verity.Hash,
+		fmt.Sprintf("--data-block-size=%d", verityBlockSize), fmt.Sprintf("--hash-block-size=%d", verityBlockSize),
+		fmt.Sprintf("--data-blocks=%d", info.DataBlocks)}
+	if hash == data {
+		info.HashOffset = info.DataBlocks * verityBlockSize
+		args = append(args, fmt.Sprintf("--hash-offset=%d", info.HashOffset))
+	}
+	info.Partition, _ = partitionNumber(data)
+	info.HashPartition, _ = partitionNumber(hash)
+
+	ui.Say(fmt.Sprintf("Creating the dm-verity hash tree of %s on %s", data, hash))
+	out, err := runCommandOutput(ctx, state, fmt.Sprintf("veritysetup %s %s %s", strings.Join(args, " "), data, hash))
+	if err != nil {
+		if hash == data {
+			return nil, fmt.Errorf("%s, the partition may have no room for the hash tree after its filesystem, set hash_partition", err)
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(fields[1])
+		switch strings.TrimSpace(fields[0]) {
+		case "Root hash":
+			info.RootHash = value
+		case "Salt":
+			info.Salt = value
+		case "UUID":
+			info.UUID = value
+		}
+	}
+	if info.RootHash == "" {
+		return nil, fmt.Errorf("no root hash in the veritysetup output: %s", out)
+	}
+	ui.Message(fmt.Sprintf("Root hash: %s", info.RootHash))
+	return info, nil
+}
+
+// partition returns the partition a selector of dm_verity selects, the root partition for "".
+func (s *stepDmVerity) partition(ctx context.Context, state multistep.StateBag, selector string, partitions []string) (string, error) {
+	if selector == "" {
+		root, ok := state.GetOk("root_partition")
+		if !ok {
+			return "", fmt.Errorf("no partition is mounted at /, set the partition of dm_verity")
+		}
+		return root.(string), nil
+	}
+	mounts, err := resolvePartitionMounts(hostBlkid(ctx, state), map[string]string{selector: "verity"}, partitions)
+	if err != nil {
+		return "", err
+	}
+	for i, mnt := range mounts {
+		if mnt != "" {
+			return partitions[i], nil
+		}
+	}
+	return "", fmt.Errorf("no partition matches %s", selector)
+}
+
+// filesystemSize returns the size of the ext or squashfs filesystem of a partition, which the
+// hash tree follows.
+func filesystemSize(ctx context.Context, state multistep.StateBag, dev string) (uint64, error) {
+	info, err := hostBlkid(ctx, state)(dev)
+	if err != nil {
+		return 0, fmt.Errorf("error running blkid on %s: %v", dev, err)
+	}
+	switch fstype := info.Type(); {
+	case strings.HasPrefix(fstype, "ext"):
+		sb, err := dumpe2fs(ctx, state, dev)
+		if err != nil {
+			return 0, err
+		}
+		return sb.Size()
+	case fstype == "squashfs":
+		f, err := os.Open(dev)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		sb, err := utils.ReadSquashfsSuperblock(f, 0)
+		if err != nil {
+			return 0, err
+		}
+		return sb.BytesUsed, nil
+	default:
+		return 0, fmt.Errorf("%s has a %q filesystem, dm_verity supports ext and squashfs", dev, fstype)
+	}
+}
+
+// writeRootHash writes the root hash to root_hash_file, mounting the partition it is on.
+func (s *stepDmVerity) writeRootHash(ctx context.Context, state multistep.StateBag, rootHash string) error {
+	mounted := state.Get("mounted_partitions").(map[string]string)
+	var mountpoints []string
+	for mnt := range mounted {
+		mountpoints = append(mountpoints, mnt)
+	}
+	// the deepest mount point holding the file
+	sort.Slice(mountpoints, func(i, j int) bool { return len(mountpoints[i]) > len(mountpoints[j]) })
+	var dev, rel string
+	for _, mnt := range mountpoints {
+		if r, err := filepath.Rel(mnt, s.Verity.RootHashFile); err == nil && !strings.HasPrefix(r, "..") {
+			dev, rel = mounted[mnt], r
+			break
+		}
+	}
+	if dev == "" {
+		return fmt.Errorf("no partition is mounted where root_hash_file %s is", s.Verity.RootHashFile)
+	}
+	if verified, _ := s.partition(ctx, state, s.Verity.Partition, state.Get(s.PartitionsKey).([]string)); dev == verified {
+		return fmt.Errorf("root_hash_file %s is on the protected partition", s.Verity.RootHashFile)
+	}
+
+	dir, err := ioutil.TempDir("", "packer-verity")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+	if err := run(ctx, state, fmt.Sprintf("mount %s %s", dev, dir)); err != nil {
+		return err
+	}
+	file := filepath.Join(dir, rel)
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(file, []byte(rootHash+"\n"), 0644)
+	}
+	if umountErr := run(context.TODO(), state, "umount "+dir); err == nil {
+		err = umountErr
+	}
+	return err
+}
+
+func (s *stepDmVerity) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,40 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/packer-plugin-sdk/chroot"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepEarlyCleanup runs the cleanup of previous steps before the end of the build, for steps
+// that need to work on the image once the chroot is torn down. Keys that were never set, because
+// their step didn't run, are ignored.
+type stepEarlyCleanup struct {
+	Keys []string
+}
+
+func (s *stepEarlyCleanup) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	for _, key := range s.Keys {
+		c, ok := state.GetOk(key)
+		if !ok {
+			continue
+		}
+		log.Printf("Running cleanup func: %s", key)
+		if err := c.(chroot.Cleanup).CleanupFunc(state); err != nil {
+			err := fmt.Errorf("Error cleaning up: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *stepEarlyCleanup) Cleanup(state multistep.StateBag) {}
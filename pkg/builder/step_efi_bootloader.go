@@ -0,0 +1,105 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// efiArchs are the grub targets and removable media names of the EFI binaries, by qemu
+// architecture.
+var efiArchs = map[string][2]string{
+	"aarch64": {"arm64-efi", "aa64"},
+	"arm":     {"arm-efi", "arm"},
+	"riscv64": {"riscv64-efi", "riscv64"},
+}
+
+// stepInstallEfiBootloader installs the bootloader of efi_system_partition to the mounted
+// ESP, in the removable media path (/EFI/BOOT/BOOT<ARCH>.EFI) firmware boots without NVRAM
+// entries, then copies the files of the ESP configuration.
+type stepInstallEfiBootloader struct {
+	ChrootKey string
+	Partition EfiSystemPartition
+}
+
+func (s *stepInstallEfiBootloader) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	arch, ok := efiArchs[qemuArch(config.QemuBinary)]
+	if !ok {
+		arch = efiArchs["arm"]
+	}
+	esp := filepath.Join(mountPath, s.Partition.Mountpoint)
+
+	switch s.Partition.Bootloader {
+	case EfiGrub:
+		ui.Say("Installing grub to the EFI system partition")
+		cmd := fmt.Sprintf("grub-install --target=%s --efi-directory=%s --removable --no-nvram", arch[0], shellQuote(s.Partition.Mountpoint))
+		if err := runInChroot(ctx, state, mountPath, cmd); err != nil {
+			return multistep.ActionHalt
+		}
+	case EfiSystemdBoot:
+		ui.Say("Installing systemd-boot to the EFI system partition")
+		if err := installSystemdBoot(mountPath, esp, arch[1]); err != nil {
+			err := fmt.Errorf("Error installing systemd-boot: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	for _, f := range s.Partition.Files {
+		ui.Message(fmt.Sprintf("Copying %s to %s on the EFI system partition", f[0], f[1]))
+		if err := copyToEsp(filepath.Join(mountPath, f[0]), filepath.Join(esp, f[1])); err != nil {
+			err := fmt.Errorf("Error copying %s to the EFI system partition: %s", f[0], err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+// installSystemdBoot copies the systemd-boot binary of the chroot to the ESP, and adds a
+// loader.conf unless there is one.
+func installSystemdBoot(mountPath, esp, arch string) error {
+	binary := fmt.Sprintf("/usr/lib/systemd/boot/efi/systemd-boot%s.efi", arch)
+	if _, err := os.Stat(filepath.Join(mountPath, binary)); err != nil {
+		return fmt.Errorf("%s not found, is systemd-boot installed? %v", binary, err)
+	}
+	for _, dst := range []string{
+		fmt.Sprintf("EFI/systemd/systemd-boot%s.efi", arch),
+		fmt.Sprintf("EFI/BOOT/BOOT%s.EFI", strings.ToUpper(arch)),
+	} {
+		if err := copyToEsp(filepath.Join(mountPath, binary), filepath.Join(esp, dst)); err != nil {
+			return err
+		}
+	}
+
+	loaderConf := filepath.Join(esp, "loader", "loader.conf")
+	if _, err := os.Stat(loaderConf); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(esp, "loader", "entries"), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(loaderConf, []byte("timeout 3\neditor no\n"), 0644)
+}
+
+// copyToEsp copies src to dst, creating the directories of dst.
+func copyToEsp(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return copyFile(dst, src)
+}
+
+func (s *stepInstallEfiBootloader) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,270 @@
+package builder
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// room for the LUKS2 header at the start of the partition, the filesystem is moved past it
+const luksHeaderSize = "32M"
+
+var cmdlineRootRegexp = regexp.MustCompile(`\broot=\S+`)
+
+// stepPrepareEncryptRoot points the image to the encrypted root before it is encrypted:
+// crypttab, fstab and the kernel command line, and rebuilds the initramfs to unlock it.
+type stepPrepareEncryptRoot struct {
+	ChrootKey string
+}
+
+func (s *stepPrepareEncryptRoot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Preparing the image for an encrypted root partition")
+	err := s.prepare(ctx, state, config, mountPath)
+	if err != nil {
+		err := fmt.Errorf("Error preparing encrypted root: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepPrepareEncryptRoot) prepare(ctx context.Context, state multistep.StateBag, config *Config, mountPath string) error {
+	ui := state.Get("ui").(packer.Ui)
+	rootRaw, ok := state.GetOk("root_partition")
+	if !ok {
+		return fmt.Errorf("no partition is mounted at /")
+	}
+	info, err := hostBlkid(ctx, state)(rootRaw.(string))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(info.Type(), "ext") {
+		return fmt.Errorf("root filesystem is %q, only ext filesystems can be encrypted", info.Type())
+	}
+
+	luksUUID, err := newUUID()
+	if err != nil {
+		return err
+	}
+	state.Put("luks_uuid", luksUUID)
+	mapperDev := "/dev/mapper/" + config.EncryptRootMapperName
+
+	ui.Message("Updating /etc/crypttab")
+	crypttab := fmt.Sprintf("%s UUID=%s none luks,discard,initramfs\n", config.EncryptRootMapperName, luksUUID)
+	if err := s.updateCrypttab(filepath.Join(mountPath, "/etc/crypttab"), config.EncryptRootMapperName, crypttab); err != nil {
+		return err
+	}
+
+	ui.Message("Updating /etc/fstab")
+	fstabPath := filepath.Join(mountPath, "/etc/fstab")
+	data, err := ioutil.ReadFile(fstabPath)
+	if err != nil {
+		return err
+	}
+	data, err = encryptRootFstab(data, mapperDev)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fstabPath, data, 0644); err != nil {
+		return err
+	}
+
+	if cmdlinePath := config.findCmdline(mountPath); cmdlinePath != "" {
+		ui.Message(fmt.Sprintf("Updating root in %s", cmdlinePath))
+		data, err := ioutil.ReadFile(cmdlinePath)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(cmdlinePath, []byte(encryptRootCmdline(string(data), mapperDev)+"\n"), 0644); err != nil {
+			return err
+		}
+		// the raspberry pi firmware only loads an initramfs when told to
+		if err := s.enableRaspiInitramfs(filepath.Dir(cmdlinePath)); err != nil {
+			return err
+		}
+	} else {
+		ui.Message(fmt.Sprintf("No cmdline.txt found, make sure the bootloader passes root=%s", mapperDev))
+	}
+
+	return s.updateInitramfs(ctx, state, mountPath)
+}
+
+// encryptRootFstab mounts / from the opened LUKS device mapperDev.
+func encryptRootFstab(data []byte, mapperDev string) ([]byte, error) {
+	return utils.UpdateFstab(data, func(e *utils.FstabEntry) bool {
+		if e.File == "/" {
+			e.Spec = mapperDev
+		}
+		return true
+	})
+}
+
+// encryptRootCmdline makes a kernel command line boot from mapperDev, adding root= when it has
+// none.
+func encryptRootCmdline(cmdline, mapperDev string) string {
+	cmdline = strings.TrimSpace(cmdline)
+	if !cmdlineRootRegexp.MatchString(cmdline) {
+		return strings.TrimSpace(cmdline + " root=" + mapperDev)
+	}
+	return cmdlineRootRegexp.ReplaceAllString(cmdline, "root="+mapperDev)
+}
+
+func (s *stepPrepareEncryptRoot) updateCrypttab(path, name, entry string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == name {
+			continue
+		}
+		out.WriteString(line)
+	}
+	if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+		out.WriteString("\n")
+	}
+	out.WriteString(entry)
+	return ioutil.WriteFile(path, []byte(out.String()), 0644)
+}
+
+func (s *stepPrepareEncryptRoot) enableRaspiInitramfs(bootDir string) error {
+	configPath := filepath.Join(bootDir, "config.txt")
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if regexp.MustCompile(`(?m)^\s*(auto_)?initramfs`).Match(data) {
+		return nil
+	}
+	f, err := os.OpenFile(configPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString("\n# load the initramfs that unlocks the encrypted root\nauto_initramfs=1\n")
+	return err
+}
+
+func (s *stepPrepareEncryptRoot) updateInitramfs(ctx context.Context, state multistep.StateBag, mountPath string) error {
+	ui := state.Get("ui").(packer.Ui)
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(mountPath, p))
+		return err == nil
+	}
+
+	switch {
+	case exists("/usr/sbin/update-initramfs") || exists("/sbin/update-initramfs"):
+		if !exists("/usr/share/initramfs-tools/hooks/cryptroot") {
+			ui.Message("Installing cryptsetup-initramfs in the chroot")
+			if err := runInChroot(ctx, state, mountPath, "DEBIAN_FRONTEND=noninteractive apt-get install -y cryptsetup-initramfs"); err != nil {
+				return err
+			}
+		}
+		ui.Message("Updating initramfs")
+		return runInChroot(ctx, state, mountPath,
+			"if ls /boot/initrd.img-* >/dev/null 2>&1; then update-initramfs -u -k all; else update-initramfs -c -k all; fi")
+	case exists("/usr/bin/dracut") || exists("/usr/sbin/dracut"):
+		conf := filepath.Join(mountPath, "/etc/dracut.conf.d/10-packer-crypt.conf")
+		if err := os.MkdirAll(filepath.Dir(conf), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(conf, []byte("add_dracutmodules+=\" crypt \"\n"), 0644); err != nil {
+			return err
+		}
+		ui.Message("Regenerating initramfs with dracut")
+		return runInChroot(ctx, state, mountPath, "dracut -f --regenerate-all")
+	}
+	return fmt.Errorf("neither update-initramfs nor dracut found in image")
+}
+
+func (s *stepPrepareEncryptRoot) Cleanup(state multistep.StateBag) {}
+
+// stepEncryptRoot encrypts the root partition in place, once it is unmounted.
+type stepEncryptRoot struct{}
+
+func (s *stepEncryptRoot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	dev := state.Get("root_partition").(string)
+	luksUUID := state.Get("luks_uuid").(string)
+
+	keyfile := config.EncryptRootKeyfile
+	if config.EncryptRootPassphrase != "" {
+		f, err := ioutil.TempFile("", "packer-luks")
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(config.EncryptRootPassphrase)
+		f.Close()
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		keyfile = f.Name()
+	}
+
+	ui.Say(fmt.Sprintf("Encrypting root partition %s", dev))
+	// shrink the filesystem so the LUKS header fits, then grow it back inside the LUKS device
+	ui.Message("Shrinking root filesystem")
+	if run(ctx, state, fmt.Sprintf("e2fsck -f -y %s || [ $? -eq 1 ]", dev)) != nil {
+		return multistep.ActionHalt
+	}
+	if run(ctx, state, "resize2fs -M "+dev) != nil {
+		return multistep.ActionHalt
+	}
+
+	ui.Message("Encrypting, this can take a while")
+	if run(ctx, state, fmt.Sprintf(
+		"cryptsetup reencrypt --encrypt --batch-mode --type luks2 --reduce-device-size %s --uuid %s --key-file %s %s",
+		luksHeaderSize, luksUUID, keyfile, dev)) != nil {
+		return multistep.ActionHalt
+	}
+
+	ui.Message("Growing root filesystem")
+	name := fmt.Sprintf("packer-luks-%d", os.Getpid())
+	if run(ctx, state, fmt.Sprintf("cryptsetup open --key-file %s %s %s", keyfile, dev, name)) != nil {
+		return multistep.ActionHalt
+	}
+	err := run(ctx, state, "resize2fs /dev/mapper/"+name)
+	if closeErr := run(context.TODO(), state, "cryptsetup close "+name); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *stepEncryptRoot) Cleanup(state multistep.StateBag) {}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
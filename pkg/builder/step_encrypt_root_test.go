@@ -0,0 +1,47 @@
+package builder
+
+import (
+	"testing"
+)
+
+func TestEncryptRootFstab(t *testing.T) {
+	for _, tc := range []struct {
+		name, fstab, want string
+	}{
+		{name: "partuuid root",
+			fstab: "proc /proc proc defaults 0 0\nPARTUUID=deadbeef-01 /boot vfat defaults 0 2\nPARTUUID=deadbeef-02 / ext4 defaults,noatime 0 1\n",
+			want:  "proc /proc proc defaults 0 0\nPARTUUID=deadbeef-01 /boot vfat defaults 0 2\n/dev/mapper/cryptroot\t/\text4\tdefaults,noatime\t0\t1\n"},
+		{name: "comments are kept",
+			fstab: "# root\n/dev/mmcblk0p2  /  ext4  defaults  0  1\n",
+			want:  "# root\n/dev/mapper/cryptroot\t/\text4\tdefaults\t0\t1\n"},
+		{name: "no root",
+			fstab: "LABEL=boot /boot vfat defaults 0 2\n",
+			want:  "LABEL=boot /boot vfat defaults 0 2\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := encryptRootFstab([]byte(tc.fstab), "/dev/mapper/cryptroot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("encryptRootFstab(%q) = %q, want %q", tc.fstab, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEncryptRootCmdline(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline, want string
+	}{
+		{cmdline: "console=serial0,115200 root=PARTUUID=deadbeef-02 rootfstype=ext4 fsck.repair=yes rootwait\n",
+			want: "console=serial0,115200 root=/dev/mapper/cryptroot rootfstype=ext4 fsck.repair=yes rootwait"},
+		{cmdline: "root=/dev/mmcblk0p2 rw", want: "root=/dev/mapper/cryptroot rw"},
+		{cmdline: "console=tty1 rootwait", want: "console=tty1 rootwait root=/dev/mapper/cryptroot"},
+		{cmdline: "", want: "root=/dev/mapper/cryptroot"},
+	} {
+		if got := encryptRootCmdline(tc.cmdline, "/dev/mapper/cryptroot"); got != tc.want {
+			t.Errorf("encryptRootCmdline(%q) = %q, want %q", tc.cmdline, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// stepExportPartitions copies each partition with a filesystem out of the finished image, for
+// tools that flash partitions on their own. They are written next to the image, named after
+// where they are mounted and their filesystem, like image.boot.vfat and image.rootfs.ext4. The
+// image must be unmapped.
+//
+// Produces:
+//
+//	partition_files []string - The exported partitions
+//	artifact_files []string - The exported partitions are appended
+type stepExportPartitions struct {
+	ImageKey string
+}
+
+func (s *stepExportPartitions) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.ImageKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Exporting partitions")
+	files, err := s.export(ctx, ui, imagefile, config.ImageMounts)
+	if err != nil {
+		for _, f := range files {
+			os.Remove(f)
+		}
+		err := fmt.Errorf("Error exporting partitions: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("partition_files", files)
+	addArtifactFiles(state, files...)
+	return multistep.ActionContinue
+}
+
+func (s *stepExportPartitions) export(ctx context.Context, ui packer.Ui, imagefile string, mounts []string) ([]string, error) {
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return nil, err
+	}
+	src, err := os.Open(imagefile)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	base := strings.TrimSuffix(imagefile, filepath.Ext(imagefile))
+	var files []string
+	for i, p := range table.Partitions {
+		start, size := p.Start*table.SectorSize, p.Size*table.SectorSize
+		info, err := utils.ProbeBlkid(imagefile, start, size)
+		if err != nil {
+			return files, fmt.Errorf("error running blkid on partition %d: %s", p.Number(), err)
+		}
+		fstype := info.Type()
+		if fstype == "" || fstype == "swap" {
+			continue
+		}
+
+		name := fmt.Sprintf("p%d", p.Number())
+		if len(mounts) == len(table.Partitions) && mounts[i] != "" {
+			name = partitionFileName(mounts[i])
+		}
+		file := fmt.Sprintf("%s.%s.%s", base, name, fstype)
+		ui.Message(fmt.Sprintf("Writing partition %d to %s", p.Number(), file))
+		files = append(files, file)
+		if err := exportPartition(ctx, src, int64(start), int64(size), file); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// partitionFileName names the partition mounted at mnt: rootfs for /, or the last element of mnt.
+func partitionFileName(mnt string) string {
+	if mnt = path.Clean(mnt); mnt == "/" {
+		return "rootfs"
+	}
+	return path.Base(mnt)
+}
+
+func exportPartition(ctx context.Context, src io.ReaderAt, offset, size int64, file string) error {
+	dst, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	sparse := utils.NewSparseWriter(dst)
+	if _, err := io.Copy(sparse, &cancelReader{ctx: ctx, r: io.NewSectionReader(src, offset, size)}); err != nil {
+		return err
+	}
+	return sparse.Close()
+}
+
+// cancelReader stops reading once ctx is done.
+type cancelReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (s *stepExportPartitions) Cleanup(state multistep.StateBag) {
+	files, ok := state.GetOk("partition_files")
+	if !ok {
+		return
+	}
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if (!cancelled && !halted) || state.Get("config").(*Config).KeepImageOnError {
+		return
+	}
+	for _, f := range files.([]string) {
+		os.Remove(f)
+	}
+}
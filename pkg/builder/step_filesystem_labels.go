@@ -0,0 +1,185 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// filesystemLabelLimits are the longest labels, in bytes, of the filesystems that can be
+// relabeled.
+var filesystemLabelLimits = map[string]int{
+	"ext2":  16,
+	"ext3":  16,
+	"ext4":  16,
+	"vfat":  11,
+	"xfs":   12,
+	"btrfs": 255,
+	"swap":  16,
+}
+
+// relabeledFilesystem is a filesystem filesystem_labels relabels.
+type relabeledFilesystem struct {
+	Device string
+	Type   string
+	Old    string
+	New    string
+}
+
+// stepFilesystemLabels resolves filesystem_labels against the mapped partitions, and replaces
+// the LABEL= and /dev/disk/by-label/ references to their current labels in fstab and the kernel
+// command line with the new ones. stepRelabelFilesystems relabels them once unmounted.
+//
+// Produces:
+//
+//	relabeled_filesystems []*relabeledFilesystem - The filesystems to relabel
+type stepFilesystemLabels struct {
+	ChrootKey     string
+	PartitionsKey string
+	Labels        map[string]string
+}
+
+func (s *stepFilesystemLabels) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	partitions := state.Get(s.PartitionsKey).([]string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	relabeled, err := resolveFilesystemLabels(hostBlkid(ctx, state), s.Labels, partitions)
+	if err != nil {
+		err := fmt.Errorf("Error resolving filesystem_labels: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	files := []string{filepath.Join(mountPath, "/etc/fstab")}
+	if cmdline := config.findCmdline(mountPath); cmdline != "" {
+		files = append(files, cmdline)
+	}
+	for _, file := range files {
+		if err := replaceLabels(file, relabeled); err != nil {
+			err := fmt.Errorf("Error updating filesystem labels in %s: %s", file, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	state.Put("relabeled_filesystems", relabeled)
+	return multistep.ActionContinue
+}
+
+func (s *stepFilesystemLabels) Cleanup(state multistep.StateBag) {}
+
+// resolveFilesystemLabels returns the filesystems of the partitions labels selects, with their
+// current label and type.
+func resolveFilesystemLabels(blkid blkidFunc, labels map[string]string, partitions []string) ([]*relabeledFilesystem, error) {
+	var relabeled []*relabeledFilesystem
+	for selector, label := range labels {
+		mounts, err := resolvePartitionMounts(blkid, map[string]string{selector: "relabel"}, partitions)
+		if err != nil {
+			return nil, err
+		}
+		for i, mnt := range mounts {
+			if mnt == "" {
+				continue
+			}
+			info, err := blkid(partitions[i])
+			if err != nil {
+				return nil, fmt.Errorf("error running blkid on %s: %v", partitions[i], err)
+			}
+			limit, ok := filesystemLabelLimits[info.Type()]
+			if !ok {
+				return nil, fmt.Errorf("the %q filesystem of %s can't be relabeled", info.Type(), partitions[i])
+			}
+			if len(label) > limit {
+				return nil, fmt.Errorf("label %q is longer than the %d bytes of %s labels", label, limit, info.Type())
+			}
+			for _, r := range relabeled {
+				if r.Device == partitions[i] {
+					return nil, fmt.Errorf("partition %s is relabeled both %s and %s", partitions[i], r.New, label)
+				}
+				if r.Old != "" && r.Old == info.Label() {
+					return nil, fmt.Errorf("%s and %s are both labeled %s, fstab can't tell them apart", r.Device, partitions[i], r.Old)
+				}
+			}
+			relabeled = append(relabeled, &relabeledFilesystem{Device: partitions[i], Type: info.Type(), Old: info.Label(), New: label})
+		}
+	}
+	return relabeled, nil
+}
+
+// labelRefRegexp matches the LABEL= and /dev/disk/by-label/ references to filesystems, but not
+// PARTLABEL= ones.
+var labelRefRegexp = regexp.MustCompile(`(?m)(^|[^A-Za-z])(LABEL="?|/dev/disk/by-label/)([^\s,"]+)`)
+
+// replaceLabels replaces the references to the old labels of the relabeled filesystems in file.
+func replaceLabels(file string, relabeled []*relabeledFilesystem) error {
+	changes := map[string]string{}
+	for _, r := range relabeled {
+		if r.Old != "" {
+			changes[r.Old] = r.New
+		}
+	}
+	return replaceFilesystemRefs(file, labelRefRegexp, changes)
+}
+
+// replaceFilesystemRefs replaces the references re matches in file, whose third group is the
+// label or UUID, with their changes, all at once so they can be swapped.
+func replaceFilesystemRefs(file string, re *regexp.Regexp, changes map[string]string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	content := re.ReplaceAllStringFunc(string(data), func(ref string) string {
+		m := re.FindStringSubmatch(ref)
+		if value, ok := changes[m[3]]; ok {
+			return m[1] + m[2] + value
+		}
+		return ref
+	})
+	if content == string(data) {
+		return nil
+	}
+	return ioutil.WriteFile(file, []byte(content), 0644)
+}
+
+// stepRelabelFilesystems relabels the filesystems stepFilesystemLabels resolved, once unmounted.
+type stepRelabelFilesystems struct{}
+
+func (s *stepRelabelFilesystems) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	relabeled := state.Get("relabeled_filesystems").([]*relabeledFilesystem)
+	ui := state.Get("ui").(packer.Ui)
+
+	for _, r := range relabeled {
+		ui.Say(fmt.Sprintf("Labeling the %s filesystem of %s %s", r.Type, r.Device, r.New))
+		var cmd string
+		switch r.Type {
+		case "vfat":
+			cmd = fmt.Sprintf("fatlabel %s %s", r.Device, shellQuote(r.New))
+		case "xfs":
+			cmd = fmt.Sprintf("xfs_admin -L %s %s", shellQuote(r.New), r.Device)
+		case "btrfs":
+			cmd = fmt.Sprintf("btrfs filesystem label %s %s", r.Device, shellQuote(r.New))
+		case "swap":
+			cmd = fmt.Sprintf("swaplabel -L %s %s", shellQuote(r.New), r.Device)
+		default:
+			cmd = fmt.Sprintf("e2label %s %s", r.Device, shellQuote(r.New))
+		}
+		if err := run(ctx, state, cmd); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepRelabelFilesystems) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,172 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+var (
+	filesystemUUIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	// the volume id of FAT filesystems, which blkid shows as their UUID
+	fatVolumeIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}$`)
+	// uuidRefRegexp matches the UUID= and /dev/disk/by-uuid/ references to filesystems, but not
+	// PARTUUID= ones.
+	uuidRefRegexp = regexp.MustCompile(`(?m)(^|[^A-Za-z])(UUID="?|/dev/disk/by-uuid/)([^\s,"]+)`)
+)
+
+// reidentifiedFilesystem is a filesystem filesystem_uuids sets the UUID of.
+type reidentifiedFilesystem struct {
+	Device string
+	Type   string
+	Old    string
+	// as blkid shows it, XXXX-XXXX for FAT volume ids
+	New string
+}
+
+// stepFilesystemUUIDs resolves filesystem_uuids against the mapped partitions, and replaces the
+// UUID= and /dev/disk/by-uuid/ references to their current UUIDs in fstab and the kernel command
+// line with the new ones. stepSetFilesystemUUIDs sets them once unmounted.
+//
+// Produces:
+//
+//	reidentified_filesystems []*reidentifiedFilesystem - The filesystems to set the UUID of
+type stepFilesystemUUIDs struct {
+	ChrootKey     string
+	PartitionsKey string
+	UUIDs         map[string]string
+}
+
+func (s *stepFilesystemUUIDs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	partitions := state.Get(s.PartitionsKey).([]string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	filesystems, err := resolveFilesystemUUIDs(hostBlkid(ctx, state), s.UUIDs, partitions)
+	if err != nil {
+		err := fmt.Errorf("Error resolving filesystem_uuids: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	changes := map[string]string{}
+	for _, f := range filesystems {
+		if f.Old != "" {
+			changes[strings.ToLower(f.Old)] = strings.ToLower(f.New)
+			changes[strings.ToUpper(f.Old)] = strings.ToUpper(f.New)
+		}
+	}
+	files := []string{filepath.Join(mountPath, "/etc/fstab")}
+	if cmdline := config.findCmdline(mountPath); cmdline != "" {
+		files = append(files, cmdline)
+	}
+	for _, file := range files {
+		if err := replaceFilesystemRefs(file, uuidRefRegexp, changes); err != nil {
+			err := fmt.Errorf("Error updating filesystem UUIDs in %s: %s", file, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	state.Put("reidentified_filesystems", filesystems)
+	return multistep.ActionContinue
+}
+
+func (s *stepFilesystemUUIDs) Cleanup(state multistep.StateBag) {}
+
+// resolveFilesystemUUIDs returns the filesystems of the partitions uuids selects, with their
+// current UUID and type.
+func resolveFilesystemUUIDs(blkid blkidFunc, uuids map[string]string, partitions []string) ([]*reidentifiedFilesystem, error) {
+	var filesystems []*reidentifiedFilesystem
+	for selector, uuid := range uuids {
+		mounts, err := resolvePartitionMounts(blkid, map[string]string{selector: "uuid"}, partitions)
+		if err != nil {
+			return nil, err
+		}
+		for i, mnt := range mounts {
+			if mnt == "" {
+				continue
+			}
+			info, err := blkid(partitions[i])
+			if err != nil {
+				return nil, fmt.Errorf("error running blkid on %s: %v", partitions[i], err)
+			}
+			switch info.Type() {
+			case "vfat":
+				if !fatVolumeIDRegexp.MatchString(uuid) {
+					return nil, fmt.Errorf("the UUID of the vfat filesystem of %s must be a volume id like 1234-ABCD, not %s", partitions[i], uuid)
+				}
+				uuid = strings.ToUpper(strings.Replace(uuid, "-", "", 1))
+				uuid = uuid[:4] + "-" + uuid[4:]
+			case "ext2", "ext3", "ext4", "xfs", "btrfs", "swap":
+				if !filesystemUUIDRegexp.MatchString(uuid) {
+					return nil, fmt.Errorf("the UUID of the %s filesystem of %s must be a UUID, not %s", info.Type(), partitions[i], uuid)
+				}
+				uuid = strings.ToLower(uuid)
+			default:
+				return nil, fmt.Errorf("the UUID of the %q filesystem of %s can't be set", info.Type(), partitions[i])
+			}
+			for _, f := range filesystems {
+				if f.Device == partitions[i] {
+					return nil, fmt.Errorf("partition %s is given both UUIDs %s and %s", partitions[i], f.New, uuid)
+				}
+				if strings.EqualFold(f.New, uuid) {
+					return nil, fmt.Errorf("%s and %s are both given UUID %s", f.Device, partitions[i], uuid)
+				}
+			}
+			filesystems = append(filesystems, &reidentifiedFilesystem{Device: partitions[i], Type: info.Type(), Old: info.UUID(), New: uuid})
+		}
+	}
+	return filesystems, nil
+}
+
+// stepSetFilesystemUUIDs sets the UUIDs of the filesystems stepFilesystemUUIDs resolved, once
+// unmounted.
+type stepSetFilesystemUUIDs struct{}
+
+func (s *stepSetFilesystemUUIDs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	filesystems := state.Get("reidentified_filesystems").([]*reidentifiedFilesystem)
+	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
+	ui := state.Get("ui").(packer.Ui)
+
+	for _, f := range filesystems {
+		if strings.EqualFold(f.Old, f.New) {
+			continue
+		}
+		ui.Say(fmt.Sprintf("Setting the UUID of the %s filesystem of %s to %s", f.Type, f.Device, f.New))
+		var cmd string
+		switch f.Type {
+		case "vfat":
+			cmd = fmt.Sprintf("fatlabel -i %s %s", f.Device, strings.Replace(f.New, "-", "", 1))
+		case "xfs":
+			cmd = fmt.Sprintf("xfs_admin -U %s %s", f.New, f.Device)
+		case "btrfs":
+			cmd = fmt.Sprintf("btrfstune -f -U %s %s", f.New, f.Device)
+		case "swap":
+			cmd = fmt.Sprintf("swaplabel -U %s %s", f.New, f.Device)
+		default:
+			// tune2fs wants a freshly checked filesystem to rewrite the metadata checksums
+			if err := e2fsckBeforeResize(wrappedCommand, f.Device); err != nil {
+				err := fmt.Errorf("Error checking %s: %s", f.Device, err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			cmd = fmt.Sprintf("tune2fs -U %s %s", f.New, f.Device)
+		}
+		if err := run(ctx, state, cmd); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepSetFilesystemUUIDs) Cleanup(state multistep.StateBag) {}
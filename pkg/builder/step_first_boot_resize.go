@@ -0,0 +1,161 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const (
+	raspiConfigInitResize = "/usr/lib/raspi-config/init_resize.sh"
+	growRootfsScript      = "/usr/local/sbin/packer-grow-rootfs"
+	growRootfsUnit        = "packer-grow-rootfs.service"
+)
+
+// the script that runs on the first boot when the distro doesn't provide its own mechanism.
+// it grows the partition holding / to the end of the disk, then the filesystem itself.
+const growRootfsScriptContent = `#!/bin/sh
+# Installed by packer-builder-arm-image. Grows the root partition and filesystem
+# to fill the disk on first boot, then disables itself.
+set -e
+
+ROOT_DEV=$(findmnt -n -o SOURCE /)
+ROOT_FSTYPE=$(findmnt -n -o FSTYPE /)
+ROOT_DISK=/dev/$(lsblk -n -o PKNAME "$ROOT_DEV")
+PART_NUM=$(cat "/sys/class/block/$(basename "$ROOT_DEV")/partition")
+
+echo ", +" | sfdisk --force --no-reread -N "$PART_NUM" "$ROOT_DISK" || true
+partx -u "$ROOT_DISK" || true
+
+case "$ROOT_FSTYPE" in
+	ext2|ext3|ext4) resize2fs "$ROOT_DEV" ;;
+	btrfs) btrfs filesystem resize max / ;;
+	xfs) xfs_growfs / ;;
+	*) echo "don't know how to grow $ROOT_FSTYPE, leaving filesystem as is" ;;
+esac
+
+systemctl disable ` + growRootfsUnit + `
+`
+
+const growRootfsUnitContent = `[Unit]
+Description=Grow the root filesystem to fill the disk
+DefaultDependencies=no
+After=local-fs.target
+ConditionPathExists=` + growRootfsScript + `
+
+[Service]
+Type=oneshot
+ExecStart=` + growRootfsScript + `
+RemainAfterExit=yes
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// stepFirstBootResize arranges for the root filesystem to be grown on the first boot of the
+// image, instead of at build time.
+type stepFirstBootResize struct {
+	ChrootKey string
+}
+
+func (s *stepFirstBootResize) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Setting up filesystem resize on first boot")
+
+	var err error
+	if _, statErr := os.Stat(filepath.Join(mountPath, raspiConfigInitResize)); statErr == nil {
+		err = s.enableRaspiConfigResize(ui, mountPath, state.Get("config").(*Config))
+	} else {
+		err = s.installGrowService(ui, mountPath)
+	}
+
+	if err != nil {
+		err := fmt.Errorf("Error setting up first boot resize: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+// enableRaspiConfigResize re-adds the raspi-config resize hook to the kernel command line,
+// raspi-config removes it after the first boot.
+func (s *stepFirstBootResize) enableRaspiConfigResize(ui packer.Ui, mountPath string, config *Config) error {
+	cmdlinePath := config.findCmdline(mountPath)
+	if cmdlinePath == "" {
+		return fmt.Errorf("image has %s but no cmdline.txt was found", raspiConfigInitResize)
+	}
+	data, err := ioutil.ReadFile(cmdlinePath)
+	if err != nil {
+		return err
+	}
+
+	cmdline := strings.TrimSpace(string(data))
+	resized, err := raspiConfigResizeCmdline(cmdline)
+	if err != nil {
+		return fmt.Errorf("%s: %s", cmdlinePath, err)
+	}
+	if resized == cmdline {
+		ui.Message("raspi-config resize already enabled")
+		return nil
+	}
+
+	ui.Message(fmt.Sprintf("Enabling raspi-config resize in %s", cmdlinePath))
+	return ioutil.WriteFile(cmdlinePath, []byte(resized+"\n"), 0644)
+}
+
+// raspiConfigResizeCmdline returns the kernel command line with the raspi-config resize hook as
+// init. The kernel only runs one init, so another one set already is an error.
+func raspiConfigResizeCmdline(cmdline string) (string, error) {
+	initArg := "init=" + raspiConfigInitResize
+	for _, arg := range strings.Fields(cmdline) {
+		if arg == initArg {
+			return cmdline, nil
+		}
+		if strings.HasPrefix(arg, "init=") {
+			return "", fmt.Errorf("the kernel command line already has %s, the raspi-config resize needs %s", arg, initArg)
+		}
+	}
+	if cmdline == "" {
+		return initArg, nil
+	}
+	return cmdline + " " + initArg, nil
+}
+
+func (s *stepFirstBootResize) installGrowService(ui packer.Ui, mountPath string) error {
+	if !hasSystemd(mountPath) {
+		return fmt.Errorf("no systemd found in image, can't install %s", growRootfsUnit)
+	}
+
+	ui.Message(fmt.Sprintf("Installing %s", growRootfsUnit))
+	scriptPath := filepath.Join(mountPath, growRootfsScript)
+	if err := os.MkdirAll(filepath.Dir(scriptPath), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(scriptPath, []byte(growRootfsScriptContent), 0755); err != nil {
+		return err
+	}
+
+	unitPath := filepath.Join(mountPath, "/etc/systemd/system", growRootfsUnit)
+	if err := ioutil.WriteFile(unitPath, []byte(growRootfsUnitContent), 0644); err != nil {
+		return err
+	}
+
+	wantsDir := filepath.Join(mountPath, "/etc/systemd/system/multi-user.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(wantsDir, growRootfsUnit)
+	os.Remove(link)
+	return os.Symlink(filepath.Join("/etc/systemd/system", growRootfsUnit), link)
+}
+
+func (s *stepFirstBootResize) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,36 @@
+package builder
+
+import "testing"
+
+func TestRaspiConfigResizeCmdline(t *testing.T) {
+	for _, tc := range []struct {
+		name, cmdline, want string
+		wantErr             bool
+	}{
+		{name: "added", cmdline: "console=tty1 root=PARTUUID=1234-02 rootwait",
+			want: "console=tty1 root=PARTUUID=1234-02 rootwait init=/usr/lib/raspi-config/init_resize.sh"},
+		{name: "already there", cmdline: "root=/dev/mmcblk0p2 init=/usr/lib/raspi-config/init_resize.sh quiet",
+			want: "root=/dev/mmcblk0p2 init=/usr/lib/raspi-config/init_resize.sh quiet"},
+		{name: "empty", cmdline: "", want: "init=/usr/lib/raspi-config/init_resize.sh"},
+		{name: "other init", cmdline: "root=/dev/mmcblk0p2 init=/sbin/overlayroot.sh", wantErr: true},
+		{name: "init of another path with the same prefix", cmdline: "init=/usr/lib/raspi-config/init_resize.sh.orig", wantErr: true},
+		{name: "rdinit is not init", cmdline: "rdinit=/init",
+			want: "rdinit=/init init=/usr/lib/raspi-config/init_resize.sh"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := raspiConfigResizeCmdline(tc.cmdline)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
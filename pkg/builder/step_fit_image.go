@@ -0,0 +1,192 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// fitArchs are the FIT architecture names, by qemu architecture.
+var fitArchs = map[string]string{
+	"arm":     "arm",
+	"aarch64": "arm64",
+	"riscv64": "riscv",
+}
+
+// fitSource is the image tree source mkimage assembles the FIT image from, with a single
+// configuration. The images are hashed, and the configuration signed when there is a key.
+var fitSource = template.Must(template.New("its").Parse(`/dts-v1/;
+
+/ {
+	description = "{{.Description}}";
+	#address-cells = <1>;
+
+	images {
+		kernel-1 {
+			description = "kernel";
+			data = /incbin/("{{.Kernel}}");
+			type = "kernel";
+			arch = "{{.Arch}}";
+			os = "linux";
+			compression = "{{.Compression}}";
+			load = <{{.LoadAddress}}>;
+			entry = <{{.EntryPoint}}>;
+			hash-1 {
+				algo = "sha256";
+			};
+		};
+		fdt-1 {
+			description = "device tree";
+			data = /incbin/("{{.Dtb}}");
+			type = "flat_dt";
+			arch = "{{.Arch}}";
+			compression = "none";
+			hash-1 {
+				algo = "sha256";
+			};
+		};
+{{- if .Initrd}}
+		ramdisk-1 {
+			description = "initrd";
+			data = /incbin/("{{.Initrd}}");
+			type = "ramdisk";
+			arch = "{{.Arch}}";
+			os = "linux";
+			compression = "none";
+			hash-1 {
+				algo = "sha256";
+			};
+		};
+{{- end}}
+	};
+
+	configurations {
+		default = "conf-1";
+		conf-1 {
+			description = "{{.Description}}";
+			kernel = "kernel-1";
+			fdt = "fdt-1";
+{{- if .Initrd}}
+			ramdisk = "ramdisk-1";
+{{- end}}
+{{- if .KeyName}}
+			signature-1 {
+				algo = "{{.SignatureAlgo}}";
+				key-name-hint = "{{.KeyName}}";
+				sign-images = "kernel", "fdt"{{if .Initrd}}, "ramdisk"{{end}};
+			};
+{{- end}}
+		};
+	};
+};
+`))
+
+type fitSourceData struct {
+	FitImage
+	Description string
+	Arch        string
+	// host paths of the files
+	Kernel, Dtb, Initrd string
+}
+
+// stepFitImage assembles the kernel, device tree and initrd of fit_image into a FIT image with
+// mkimage once provisioned, so kernels installed by provisioners are included, and signs it
+// for u-boot verified boot when a key is set.
+type stepFitImage struct {
+	ChrootKey string
+	Fit       FitImage
+}
+
+func (s *stepFitImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Creating FIT image %s", s.Fit.Output))
+	if err := s.create(ctx, state, config, mountPath); err != nil {
+		err := fmt.Errorf("Error creating the FIT image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepFitImage) create(ctx context.Context, state multistep.StateBag, config *Config, mountPath string) error {
+	ui := state.Get("ui").(packer.Ui)
+
+	data := fitSourceData{FitImage: s.Fit, Description: config.PackerBuildName, Arch: s.Fit.Arch}
+	if data.Description == "" {
+		data.Description = "packer-builder-arm-image"
+	}
+	if data.Arch == "" {
+		var ok bool
+		if data.Arch, ok = fitArchs[qemuArch(config.QemuBinary)]; !ok {
+			data.Arch = "arm"
+		}
+	}
+	var err error
+	for _, f := range []struct {
+		path string
+		dest *string
+	}{{s.Fit.Kernel, &data.Kernel}, {s.Fit.Dtb, &data.Dtb}, {s.Fit.Initrd, &data.Initrd}} {
+		if f.path == "" {
+			continue
+		}
+		if *f.dest, err = globInChroot(mountPath, f.path); err != nil {
+			return err
+		}
+		ui.Message(fmt.Sprintf("Adding %s", strings.TrimPrefix(*f.dest, mountPath)))
+	}
+
+	its, err := ioutil.TempFile("", "packer-fit-*.its")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(its.Name())
+	err = fitSource.Execute(its, data)
+	if closeErr := its.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	output := filepath.Join(mountPath, s.Fit.Output)
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("mkimage -f %s", shellQuote(its.Name()))
+	if s.Fit.KeyDir != "" {
+		cmd += " -k " + shellQuote(s.Fit.KeyDir)
+		if s.Fit.UbootDtb != "" {
+			// u-boot checks the signature with the public key of its control device tree
+			cmd += " -K " + shellQuote(s.Fit.UbootDtb) + " -r"
+		}
+	}
+	return run(ctx, state, cmd+" "+shellQuote(output))
+}
+
+// globInChroot returns the host path of the last file matching a pattern of the chroot, like
+// /boot/vmlinuz-*, so the newest of versioned kernels is picked.
+func globInChroot(mountPath, pattern string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(mountPath, pattern))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no file of the image matches %s", pattern)
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], nil
+}
+
+func (s *stepFitImage) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,38 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/flasher"
+)
+
+// stepFlashDevice writes the finished image to output_device, like the flasher post-processor
+// does when not interactive, and reads it back to verify it.
+type stepFlashDevice struct {
+	ImageKey string
+	Device   string
+}
+
+func (s *stepFlashDevice) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	imagefile := state.Get(s.ImageKey).(string)
+
+	f := flasher.NewFlasher(ui, flasher.FlashConfig{
+		Image:          imagefile,
+		Device:         s.Device,
+		NotInteractive: true,
+		Verify:         true,
+	})
+	if err := f.Flash(ctx); err != nil {
+		err := fmt.Errorf("Error writing image to %s: %s", s.Device, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepFlashDevice) Cleanup(state multistep.StateBag) {}
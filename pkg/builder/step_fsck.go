@@ -0,0 +1,63 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepFsck checks and repairs the filesystems of the mapped partitions before they are mounted.
+// With ReadOnly it only checks them, to validate the finished image.
+type stepFsck struct {
+	PartitionsKey string
+	ReadOnly      bool
+}
+
+func (s *stepFsck) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Checking filesystems")
+	blkid := hostBlkid(ctx, state)
+	for _, p := range partitions {
+		info, err := blkid(p)
+		if err != nil {
+			ui.Error(fmt.Sprintf("error running blkid on %s: %v", p, err))
+			return multistep.ActionHalt
+		}
+
+		var cmd string
+		switch fstype := info.Type(); {
+		case strings.HasPrefix(fstype, "ext") && s.ReadOnly:
+			cmd = "e2fsck -n -f " + p
+		case strings.HasPrefix(fstype, "ext"):
+			// exit code 1 means errors were fixed
+			cmd = "e2fsck -p " + p + " || [ $? -eq 1 ]"
+		case fstype == "vfat" && s.ReadOnly:
+			cmd = "fsck.vfat -n " + p
+		case fstype == "vfat":
+			cmd = "fsck.vfat -a " + p + " || [ $? -eq 1 ]"
+		default:
+			ui.Message(fmt.Sprintf("Not checking %s, filesystem %q", p, fstype))
+			continue
+		}
+
+		ui.Message(fmt.Sprintf("Checking %s (%s)", p, info.Type()))
+		if err := run(ctx, state, cmd); err != nil {
+			if s.ReadOnly {
+				err = fmt.Errorf("Error validating the final image, the filesystem of %s is damaged: %s", p, err)
+			} else {
+				err = fmt.Errorf("Error checking filesystem of %s, the image may be damaged: %s", p, err)
+			}
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepFsck) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,66 @@
+package builder
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/chroot"
+	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// hookCommandsData is available to the host side hook commands as template data.
+type hookCommandsData struct {
+	// the image being built
+	ImageFile string
+	// space separated mapped partition devices
+	Partitions string
+	// where the image is mounted, empty once unmounted
+	MountPath string
+	// the address of the http_directory server, empty without one
+	HTTPIP   string
+	HTTPPort int
+}
+
+// stepHookCommands runs user commands on the host.
+type stepHookCommands struct {
+	Commands    []string
+	Description string
+	// set while the image is mounted, to expose the mount path to the commands
+	ChrootKey string
+}
+
+func (s *stepHookCommands) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
+
+	if len(s.Commands) == 0 {
+		return multistep.ActionContinue
+	}
+
+	data := &hookCommandsData{ImageFile: state.Get("imagefile").(string)}
+	if partitions, ok := state.GetOk("partitions"); ok {
+		data.Partitions = strings.Join(partitions.([]string), " ")
+	}
+	if ip, ok := state.GetOk("http_ip"); ok {
+		data.HTTPIP = ip.(string)
+		data.HTTPPort = state.Get("http_port").(int)
+	}
+	if s.ChrootKey != "" {
+		data.MountPath = state.Get(s.ChrootKey).(string)
+	}
+	ictx := config.ctx
+	ictx.Data = data
+
+	ui.Say("Running " + s.Description + "...")
+	if err := chroot.RunLocalCommands(s.Commands, wrappedCommand, ictx, ui); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepHookCommands) Cleanup(state multistep.StateBag) {}
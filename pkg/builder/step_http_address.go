@@ -0,0 +1,55 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// the address qemu user networking gives the host, for boot_test
+const qemuUserHostIP = "10.0.2.2"
+
+// httpTemplateData is the template data of boot_test_cmdline and boot_test_args, the address of
+// the http_directory server as the guest sees it.
+type httpTemplateData struct {
+	HTTPIP   string
+	HTTPPort int
+}
+
+// stepHTTPAddress makes the server of StepHTTPServer known to provisioners. The chroot shares
+// the network of the host, so it reaches the server on the loopback address unless it is bound
+// to another one. The address is exported to the commands run in the chroot as PACKER_HTTP_IP,
+// PACKER_HTTP_PORT and PACKER_HTTP_ADDR.
+//
+// Produces:
+//
+//	http_ip string - The address of the server
+type stepHTTPAddress struct{}
+
+func (s *stepHTTPAddress) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	port := state.Get("http_port").(int)
+
+	ip := config.HTTPAddress
+	if ip == "" || ip == "0.0.0.0" {
+		ip = "127.0.0.1"
+	}
+	state.Put("http_ip", ip)
+	ui.Message(fmt.Sprintf("Serving %s at http://%s:%d/ to the chroot", config.HTTPDir, ip, port))
+
+	env := map[string]string{}
+	for k, v := range config.ChrootEnv {
+		env[k] = v
+	}
+	env["PACKER_HTTP_IP"] = ip
+	env["PACKER_HTTP_PORT"] = strconv.Itoa(port)
+	env["PACKER_HTTP_ADDR"] = fmt.Sprintf("%s:%d", ip, port)
+	config.ChrootEnv = env
+	return multistep.ActionContinue
+}
+
+func (s *stepHTTPAddress) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,171 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// stepCopyImageFiles copies the files of image_files into the mounted image before provisioning,
+// from the host, so nothing runs in the chroot. Owners are looked up in the passwd and group
+// files of the image.
+type stepCopyImageFiles struct {
+	ChrootKey string
+	Files     []ImageFile
+}
+
+func (s *stepCopyImageFiles) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Copying image_files into the image")
+	for _, f := range s.Files {
+		ui.Message(fmt.Sprintf("Copying %s to %s", f.Source, f.Destination))
+		if err := copyImageFile(ctx, mountPath, f); err != nil {
+			err := fmt.Errorf("Error copying %s into the image: %s", f.Source, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+// copyImageFile copies a file, or the content of a directory, to its destination in the chroot.
+// A file is copied into the destination when it ends with a slash.
+func copyImageFile(ctx context.Context, mountPath string, f ImageFile) error {
+	uid, gid := -1, -1
+	if f.Owner != "" {
+		var err error
+		if uid, gid, err = imageOwner(mountPath, f.Owner); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(f.Source)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(mountPath, f.Destination)
+	if !info.IsDir() {
+		if strings.HasSuffix(f.Destination, "/") {
+			dst = filepath.Join(dst, filepath.Base(f.Source))
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return copyImageFileEntry(f.Source, dst, info, f.mode, uid, gid)
+	}
+
+	return filepath.Walk(f.Source, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(f.Source, src)
+		if err != nil {
+			return err
+		}
+		return copyImageFileEntry(src, filepath.Join(dst, rel), info, f.mode, uid, gid)
+	})
+}
+
+// copyImageFileEntry copies a file, directory or symlink. mode applies to files, and uid and gid
+// to all of them when not -1.
+func copyImageFileEntry(src, dst string, info os.FileInfo, mode os.FileMode, uid, gid int) error {
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	default:
+		if mode == 0 {
+			mode = info.Mode().Perm()
+		}
+		if err := copyRegularFile(src, dst, mode); err != nil {
+			return err
+		}
+	}
+	if uid < 0 {
+		return nil
+	}
+	return os.Lchown(dst, uid, gid)
+}
+
+func copyRegularFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// the umask applies to new files
+	return os.Chmod(dst, mode)
+}
+
+// imageOwner returns the uid and gid of an owner like pi, pi:video or 1000:1000, from the passwd
+// and group files of the image. The group defaults to the primary group of the user.
+func imageOwner(mountPath, owner string) (int, int, error) {
+	user, group := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		user, group = owner[:i], owner[i+1:]
+	}
+	passwd, err := ioutil.ReadFile(filepath.Join(mountPath, "/etc/passwd"))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	uid, err := utils.LookupID(passwd, user)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s of the image: %s", user, err)
+	}
+	if group == "" {
+		for _, line := range strings.Split(string(passwd), "\n") {
+			if fields := strings.Split(line, ":"); len(fields) > 3 && fields[0] == user {
+				group = fields[3]
+			}
+		}
+		if group == "" {
+			group = user
+		}
+	}
+	groups, err := ioutil.ReadFile(filepath.Join(mountPath, "/etc/group"))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	gid, err := utils.LookupID(groups, group)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group %s of the image: %s", group, err)
+	}
+	return uid, gid, nil
+}
+
+func (s *stepCopyImageFiles) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,316 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	osutils "github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// stepInjectFiles runs the provisioners with a communicator that writes the uploaded files
+// straight into the filesystems of the image, with debugfs for ext and mtools for FAT. Nothing
+// is mapped or mounted and nothing runs in the image, so it needs neither root nor qemu, but
+// only file provisioners work.
+type stepInjectFiles struct {
+	ImageKey string
+}
+
+func (s *stepInjectFiles) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	hook := state.Get("hook").(packer.Hook)
+	ui := state.Get("ui").(packer.Ui)
+	config := state.Get("config").(*Config)
+	imagefile := state.Get(s.ImageKey).(string)
+
+	comm, err := newInjectCommunicator(ui, imagefile, config.ImageMounts)
+	if err != nil {
+		err := fmt.Errorf("Error reading the partitions of the image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	log.Println("Running the provision hook")
+	if err := hook.Run(ctx, packer.HookProvision, ui, comm, nil); err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepInjectFiles) Cleanup(state multistep.StateBag) {}
+
+// injectPartition is a filesystem of the image files are written to.
+type injectPartition struct {
+	mnt    string
+	offset int64
+	// ext or vfat
+	fs string
+}
+
+// injectCommunicator uploads files into the partitions of an image that isn't mounted.
+type injectCommunicator struct {
+	image string
+	// longest mount point first
+	partitions []injectPartition
+}
+
+func newInjectCommunicator(ui packer.Ui, imagefile string, mounts []string) (*injectCommunicator, error) {
+	table, err := osutils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return nil, err
+	}
+	if len(table.Partitions) != len(mounts) {
+		return nil, fmt.Errorf("the image has %d partitions but image_mounts has %d", len(table.Partitions), len(mounts))
+	}
+
+	c := &injectCommunicator{image: imagefile}
+	for i, p := range table.Partitions {
+		mnt := mounts[i]
+		if mnt == "" || mnt == skipMount {
+			continue
+		}
+		offset, size := p.Start*table.SectorSize, p.Size*table.SectorSize
+		info, err := osutils.ProbeBlkid(imagefile, offset, size)
+		if err != nil {
+			return nil, fmt.Errorf("error running blkid on partition %d: %s", i+1, err)
+		}
+		fs := info.Type()
+		switch fs {
+		case "ext2", "ext3", "ext4":
+			fs = "ext"
+		case "vfat":
+		default:
+			return nil, fmt.Errorf("can't write files to the %q filesystem of partition %d", info.Type(), i+1)
+		}
+		ui.Message(fmt.Sprintf("Writing files for %s to partition %d (%s)", mnt, i+1, info.Type()))
+		c.partitions = append(c.partitions, injectPartition{mnt: path.Clean(mnt), offset: int64(offset), fs: fs})
+	}
+	sort.Slice(c.partitions, func(i, j int) bool { return len(c.partitions[i].mnt) > len(c.partitions[j].mnt) })
+	return c, nil
+}
+
+func (c *injectCommunicator) Start(_ context.Context, cmd *packer.RemoteCmd) error {
+	return fmt.Errorf("inject_files builds can't run commands, only upload files: %s", cmd.Command)
+}
+
+// partition returns the partition of the absolute path p in the image, and p in that partition.
+func (c *injectCommunicator) partition(p string) (*injectPartition, string, error) {
+	p = path.Clean("/" + p)
+	for i := range c.partitions {
+		part := &c.partitions[i]
+		if part.mnt == "/" {
+			return part, p, nil
+		}
+		if p == part.mnt || strings.HasPrefix(p, part.mnt+"/") {
+			return part, path.Clean("/" + strings.TrimPrefix(p, part.mnt)), nil
+		}
+	}
+	return nil, "", fmt.Errorf("no partition of image_mounts holds %s", p)
+}
+
+func (c *injectCommunicator) Upload(dst string, r io.Reader, fi *os.FileInfo) error {
+	part, p, err := c.partition(dst)
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing %s to partition %s at %s", dst, part.mnt, p)
+
+	tmp, err := ioutil.TempFile("", "inject")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi != nil {
+		mode = (*fi).Mode().Perm()
+	}
+
+	if part.fs == "vfat" {
+		c.mkdirAll(part, path.Dir(p))
+		return c.mtools(part, "mcopy", "-o", tmp.Name(), "::"+p)
+	}
+	quoted, err := debugfsQuote(p)
+	if err != nil {
+		return err
+	}
+	local, err := debugfsQuote(tmp.Name())
+	if err != nil {
+		return err
+	}
+	c.mkdirAll(part, path.Dir(p))
+	// write doesn't replace files, and copies the owner of the local file
+	c.debugfs(part, false, "rm "+quoted)
+	return c.debugfs(part, true,
+		fmt.Sprintf("write %s %s", local, quoted),
+		fmt.Sprintf("sif %s mode 0100%o", quoted, mode),
+		fmt.Sprintf("sif %s uid 0", quoted),
+		fmt.Sprintf("sif %s gid 0", quoted),
+	)
+}
+
+func (c *injectCommunicator) UploadDir(dst string, src string, exclude []string) error {
+	// like cp -R, src/ copies the contents of src
+	if !strings.HasSuffix(src, "/") {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+	return filepath.Walk(src, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, local)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, filepath.ToSlash(rel))
+		if info.IsDir() {
+			part, p, err := c.partition(target)
+			if err != nil {
+				return err
+			}
+			c.mkdirAll(part, p)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			log.Printf("Skipping %s, only regular files can be written to the image", local)
+			return nil
+		}
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.Upload(target, f, &info)
+	})
+}
+
+func (c *injectCommunicator) Download(src string, w io.Writer) error {
+	part, p, err := c.partition(src)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile("", "inject")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if part.fs == "vfat" {
+		err = c.mtools(part, "mcopy", "-o", "::"+p, tmp.Name())
+	} else {
+		err = c.dump(part, p, tmp.Name())
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (c *injectCommunicator) DownloadDir(src string, dst string, exclude []string) error {
+	return fmt.Errorf("inject_files builds can't download directories")
+}
+
+// mkdirAll creates dir and its parents in part. Errors are ignored, as creating directories
+// fails when they exist, and writing their files fails after.
+func (c *injectCommunicator) mkdirAll(part *injectPartition, dir string) {
+	var cmds []string
+	for d := dir; d != "/"; d = path.Dir(d) {
+		cmds = append([]string{d}, cmds...)
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	if part.fs == "vfat" {
+		for _, d := range cmds {
+			c.mtools(part, "mmd", "-D", "s", "::"+d)
+		}
+		return
+	}
+	for i, d := range cmds {
+		quoted, err := debugfsQuote(d)
+		if err != nil {
+			return
+		}
+		cmds[i] = "mkdir " + quoted
+	}
+	c.debugfs(part, false, cmds...)
+}
+
+// dump copies the file p of the ext filesystem of part to the local file dst.
+func (c *injectCommunicator) dump(part *injectPartition, p, dst string) error {
+	quoted, err := debugfsQuote(p)
+	if err != nil {
+		return err
+	}
+	local, err := debugfsQuote(dst)
+	if err != nil {
+		return err
+	}
+	return c.debugfs(part, true, fmt.Sprintf("dump %s %s", quoted, local))
+}
+
+// debugfsQuote quotes a path for a debugfs request. debugfs has no escapes, so paths with
+// double quotes or newlines can't be written.
+func debugfsQuote(p string) (string, error) {
+	if strings.ContainsAny(p, "\"\n") {
+		return "", fmt.Errorf("debugfs can't write paths with double quotes or newlines: %q", p)
+	}
+	return `"` + p + `"`, nil
+}
+
+// debugfs runs requests on the ext filesystem of part. debugfs always exits with 0, so when
+// strict the requests fail if they print errors.
+func (c *injectCommunicator) debugfs(part *injectPartition, strict bool, requests ...string) error {
+	cmd := exec.Command("debugfs", "-w", "-f", "-", fmt.Sprintf("%s?offset=%d", c.image, part.offset))
+	cmd.Stdin = strings.NewReader(strings.Join(requests, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running debugfs, is e2fsprogs installed? %s", err)
+	}
+	if !strict {
+		return nil
+	}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		// the version banner
+		if line == "" || strings.HasPrefix(line, "debugfs ") {
+			continue
+		}
+		return fmt.Errorf("debugfs: %s", line)
+	}
+	return nil
+}
+
+// mtools runs an mtools command on the FAT filesystem of part.
+func (c *injectCommunicator) mtools(part *injectPartition, name string, args ...string) error {
+	cmd := exec.Command(name, append([]string{"-i", fmt.Sprintf("%s@@%d", c.image, part.offset)}, args...)...)
+	// the partition geometry of images doesn't match what mtools expects
+	cmd.Env = append(os.Environ(), "MTOOLS_SKIP_CHECK=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error running %s, is mtools installed? %s: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
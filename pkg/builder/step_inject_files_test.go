@@ -0,0 +1,64 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestDebugfsQuote(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+		wantErr    bool
+	}{
+		{path: "/etc/hostname", want: `"/etc/hostname"`},
+		{path: "/opt/with space/$HOME`id`", want: "\"/opt/with space/$HOME`id`\""},
+		{path: `/etc/"quoted"`, wantErr: true},
+		{path: "/etc/new\nline", wantErr: true},
+	} {
+		got, err := debugfsQuote(tc.path)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("debugfsQuote(%q) error = %v, want an error: %v", tc.path, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("debugfsQuote(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestInjectExtFiles(t *testing.T) {
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs not found")
+	}
+	f, err := ioutil.TempFile("", "inject-ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Truncate(8 << 20)
+	f.Close()
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", f.Name()).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4: %v: %s", err, out)
+	}
+
+	c := &injectCommunicator{image: f.Name(), partitions: []injectPartition{{mnt: "/", fs: "ext"}}}
+	const dst = "/opt/with space/$HOME`id`"
+	if err := c.Upload(dst, strings.NewReader("content"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := c.Download(dst, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "content" {
+		t.Errorf("read back %q, want %q", got.String(), "content")
+	}
+
+	if err := c.Upload(`/etc/"quoted"`, strings.NewReader("content"), nil); err == nil {
+		t.Errorf("uploaded a path with double quotes")
+	}
+}
@@ -0,0 +1,164 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// imageManifest describes the layout of the final image, for provisioning databases and
+// flashing tools. offsets and sizes are in bytes.
+type imageManifest struct {
+	Image          string              `json:"image"`
+	Size           int64               `json:"size"`
+	Sha256         string              `json:"sha256"`
+	PartitionTable string              `json:"partition_table"`
+	DiskID         string              `json:"disk_id"`
+	Partitions     []manifestPartition `json:"partitions"`
+	// the image published with output_xz
+	Compressed *manifestFile `json:"compressed,omitempty"`
+	// the hash tree of dm_verity
+	DmVerity *dmVerityInfo `json:"dm_verity,omitempty"`
+}
+
+type manifestPartition struct {
+	Number     int    `json:"number"`
+	Start      uint64 `json:"start"`
+	Size       uint64 `json:"size"`
+	Type       string `json:"type"`
+	Bootable   bool   `json:"bootable,omitempty"`
+	PartUUID   string `json:"partuuid"`
+	PartLabel  string `json:"partlabel,omitempty"`
+	Filesystem string `json:"filesystem"`
+	UUID       string `json:"uuid,omitempty"`
+	Label      string `json:"label,omitempty"`
+}
+
+type manifestFile struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// stepCollectManifest reads the partition table and filesystems of the unmapped image.
+// the manifest is written by stepWriteManifest, once the image is compressed if it is.
+type stepCollectManifest struct {
+	ImageKey string
+	// the image is about to be compressed, which hashes it anyway
+	Compressed bool
+}
+
+func (s *stepCollectManifest) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	image := state.Get(s.ImageKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Collecting the partition layout of the image")
+	manifest, err := s.collect(image)
+	if err != nil {
+		err := fmt.Errorf("Error collecting the image manifest: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if verity, ok := state.GetOk("dm_verity"); ok {
+		manifest.DmVerity = verity.(*dmVerityInfo)
+	}
+	state.Put("manifest", manifest)
+	return multistep.ActionContinue
+}
+
+func (s *stepCollectManifest) collect(image string) (*imageManifest, error) {
+	table, err := utils.ReadPartitionTable(image)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the partition table: %v", err)
+	}
+	stat, err := os.Stat(image)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &imageManifest{Image: image, Size: stat.Size(), PartitionTable: table.Label, DiskID: table.ID}
+	for _, p := range table.Partitions {
+		part := manifestPartition{
+			Number:    p.Number(),
+			Start:     p.Start * table.SectorSize,
+			Size:      p.Size * table.SectorSize,
+			Type:      p.Type,
+			Bootable:  p.Bootable,
+			PartUUID:  table.PartUUID(p.Number()),
+			PartLabel: p.Name,
+		}
+		info, err := utils.ProbeBlkid(image, part.Start, part.Size)
+		if err != nil {
+			return nil, fmt.Errorf("error running blkid on partition %d: %v", part.Number, err)
+		}
+		part.Filesystem, part.UUID, part.Label = info.Type(), info.UUID(), info.Label()
+		manifest.Partitions = append(manifest.Partitions, part)
+	}
+
+	if !s.Compressed {
+		if manifest.Sha256, err = sha256File(image); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *stepCollectManifest) Cleanup(state multistep.StateBag) {}
+
+// stepWriteManifest writes the manifest next to the artifact, as <artifact>.manifest.json.
+type stepWriteManifest struct {
+	ImageKey string
+}
+
+func (s *stepWriteManifest) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	manifest := state.Get("manifest").(*imageManifest)
+	ui := state.Get("ui").(packer.Ui)
+
+	artifact := state.Get(s.ImageKey).(string)
+	if c, ok := state.GetOk("compressed_image"); ok {
+		compressed := c.(*compressedImage)
+		manifest.Sha256 = compressed.ExtractSha256
+		manifest.Compressed = &manifestFile{File: artifact, Size: compressed.DownloadSize, Sha256: compressed.DownloadSha256}
+	}
+
+	path := artifact + ".manifest.json"
+	ui.Say(fmt.Sprintf("Writing image manifest to %s", path))
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error writing the image manifest: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("manifest_file", path)
+	addArtifactFiles(state, path)
+	return multistep.ActionContinue
+}
+
+func (s *stepWriteManifest) Cleanup(state multistep.StateBag) {}
@@ -3,37 +3,80 @@ package builder
 import (
 	"context"
 	"fmt"
-	"os/exec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	osutils "github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+const (
+	// MapperKpartx maps the partitions with device mapper
+	MapperKpartx = "kpartx"
+	// MapperLosetup attaches each partition to a loop device of its own, by offset
+	MapperLosetup = "losetup"
 )
 
 type stepMapImage struct {
 	ImageKey  string
 	ResultKey string
+	// map the partitions read-only, to check the finished image
+	ReadOnly bool
+	unmapped bool
+	// the loop device images with 4096 byte sectors are attached to, as kpartx assumes
+	// image files have 512 byte sectors
+	loop string
+	// with losetup, the loop devices of the partitions, and the directory of their links
+	loops   []string
+	linkDir string
 }
 
-func (s *stepMapImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+func (s *stepMapImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	// Read our value and assert that it is they type we want
 	image := state.Get(s.ImageKey).(string)
 	ui := state.Get("ui").(packer.Ui)
 
 	ui.Message(fmt.Sprintf("mapping %s", image))
+	if state.Get("config").(*Config).PartitionMapper == MapperLosetup {
+		partitions, err := s.attachPartitions(ctx, state, image)
+		if err != nil {
+			ui.Error(fmt.Sprintf("error attaching the partitions of %s: %v", image, err))
+			s.detachPartitions(state)
+			return multistep.ActionHalt
+		}
+		state.Put(s.ResultKey, partitions)
+		state.Put("map_image_cleanup", s)
+		return multistep.ActionContinue
+	}
 	// if run(state, fmt.Sprintf(
 	//	"kpartx -s -a %s",
 	//	image)) != nil {
 	//	return multistep.ActionHalt
 	//}
 
-	out, err := exec.Command("kpartx", "-s", "-a", "-v", image).CombinedOutput()
-	ui.Say(fmt.Sprintf("kpartx -s -a -v %s", image))
+	target := image
+	if shift, err := imageSectorShift(image); err == nil && shift != SectorShift {
+		if err := s.attachLoop(ctx, state, image); err != nil {
+			ui.Error(fmt.Sprintf("error attaching image with 4096 byte sectors: %v", err))
+			return multistep.ActionHalt
+		}
+		target = s.loop
+	}
+
+	args := []string{"-s", "-a", "-v"}
+	if s.ReadOnly {
+		args = append(args, "-r")
+	}
+	out, err := runCommandOutput(ctx, state, fmt.Sprintf("kpartx %s %s", strings.Join(args, " "), target))
+	ui.Say(fmt.Sprintf("kpartx %s %s", strings.Join(args, " "), target))
 
 	// out, err := exec.Command("kpartx", "-l", image).CombinedOutput()
 	// ui.Say(fmt.Sprintf("kpartx -l: %s", string(out)))
 	if err != nil {
-		ui.Error(fmt.Sprintf("error kaprts -l %v: %s", err, string(out)))
+		ui.Error(fmt.Sprintf("error kaprts -l %v", err))
 		s.Cleanup(state)
 		return multistep.ActionHalt
 	}
@@ -50,7 +93,7 @@ func (s *stepMapImage) Run(_ context.Context, state multistep.StateBag) multiste
 			add map loop20p1 (254:22): 0 88262 linear 7:20 8192
 			add map loop20p2 (254:23): 0 3538944 linear 7:20 98304
 	*/
-	lines := strings.Split(string(out), "\n")
+	lines := strings.Split(out, "\n")
 
 	var partitions []string
 	for _, line := range lines {
@@ -60,7 +103,7 @@ func (s *stepMapImage) Run(_ context.Context, state multistep.StateBag) multiste
 		}
 		device := strings.Split(string(line), " ")
 		if len(device) != 9 {
-			ui.Error("bad kpartx output: " + string(out))
+			ui.Error("bad kpartx output: " + out)
 			s.Cleanup(state)
 			return multistep.ActionHalt
 		}
@@ -68,11 +111,105 @@ func (s *stepMapImage) Run(_ context.Context, state multistep.StateBag) multiste
 	}
 
 	state.Put(s.ResultKey, partitions)
+	state.Put("map_image_cleanup", s)
 
 	return multistep.ActionContinue
 }
 
 func (s *stepMapImage) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *stepMapImage) CleanupFunc(state multistep.StateBag) error {
+	if s.unmapped {
+		return nil
+	}
+	if s.linkDir != "" {
+		return s.detachPartitions(state)
+	}
 	image := state.Get(s.ImageKey).(string)
-	run(context.TODO(), state, fmt.Sprintf("kpartx -d %s", image))
+	if s.loop != "" {
+		image = s.loop
+	}
+	if err := run(context.TODO(), state, fmt.Sprintf("kpartx -d %s", image)); err != nil {
+		return err
+	}
+	if s.loop != "" {
+		if err := run(context.TODO(), state, fmt.Sprintf("losetup -d %s", s.loop)); err != nil {
+			return err
+		}
+		s.loop = ""
+	}
+	s.unmapped = true
+	return nil
+}
+
+func (s *stepMapImage) attachLoop(ctx context.Context, state multistep.StateBag, image string) error {
+	args := []string{"--find", "--show", "--sector-size", "4096"}
+	if s.ReadOnly {
+		args = append(args, "--read-only")
+	}
+	out, err := runCommandOutput(ctx, state, fmt.Sprintf("losetup %s %s", strings.Join(args, " "), image))
+	if err != nil {
+		return err
+	}
+	s.loop = strings.TrimSpace(out)
+	return nil
+}
+
+// attachPartitions attaches each partition of the partition table to a loop device with its
+// offset and size, for hosts without device mapper. The devices are linked as p1, p2... in a
+// temporary directory, so the partition numbers can be found from their names like with kpartx.
+// Like kpartx, extended partitions are mapped to their first 2 sectors.
+func (s *stepMapImage) attachPartitions(ctx context.Context, state multistep.StateBag, image string) ([]string, error) {
+	table, err := osutils.ReadPartitionTable(image)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the partition table: %s", err)
+	}
+	if s.linkDir, err = ioutil.TempDir("", "packer-partitions"); err != nil {
+		return nil, err
+	}
+
+	var partitions []string
+	for _, p := range table.Partitions {
+		size := p.Size
+		if p.Type == "5" || p.Type == "f" || p.Type == "85" {
+			size = 2
+		}
+		args := []string{"--find", "--show",
+			"--offset", fmt.Sprint(p.Start * table.SectorSize),
+			"--sizelimit", fmt.Sprint(size * table.SectorSize)}
+		if s.ReadOnly {
+			args = append(args, "--read-only")
+		}
+		out, err := runCommandOutput(ctx, state, fmt.Sprintf("losetup %s %s", strings.Join(args, " "), image))
+		if err != nil {
+			return nil, err
+		}
+		loop := strings.TrimSpace(out)
+		s.loops = append(s.loops, loop)
+
+		link := filepath.Join(s.linkDir, fmt.Sprintf("p%d", p.Number()))
+		if err := os.Symlink(loop, link); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, link)
+	}
+	return partitions, nil
+}
+
+func (s *stepMapImage) detachPartitions(state multistep.StateBag) error {
+	for len(s.loops) > 0 {
+		last := len(s.loops) - 1
+		if err := run(context.TODO(), state, fmt.Sprintf("losetup -d %s", s.loops[last])); err != nil {
+			return err
+		}
+		s.loops = s.loops[:last]
+	}
+	if err := os.RemoveAll(s.linkDir); err != nil {
+		return err
+	}
+	s.linkDir = ""
+	s.unmapped = true
+	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
@@ -12,11 +13,23 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
+// stepMountImage mounts the image partitions.
+//
+// Produces:
+//
+//	root_partition string - The partition mounted at /
+//	boot_mount string - Where the first FAT partition is mounted in the chroot, if any
+//	mounted_partitions map[string]string - The partitions mounted, by mount point in the chroot
+//	mount_image_cleanup CleanupFunc - To perform early cleanup
 type stepMountImage struct {
 	PartitionsKey string
 	ResultKey     string
 	MountPath     string
 	mountpoints   []string
+	// the directories of the overlays on read-only root filesystems
+	overlayDirs []string
+	// the squashfs partitions unpacked with repack_squashfs
+	squashfs []*squashfsPartition
 }
 
 func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -26,11 +39,40 @@ func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) mult
 	partitions := state.Get(s.PartitionsKey).([]string)
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say(fmt.Sprintf("partitions: %v", partitions))
+	blkid := hostBlkid(ctx, state)
 
-	// assume first one is boot and second one is root!
-	if len(partitions) != len(config.ImageMounts) {
-		ui.Error(fmt.Sprintf("error different of partitions than expected %v", len(partitions)))
-		return multistep.ActionHalt
+	// the default mounts of detected image types follow the fstab of the image, see followFstab
+	fromFstab := config.detectImageType && config.defaultImageMounts && len(config.PartitionMounts) == 0
+
+	var mounts []string
+	if len(config.PartitionMounts) > 0 {
+		var err error
+		mounts, err = resolvePartitionMounts(blkid, config.PartitionMounts, partitions)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	} else {
+		if resolve, ok := knownMountResolvers[config.ImageType]; ok && config.defaultImageMounts {
+			// the mounts of add_partitions follow the ones of the image type
+			added := len(config.AddPartitions)
+			if added > len(partitions) {
+				added = len(partitions)
+			}
+			resolved, err := resolve(blkid, partitions[:len(partitions)-added])
+			if err != nil {
+				ui.Error(fmt.Sprintf("error finding the partitions to mount: %v", err))
+				return multistep.ActionHalt
+			}
+			config.ImageMounts = append(resolved, config.ImageMounts[len(config.ImageMounts)-added:]...)
+			config.defaultImageMounts = false
+		}
+		// assume first one is boot and second one is root!
+		if len(partitions) != len(config.ImageMounts) {
+			ui.Error(fmt.Sprintf("error different of partitions than expected %v", len(partitions)))
+			return multistep.ActionHalt
+		}
+		mounts = config.ImageMounts
 	}
 
 	if len(s.MountPath) > 0 {
@@ -48,26 +90,70 @@ func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) mult
 		s.MountPath = tempDir
 	}
 
-	mountsAndPartitions := make([]struct{ part, mnt string }, len(partitions))
+	mountsAndPartitions := make([]partitionMount, len(partitions))
 	for i := range partitions {
 		mountsAndPartitions[i].part = partitions[i]
-		mountsAndPartitions[i].mnt = config.ImageMounts[i]
+		mountsAndPartitions[i].mnt = mounts[i]
 	}
 
 	// sort so we mount with the right order
 	// sort that / is mounted before /boot
-	sort.Slice(mountsAndPartitions, func(i, j int) bool { return mountsAndPartitions[i].mnt < mountsAndPartitions[j].mnt })
+	sortPartitionMounts(mountsAndPartitions)
 
-	for _, mntAndPart := range mountsAndPartitions {
+	bootNumber := 0
+	mounted := map[string]string{}
+	state.Put("mounted_partitions", mounted)
+	for k, mntAndPart := range mountsAndPartitions {
 		if mntAndPart.mnt == "" {
+			ui.Message(fmt.Sprintf("Skipping: %s", mntAndPart.part))
 			continue
 		}
 
+		info, err := blkid(mntAndPart.part)
+		if err != nil {
+			ui.Error(fmt.Sprintf("error running blkid on %s: %v", mntAndPart.part, err))
+			return multistep.ActionHalt
+		}
+		if fstype := info.Type(); fstype == "" || fstype == "swap" {
+			ui.Error(fmt.Sprintf("partition %s has no mountable filesystem (type %q), mark it as %q to leave it unmounted",
+				mntAndPart.part, fstype, skipMount))
+			return multistep.ActionHalt
+		}
+
 		mntpnt := filepath.Join(s.MountPath, mntAndPart.mnt)
+		mounted[mntAndPart.mnt] = mntAndPart.part
 
 		ui.Message(fmt.Sprintf("Mounting: %s", mntAndPart.part))
 
-		err := run(ctx, state, fmt.Sprintf(
+		if info.Type() == "squashfs" && config.RepackSquashfs {
+			if err := s.unpackSquashfs(ctx, state, mntAndPart.part, mntpnt); err != nil {
+				ui.Error(fmt.Sprintf("error unpacking the squashfs filesystem of %s: %v", mntAndPart.part, err))
+				return multistep.ActionHalt
+			}
+			if mntAndPart.mnt == "/" {
+				state.Put("root_partition", mntAndPart.part)
+			}
+			continue
+		}
+
+		if readOnlyFilesystems[info.Type()] && mntAndPart.mnt == "/" {
+			overlay, err := rootOverlayPartition(blkid, config, partitions)
+			if err != nil {
+				ui.Error(fmt.Sprintf("error finding the overlay partition of the read-only root filesystem: %v", err))
+				return multistep.ActionHalt
+			}
+			if overlay != "" {
+				ui.Message(fmt.Sprintf("Provisioning through the overlay on %s", overlay))
+			}
+			if err := s.mountReadOnlyRoot(ctx, state, mntAndPart.part, info.Type(), mntpnt, overlay, config.RootOverlayUpperdir); err != nil {
+				ui.Error(fmt.Sprintf("error mounting the read-only root filesystem %s: %v", mntAndPart.part, err))
+				return multistep.ActionHalt
+			}
+			state.Put("root_partition", mntAndPart.part)
+			continue
+		}
+
+		err = run(ctx, state, fmt.Sprintf(
 			"mount %s %s",
 			mntAndPart.part, mntpnt))
 		if err != nil {
@@ -75,28 +161,137 @@ func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) mult
 		}
 
 		s.mountpoints = append(s.mountpoints, mntpnt)
+		if info.Type() == "vfat" {
+			if n, err := partitionNumber(mntAndPart.part); err == nil && (bootNumber == 0 || n < bootNumber) {
+				bootNumber = n
+				state.Put("boot_mount", mntAndPart.mnt)
+			}
+		}
+		if mntAndPart.mnt == "/" {
+			state.Put("root_partition", mntAndPart.part)
+			if info.Type() == "btrfs" {
+				if err := s.mountBtrfsSubvolumes(ctx, state, mntAndPart.part, mntpnt, info, mounts); err != nil {
+					ui.Error(fmt.Sprintf("error mounting the btrfs subvolumes of %s: %v", mntAndPart.part, err))
+					return multistep.ActionHalt
+				}
+			}
+			if fromFstab {
+				if err := followFstab(ui, blkid, mntpnt, mountsAndPartitions[k+1:], partitions, mounts); err != nil {
+					ui.Error(fmt.Sprintf("error reading the fstab of the image: %v", err))
+					return multistep.ActionHalt
+				}
+			}
+		}
 	}
 
 	state.Put(s.ResultKey, s.MountPath)
+	state.Put("mount_image_cleanup", s)
 	return multistep.ActionContinue
 }
 
 func (s *stepMountImage) Cleanup(state multistep.StateBag) {
 	ui := state.Get("ui").(packer.Ui)
 
-	if s.MountPath != "" {
-		for _, mntpnt := range reverse(s.mountpoints) {
-			run(context.TODO(), state, "umount "+mntpnt)
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+		return
+	}
+	// kept until the end of the build for stepRepackSquashfs
+	for _, p := range s.squashfs {
+		os.RemoveAll(p.Dir)
+	}
+	s.squashfs = nil
+}
+
+func (s *stepMountImage) CleanupFunc(state multistep.StateBag) error {
+	if s.MountPath == "" {
+		return nil
+	}
+
+	var umountErr error
+	for _, mntpnt := range reverse(s.mountpoints) {
+		if err := runCommand(context.TODO(), state, "umount "+mntpnt); err != nil {
+			// fuser -m on a directory that is not a mountpoint anymore would kill the processes
+			// using the filesystem it's on, the root filesystem of the host
+			if runCommand(context.TODO(), state, "mountpoint -q "+mntpnt) != nil {
+				log.Printf("umount %s failed, but it is not mounted anymore: %s", mntpnt, err)
+				continue
+			}
+			// likely busy with what an interrupted provisioner left running
+			log.Printf("umount %s failed, killing the processes using it: %s", mntpnt, err)
+			runCommand(context.TODO(), state, "fuser -k -M -m "+mntpnt)
+			if err := run(context.TODO(), state, "umount "+mntpnt); err != nil && umountErr == nil {
+				umountErr = err
+			}
 		}
-		s.mountpoints = nil
-		// DO NOT do remove all here! if dev fails to umount it would be undesirable.
-		err := os.Remove(s.MountPath)
-		if err != nil {
-			ui.Error(err.Error())
+	}
+	s.mountpoints = nil
+	// DO NOT do remove all here! if dev fails to umount it would be undesirable.
+	if umountErr == nil {
+		for _, dir := range s.overlayDirs {
+			removeOverlayDir(dir)
 		}
+		s.overlayDirs = nil
+	}
+	err := os.Remove(s.MountPath)
+	s.MountPath = ""
+	if umountErr != nil {
+		return umountErr
+	}
+	return err
+}
+
+// partitionMount is where a partition is mounted in the chroot, "" when it isn't.
+type partitionMount struct{ part, mnt string }
 
-		s.MountPath = ""
+// sortPartitionMounts sorts mounts so parents are mounted first, and the partitions that aren't
+// mounted last, for followFstab to mount them.
+func sortPartitionMounts(mounts []partitionMount) {
+	sort.Slice(mounts, func(i, j int) bool {
+		if (mounts[i].mnt == "") != (mounts[j].mnt == "") {
+			return mounts[j].mnt == ""
+		}
+		return mounts[i].mnt < mounts[j].mnt
+	})
+}
+
+// followFstab moves the partitions of rest, which aren't mounted yet, to where the fstab of the
+// image mounted at rootDir mounts them, so the default mounts of detected image types follow the
+// layout of the image, like a boot partition at /boot/firmware rather than /boot. The moves are
+// also made to mounts, the mounts of partitions.
+func followFstab(ui packer.Ui, blkid blkidFunc, rootDir string, rest []partitionMount, partitions, mounts []string) error {
+	var parts []string
+	for _, pm := range rest {
+		parts = append(parts, pm.part)
+	}
+	fstab, err := fstabMounts(blkid, rootDir, parts)
+	if err != nil {
+		return err
+	}
+
+	// the mounts the fstab doesn't move stay where they are
+	used := map[string]bool{"/": true}
+	for _, pm := range rest {
+		if _, ok := fstab[pm.part]; !ok && pm.mnt != "" {
+			used[pm.mnt] = true
+		}
+	}
+	for i := range rest {
+		mnt, ok := fstab[rest[i].part]
+		if !ok || mnt == rest[i].mnt || used[mnt] {
+			continue
+		}
+		ui.Message(fmt.Sprintf("Mounting %s at %s, like the fstab of the image", rest[i].part, mnt))
+		rest[i].mnt = mnt
+		used[mnt] = true
+		for j, p := range partitions {
+			if p == rest[i].part {
+				mounts[j] = mnt
+			}
+		}
 	}
+	sortPartitionMounts(rest)
+	return nil
 }
 
 func reverse(numbers []string) []string {
@@ -0,0 +1,142 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// isShareURL tells if a source url is on a network share that stepMountSource mounts.
+func isShareURL(u string) bool {
+	lower := strings.ToLower(u)
+	return strings.HasPrefix(lower, "nfs://") || strings.HasPrefix(lower, "smb://")
+}
+
+// absoluteFileURL makes relative file:// urls, like file://images/raspios.img, absolute. Such a
+// url would otherwise be read as a file on the host "images".
+func absoluteFileURL(u string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(u), "file:") {
+		return u, nil
+	}
+	p := strings.TrimPrefix(u[len("file:"):], "//")
+	if filepath.IsAbs(p) {
+		return u, nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return "file://" + abs, nil
+}
+
+// stepMountSource mounts the nfs:// and smb:// source urls read-only, and points the download
+// step to the image on the mounted share, which is then used in place.
+//
+// nfs://host[:port]/path/to/image.img mounts host:/path/to.
+// smb://[user[:password]@]host/share/path/to/image.img mounts //host/share.
+type stepMountSource struct {
+	Download *packer_common_commonsteps.StepDownload
+	mounts   []string
+}
+
+func (s *stepMountSource) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	for i, source := range s.Download.Url {
+		if !isShareURL(source) {
+			continue
+		}
+		u, err := url.Parse(source)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Invalid source url %s: %v", source, err))
+			return multistep.ActionHalt
+		}
+
+		mountPath, err := ioutil.TempDir("", "packer-source")
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		ui.Say(fmt.Sprintf("Mounting %s://%s", u.Scheme, u.Host))
+		var file string
+		if strings.ToLower(u.Scheme) == "nfs" {
+			file, err = s.mountNfs(ctx, state, u, mountPath)
+		} else {
+			file, err = s.mountSmb(ctx, state, u, mountPath)
+		}
+		if err != nil {
+			os.Remove(mountPath)
+			err := fmt.Errorf("Error mounting source share: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		s.mounts = append(s.mounts, mountPath)
+		s.Download.Url[i] = "file://" + file
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepMountSource) mountNfs(ctx context.Context, state multistep.StateBag, u *url.URL, mountPath string) (string, error) {
+	dir, file := path.Split(u.Path)
+	opts := "ro"
+	if port := u.Port(); port != "" {
+		opts += ",port=" + port
+	}
+	if err := run(ctx, state, fmt.Sprintf("mount -t nfs -o %s '%s:%s' %s", opts, u.Hostname(), dir, mountPath)); err != nil {
+		return "", err
+	}
+	return filepath.Join(mountPath, file), nil
+}
+
+func (s *stepMountSource) mountSmb(ctx context.Context, state multistep.StateBag, u *url.URL, mountPath string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", fmt.Errorf("smb url must include a share and a file path")
+	}
+
+	opts := "ro,guest"
+	if u.User != nil {
+		// pass the credentials in a file, so they don't show up in the command line
+		creds, err := ioutil.TempFile("", "packer-smb")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(creds.Name())
+		password, _ := u.User.Password()
+		_, err = fmt.Fprintf(creds, "username=%s\npassword=%s\n", u.User.Username(), password)
+		creds.Close()
+		if err != nil {
+			return "", err
+		}
+		opts = "ro,credentials=" + creds.Name()
+	}
+
+	if err := run(ctx, state, fmt.Sprintf("mount -t cifs -o %s '//%s/%s' %s", opts, u.Host, parts[0], mountPath)); err != nil {
+		return "", err
+	}
+	return filepath.Join(mountPath, parts[1]), nil
+}
+
+func (s *stepMountSource) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+	for _, mountPath := range reverse(s.mounts) {
+		if err := run(context.TODO(), state, "umount "+mountPath); err != nil {
+			continue
+		}
+		if err := os.Remove(mountPath); err != nil {
+			ui.Error(err.Error())
+		}
+	}
+	s.mounts = nil
+}
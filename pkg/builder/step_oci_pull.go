@@ -0,0 +1,121 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// isOCIURL tells if a source url is an artifact in an OCI registry, like
+// oci://ghcr.io/acme/acme-os:1.2.
+func isOCIURL(u string) bool {
+	return strings.HasPrefix(strings.ToLower(u), "oci://")
+}
+
+// ociReference returns the registry reference of an oci:// url or of oci_push, which oras takes.
+func ociReference(u string) string {
+	if isOCIURL(u) {
+		return u[len("oci://"):]
+	}
+	return u
+}
+
+// orasCommand returns the command line of an oras subcommand, for registries served over http
+// when plainHTTP is set.
+func orasCommand(plainHTTP bool, subcommand string, args ...string) string {
+	cmd := []string{"oras", subcommand}
+	if plainHTTP {
+		cmd = append(cmd, "--plain-http")
+	}
+	for _, arg := range args {
+		cmd = append(cmd, shellQuote(arg))
+	}
+	return strings.Join(cmd, " ")
+}
+
+// stepOciPull pulls the oci:// sources of the download step with oras, to the packer cache, and
+// points the download step to the pulled image, which it then verifies against iso_checksum. The
+// largest file of the artifact is the image, so it can have a checksum or signature file besides
+// it. Artifacts pulled by digest are pulled once, tags are pulled again by each build. When a
+// pull fails, the download step falls back to the other urls. Registry credentials are the ones
+// of oras login or docker login.
+type stepOciPull struct {
+	Download  *packer_common_commonsteps.StepDownload
+	PlainHTTP bool
+	// keep the archive of rootfs archive sources, see keepArchive
+	KeepArchive bool
+}
+
+func (s *stepOciPull) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	var urls []string
+	var image string
+	for _, source := range s.Download.Url {
+		if !isOCIURL(source) {
+			urls = append(urls, source)
+			continue
+		}
+		if image != "" {
+			continue
+		}
+		ui.Say(fmt.Sprintf("Pulling %s", ociReference(source)))
+		var err error
+		if image, err = s.pull(ctx, state, ociReference(source)); err != nil {
+			ui.Error(fmt.Sprintf("Pull of %s failed: %s", source, err))
+			continue
+		}
+		ui.Message(fmt.Sprintf("%s => %s", source, image))
+		u := "file://" + image
+		if s.KeepArchive {
+			u = keepArchive(u)
+		}
+		urls = append([]string{u}, urls...)
+	}
+	if len(urls) == 0 {
+		err := fmt.Errorf("Error downloading the image: all OCI pulls failed")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.Download.Url = urls
+	return multistep.ActionContinue
+}
+
+// pull pulls the artifact at ref to the cache, unless a previous build pulled the same digest,
+// and returns the path of its image.
+func (s *stepOciPull) pull(ctx context.Context, state multistep.StateBag, ref string) (string, error) {
+	dir, err := packer.CachePath(fmt.Sprintf("oci-%x", sha1.Sum([]byte(ref))))
+	if err != nil {
+		return "", err
+	}
+	complete := filepath.Join(dir, ".packer-complete")
+	if _, err := os.Stat(complete); err == nil && strings.Contains(ref, "@") {
+		return largestFile(dir)
+	}
+	// a tag may have moved since the last pull, whose files must not be taken for the image
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	if err := runCommand(ctx, state, orasCommand(s.PlainHTTP, "pull", "--output", dir, ref)); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(complete, nil, 0644); err != nil {
+		return "", err
+	}
+	return largestFile(dir)
+}
+
+func (s *stepOciPull) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,104 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// ociArtifactType is the artifact type of the images pushed to OCI registries.
+const ociArtifactType = "application/vnd.packer-arm-image.image.v1"
+
+// ociPushFiles are the outputs pushed with the image, by state key, and their media types.
+var ociPushFiles = []struct {
+	Key, MediaType string
+}{
+	{"manifest_file", "application/vnd.packer-arm-image.manifest.v1+json"},
+	{"bmap_file", "application/vnd.bmap+xml"},
+	// spdx or cyclonedx, by the sbom format
+	{"sbom_file", ""},
+	{"provenance_file", "application/vnd.dsse.envelope.v1+json"},
+}
+
+// stepOciPush pushes the artifact to an OCI registry with oras, as an artifact with the image and
+// the manifest, bmap, SBOM and provenance written by the build, so it can be pulled back with an
+// oci:// iso_url or with oras pull. Registry credentials are the ones of oras login or docker
+// login.
+//
+// Produces:
+//
+//	oci_reference string - The reference the artifact was pushed to
+type stepOciPush struct {
+	ImageKey  string
+	Reference string
+	PlainHTTP bool
+}
+
+func (s *stepOciPush) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	image := state.Get(s.ImageKey).(string)
+
+	// the files are pushed by name from a directory of links to them, as oras names the files
+	// of the artifact after the paths it's given
+	dir, err := ioutil.TempDir("", "oci-push")
+	if err != nil {
+		err := fmt.Errorf("Error creating a temporary directory: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	defer os.RemoveAll(dir)
+
+	imageType := "application/vnd.packer-arm-image.disk.v1"
+	if _, ok := state.GetOk("compressed_image"); ok {
+		imageType += "+xz"
+	}
+	files := map[string]string{image: imageType}
+	paths := []string{image}
+	for _, f := range ociPushFiles {
+		path, ok := state.GetOk(f.Key)
+		if !ok {
+			continue
+		}
+		mediaType := f.MediaType
+		if f.Key == "sbom_file" {
+			mediaType = "application/spdx+json"
+			if config.Sbom == SbomCycloneDX {
+				mediaType = "application/vnd.cyclonedx+json"
+			}
+		}
+		files[path.(string)] = mediaType
+		paths = append(paths, path.(string))
+	}
+
+	args := []string{"--artifact-type", ociArtifactType, s.Reference}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			err = os.Symlink(abs, filepath.Join(dir, filepath.Base(path)))
+		}
+		if err != nil {
+			err := fmt.Errorf("Error linking %s to push it: %s", path, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		args = append(args, filepath.Base(path)+":"+files[path])
+	}
+
+	ui.Say(fmt.Sprintf("Pushing the image to %s", s.Reference))
+	cmd := fmt.Sprintf("cd %s && %s", shellQuote(dir), orasCommand(s.PlainHTTP, "push", args...))
+	if err := run(ctx, state, cmd); err != nil {
+		return multistep.ActionHalt
+	}
+	state.Put("oci_reference", s.Reference)
+	return multistep.ActionContinue
+}
+
+func (s *stepOciPush) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,74 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepOstreeCommit commits the provisioned filesystems of the mounted image to an OSTree
+// repository. The tree is imported from a tarball, the one of rootfs_tarball when there is one,
+// so the host mounts and qemu binaries of the chroot are left out like there.
+type stepOstreeCommit struct {
+	ChrootKey string
+	Commit    OstreeCommit
+}
+
+func (s *stepOstreeCommit) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	if _, err := os.Stat(filepath.Join(s.Commit.Repo, "config")); os.IsNotExist(err) {
+		ui.Say(fmt.Sprintf("Creating the OSTree repository %s", s.Commit.Repo))
+		if err := run(ctx, state, fmt.Sprintf("ostree init --mode=archive --repo=%s", shellQuote(s.Commit.Repo))); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+
+	tarball, ok := state.GetOk("rootfs_tarball")
+	if !ok {
+		dir, err := ioutil.TempDir("", "ostree")
+		if err != nil {
+			err := fmt.Errorf("Error creating a temporary directory: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		defer os.RemoveAll(dir)
+		tarball = filepath.Join(dir, "rootfs.tar")
+		ui.Say("Archiving the root filesystem for OSTree")
+		if err := run(ctx, state, rootfsTarCommand(state, mountPath, tarball.(string))); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+
+	args := []string{"ostree", "commit", "--repo=" + shellQuote(s.Commit.Repo), "--branch=" + shellQuote(s.Commit.Branch),
+		"--subject=" + shellQuote(s.Commit.Subject)}
+	var keys []string
+	for key := range s.Commit.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--add-metadata-string="+shellQuote(key+"="+s.Commit.Metadata[key]))
+	}
+	if s.Commit.GpgSign != "" {
+		args = append(args, "--gpg-sign="+shellQuote(s.Commit.GpgSign))
+	}
+	args = append(args, "--tree=tar="+shellQuote(tarball.(string)))
+
+	ui.Say(fmt.Sprintf("Committing the root filesystem to %s in %s", s.Commit.Branch, s.Commit.Repo))
+	if err := run(ctx, state, strings.Join(args, " ")); err != nil {
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepOstreeCommit) Cleanup(state multistep.StateBag) {}
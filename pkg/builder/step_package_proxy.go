@@ -0,0 +1,123 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const (
+	aptProxyConf  = "/etc/apt/apt.conf.d/00packer-proxy"
+	dnfConf       = "/etc/dnf/dnf.conf"
+	dnfConfBackup = dnfConf + ".packer-orig"
+)
+
+// stepPackageProxy points apt and dnf in the chroot at package_proxy, like an apt-cacher-ng
+// instance, while provisioning. apt gets a configuration file of its own, the [main] section of
+// dnf.conf gets a proxy line; both are undone once provisioned.
+//
+// Produces:
+//
+//	package_proxy_cleanup CleanupFunc - To perform early cleanup
+type stepPackageProxy struct {
+	ChrootKey string
+	Proxy     string
+
+	mountPath   string
+	aptConf     bool
+	dnfReplaced bool
+}
+
+func (s *stepPackageProxy) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	s.mountPath = state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Using package proxy %s in the chroot", s.Proxy))
+	state.Put("package_proxy_cleanup", s)
+	if err := s.install(); err != nil {
+		err := fmt.Errorf("Error configuring the package proxy: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepPackageProxy) install() error {
+	if fi, err := os.Stat(filepath.Join(s.mountPath, "/etc/apt/apt.conf.d")); err == nil && fi.IsDir() {
+		conf := fmt.Sprintf("// Installed by packer-builder-arm-image while provisioning\nAcquire::http::Proxy \"%s\";\n", s.Proxy)
+		if err := ioutil.WriteFile(filepath.Join(s.mountPath, aptProxyConf), []byte(conf), 0644); err != nil {
+			return err
+		}
+		s.aptConf = true
+	}
+
+	conf := filepath.Join(s.mountPath, dnfConf)
+	data, err := ioutil.ReadFile(conf)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Rename(conf, filepath.Join(s.mountPath, dnfConfBackup)); err != nil {
+		return err
+	}
+	s.dnfReplaced = true
+	return ioutil.WriteFile(conf, []byte(dnfConfWithProxy(string(data), s.Proxy)), 0644)
+}
+
+// dnfConfWithProxy sets the proxy of the [main] section of dnf.conf, adding the section if needed.
+func dnfConfWithProxy(conf, proxy string) string {
+	var lines []string
+	inMain, done := false, false
+	for _, line := range strings.Split(strings.TrimRight(conf, "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inMain = trimmed == "[main]"
+			lines = append(lines, line)
+			if inMain && !done {
+				lines = append(lines, "proxy="+proxy)
+				done = true
+			}
+			continue
+		}
+		if inMain && strings.HasPrefix(strings.ReplaceAll(trimmed, " ", ""), "proxy=") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if !done {
+		lines = append([]string{"[main]", "proxy=" + proxy}, lines...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (s *stepPackageProxy) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *stepPackageProxy) CleanupFunc(_ multistep.StateBag) error {
+	if s.aptConf {
+		if err := os.Remove(filepath.Join(s.mountPath, aptProxyConf)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.aptConf = false
+	}
+	if s.dnfReplaced {
+		if err := os.Rename(filepath.Join(s.mountPath, dnfConfBackup), filepath.Join(s.mountPath, dnfConf)); err != nil {
+			return err
+		}
+		s.dnfReplaced = false
+	}
+	return nil
+}
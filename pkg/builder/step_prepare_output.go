@@ -0,0 +1,102 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepPrepareOutput makes sure the files of a previous build are not mixed with the ones of
+// this build: it fails when the files this build writes exist, or deletes all the files of the
+// previous build when forced.
+type stepPrepareOutput struct {
+	OutputFile string
+	// the files this build writes, see outputFiles
+	Files []string
+	Force bool
+}
+
+// outputFiles are the files the build writes for the image, which a previous build may have
+// left. With resume, the image is left out: it is the one of the failed build, to resume.
+func outputFiles(c *Config) []string {
+	var files []string
+	if !c.Resume {
+		files = append(files, c.OutputFile)
+		if c.QcowCache != "" {
+			files = append(files, c.OutputFile+".qcow2")
+		}
+	}
+	if c.Bmap {
+		files = append(files, c.OutputFile+".bmap")
+	}
+	artifact := c.OutputFile
+	if c.OutputXz {
+		artifact += ".xz"
+		files = append(files, artifact)
+	}
+	if c.Manifest {
+		files = append(files, artifact+".manifest.json")
+	}
+	if c.Provenance {
+		files = append(files, artifact+".intoto.jsonl")
+	}
+	if c.Sbom != "" {
+		files = append(files, c.SbomFile)
+	}
+	return files
+}
+
+// previousOutputFiles are the files any build can write for the image, deleted when forced.
+func previousOutputFiles(image string) []string {
+	return []string{
+		image,
+		image + ".raw",
+		image + ".bmap",
+		image + ".manifest.json",
+		image + ".xz",
+		image + ".xz.manifest.json",
+		image + ".intoto.jsonl",
+		image + ".xz.intoto.jsonl",
+		image + ".spdx.json",
+		image + ".cdx.json",
+		image + ".qcow2",
+		resumeStatePath(image),
+	}
+}
+
+func (s *stepPrepareOutput) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	if !s.Force {
+		for _, f := range s.Files {
+			if _, err := os.Lstat(f); err != nil {
+				continue
+			}
+			err := fmt.Errorf("Output file exists: %s\n\n"+
+				"Use the force flag or set overwrite to delete it prior to building.", f)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	}
+
+	for _, f := range append(previousOutputFiles(s.OutputFile), s.Files...) {
+		if _, err := os.Lstat(f); err != nil {
+			continue
+		}
+		ui.Say(fmt.Sprintf("Deleting previous output %s", f))
+		if err := os.Remove(f); err != nil {
+			err := fmt.Errorf("Error deleting previous output: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepPrepareOutput) Cleanup(state multistep.StateBag) {}
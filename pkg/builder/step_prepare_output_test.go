@@ -0,0 +1,73 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestOutputFiles(t *testing.T) {
+	c := &Config{OutputFile: "out/image", Bmap: true, OutputXz: true, Manifest: true}
+	want := []string{"out/image", "out/image.bmap", "out/image.xz", "out/image.xz.manifest.json"}
+	got := outputFiles(c)
+	if len(got) != len(want) {
+		t.Fatalf("unexpected output files %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("unexpected output files %v", got)
+		}
+	}
+
+	// the image of the failed build is resumed
+	c = &Config{OutputFile: "out/image", Resume: true}
+	if files := outputFiles(c); len(files) != 0 {
+		t.Errorf("unexpected output files with resume %v", files)
+	}
+}
+
+func TestPrepareOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		existing []string
+		force    bool
+		halt     bool
+	}{
+		{name: "no previous output"},
+		{name: "previous image", existing: []string{"image"}, halt: true},
+		{name: "files this build doesn't write", existing: []string{"image.qcow2", "image.resume.json"}},
+		{name: "forced", existing: []string{"image", "image.qcow2", "image.resume.json"}, force: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, f := range tc.existing {
+				if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			image := filepath.Join(dir, "image")
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", packer.TestUi(t))
+			step := &stepPrepareOutput{OutputFile: image, Files: outputFiles(&Config{OutputFile: image}), Force: tc.force}
+			action := step.Run(context.Background(), state)
+			if halted := action == multistep.ActionHalt; halted != tc.halt {
+				t.Fatalf("halted: %v, expected %v", halted, tc.halt)
+			}
+			if tc.force {
+				if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+					t.Errorf("previous output left: %v", files)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	getter "github.com/hashicorp/go-getter/v2"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const (
+	// how much of the image a probe downloads
+	mirrorProbeSize    = 256 << 10
+	mirrorProbeTimeout = 10 * time.Second
+)
+
+// stepProbeMirrors orders the http iso_urls of the download step by how fast they send the start
+// of the image, probed in parallel, so the download starts with the fastest mirror and falls
+// back to the next ones. Mirrors that fail the probe are tried last. Other urls, like local files,
+// stay first. Nothing is probed when the image of a url is already in the cache and matches its
+// checksum, as the download step uses it then.
+type stepProbeMirrors struct {
+	Download *packer_common_commonsteps.StepDownload
+}
+
+// mirrorProbe is the result of the probe of a mirror.
+type mirrorProbe struct {
+	Url string
+	// bytes per second, start of the response included
+	Rate float64
+	Err  error
+}
+
+func (s *stepProbeMirrors) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	var probes []*mirrorProbe
+	var others []string
+	for _, u := range s.Download.Url {
+		if isHTTPURL(u) && !isTorrentURL(u) {
+			probes = append(probes, &mirrorProbe{Url: u})
+		} else {
+			others = append(others, u)
+		}
+	}
+	if len(probes) < 2 || s.cached(ctx) {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Probing %d mirrors...", len(probes)))
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p *mirrorProbe) {
+			defer wg.Done()
+			p.Rate, p.Err = probeMirror(ctx, p.Url)
+		}(p)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		state.Put("error", ctx.Err())
+		return multistep.ActionHalt
+	}
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].Err == nil) != (probes[j].Err == nil) {
+			return probes[i].Err == nil
+		}
+		return probes[i].Rate > probes[j].Rate
+	})
+	urls := others
+	for _, p := range probes {
+		if p.Err != nil {
+			ui.Message(fmt.Sprintf("%s: %s", p.Url, p.Err))
+		} else {
+			ui.Message(fmt.Sprintf("%s: %.1f MB/s", p.Url, p.Rate/1e6))
+		}
+		urls = append(urls, p.Url)
+	}
+	s.Download.Url = urls
+	return multistep.ActionContinue
+}
+
+// cached tells if the download step has the image of a url in the cache already. go-getter
+// only skips the download of a file that matches its checksum, so a partial download or an
+// image without a checksum is not cached.
+func (s *stepProbeMirrors) cached(ctx context.Context) bool {
+	// the checksum query of a url replaces the checksum of the download step
+	defer func(checksum string) { s.Download.Checksum = checksum }(s.Download.Checksum)
+	pwd, _ := os.Getwd()
+	for _, u := range s.Download.Url {
+		src, target, err := s.Download.UseSourceToFindCacheTarget(u)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		checksum, err := getter.DefaultClient.GetChecksum(ctx, &getter.Request{Src: src.String(), Pwd: pwd})
+		if err != nil || checksum == nil {
+			continue
+		}
+		if checksum.Checksum(target) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stepProbeMirrors) Cleanup(state multistep.StateBag) {}
+
+// isHTTPURL tells if a source url is downloaded over http.
+func isHTTPURL(u string) bool {
+	lower := strings.ToLower(u)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// probeMirror downloads the start of the image at u, and returns how fast it came.
+func probeMirror(ctx context.Context, u string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, mirrorProbeTimeout)
+	defer cancel()
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return 0, err
+	}
+	// the options of go-getter are not for the server
+	q := parsed.Query()
+	q.Del("checksum")
+	q.Del("archive")
+	parsed.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", parsed.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mirrorProbeSize-1))
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("bad response code: %d", resp.StatusCode)
+	}
+	n, err := io.CopyN(ioutil.Discard, resp.Body, mirrorProbeSize)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,177 @@
+package builder
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+	"github.com/solo-io/packer-builder-arm-image/pkg/version"
+)
+
+const (
+	provenanceBuilderID = "https://github.com/solo-io/packer-builder-arm-image"
+	provenanceBuildType = "https://github.com/solo-io/packer-builder-arm-image/provenance/v1"
+)
+
+// stepProvenance writes a SLSA provenance statement of the artifact next to it, as
+// <artifact>.intoto.jsonl: a DSSE envelope of an in-toto statement, signed with
+// provenance_key when set.
+//
+// Produces:
+//
+//	provenance_file string - The statement written
+//	artifact_files []string - The statement is appended
+type stepProvenance struct {
+	ImageKey string
+	Key      string
+	// when the build started, for the run details
+	Started time.Time
+}
+
+func (s *stepProvenance) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	artifact := state.Get(s.ImageKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	path := artifact + ".intoto.jsonl"
+	ui.Say(fmt.Sprintf("Writing the provenance of the image to %s", path))
+	if err := s.write(state, artifact, path); err != nil {
+		err := fmt.Errorf("Error writing the provenance: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("provenance_file", path)
+	addArtifactFiles(state, path)
+	return multistep.ActionContinue
+}
+
+func (s *stepProvenance) write(state multistep.StateBag, artifact, path string) error {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	digest, err := s.artifactDigest(state, artifact)
+	if err != nil {
+		return err
+	}
+	invocation, err := newUUID()
+	if err != nil {
+		return err
+	}
+	statement := utils.InTotoStatement{
+		Type:          utils.InTotoStatementType,
+		Subject:       []utils.InTotoSubject{{Name: filepath.Base(artifact), Digest: map[string]string{"sha256": digest}}},
+		PredicateType: utils.SlsaProvenanceType,
+		Predicate: utils.SlsaProvenance{
+			BuildDefinition: utils.SlsaBuildDefinition{
+				BuildType: provenanceBuildType,
+				ExternalParameters: map[string]interface{}{
+					"build_name":      config.PackerBuildName,
+					"template_sha256": config.configHash,
+					"image_type":      string(config.ImageType),
+					"qemu_binary":     filepath.Base(config.QemuBinary),
+					"output_filename": filepath.Base(config.OutputFile),
+				},
+				InternalParameters: map[string]interface{}{
+					"packer_version": config.PackerCoreVersion,
+				},
+				ResolvedDependencies: s.dependencies(state, config),
+			},
+			RunDetails: utils.SlsaRunDetails{
+				Builder: utils.SlsaBuilder{
+					ID:      provenanceBuilderID,
+					Version: map[string]string{"packer-builder-arm-image": version.String()},
+				},
+				Metadata: utils.SlsaBuildMetadata{
+					InvocationID: invocation,
+					StartedOn:    s.Started.UTC().Format(time.RFC3339),
+					FinishedOn:   time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+
+	var signer crypto.Signer
+	if s.Key != "" {
+		data, err := ioutil.ReadFile(s.Key)
+		if err != nil {
+			return err
+		}
+		if signer, err = utils.ParsePrivateKey(data); err != nil {
+			return fmt.Errorf("provenance_key %s: %s", s.Key, err)
+		}
+	} else {
+		ui.Message("No provenance_key set, the statement is not signed")
+	}
+	envelope, err := utils.NewDsseEnvelope(utils.InTotoPayloadType, payload, signer)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// artifactDigest returns the sha256 of the artifact, from the compression or the manifest when
+// they hashed it already.
+func (s *stepProvenance) artifactDigest(state multistep.StateBag, artifact string) (string, error) {
+	if _, ok := state.GetOk("artifact_image"); ok {
+		return state.Get("compressed_image").(*compressedImage).DownloadSha256, nil
+	}
+	if manifest, ok := state.GetOk("manifest"); ok && manifest.(*imageManifest).Sha256 != "" {
+		return manifest.(*imageManifest).Sha256, nil
+	}
+	return sha256File(artifact)
+}
+
+// provenanceDigests are the iso_checksum types recorded as the digest of the source image.
+var provenanceDigests = map[string]bool{"md5": true, "sha1": true, "sha256": true, "sha512": true, "blake2b": true}
+
+// dependencies returns the source image, with the checksum it was verified with, or the
+// sha256 of the downloaded file when the checksum was read from a file.
+func (s *stepProvenance) dependencies(state multistep.StateBag, config *Config) []utils.SlsaResourceDescriptor {
+	if config.SourceDevice != "" {
+		return []utils.SlsaResourceDescriptor{{URI: "device:" + config.SourceDevice}}
+	}
+	if len(config.ISOUrls) == 0 {
+		return nil
+	}
+	source := utils.SlsaResourceDescriptor{URI: config.ISOUrls[0], Digest: map[string]string{}}
+	checksum := config.ISOChecksum
+	if config.blake2Checksum != "" {
+		checksum = config.blake2Checksum
+	}
+	algo, value := "", ""
+	if i := strings.Index(checksum, ":"); i > 0 {
+		algo, value = strings.ToLower(checksum[:i]), checksum[i+1:]
+	}
+	if algo == "b2" {
+		algo = "blake2b"
+	}
+	if provenanceDigests[algo] && !strings.HasPrefix(value, "file:") {
+		source.Digest[algo] = strings.ToLower(value)
+	} else if path, ok := state.GetOk("iso_path"); ok {
+		if info, err := os.Stat(path.(string)); err == nil && info.Mode().IsRegular() {
+			if sum, err := sha256File(path.(string)); err == nil {
+				source.Digest["sha256"] = sum
+			}
+		}
+	}
+	return []utils.SlsaResourceDescriptor{source}
+}
+
+func (s *stepProvenance) Cleanup(state multistep.StateBag) {}
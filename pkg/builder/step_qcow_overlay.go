@@ -0,0 +1,245 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// stepQcowOverlay replaces stepCopyImage with qcow_cache: the source image is converted to a
+// qcow2 base in the cache once, and the build writes to a fresh overlay of it, next to the
+// output file. stepCommitOverlay converts the overlay to the raw output file.
+type stepQcowOverlay struct {
+	FromKey, ResultKey string
+	overlay            string
+}
+
+func (s *stepQcowOverlay) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	fromFile := state.Get(s.FromKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	base, err := s.base(ctx, state, fromFile, config.QcowCache)
+	if err != nil {
+		err := fmt.Errorf("Error creating the qcow2 base image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.OutputFile), 0755); err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.overlay = config.OutputFile + ".qcow2"
+	ui.Say(fmt.Sprintf("Creating an overlay of %s", base))
+	if err := run(ctx, state, fmt.Sprintf("qemu-img create -q -f qcow2 -F qcow2 -b %s %s", shellQuote(base), shellQuote(s.overlay))); err != nil {
+		return multistep.ActionHalt
+	}
+	state.Put(s.ResultKey, s.overlay)
+	return multistep.ActionContinue
+}
+
+// base returns the qcow2 base image of src in cache, converting src if it isn't there yet.
+func (s *stepQcowOverlay) base(ctx context.Context, state multistep.StateBag, src, cache string) (string, error) {
+	ui := state.Get("ui").(packer.Ui)
+
+	stat, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return "", err
+	}
+	// a changed source, even at the same path, gets a new base
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", abs, stat.Size(), stat.ModTime().UnixNano())))
+	base := filepath.Join(cache, hex.EncodeToString(key[:8])+".qcow2")
+	if _, err := os.Stat(base); err == nil {
+		ui.Say(fmt.Sprintf("Using the cached qcow2 base image %s", base))
+		return base, nil
+	}
+
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return "", err
+	}
+	ui.Say(fmt.Sprintf("Converting the source image to the qcow2 base image %s", base))
+	if !image.IsRaw(src) {
+		tmp, err := ioutil.TempFile(cache, "source")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tmp.Name())
+		img, err := image.NewImageOpener(ui).Open(src)
+		if err != nil {
+			tmp.Close()
+			return "", err
+		}
+		_, err = utils.CopyWithProgress(ctx, ui, tmp, img)
+		img.Close()
+		tmp.Close()
+		if err != nil {
+			return "", err
+		}
+		src = tmp.Name()
+	}
+	// converted under a temporary name, so an interrupted conversion isn't used as a base
+	if err := run(ctx, state, fmt.Sprintf("qemu-img convert -O qcow2 %s %s", shellQuote(src), shellQuote(base+".tmp"))); err != nil {
+		os.Remove(base + ".tmp")
+		return "", err
+	}
+	return base, os.Rename(base+".tmp", base)
+}
+
+func (s *stepQcowOverlay) Cleanup(state multistep.StateBag) {
+	if s.overlay == "" {
+		return
+	}
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if (cancelled || halted) && state.Get("config").(*Config).KeepImageOnError {
+		state.Get("ui").(packer.Ui).Say(fmt.Sprintf("Build failed, keeping overlay at %s", s.overlay))
+		return
+	}
+	os.Remove(s.overlay)
+}
+
+// stepNbdMapImage attaches the qcow2 overlay to a network block device with qemu-nbd, in
+// place of stepMapImage, and lists its partitions.
+type stepNbdMapImage struct {
+	ImageKey  string
+	ResultKey string
+	device    string
+}
+
+func (s *stepNbdMapImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	overlay := state.Get(s.ImageKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	// the module may be loaded already, or built in
+	runCommand(ctx, state, "modprobe nbd max_part=16")
+	device, err := freeNbdDevice()
+	if err != nil {
+		ui.Error(fmt.Sprintf("error finding a free nbd device: %v", err))
+		return multistep.ActionHalt
+	}
+
+	ui.Message(fmt.Sprintf("attaching %s to %s", overlay, device))
+	if err := run(ctx, state, fmt.Sprintf("qemu-nbd --connect=%s --format=qcow2 %s", device, shellQuote(overlay))); err != nil {
+		return multistep.ActionHalt
+	}
+	s.device = device
+	state.Put("map_image_cleanup", s)
+
+	partitions, err := nbdPartitions(device, 10*time.Second)
+	if err != nil {
+		ui.Error(fmt.Sprintf("error listing the partitions of %s: %v", device, err))
+		return multistep.ActionHalt
+	}
+	state.Put(s.ResultKey, partitions)
+	return multistep.ActionContinue
+}
+
+// freeNbdDevice returns an nbd device no qemu-nbd is connected to.
+func freeNbdDevice() (string, error) {
+	devices, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil {
+		return "", err
+	}
+	if len(devices) == 0 {
+		return "", fmt.Errorf("no nbd devices, is the nbd kernel module available?")
+	}
+	sort.Strings(devices)
+	for _, d := range devices {
+		if _, err := os.Stat(filepath.Join(d, "pid")); os.IsNotExist(err) {
+			return "/dev/" + filepath.Base(d), nil
+		}
+	}
+	return "", fmt.Errorf("all nbd devices are in use")
+}
+
+// nbdPartitions waits for the kernel to scan the partitions of device, and returns them in order.
+func nbdPartitions(device string, timeout time.Duration) ([]string, error) {
+	name := filepath.Base(device)
+	for deadline := time.Now().Add(timeout); ; time.Sleep(200 * time.Millisecond) {
+		nodes, err := filepath.Glob(filepath.Join("/sys/block", name, name+"p*"))
+		if err != nil {
+			return nil, err
+		}
+		if len(nodes) > 0 {
+			var partitions []string
+			for _, node := range nodes {
+				partitions = append(partitions, "/dev/"+filepath.Base(node))
+			}
+			sort.Slice(partitions, func(i, j int) bool {
+				ni, _ := partitionNumber(partitions[i])
+				nj, _ := partitionNumber(partitions[j])
+				return ni < nj
+			})
+			return partitions, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no partitions found")
+		}
+	}
+}
+
+func (s *stepNbdMapImage) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *stepNbdMapImage) CleanupFunc(state multistep.StateBag) error {
+	if s.device == "" {
+		return nil
+	}
+	if err := run(context.TODO(), state, fmt.Sprintf("qemu-nbd --disconnect %s", s.device)); err != nil {
+		return err
+	}
+	s.device = ""
+	return nil
+}
+
+// stepCommitOverlay converts the overlay of stepQcowOverlay to the raw output file, once it is
+// detached.
+type stepCommitOverlay struct {
+	FromKey, ResultKey string
+	committed          string
+}
+
+func (s *stepCommitOverlay) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	overlay := state.Get(s.FromKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Converting the overlay to %s", config.OutputFile))
+	if err := run(ctx, state, fmt.Sprintf("qemu-img convert -f qcow2 -O raw %s %s", shellQuote(overlay), shellQuote(config.OutputFile))); err != nil {
+		os.Remove(config.OutputFile)
+		return multistep.ActionHalt
+	}
+	s.committed = config.OutputFile
+	state.Put(s.ResultKey, config.OutputFile)
+	return multistep.ActionContinue
+}
+
+func (s *stepCommitOverlay) Cleanup(state multistep.StateBag) {
+	if s.committed == "" {
+		return
+	}
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if (!cancelled && !halted) || state.Get("config").(*Config).KeepImageOnError {
+		return
+	}
+	os.Remove(s.committed)
+}
@@ -7,10 +7,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 )
 
 const wrapped = "-wrapped"
@@ -23,10 +25,14 @@ type Args struct {
 type stepQemuUserStatic struct {
 	ChrootKey             string
 	PathToQemuInChrootKey string
+	// qemu binaries copied next to the main one, without arguments
+	AdditionalBinaries               []string
+	AdditionalPathsToQemuInChrootKey string
 
 	Args                    Args
 	qemuDestinationInChroot string
 	destWrapper             string
+	additionalDestinations  []string
 }
 
 // if we need to pass args to qemu, we need to compile a static wrapper
@@ -53,12 +59,33 @@ int main(int argc, char **argv, char **envp) {
 }
 `
 
+// qemuArgsData is available to qemu_args as template data.
+type qemuArgsData struct {
+	MountPath string
+	// space separated mapped partition devices
+	Partitions    string
+	RootPartition string
+	ImageType     string
+	// the cpu the image type defaults to, or max
+	CPU string
+}
+
 func (s *stepQemuUserStatic) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	// Read our value and assert that it is they type we want
 	chrootDir := state.Get(s.ChrootKey).(string)
 	config := state.Get("config").(*Config)
 
 	ui := state.Get("ui").(packer.Ui)
+
+	args, err := renderQemuArgs(state, chrootDir)
+	if err != nil {
+		err := fmt.Errorf("Error interpolating qemu_args: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.Args.Args = args
+
 	ui.Say("Installing qemu-user-static in the chroot")
 	qemuInHostPath := config.QemuBinary
 	_, qemuFilename := filepath.Split(qemuInHostPath)
@@ -69,10 +96,24 @@ func (s *stepQemuUserStatic) Run(ctx context.Context, state multistep.StateBag)
 	s.qemuDestinationInChroot = filepath.Join(chrootDir, s.Args.PathToQemuInChroot)
 	state.Put(s.PathToQemuInChrootKey, s.Args.PathToQemuInChroot)
 
-	err := run(ctx, state, fmt.Sprintf("cp %s %s", qemuInHostPath, s.qemuDestinationInChroot))
+	err = run(ctx, state, fmt.Sprintf("cp %s %s", qemuInHostPath, s.qemuDestinationInChroot))
 	if err != nil {
 		return multistep.ActionHalt
 	}
+	state.Put("qemu_user_static_cleanup", s)
+
+	var additionalInChroot []string
+	for _, qemu := range s.AdditionalBinaries {
+		pathInChroot := "/" + filepath.Base(qemu)
+		dest := filepath.Join(chrootDir, pathInChroot)
+		err = run(ctx, state, fmt.Sprintf("cp %s %s", qemu, dest))
+		if err != nil {
+			return multistep.ActionHalt
+		}
+		s.additionalDestinations = append(s.additionalDestinations, dest)
+		additionalInChroot = append(additionalInChroot, pathInChroot)
+	}
+	state.Put(s.AdditionalPathsToQemuInChrootKey, additionalInChroot)
 
 	err = s.makeWrapper(ctx, ui, state)
 	if err != nil {
@@ -81,6 +122,37 @@ func (s *stepQemuUserStatic) Run(ctx context.Context, state multistep.StateBag)
 	return multistep.ActionContinue
 }
 
+// renderQemuArgs renders qemu_args for the image mounted at chrootDir.
+func renderQemuArgs(state multistep.StateBag, chrootDir string) ([]string, error) {
+	config := state.Get("config").(*Config)
+
+	data := &qemuArgsData{MountPath: chrootDir, ImageType: string(config.ImageType), CPU: "max"}
+	if partitions, ok := state.GetOk("partitions"); ok {
+		data.Partitions = strings.Join(partitions.([]string), " ")
+	}
+	if root, ok := state.GetOk("root_partition"); ok {
+		data.RootPartition = root.(string)
+	}
+	defaults := config.qemuArgsOf(config.ImageType)
+	for i := 0; i+1 < len(defaults); i++ {
+		if defaults[i] == "-cpu" {
+			data.CPU = defaults[i+1]
+		}
+	}
+
+	ictx := config.ctx
+	ictx.Data = data
+	// the detected image type may have changed the defaults since the step was created
+	args := make([]string, len(config.QemuArgs))
+	for i, arg := range config.QemuArgs {
+		var err error
+		if args[i], err = interpolate.Render(arg, &ictx); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
 func (s *stepQemuUserStatic) makeWrapper(ctx context.Context, ui packer.Ui, state multistep.StateBag) error {
 	if len(s.Args.Args) == 0 {
 		return nil
@@ -128,10 +200,21 @@ func (s *stepQemuUserStatic) makeWrapper(ctx context.Context, ui packer.Ui, stat
 }
 
 func (s *stepQemuUserStatic) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *stepQemuUserStatic) CleanupFunc(state multistep.StateBag) error {
 	if s.qemuDestinationInChroot != "" {
 		os.Remove(s.qemuDestinationInChroot)
+		s.qemuDestinationInChroot = ""
 	}
 	if s.destWrapper != "" {
 		os.Remove(s.destWrapper)
+		s.destWrapper = ""
 	}
+	for _, dest := range s.additionalDestinations {
+		os.Remove(dest)
+	}
+	s.additionalDestinations = nil
+	return nil
 }
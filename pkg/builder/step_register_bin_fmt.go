@@ -2,48 +2,130 @@ package builder
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"syscall"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
 type stepRegisterBinFmt struct {
+	// the qemu binary in the chroot, if qemu is used
 	QemuPathKey string
+	// the qemu binaries of additional_qemu_binaries
+	AdditionalQemuPathsKey string
+	ChrootKey              string
+	// binfmt_entries
+	Entries []BinfmtEntry
+
+	registered []string
+	// interpreters of Entries copied to the chroot
+	copied []string
 }
 
-func (s *stepRegisterBinFmt) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+func (s *stepRegisterBinFmt) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	// Read our value and assert that it is they type we want
 	ui := state.Get("ui").(packer.Ui)
-	qemu := state.Get(s.QemuPathKey).(string)
+	chrootDir := state.Get(s.ChrootKey).(string)
+
+	var entries []BinfmtEntry
+	if qemu, ok := state.GetOk(s.QemuPathKey); ok {
+		entry, ok := qemuBinfmtEntry(binfmtName, qemu.(string))
+		if !ok {
+			// not a qemu binary name we know, assume it runs 32 bit arm binaries
+			entry = BinfmtEntry{Name: binfmtName, Magic: qemuBinfmtMagic["arm"][0], Mask: qemuBinfmtMagic["arm"][1], Interpreter: qemu.(string)}
+		}
+		entries = append(entries, entry)
+	}
+
+	if additional, ok := state.GetOk(s.AdditionalQemuPathsKey); ok {
+		for _, qemu := range additional.([]string) {
+			entry, ok := qemuBinfmtEntry(binfmtName+"-"+qemuArch(qemu), qemu)
+			if !ok {
+				err := fmt.Errorf("Error registering %s: unknown qemu architecture %s", qemu, qemuArch(qemu))
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			entries = append(entries, entry)
+		}
+	}
 
-	// registerstring := `:packer-builder-arm-image:M::\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00:\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff:/usr/bin/qemu-arm-static:`
+	state.Put("register_binfmt_cleanup", s)
+	for _, entry := range s.Entries {
+		if entry.fixBinary() {
+			// the kernel keeps the host binary open
+			entries = append(entries, entry)
+			continue
+		}
+		pathInChroot := "/" + filepath.Base(entry.Interpreter)
+		dest := filepath.Join(chrootDir, pathInChroot)
+		if err := run(ctx, state, fmt.Sprintf("cp %s %s", entry.Interpreter, dest)); err != nil {
+			return multistep.ActionHalt
+		}
+		s.copied = append(s.copied, dest)
+		entry.Interpreter = pathInChroot
+		entries = append(entries, entry)
+	}
+
+	if _, err := os.Stat(filepath.Join(binfmtMiscDir, "register")); os.IsNotExist(err) {
+		// hosts without systemd, like WSL2 distros, may not have mounted it
+		if err := run(ctx, state, "mount -t binfmt_misc binfmt_misc "+binfmtMiscDir); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+	for _, entry := range entries {
+		if err := s.register(entry); err != nil {
+			if errors.Is(err, syscall.EEXIST) {
+				// WSL2 distros share the binfmt_misc of their VM, a build in another one registered it
+				err = fmt.Errorf("%s: a build running elsewhere on the host registered it, or a killed build "+
+					"left it, remove it with echo -1 > %s", err, filepath.Join(binfmtMiscDir, entry.Name))
+			}
+			err := fmt.Errorf("Error registering binfmt entry %s: %s", entry.Name, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
 
-	registerstring_prefix := []byte{':', 'p', 'a', 'c', 'k', 'e', 'r', '-', 'b', 'u', 'i', 'l', 'd', 'e', 'r', '-', 'a', 'r', 'm', '-', 'i', 'm', 'a', 'g', 'e', ':', 'M', ':', ':', '\\', 'x', '7', 'f', 'E', 'L', 'F', '\\', 'x', '0', '1', '\\', 'x', '0', '1', '\\', 'x', '0', '1', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '0', '\\', 'x', '0', '2', '\\', 'x', '0', '0', '(', '\\', 'x', '0', '0', ':', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', '0', '0', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'e', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', '\\', 'x', 'f', 'f', ':'}
-	registerstring := append(registerstring_prefix, ([]byte(qemu))...)
-	registerstring = append(registerstring, ':')
-	f, err := os.OpenFile("/proc/sys/fs/binfmt_misc/register", os.O_RDWR, 0)
+func (s *stepRegisterBinFmt) register(entry BinfmtEntry) error {
+	f, err := os.OpenFile(filepath.Join(binfmtMiscDir, "register"), os.O_RDWR, 0)
 	if err != nil {
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+		return err
 	}
 	defer f.Close()
-	_, err = f.Write(registerstring)
-	if err != nil {
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+	if _, err = f.WriteString(entry.registration()); err != nil {
+		return err
 	}
-	return multistep.ActionContinue
+	s.registered = append(s.registered, entry.Name)
+	return nil
 }
 
 func (s *stepRegisterBinFmt) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *stepRegisterBinFmt) CleanupFunc(state multistep.StateBag) error {
 	ui := state.Get("ui").(packer.Ui)
 
-	f, err := os.OpenFile("/proc/sys/fs/binfmt_misc/packer-builder-arm-image", os.O_RDWR, 0)
-	if err != nil {
-		ui.Error(err.Error())
-		return
+	for _, name := range s.registered {
+		f, err := os.OpenFile(filepath.Join(binfmtMiscDir, name), os.O_RDWR, 0)
+		if err != nil {
+			ui.Error(err.Error())
+			continue
+		}
+		f.WriteString("-1")
+		f.Close()
 	}
-	defer f.Close()
-	_, err = f.WriteString("-1")
+	s.registered = nil
+	for _, dest := range s.copied {
+		os.Remove(dest)
+	}
+	s.copied = nil
+	return nil
 }
@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
 
 	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -22,8 +26,47 @@ func (s *stepResizeFs) Run(ctx context.Context, state multistep.StateBag) multis
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say(fmt.Sprintf("partitions: %v", partitions))
 
-	p := partitions[len(partitions)-1]
-	err := s.e2fsck(ctx, wrappedCommand, p)
+	p := resizedPartition(state, partitions)
+	info, err := hostBlkid(ctx, state)(p)
+	if err != nil {
+		err := fmt.Errorf("Error running blkid on %s: %s", p, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	switch {
+	case info.Type() == lvmMemberType:
+		// the logical volumes are left as is, the new room is free space in the volume group
+		ui.Message(fmt.Sprintf("Resizing LVM physical volume %s", p))
+		if run(ctx, state, "pvresize "+p) != nil {
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	case info.Type() == "vfat":
+		if err := s.fatresize(ctx, state, p); err != nil {
+			err := fmt.Errorf("Error resizing FAT filesystem: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	case info.Type() == "xfs" || info.Type() == "btrfs":
+		if err := s.growMounted(ctx, state, p, info.Type()); err != nil {
+			err := fmt.Errorf("Error growing %s filesystem: %s", info.Type(), err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	case !strings.HasPrefix(info.Type(), "ext"):
+		err := fmt.Errorf("Error resizing %s: don't know how to resize a %q filesystem, only ext, xfs, btrfs and vfat are supported", p, info.Type())
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Message(fmt.Sprintf("Checking filesystem of %s", p))
+	err = e2fsckBeforeResize(wrappedCommand, p)
 	if err != nil {
 		err := fmt.Errorf("Error e2fsck command: %s", err)
 		state.Put("error", err)
@@ -43,19 +86,32 @@ func (s *stepResizeFs) Run(ctx context.Context, state multistep.StateBag) multis
 	return multistep.ActionContinue
 }
 
-func (s *stepResizeFs) e2fsck(ctx context.Context, wrappedCommand packer_common_common.CommandWrapper, dev string) error {
-	e2fsckCommand, err := wrappedCommand(fmt.Sprintf("e2fsck -y -f %s", dev))
+// e2fsckBeforeResize checks and repairs the filesystem before resize2fs, which refuses
+// filesystems that weren't checked recently. repaired errors are fine, errors e2fsck -p
+// can't fix fail the build.
+func e2fsckBeforeResize(wrappedCommand packer_common_common.CommandWrapper, dev string) error {
+	e2fsckCommand, err := wrappedCommand(fmt.Sprintf("e2fsck -f -p %s", dev))
 	if err != nil {
 		return err
 	}
 
 	cmd := packer_common_common.ShellCommand(e2fsckCommand)
-	var stderr bytes.Buffer
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		err := fmt.Errorf(
-			"Error e2fsck: %s\nStderr: %s", err, stderr.String())
-		return err
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// 1: errors were corrected, 2: corrected, the system should be rebooted
+		switch code := exitErr.ExitCode(); {
+		case code&^3 == 0:
+			return nil
+		case code&4 != 0:
+			return fmt.Errorf(
+				"%s has errors e2fsck -p can't fix, check the source image with e2fsck -f:\n%s%s", dev, stdout.String(), stderr.String())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error e2fsck: %s\nStderr: %s", err, stderr.String())
 	}
 	return nil
 }
@@ -78,5 +134,59 @@ func (s *stepResizeFs) resize(ctx context.Context, wrappedCommand packer_common_
 	return nil
 }
 
+// fatresize grows a FAT filesystem to the size of its partition.
+func (s *stepResizeFs) fatresize(ctx context.Context, state multistep.StateBag, dev string) error {
+	if _, err := exec.LookPath("fatresize"); err != nil {
+		return fmt.Errorf("%s is a FAT filesystem, install fatresize to resize it", dev)
+	}
+	out, err := runCommandOutput(ctx, state, fmt.Sprintf("blockdev --getsize64 %s", dev))
+	if err != nil {
+		return err
+	}
+	size := strings.TrimSpace(out)
+	state.Get("ui").(packer.Ui).Message(fmt.Sprintf("Resizing FAT filesystem %s to %s bytes", dev, size))
+	if err := run(ctx, state, fmt.Sprintf("fsck.vfat -a %s || [ $? -eq 1 ]", dev)); err != nil {
+		return err
+	}
+	return run(ctx, state, fmt.Sprintf("fatresize --force --size %s %s", size, dev))
+}
+
+// growMountedCommands are the commands growing filesystems that are only grown mounted, with
+// the package they come from.
+var growMountedCommands = map[string][2]string{
+	"xfs":   {"xfs_growfs %s", "xfsprogs"},
+	"btrfs": {"btrfs filesystem resize max %s", "btrfs-progs"},
+}
+
+// growMounted grows an XFS or btrfs filesystem to the size of its partition. They are only grown
+// mounted, so the filesystem is mounted on a temporary directory. nouuid lets XFS mount next to
+// a host filesystem made from the same image.
+func (s *stepResizeFs) growMounted(ctx context.Context, state multistep.StateBag, dev, fstype string) error {
+	grow := growMountedCommands[fstype]
+	tool := strings.Fields(grow[0])[0]
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("%s is a %s filesystem, install %s to resize it", dev, fstype, grow[1])
+	}
+	dir, err := ioutil.TempDir("", "packer-grow")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	opts := ""
+	if fstype == "xfs" {
+		opts = " -o nouuid"
+	}
+	state.Get("ui").(packer.Ui).Message(fmt.Sprintf("Growing %s filesystem %s", fstype, dev))
+	if err := run(ctx, state, fmt.Sprintf("mount -t %s%s %s %s", fstype, opts, dev, dir)); err != nil {
+		return err
+	}
+	err = run(ctx, state, fmt.Sprintf(grow[0], dir))
+	if umountErr := run(context.Background(), state, "umount "+dir); err == nil {
+		err = umountErr
+	}
+	return err
+}
+
 func (s *stepResizeFs) Cleanup(state multistep.StateBag) {
 }
@@ -4,15 +4,37 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
 )
 
-// sector size is 512 bytes
+// sector size is 512 bytes, except for images with 4096 byte sectors, see imageSectorShift
 const SectorShift = 9
 
+// partitions are aligned to 1MiB, in 512 byte sectors
+const partitionAlignment = 2048
+
+// imageSectorShift returns the sector shift of the image, 12 for images with 4096 byte sectors.
+func imageSectorShift(imagefile string) (uint, error) {
+	f, err := os.Open(imagefile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size, err := utils.SectorSize(f)
+	if err != nil {
+		return 0, err
+	}
+	if size == 4096 {
+		return 12, nil
+	}
+	return SectorShift, nil
+}
+
 type stepResizeLastPart struct {
 	FromKey string
 }
@@ -22,7 +44,7 @@ func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) mu
 	config := state.Get("config").(*Config)
 	ui := state.Get("ui").(packer.Ui)
 	extraSize := int64(config.LastPartitionExtraSize) // legacy way to resize last partition
-	targetSize := int64(config.TargetImageSize)
+	targetSize := int64(config.targetImageSize)
 
 	if extraSize <= 0 && targetSize <= 0 {
 		return multistep.ActionContinue
@@ -53,6 +75,12 @@ func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) mu
 		targetSize = currentSize + extraSize
 	}
 
+	shift, err := imageSectorShift(imagefile)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error reading the sector size of the image %v", err))
+		return multistep.ActionHalt
+	}
+
 	// resize image
 	err = os.Truncate(imagefile, targetSize)
 	if err != nil {
@@ -73,19 +101,45 @@ func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) mu
 		return multistep.ActionHalt
 	}
 
-	var part *mbr.MBRPartition
-	for _, potentialpart := range partitions {
+	last, prev := -1, -1
+	for i, potentialpart := range partitions {
 		if !potentialpart.IsEmpty() {
-			part = potentialpart
+			prev, last = last, i
 		}
 	}
 
-	if part == nil {
+	if last < 0 {
 		ui.Error(fmt.Sprintf("no partition %v", *mbrp))
 		return multistep.ActionHalt
 	}
-	extrasector := uint32(extraSize >> SectorShift)
-	part.SetLBALen(part.GetLBALen() + extrasector)
+	extrasector := uint32(extraSize >> shift)
+
+	part := partitions[last]
+	resized := last
+	if n := config.ResizePartitionNumber - 1; n >= 0 && n != last {
+		if n >= len(partitions) || partitions[n].IsEmpty() {
+			ui.Error(fmt.Sprintf("Partition %d doesn't exist", n+1))
+			return multistep.ActionHalt
+		}
+		if err := s.relocateAfter(ui, imagefile, partitions, n, extrasector, shift); err != nil {
+			ui.Error(fmt.Sprintf("Error moving the partitions after partition %d: %v", n+1, err))
+			return multistep.ActionHalt
+		}
+		resized = n
+	} else if part.GetType() == mbr.PART_LINUX_SWAP_SOLARIS && prev >= 0 {
+		// the last partition is swap, grow the one before it instead.
+		swap, err := s.handleSwap(ui, imagefile, config.SwapPartition, part, partitions[prev], extrasector, shift)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error handling swap partition %v", err))
+			return multistep.ActionHalt
+		}
+		swap.Number = last + 1
+		state.Put("swap_partition", swap)
+		resized = prev
+	} else {
+		part.SetLBALen(part.GetLBALen() + extrasector)
+	}
+	state.Put("resized_partition", resized+1)
 
 	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
 	if err != nil {
@@ -103,6 +157,95 @@ func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) mu
 	return multistep.ActionContinue
 }
 
+// handleSwap makes room for root to grow by moving the swap partition to the end of the
+// image, or by deleting it. the swap contents are not kept, only its UUID and label.
+func (s *stepResizeLastPart) handleSwap(ui packer.Ui, imagefile string, behavior SwapPartitionBehavior, swap, root *mbr.MBRPartition, extrasector uint32, sectorShift uint) (*swapPartition, error) {
+	info, err := readSwapHeader(imagefile, int64(swap.GetLBAStart())<<sectorShift)
+	if err != nil {
+		return nil, err
+	}
+
+	if behavior == SwapDrop {
+		ui.Say("Dropping swap partition")
+		root.SetLBALen(swap.GetLBALast() + 1 + extrasector - root.GetLBAStart())
+		swap.SetType(mbr.PART_EMPTY)
+		swap.SetLBAStart(0)
+		swap.SetLBALen(0)
+		info.Dropped = true
+		return info, nil
+	}
+
+	// keep the swap partition 1MiB aligned, it absorbs the rest of the extra room
+	alignment := uint32(partitionAlignment << SectorShift >> sectorShift)
+	shift := extrasector &^ (alignment - 1)
+	ui.Say(fmt.Sprintf("Moving swap partition %v sectors towards the end of the image", shift))
+	swap.SetLBAStart(swap.GetLBAStart() + shift)
+	swap.SetLBALen(swap.GetLBALen() + extrasector - shift)
+	root.SetLBALen(root.GetLBALen() + shift)
+	return info, nil
+}
+
+// relocateAfter makes room for partition n to grow by moving the partitions after it, and their
+// data, towards the end of the image. An extended partition moves with its logical partitions,
+// their boot records are relative to it.
+func (s *stepResizeLastPart) relocateAfter(ui packer.Ui, imagefile string, partitions []*mbr.MBRPartition, n int, extrasector uint32, sectorShift uint) error {
+	grown := partitions[n]
+	if extendedPartitionTypes[grown.GetType()] {
+		return fmt.Errorf("partition %d is an extended partition", n+1)
+	}
+	var moved []*mbr.MBRPartition
+	for _, part := range partitions {
+		if !part.IsEmpty() && part.GetLBAStart() > grown.GetLBAStart() {
+			moved = append(moved, part)
+		}
+	}
+	// the last one first, as they move into each other
+	sort.Slice(moved, func(i, j int) bool { return moved[i].GetLBAStart() > moved[j].GetLBAStart() })
+
+	// keep the moved partitions 1MiB aligned
+	alignment := uint32(partitionAlignment << SectorShift >> sectorShift)
+	shift := extrasector &^ (alignment - 1)
+	if shift == 0 {
+		return fmt.Errorf("growing by less than 1MiB")
+	}
+
+	f, err := os.OpenFile(imagefile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, part := range moved {
+		ui.Say(fmt.Sprintf("Moving partition at sector %v %v sectors towards the end of the image", part.GetLBAStart(), shift))
+		start := int64(part.GetLBAStart()) << sectorShift
+		if err := moveData(f, start, int64(part.GetLBALen())<<sectorShift, int64(shift)<<sectorShift); err != nil {
+			return err
+		}
+		part.SetLBAStart(part.GetLBAStart() + shift)
+	}
+	grown.SetLBALen(grown.GetLBALen() + shift)
+	return f.Sync()
+}
+
+// moveData moves length bytes at offset by delta bytes towards the end of f, from the end so it
+// can overlap where they were.
+func moveData(f *os.File, offset, length, delta int64) error {
+	buf := make([]byte, 4<<20)
+	for end := length; end > 0; {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], offset+end-n); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], offset+end-n+delta); err != nil {
+			return err
+		}
+		end -= n
+	}
+	return nil
+}
+
 func (s *stepResizeLastPart) getMbr(imagefile string) (*mbr.MBR, error) {
 
 	disk, err := os.Open(imagefile)
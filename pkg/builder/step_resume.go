@@ -0,0 +1,152 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// resumeState is what the steps preparing the image left in the state bag, saved so a failed
+// build can be resumed from mounting the image.
+type resumeState struct {
+	// the configuration of the steps preparing the image, not to resume a different build
+	Fingerprint      string             `json:"fingerprint"`
+	Source           string             `json:"source"`
+	Image            string             `json:"image"`
+	ResizedPartition int                `json:"resized_partition,omitempty"`
+	SwapPartition    *swapPartition     `json:"swap_partition,omitempty"`
+	AddedPartitions  []resumedPartition `json:"added_partitions,omitempty"`
+	PartuuidChanges  map[string]string  `json:"partuuid_changes,omitempty"`
+}
+
+// resumedPartition is an addedPartition, with the index of its add_partitions entry.
+type resumedPartition struct {
+	Index  int `json:"index"`
+	Number int `json:"number"`
+	Source int `json:"source,omitempty"`
+}
+
+func resumeStatePath(outputFile string) string {
+	return outputFile + ".resume.json"
+}
+
+// resumeFingerprint hashes the configuration the image was prepared with.
+func resumeFingerprint(c *Config) string {
+	data, _ := json.Marshal([]interface{}{c.ISOUrls, c.ISOChecksum, c.SourceDevice, c.ImageType, c.TargetImageSize,
+		c.LastPartitionExtraSize, c.ResizePartitionNumber, c.SwapPartition, c.AddPartitions, c.ConvertToGpt,
+		c.GptEspPartition, c.UbootBinaries, c.QcowCache})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadResumeState reads the state a failed build of the same configuration saved, with its
+// image still there.
+func loadResumeState(config *Config) (*resumeState, error) {
+	data, err := ioutil.ReadFile(resumeStatePath(config.OutputFile))
+	if err != nil {
+		return nil, err
+	}
+	var resumed resumeState
+	if err := json.Unmarshal(data, &resumed); err != nil {
+		return nil, err
+	}
+	if resumed.Fingerprint != resumeFingerprint(config) {
+		return nil, fmt.Errorf("the image was prepared with a different configuration")
+	}
+	if _, err := os.Stat(resumed.Image); err != nil {
+		return nil, err
+	}
+	return &resumed, nil
+}
+
+// stepResume saves the state of the steps that prepared the image, once they are done, or
+// restores it when Resumed is set, in place of them. The saved state is removed once the
+// build succeeds.
+type stepResume struct {
+	Path    string
+	Resumed *resumeState
+}
+
+func (s *stepResume) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	if s.Resumed != nil {
+		ui.Say(fmt.Sprintf("Resuming the failed build of %s", s.Resumed.Image))
+		s.restore(state, config)
+		return multistep.ActionContinue
+	}
+
+	data, err := json.MarshalIndent(s.save(state, config), "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(s.Path, data, 0644)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error saving the state to resume the build: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepResume) save(state multistep.StateBag, config *Config) *resumeState {
+	saved := &resumeState{
+		Fingerprint: resumeFingerprint(config),
+		Source:      state.Get("iso_path").(string),
+		Image:       state.Get("imagefile").(string),
+	}
+	if resized, ok := state.GetOk("resized_partition"); ok {
+		saved.ResizedPartition = resized.(int)
+	}
+	if swap, ok := state.GetOk("swap_partition"); ok {
+		saved.SwapPartition = swap.(*swapPartition)
+	}
+	if added, ok := state.GetOk("added_partitions"); ok {
+		for i, p := range added.([]*addedPartition) {
+			saved.AddedPartitions = append(saved.AddedPartitions, resumedPartition{Index: i, Number: p.Number, Source: p.Source})
+		}
+	}
+	if changes, ok := state.GetOk("partuuid_changes"); ok {
+		saved.PartuuidChanges = changes.(map[string]string)
+	}
+	return saved
+}
+
+func (s *stepResume) restore(state multistep.StateBag, config *Config) {
+	state.Put("iso_path", s.Resumed.Source)
+	state.Put("imagefile", s.Resumed.Image)
+	if s.Resumed.ResizedPartition != 0 {
+		state.Put("resized_partition", s.Resumed.ResizedPartition)
+	}
+	if s.Resumed.SwapPartition != nil {
+		state.Put("swap_partition", s.Resumed.SwapPartition)
+	}
+	if len(s.Resumed.AddedPartitions) > 0 {
+		var added []*addedPartition
+		for _, p := range s.Resumed.AddedPartitions {
+			added = append(added, &addedPartition{NewPartition: config.AddPartitions[p.Index], Number: p.Number, Source: p.Source})
+		}
+		state.Put("added_partitions", added)
+	}
+	if s.Resumed.PartuuidChanges != nil {
+		state.Put("partuuid_changes", s.Resumed.PartuuidChanges)
+	}
+}
+
+func (s *stepResume) Cleanup(state multistep.StateBag) {
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if cancelled || halted {
+		state.Get("ui").(packer.Ui).Say("Set resume to continue the build from mounting the image")
+		return
+	}
+	os.Remove(s.Path)
+}
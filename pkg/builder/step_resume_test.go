@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"testing"
+)
+
+func TestResumeFingerprint(t *testing.T) {
+	base := func() *Config {
+		c := &Config{}
+		c.ISOUrls = []string{"https://example.com/image.img.xz"}
+		c.ISOChecksum = "sha256:1234"
+		c.ImageType = "raspberrypi"
+		c.TargetImageSize = "4G"
+		return c
+	}
+	want := resumeFingerprint(base())
+	if got := resumeFingerprint(base()); got != want {
+		t.Fatalf("the fingerprint of the same configuration changed: %s, %s", got, want)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		change  func(*Config)
+		changed bool
+	}{
+		{name: "iso_url", change: func(c *Config) { c.ISOUrls = []string{"https://example.com/other.img.xz"} }, changed: true},
+		{name: "iso_checksum", change: func(c *Config) { c.ISOChecksum = "sha256:5678" }, changed: true},
+		{name: "target_image_size", change: func(c *Config) { c.TargetImageSize = "8G" }, changed: true},
+		{name: "add_partitions", change: func(c *Config) { c.AddPartitions = []NewPartition{{}} }, changed: true},
+		{name: "convert_to_gpt", change: func(c *Config) { c.ConvertToGpt = true }, changed: true},
+		{name: "qcow_cache", change: func(c *Config) { c.QcowCache = "/var/cache/images" }, changed: true},
+		// provisioning and the output don't change how the image is prepared
+		{name: "output_filename", change: func(c *Config) { c.OutputFile = "/tmp/other" }},
+		{name: "build_info", change: func(c *Config) { c.BuildInfo = true }},
+		{name: "chroot_env", change: func(c *Config) { c.ChrootEnv = map[string]string{"A": "b"} }},
+	} {
+		c := base()
+		tc.change(c)
+		if changed := resumeFingerprint(c) != want; changed != tc.changed {
+			t.Errorf("changing %s changed the fingerprint: %v, want %v", tc.name, changed, tc.changed)
+		}
+	}
+}
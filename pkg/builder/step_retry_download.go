@@ -0,0 +1,155 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	getter "github.com/hashicorp/go-getter/v2"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const (
+	// a download that receives nothing for this long is failed, so it can be retried
+	downloadStallTimeout = 2 * time.Minute
+	// the backoff between download attempts doubles up to this
+	maxDownloadBackoff = 5 * time.Minute
+)
+
+// stepRetryDownload runs the download step again when it fails, after a backoff doubling
+// between attempts, up to download_retries times. The partial file is kept in the cache, and
+// go-getter resumes http downloads from where they stopped, with a range request, when the
+// server supports them.
+type stepRetryDownload struct {
+	Download *packer_common_commonsteps.StepDownload
+	Retries  int
+	Backoff  time.Duration
+}
+
+func (s *stepRetryDownload) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	backoff := s.Backoff
+	for attempt := 1; ; attempt++ {
+		action := s.Download.Run(ctx, state)
+		if action == multistep.ActionContinue || attempt > s.Retries || ctx.Err() != nil {
+			return action
+		}
+		err := state.Get("error")
+		state.Remove("error")
+		ui.Say(fmt.Sprintf("Retrying the download in %s (%d/%d)", backoff, attempt, s.Retries))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+		if backoff *= 2; backoff > maxDownloadBackoff {
+			backoff = maxDownloadBackoff
+		}
+	}
+}
+
+func (s *stepRetryDownload) Cleanup(state multistep.StateBag) {
+	s.Download.Cleanup(state)
+}
+
+// useResumingHTTPClient makes the http getter of go-getter, shared by the download steps, fail
+// stalled downloads and resume from servers that ignore range requests.
+func useResumingHTTPClient() {
+	for _, g := range getter.Getters {
+		if g, ok := g.(*getter.HttpGetter); ok {
+			g.Client = &http.Client{Transport: &resumingTransport{base: http.DefaultTransport}}
+		}
+	}
+}
+
+// resumingTransport is the transport of go-getter downloads. go-getter asks for the rest of a
+// partial file with a range request, and appends the response to it: servers that answer with
+// the whole file have the part already downloaded skipped, rather than appended again. Response
+// bodies that don't receive anything for downloadStallTimeout fail.
+type resumingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *resumingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newStallReader(resp.Body, cancel, downloadStallTimeout)
+
+	offset, ok := rangeOffset(req.Header.Get("Range"))
+	if !ok || offset == 0 || resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("skipping the %d bytes already downloaded: %s", offset, err)
+	}
+	resp.StatusCode, resp.Status = http.StatusPartialContent, "206 Partial Content"
+	if resp.ContentLength >= 0 {
+		resp.ContentLength -= offset
+	}
+	return resp, nil
+}
+
+// rangeOffset returns the start of an open ended range, like bytes=1024-.
+func rangeOffset(header string) (int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || !strings.HasSuffix(header, "-") {
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(header[len("bytes="):len(header)-1], 10, 64)
+	return offset, err == nil
+}
+
+// stallReader cancels the request of a response body that receives nothing for timeout.
+type stallReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+func newStallReader(body io.ReadCloser, cancel context.CancelFunc, timeout time.Duration) *stallReader {
+	r := &stallReader{ReadCloser: body, timeout: timeout, cancel: cancel}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		r.stalled = true
+		r.mu.Unlock()
+		cancel()
+	})
+	return r
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil && err != io.EOF && r.stalled {
+		err = fmt.Errorf("nothing received for %s", r.timeout)
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,93 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumingTransport(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	// ignores range requests
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		fmt.Fprint(w, content)
+	}))
+	defer ignoring.Close()
+	// serves them
+	serving := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image.img", time.Time{}, strings.NewReader(content))
+	}))
+	defer serving.Close()
+
+	for _, tc := range []struct {
+		name, url, rng string
+		status         int
+		want           string
+		wantErr        bool
+	}{
+		{name: "no range", url: ignoring.URL, status: http.StatusOK, want: content},
+		{name: "range from 0", url: ignoring.URL, rng: "bytes=0-", status: http.StatusOK, want: content},
+		{name: "range ignored", url: ignoring.URL, rng: "bytes=10-", status: http.StatusPartialContent, want: content[10:]},
+		{name: "range served", url: serving.URL, rng: "bytes=10-", status: http.StatusPartialContent, want: content[10:]},
+		{name: "closed range", url: ignoring.URL, rng: "bytes=10-12", status: http.StatusOK, want: content},
+		{name: "past the end", url: ignoring.URL, rng: "bytes=30-", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: &resumingTransport{base: http.DefaultTransport}}
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.rng != "" {
+				req.Header.Set("Range", tc.rng)
+			}
+			resp, err := client.Do(req)
+			if tc.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("skipping past the end of the response succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status || string(body) != tc.want {
+				t.Fatalf("got %d %q, want %d %q", resp.StatusCode, body, tc.status, tc.want)
+			}
+			if resp.ContentLength != int64(len(tc.want)) {
+				t.Fatalf("Content-Length %d, want %d", resp.ContentLength, len(tc.want))
+			}
+		})
+	}
+}
+
+func TestRangeOffset(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		offset int64
+		ok     bool
+	}{
+		{header: "bytes=1024-", offset: 1024, ok: true},
+		{header: "bytes=0-", offset: 0, ok: true},
+		{header: "bytes=0-1023"},
+		{header: "bytes=-500"},
+		{header: "items=10-"},
+		{header: ""},
+	} {
+		offset, ok := rangeOffset(tc.header)
+		if offset != tc.offset || ok != tc.ok {
+			t.Errorf("rangeOffset(%q) = %d, %v, want %d, %v", tc.header, offset, ok, tc.offset, tc.ok)
+		}
+	}
+}
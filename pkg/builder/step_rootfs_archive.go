@@ -0,0 +1,144 @@
+package builder
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+var rootfsArchiveExtensions = []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".tar.bz2", ".tar.zst"}
+
+// isRootfsArchive tells if the source url is a tarball of a root filesystem, like the
+// ArchLinuxARM-rpi-aarch64-latest.tar.gz of Arch Linux ARM, rather than a disk image.
+func isRootfsArchive(u string) bool {
+	if parsed, err := url.Parse(u); err == nil && parsed.Path != "" {
+		u = parsed.Path
+	}
+	u = strings.ToLower(u)
+	for _, ext := range rootfsArchiveExtensions {
+		if strings.HasSuffix(u, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepArchive sets the archive=false query of go-getter on u, so the archive is downloaded as
+// a file.
+func keepArchive(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	q := parsed.Query()
+	q.Set("archive", "false")
+	parsed.RawQuery = q.Encode()
+	return parsed.String()
+}
+
+// stepCreateImage creates the blank image of a rootfs archive, of target_image_size with an empty
+// MBR. stepAddPartitions then lays out its boot and root partitions.
+type stepCreateImage struct {
+	ResultKey string
+}
+
+func (s *stepCreateImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Creating a blank image of %d M", config.targetImageSize>>20))
+	if err := s.create(config.OutputFile, int64(config.targetImageSize)); err != nil {
+		os.Remove(config.OutputFile)
+		err := fmt.Errorf("Error creating the image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put(s.ResultKey, config.OutputFile)
+	return multistep.ActionContinue
+}
+
+func (s *stepCreateImage) create(imagefile string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(imagefile), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(imagefile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	// a random disk identifier, which the PARTUUIDs are made of, and the boot signature
+	mbr := make([]byte, 512)
+	if _, err := rand.Read(mbr[440:444]); err != nil {
+		return err
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	_, err = f.WriteAt(mbr, 0)
+	return err
+}
+
+func (s *stepCreateImage) Cleanup(state multistep.StateBag) {
+	imagefile, ok := state.GetOk(s.ResultKey)
+	if !ok {
+		return
+	}
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if (!cancelled && !halted) || state.Get("config").(*Config).KeepImageOnError {
+		return
+	}
+	os.Remove(imagefile.(string))
+}
+
+// stepUnpackRootfsArchive unpacks the rootfs archive to the mounted partitions of the image.
+// FAT can't hold the owners and modes of the archive, so, like the Arch Linux ARM instructions
+// that unpack it before moving /boot to the boot partition, /boot is unpacked on its own without
+// them.
+type stepUnpackRootfsArchive struct {
+	ChrootKey string
+	FromKey   string
+}
+
+func (s *stepUnpackRootfsArchive) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	archive := state.Get(s.FromKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	// members are named like ./boot/Image or boot/Image
+	prefix := ""
+	first, err := runCommandOutput(ctx, state, fmt.Sprintf("tar --list --file %s | head -n 1", shellQuote(archive)))
+	if err != nil {
+		err := fmt.Errorf("Error listing the rootfs archive: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if strings.HasPrefix(first, "./") {
+		prefix = "./"
+	}
+
+	ui.Say("Unpacking the rootfs archive")
+	tar := fmt.Sprintf("tar --extract --file %s -C %s", shellQuote(archive), shellQuote(mountPath))
+	if err := run(ctx, state, fmt.Sprintf("%s --numeric-owner --xattrs --xattrs-include='*' --acls --anchored --exclude=%s --exclude=%s",
+		tar, shellQuote(prefix+"boot"), shellQuote(prefix+"boot/*"))); err != nil {
+		return multistep.ActionHalt
+	}
+	ui.Message("Unpacking /boot")
+	if err := run(ctx, state, fmt.Sprintf("%s --no-same-owner --no-same-permissions --wildcards %s", tar, shellQuote(prefix+"boot/*"))); err != nil {
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepUnpackRootfsArchive) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,84 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepRootfsTarball archives the provisioned filesystems of the mounted image, with numeric
+// owners, xattrs and ACLs. The host mounts of the chroot and the qemu binaries copied into it
+// are left out. tar picks the compression from the extension of the tarball.
+//
+// Produces:
+//
+//	rootfs_tarball string - The path of the tarball
+//	artifact_files []string - The tarball is appended
+type stepRootfsTarball struct {
+	ChrootKey string
+	Tarball   string
+}
+
+func (s *stepRootfsTarball) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	if err := os.MkdirAll(filepath.Dir(s.Tarball), 0755); err != nil {
+		err := fmt.Errorf("Error creating the directory of rootfs_tarball: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Archiving the root filesystem to %s", s.Tarball))
+	if err := run(ctx, state, rootfsTarCommand(state, mountPath, s.Tarball)); err != nil {
+		os.Remove(s.Tarball)
+		return multistep.ActionHalt
+	}
+	state.Put("rootfs_tarball", s.Tarball)
+	addArtifactFiles(state, s.Tarball)
+	return multistep.ActionContinue
+}
+
+// rootfsTarCommand returns the tar command archiving the chroot at mountPath to tarball, without
+// the host mounts and qemu binaries of the build.
+func rootfsTarCommand(state multistep.StateBag, mountPath, tarball string) string {
+	config := state.Get("config").(*Config)
+
+	var excludes []string
+	for _, mount := range config.ChrootMounts {
+		excludes = append(excludes, "."+mount[2]+"/*")
+	}
+	if qemu, ok := state.GetOk("qemuInChroot"); ok {
+		excludes = append(excludes, "."+qemu.(string))
+	}
+	if qemus, ok := state.GetOk("additionalQemuInChroot"); ok {
+		for _, qemu := range qemus.([]string) {
+			excludes = append(excludes, "."+qemu)
+		}
+	}
+
+	args := []string{"tar", "--create", "--auto-compress", "--numeric-owner", "--xattrs", "--xattrs-include='*'", "--acls", "--sparse"}
+	for _, exclude := range excludes {
+		args = append(args, "--exclude="+shellQuote(exclude))
+	}
+	args = append(args, "--file", shellQuote(tarball), "-C", shellQuote(mountPath), ".")
+	return strings.Join(args, " ")
+}
+
+func (s *stepRootfsTarball) Cleanup(state multistep.StateBag) {
+	if _, ok := state.GetOk("rootfs_tarball"); !ok {
+		return
+	}
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if (!cancelled && !halted) || state.Get("config").(*Config).KeepImageOnError {
+		return
+	}
+	os.Remove(s.Tarball)
+}
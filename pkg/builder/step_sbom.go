@@ -0,0 +1,145 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+	"github.com/solo-io/packer-builder-arm-image/pkg/version"
+)
+
+const (
+	SbomSpdx      = "spdx"
+	SbomCycloneDX = "cyclonedx"
+)
+
+// sbomPackageManagers are the package managers queried for the installed packages, by the file
+// telling the image uses them. The first one found is queried.
+var sbomPackageManagers = []struct {
+	Database string
+	Query    string
+	Parse    func([]byte) ([]utils.Package, error)
+}{
+	{"/var/lib/dpkg/status", "dpkg-query -W -f='" + utils.DpkgQueryFormat + "'", utils.ParseDpkgPackages},
+	{"/var/lib/rpm", "rpm -qa --queryformat '" + utils.RpmQueryFormat + "'", utils.ParseRpmPackages},
+	{"/usr/lib/sysimage/rpm", "rpm -qa --queryformat '" + utils.RpmQueryFormat + "'", utils.ParseRpmPackages},
+	{"/lib/apk/db/installed", "apk list --installed", utils.ParseApkPackages},
+}
+
+// sbomScript queries the package manager in the chroot, writing the package list to
+// sbomOutput, as the output of commands isn't captured. The query is a script so the host
+// shell doesn't expand the ${} of dpkg-query formats.
+const (
+	sbomScript = "/tmp/packer-sbom.sh"
+	sbomOutput = "/tmp/packer-sbom-packages"
+)
+
+// stepSbom writes an SPDX or CycloneDX SBOM of the packages installed in the image to
+// sbom_file once provisioned, querying the package manager of the image in the chroot.
+//
+// Produces:
+//
+//	sbom_file string - The SBOM written
+//	artifact_files []string - The SBOM is appended
+type stepSbom struct {
+	ChrootKey string
+	Format    string
+	File      string
+}
+
+func (s *stepSbom) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Writing the SBOM of the image to %s", s.File))
+	if err := s.write(ctx, state, config, mountPath); err != nil {
+		err := fmt.Errorf("Error creating the SBOM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("sbom_file", s.File)
+	addArtifactFiles(state, s.File)
+	return multistep.ActionContinue
+}
+
+func (s *stepSbom) write(ctx context.Context, state multistep.StateBag, config *Config, mountPath string) error {
+	ui := state.Get("ui").(packer.Ui)
+
+	packages, err := s.packages(ctx, state, mountPath)
+	if err != nil {
+		return err
+	}
+	ui.Message(fmt.Sprintf("%d packages installed", len(packages)))
+
+	serial, err := newUUID()
+	if err != nil {
+		return err
+	}
+	sbom := &utils.Sbom{
+		Name:        config.PackerBuildName,
+		Serial:      serial,
+		Created:     time.Now(),
+		Tool:        "packer-builder-arm-image",
+		ToolVersion: version.String(),
+		Os:          utils.OsRelease{},
+		Packages:    packages,
+	}
+	if sbom.Name == "" {
+		sbom.Name = filepath.Base(config.OutputFile)
+	}
+	for _, file := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		data, err := ioutil.ReadFile(resolveInChroot(mountPath, file))
+		if err != nil {
+			continue
+		}
+		if release, err := utils.ParseOsRelease(data); err == nil {
+			sbom.Os = release
+			break
+		}
+	}
+
+	var data []byte
+	if s.Format == SbomCycloneDX {
+		data, err = sbom.CycloneDX()
+	} else {
+		data, err = sbom.SPDX()
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.File, append(data, '\n'), 0644)
+}
+
+// packages lists the packages installed in the image with its package manager.
+func (s *stepSbom) packages(ctx context.Context, state multistep.StateBag, mountPath string) ([]utils.Package, error) {
+	for _, pm := range sbomPackageManagers {
+		if _, err := os.Stat(resolveInChroot(mountPath, pm.Database)); err != nil {
+			continue
+		}
+		script, output := filepath.Join(mountPath, sbomScript), filepath.Join(mountPath, sbomOutput)
+		defer os.Remove(script)
+		defer os.Remove(output)
+		if err := ioutil.WriteFile(script, []byte(pm.Query+" > "+sbomOutput+"\n"), 0755); err != nil {
+			return nil, err
+		}
+		if err := runInChroot(ctx, state, mountPath, chrootShellOf(state)+" "+sbomScript); err != nil {
+			return nil, err
+		}
+		out, err := ioutil.ReadFile(output)
+		if err != nil {
+			return nil, err
+		}
+		return pm.Parse(out)
+	}
+	return nil, fmt.Errorf("no dpkg, rpm or apk package database found in the image")
+}
+
+func (s *stepSbom) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,141 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// NOOBS and PINN keep a small ext4 SETTINGS partition as the first logical partition.
+// It holds installed_os.json, which lists the partitions of every installed OS.
+const noobsSettingsPartition = 5
+
+type noobsInstalledOS struct {
+	Name       string   `json:"name"`
+	Partitions []string `json:"partitions"`
+}
+
+// stepSelectNoobsOS narrows down the mapped partitions of a NOOBS/PINN card to the
+// partitions of one installed OS, so they can be mounted like a regular image.
+type stepSelectNoobsOS struct {
+	PartitionsKey string
+	// Name or 1 based index of the installed OS.
+	OS string
+}
+
+func (s *stepSelectNoobsOS) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	byNumber := make(map[int]string, len(partitions))
+	for _, p := range partitions {
+		n, err := partitionNumber(p)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		byNumber[n] = p
+	}
+
+	settings, ok := byNumber[noobsSettingsPartition]
+	if !ok {
+		err := fmt.Errorf("no NOOBS settings partition found in image")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	installed, err := s.readInstalledOS(ctx, state, settings)
+	if err != nil {
+		err := fmt.Errorf("Error reading installed_os.json: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	selected, err := s.selectOS(installed)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	var osPartitions []string
+	for _, p := range selected.Partitions {
+		n, err := partitionNumber(p)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		dev, ok := byNumber[n]
+		if !ok {
+			err := fmt.Errorf("partition %d of %s is not in the image", n, selected.Name)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		osPartitions = append(osPartitions, dev)
+	}
+
+	ui.Say(fmt.Sprintf("Selected NOOBS OS %s: %v", selected.Name, osPartitions))
+	state.Put(s.PartitionsKey, osPartitions)
+	return multistep.ActionContinue
+}
+
+func (s *stepSelectNoobsOS) readInstalledOS(ctx context.Context, state multistep.StateBag, settings string) ([]noobsInstalledOS, error) {
+	tempDir, err := ioutil.TempDir("", "noobs-settings")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempDir)
+
+	if err := run(ctx, state, fmt.Sprintf("mount -o ro %s %s", settings, tempDir)); err != nil {
+		return nil, err
+	}
+	defer run(context.TODO(), state, "umount "+tempDir)
+
+	data, err := ioutil.ReadFile(filepath.Join(tempDir, "installed_os.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []noobsInstalledOS
+	if err := json.Unmarshal(data, &installed); err != nil {
+		return nil, err
+	}
+	return installed, nil
+}
+
+func (s *stepSelectNoobsOS) selectOS(installed []noobsInstalledOS) (*noobsInstalledOS, error) {
+	if len(installed) == 0 {
+		return nil, fmt.Errorf("no OS installed in NOOBS image")
+	}
+
+	if index, err := strconv.Atoi(s.OS); err == nil {
+		if index < 1 || index > len(installed) {
+			return nil, fmt.Errorf("noobs_os %d out of range, image has %d installed OSes", index, len(installed))
+		}
+		return &installed[index-1], nil
+	}
+
+	var names []string
+	for i := range installed {
+		if strings.EqualFold(installed[i].Name, s.OS) {
+			return &installed[i], nil
+		}
+		names = append(names, installed[i].Name)
+	}
+	return nil, fmt.Errorf("OS %q not found in NOOBS image, installed are: %v", s.OS, names)
+}
+
+func (s *stepSelectNoobsOS) Cleanup(state multistep.StateBag) {}
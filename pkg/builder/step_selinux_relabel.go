@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// the f_type statfs reports for FAT filesystems, which have no xattrs to hold labels
+const msdosSuperMagic = 0x4d44
+
+// stepSelinuxRelabel fixes the SELinux labels of the mounted image once provisioned, as files
+// written from the chroot get no label, or the one of the host. It does nothing on images
+// without SELinux enabled.
+type stepSelinuxRelabel struct {
+	ChrootKey string
+	Mode      SelinuxRelabel
+}
+
+func (s *stepSelinuxRelabel) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	policy, err := selinuxPolicy(mountPath)
+	if err != nil {
+		err := fmt.Errorf("Error reading the SELinux config of the image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if policy == "" {
+		if s.Mode != SelinuxAuto {
+			ui.Message("SELinux is not enabled in the image, not relabeling")
+		}
+		return multistep.ActionContinue
+	}
+
+	switch s.Mode {
+	case SelinuxSetfiles:
+		ui.Say(fmt.Sprintf("Relabeling the image with the %s SELinux policy", policy))
+		contexts := filepath.Join(mountPath, "etc/selinux", policy, "contexts/files/file_contexts")
+		if _, err := os.Stat(contexts); err != nil {
+			err := fmt.Errorf("Error relabeling the image: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		args := []string{"setfiles", "-F", "-m", "-r", shellQuote(mountPath)}
+		for _, exclude := range selinuxExcludes(mountPath, config) {
+			args = append(args, "-e", shellQuote(exclude))
+		}
+		args = append(args, shellQuote(contexts), shellQuote(mountPath))
+		if err := run(ctx, state, strings.Join(args, " ")); err != nil {
+			return multistep.ActionHalt
+		}
+	default:
+		ui.Say("SELinux is enabled in the image, relabeling it on first boot")
+		if err := ioutil.WriteFile(filepath.Join(mountPath, ".autorelabel"), nil, 0644); err != nil {
+			err := fmt.Errorf("Error creating /.autorelabel: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+// selinuxPolicy returns the SELINUXTYPE of the image at mountPath, or "" when SELinux isn't
+// enabled in it.
+func selinuxPolicy(mountPath string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(mountPath, "etc/selinux/config"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	// same VAR=value format as os-release
+	vars, err := utils.ParseOsRelease(data)
+	if err != nil {
+		return "", err
+	}
+	if mode := vars["SELINUX"]; mode == "" || mode == "disabled" {
+		return "", nil
+	}
+	if vars["SELINUXTYPE"] == "" {
+		return "targeted", nil
+	}
+	return vars["SELINUXTYPE"], nil
+}
+
+// selinuxExcludes returns the directories of the chroot setfiles must not descend into: the host
+// mounts of the build, and the FAT partitions that can't hold labels.
+func selinuxExcludes(mountPath string, config *Config) []string {
+	var excludes []string
+	for _, mount := range config.ChrootMounts {
+		excludes = append(excludes, filepath.Join(mountPath, mount[2]))
+	}
+	for _, mnt := range config.ImageMounts {
+		if mnt == "" || filepath.Clean(mnt) == "/" {
+			continue
+		}
+		dir := filepath.Join(mountPath, mnt)
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err == nil && st.Type == msdosSuperMagic {
+			excludes = append(excludes, dir)
+		}
+	}
+	return excludes
+}
+
+func (s *stepSelinuxRelabel) Cleanup(state multistep.StateBag) {}
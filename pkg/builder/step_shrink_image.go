@@ -0,0 +1,178 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// stepShrinkFs shrinks the filesystem of the last partition to its minimum size plus
+// shrink_free_space, once the image is unmounted. stepShrinkPartition then shrinks the
+// partition and the image file to match.
+type stepShrinkFs struct {
+	PartitionsKey string
+}
+
+func (s *stepShrinkFs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	partitions := state.Get(s.PartitionsKey).([]string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	p := resizedPartition(state, partitions)
+	size, err := s.shrink(ctx, state, p, config.shrinkFreeSpace)
+	if err != nil {
+		err := fmt.Errorf("Error shrinking filesystem of %s: %s", p, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	number, _ := partitionNumber(p)
+	state.Put("shrunk_partition", number)
+	state.Put("shrunk_fs_size", size)
+	return multistep.ActionContinue
+}
+
+func (s *stepShrinkFs) shrink(ctx context.Context, state multistep.StateBag, p string, freeSpace uint64) (uint64, error) {
+	ui := state.Get("ui").(packer.Ui)
+
+	info, err := hostBlkid(ctx, state)(p)
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(info.Type(), "ext") {
+		return 0, fmt.Errorf("only ext filesystems can be shrunk, %s is %q", p, info.Type())
+	}
+	if _, err := partitionNumber(p); err != nil {
+		return 0, err
+	}
+
+	ui.Say(fmt.Sprintf("Shrinking filesystem of %s", p))
+	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
+	if err := e2fsckBeforeResize(wrappedCommand, p); err != nil {
+		return 0, err
+	}
+	if err := run(ctx, state, fmt.Sprintf("resize2fs -M %s", p)); err != nil {
+		return 0, err
+	}
+
+	sb, err := dumpe2fs(ctx, state, p)
+	if err != nil {
+		return 0, err
+	}
+	if freeSpace > 0 {
+		blockSize, err := sb.BlockSize()
+		if err != nil {
+			return 0, err
+		}
+		blockCount, err := sb.BlockCount()
+		if err != nil {
+			return 0, err
+		}
+		blockCount += (freeSpace + blockSize - 1) / blockSize
+		ui.Message(fmt.Sprintf("Keeping %d bytes of free space", freeSpace))
+		if err := run(ctx, state, fmt.Sprintf("resize2fs %s %d", p, blockCount)); err != nil {
+			return 0, err
+		}
+		if sb, err = dumpe2fs(ctx, state, p); err != nil {
+			return 0, err
+		}
+	}
+	return sb.Size()
+}
+
+// dumpe2fs returns the superblock of the ext filesystem of dev.
+func dumpe2fs(ctx context.Context, state multistep.StateBag, dev string) (utils.Ext2Superblock, error) {
+	out, err := runCommandOutput(ctx, state, fmt.Sprintf("dumpe2fs -h %s", dev))
+	if err != nil {
+		return nil, err
+	}
+	return utils.ParseDumpe2fs([]byte(out)), nil
+}
+
+func (s *stepShrinkFs) Cleanup(state multistep.StateBag) {}
+
+// stepShrinkPartition shrinks the partition stepShrinkFs shrunk the filesystem of, and cuts
+// the image file after it. the image must be unmapped.
+type stepShrinkPartition struct {
+	FromKey string
+}
+
+func (s *stepShrinkPartition) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	number := state.Get("shrunk_partition").(int)
+	fsSize := state.Get("shrunk_fs_size").(uint64)
+	ui := state.Get("ui").(packer.Ui)
+
+	size, err := s.shrink(imagefile, number, fsSize)
+	if err != nil {
+		err := fmt.Errorf("Error shrinking partition %d: %s", number, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Say(fmt.Sprintf("Shrunk image to %v M (%v bytes)", size/1024/1024, size))
+	return multistep.ActionContinue
+}
+
+func (s *stepShrinkPartition) shrink(imagefile string, number int, fsSize uint64) (int64, error) {
+	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	mbrp, err := mbr.Read(f)
+	if err != nil {
+		return 0, err
+	}
+	partitions := mbrp.GetAllPartitions()
+	if number < 1 || number > len(partitions) {
+		return 0, fmt.Errorf("not a primary partition")
+	}
+	part := partitions[number-1]
+	for _, other := range partitions[number:] {
+		if !other.IsEmpty() {
+			return 0, fmt.Errorf("it is not the last partition, set swap_partition to drop if it is followed by swap")
+		}
+	}
+
+	sectorSize, err := utils.SectorSize(f)
+	if err != nil {
+		return 0, err
+	}
+	// keep the end of the partition 1MiB aligned
+	sectors := uint32((fsSize + sectorSize - 1) / sectorSize)
+	alignment := uint32(partitionAlignment << SectorShift / sectorSize)
+	end := (part.GetLBAStart() + sectors + alignment - 1) &^ (alignment - 1)
+	if end-part.GetLBAStart() < part.GetLBALen() {
+		part.SetLBALen(end - part.GetLBAStart())
+		if _, err := f.Seek(0, 0); err != nil {
+			return 0, err
+		}
+		if err := mbrp.Write(f); err != nil {
+			return 0, err
+		}
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := int64(part.GetLBALast()+1) * int64(sectorSize)
+	if size >= stat.Size() {
+		return stat.Size(), nil
+	}
+	if err := f.Truncate(size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *stepShrinkPartition) Cleanup(state multistep.StateBag) {}
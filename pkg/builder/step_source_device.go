@@ -0,0 +1,74 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepSourceDevice uses a block device as the source image, once it made sure none of its
+// partitions is mounted, as the copy would be inconsistent.
+type stepSourceDevice struct {
+	Device    string
+	ResultKey string
+}
+
+func (s *stepSourceDevice) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Using device %s as the source image", s.Device))
+	if err := s.checkNotMounted(); err != nil {
+		err := fmt.Errorf("Error using source_device: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put(s.ResultKey, s.Device)
+	return multistep.ActionContinue
+}
+
+func (s *stepSourceDevice) checkNotMounted() error {
+	device, err := filepath.EvalSymlinks(s.Device)
+	if err != nil {
+		return err
+	}
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		source, err := filepath.EvalSymlinks(fields[0])
+		if err != nil {
+			source = fields[0]
+		}
+		// partitions are named like sdb1 or mmcblk0p1
+		if source == device || (strings.HasPrefix(source, device) && isPartitionSuffix(strings.TrimPrefix(source, device))) {
+			return fmt.Errorf("%s is mounted on %s, unmount it first", fields[0], fields[1])
+		}
+	}
+	return nil
+}
+
+func isPartitionSuffix(suffix string) bool {
+	suffix = strings.TrimPrefix(suffix, "p")
+	if suffix == "" {
+		return false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *stepSourceDevice) Cleanup(state multistep.StateBag) {}
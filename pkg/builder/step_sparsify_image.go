@@ -0,0 +1,42 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+)
+
+// stepSparsifyImage punches holes in the zero blocks of the unmapped image, like the free
+// space provisioning and resizing left zeroed.
+type stepSparsifyImage struct {
+	ImageKey string
+}
+
+func (s *stepSparsifyImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	imagefile := state.Get(s.ImageKey).(string)
+
+	ui.Say("Punching holes in the zero blocks of the image")
+	punched, err := image.PunchZeroes(imagefile)
+	if err != nil {
+		err := fmt.Errorf("Error making the image sparse, does the filesystem support holes? %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Message(fmt.Sprintf("Punched %d bytes", punched))
+
+	if finfo, err := os.Stat(imagefile); err == nil {
+		if st, ok := finfo.Sys().(*syscall.Stat_t); ok {
+			ui.Message(fmt.Sprintf("Image takes %d bytes on disk for %d bytes", st.Blocks*512, finfo.Size()))
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepSparsifyImage) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,126 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const (
+	policyRcD       = "/usr/sbin/policy-rc.d"
+	policyRcDBackup = policyRcD + ".packer-orig"
+)
+
+// invoke-rc.d doesn't start services when policy-rc.d exits with 101
+const policyRcDContent = `#!/bin/sh
+# Installed by packer-builder-arm-image while provisioning, services are not started in the chroot.
+exit 101
+`
+
+const fakeStartStopDaemon = `#!/bin/sh
+echo "Warning: start-stop-daemon is disabled while provisioning, doing nothing" >&2
+exit 0
+`
+
+// stepSuppressServices keeps package installs in the chroot from starting daemons, which hang or
+// fail under qemu-user. It installs a policy-rc.d that denies everything and diverts
+// start-stop-daemon, the same way debootstrap does, and undoes both before the image is unmounted.
+//
+// Produces:
+//
+//	suppress_services_cleanup CleanupFunc - To perform early cleanup
+type stepSuppressServices struct {
+	ChrootKey string
+
+	mountPath       string
+	policyInstalled bool
+	diverted        string
+}
+
+func (s *stepSuppressServices) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	s.mountPath = state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Disabling service start in the chroot")
+	state.Put("suppress_services_cleanup", s)
+	if err := s.install(ctx, state); err != nil {
+		err := fmt.Errorf("Error disabling service start: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepSuppressServices) install(ctx context.Context, state multistep.StateBag) error {
+	policy := filepath.Join(s.mountPath, policyRcD)
+	if _, err := os.Lstat(policy); err == nil {
+		if err := os.Rename(policy, filepath.Join(s.mountPath, policyRcDBackup)); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(policy), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(policy, []byte(policyRcDContent), 0755); err != nil {
+		return err
+	}
+	s.policyInstalled = true
+
+	if _, err := os.Stat(filepath.Join(s.mountPath, "/usr/bin/dpkg-divert")); err != nil {
+		// not a dpkg based image
+		return nil
+	}
+	for _, daemon := range []string{"/sbin/start-stop-daemon", "/usr/sbin/start-stop-daemon"} {
+		if fi, err := os.Lstat(filepath.Join(s.mountPath, daemon)); err != nil || !fi.Mode().IsRegular() {
+			// with a merged /usr, /sbin is a symlink
+			continue
+		}
+		if err := runInChroot(ctx, state, s.mountPath, "dpkg-divert --local --rename --add "+daemon); err != nil {
+			return err
+		}
+		s.diverted = daemon
+		return ioutil.WriteFile(filepath.Join(s.mountPath, daemon), []byte(fakeStartStopDaemon), 0755)
+	}
+	return nil
+}
+
+func (s *stepSuppressServices) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *stepSuppressServices) CleanupFunc(state multistep.StateBag) error {
+	if s.diverted != "" {
+		if err := os.Remove(filepath.Join(s.mountPath, s.diverted)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := runInChroot(context.TODO(), state, s.mountPath, "dpkg-divert --local --rename --remove "+s.diverted); err != nil {
+			return err
+		}
+		s.diverted = ""
+	}
+
+	if s.policyInstalled {
+		policy := filepath.Join(s.mountPath, policyRcD)
+		if err := os.Remove(policy); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backup := filepath.Join(s.mountPath, policyRcDBackup)
+		if _, err := os.Lstat(backup); err == nil {
+			if err := os.Rename(backup, policy); err != nil {
+				return err
+			}
+		}
+		s.policyInstalled = false
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// swapPartition is the swap partition that was moved or dropped to grow the partition before it.
+type swapPartition struct {
+	// 1 based partition number
+	Number  int
+	UUID    string
+	Label   string
+	Dropped bool
+}
+
+// readSwapHeader reads the UUID and label of the swap area at offset in the image.
+// the header is at the start of the first page, with the signature at the end of that page.
+func readSwapHeader(imagefile string, offset int64) (*swapPartition, error) {
+	f, err := os.Open(imagefile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 65536)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+
+	info := &swapPartition{}
+	for _, pageSize := range []int{4096, 8192, 16384, 65536} {
+		if string(buf[pageSize-10:pageSize]) != "SWAPSPACE2" {
+			continue
+		}
+		// struct swap_header_v1_2: 1024 bytes of boot block, version, last_page, nr_badpages, uuid, volume_name
+		uuid := buf[1036:1052]
+		if !bytes.Equal(uuid, make([]byte, 16)) {
+			info.UUID = fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+		}
+		info.Label = string(bytes.TrimRight(buf[1052:1068], "\x00"))
+		return info, nil
+	}
+	// not initialized, mkswap will pick a new UUID
+	return info, nil
+}
+
+// stepRecreateSwap formats the swap partition again after it was moved.
+type stepRecreateSwap struct {
+	PartitionsKey string
+}
+
+func (s *stepRecreateSwap) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	swapRaw, ok := state.GetOk("swap_partition")
+	if !ok || swapRaw.(*swapPartition).Dropped {
+		return multistep.ActionContinue
+	}
+	swap := swapRaw.(*swapPartition)
+	partitions := state.Get(s.PartitionsKey).([]string)
+
+	var dev string
+	for _, p := range partitions {
+		if n, err := partitionNumber(p); err == nil && n == swap.Number {
+			dev = p
+		}
+	}
+	if dev == "" {
+		ui.Error(fmt.Sprintf("swap partition %d not found in %v", swap.Number, partitions))
+		return multistep.ActionHalt
+	}
+
+	cmd := "mkswap"
+	if swap.UUID != "" {
+		cmd += " -U " + swap.UUID
+	} else {
+		ui.Message("swap partition had no UUID, fstab entries using UUID= must be updated")
+	}
+	if swap.Label != "" {
+		cmd += fmt.Sprintf(" -L '%s'", swap.Label)
+	}
+
+	ui.Say(fmt.Sprintf("Recreating swap on %s", dev))
+	if err := run(ctx, state, cmd+" "+dev); err != nil {
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepRecreateSwap) Cleanup(state multistep.StateBag) {}
+
+// stepRemoveSwapFstab removes the fstab entry of a dropped swap partition.
+type stepRemoveSwapFstab struct {
+	ChrootKey string
+}
+
+func (s *stepRemoveSwapFstab) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	swapRaw, ok := state.GetOk("swap_partition")
+	if !ok || !swapRaw.(*swapPartition).Dropped {
+		return multistep.ActionContinue
+	}
+	swap := swapRaw.(*swapPartition)
+	mountPath := state.Get(s.ChrootKey).(string)
+
+	fstabPath := filepath.Join(mountPath, "/etc/fstab")
+	data, err := ioutil.ReadFile(fstabPath)
+	if os.IsNotExist(err) {
+		return multistep.ActionContinue
+	}
+
+	var filtered []byte
+	if err == nil {
+		filtered, err = utils.FilterFstab(data, swap.matches)
+	}
+	if err == nil && len(filtered) != len(data) {
+		ui.Say("Removing dropped swap partition from fstab")
+		err = ioutil.WriteFile(fstabPath, filtered, 0644)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error updating fstab: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepRemoveSwapFstab) Cleanup(state multistep.StateBag) {}
+
+// matches tells if an fstab entry refers to the swap partition, by UUID, label,
+// dos PARTUUID (<disk id>-<number>) or device name.
+func (s *swapPartition) matches(e utils.FstabEntry) bool {
+	if e.VfsType != "swap" {
+		return false
+	}
+	switch {
+	case s.UUID != "" && strings.EqualFold(e.Spec, "UUID="+s.UUID):
+		return true
+	case s.Label != "" && e.Spec == "LABEL="+s.Label:
+		return true
+	case strings.HasPrefix(e.Spec, "PARTUUID="):
+		return strings.HasSuffix(e.Spec, fmt.Sprintf("-%02x", s.Number))
+	case strings.HasPrefix(e.Spec, "/dev/"):
+		return regexp.MustCompile(fmt.Sprintf(`[^0-9]%d$`, s.Number)).MatchString(e.Spec)
+	}
+	return false
+}
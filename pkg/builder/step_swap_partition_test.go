@@ -0,0 +1,35 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+func TestRemoveSwapFstab(t *testing.T) {
+	swap := &swapPartition{Number: 3, UUID: "5e8a1c2d-3b4f-4a6e-8c9d-0f1e2d3c4b5a", Label: "swap", Dropped: true}
+	for _, tc := range []struct {
+		name, fstab, want string
+	}{
+		{name: "uuid",
+			fstab: "/dev/mmcblk0p2 / ext4 defaults 0 1\nUUID=5E8A1C2D-3B4F-4A6E-8C9D-0F1E2D3C4B5A none swap sw 0 0\n",
+			want:  "/dev/mmcblk0p2 / ext4 defaults 0 1\n"},
+		{name: "label", fstab: "LABEL=swap none swap sw 0 0\n", want: ""},
+		{name: "partuuid", fstab: "PARTUUID=deadbeef-03 none swap sw 0 0\nPARTUUID=deadbeef-02 / ext4 defaults 0 1\n",
+			want: "PARTUUID=deadbeef-02 / ext4 defaults 0 1\n"},
+		{name: "device", fstab: "/dev/mmcblk0p3 none swap sw 0 0\n", want: ""},
+		{name: "other swap", fstab: "/dev/mmcblk0p13 none swap sw 0 0\n/swapfile none swap sw 0 0\n",
+			want: "/dev/mmcblk0p13 none swap sw 0 0\n/swapfile none swap sw 0 0\n"},
+		{name: "not swap", fstab: "LABEL=swap /mnt ext4 defaults 0 2\n", want: "LABEL=swap /mnt ext4 defaults 0 2\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := utils.FilterFstab([]byte(tc.fstab), swap.matches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("filtered fstab %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
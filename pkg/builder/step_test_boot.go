@@ -0,0 +1,225 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// stepBootTest boots the finished image under qemu-system with boot_test_kernel, and waits for
+// boot_test_expect on the serial console, or an ssh banner on boot_test_ssh_port. The image is
+// booted from a qcow2 overlay, so it is not modified.
+type stepBootTest struct {
+	ImageKey string
+}
+
+func (s *stepBootTest) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	image := state.Get(s.ImageKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Boot testing the image with %s", config.BootTestQemu))
+	if err := s.bootTest(ctx, state, image); err != nil {
+		err := fmt.Errorf("Error boot testing the image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepBootTest) bootTest(ctx context.Context, state multistep.StateBag, image string) error {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	dir, err := ioutil.TempDir("", "boot-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	image, err = filepath.Abs(image)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	// the raspi machines need sd cards sized a power of 2
+	size := int64(1)
+	for size < stat.Size() {
+		size <<= 1
+	}
+	overlay := filepath.Join(dir, "overlay.qcow2")
+	out, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "raw", "-b", image, overlay, fmt.Sprint(size)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img create: %v: %s", err, out)
+	}
+
+	root := 2
+	if p, ok := state.GetOk("root_partition"); ok {
+		if n, err := partitionNumber(p.(string)); err == nil {
+			root = n
+		}
+	}
+	rendered, err := renderBootTestTemplates(state)
+	if err != nil {
+		return err
+	}
+	args := bootTestArgs(rendered, overlay, root)
+	log.Printf("boot test: %s %s", config.BootTestQemu, strings.Join(args, " "))
+
+	ctx, cancel := context.WithTimeout(ctx, config.BootTestTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.BootTestQemu, args...)
+	console, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	found := make(chan string, 2)
+	exited := make(chan struct{})
+	go func() {
+		watchConsole(console, regexp.MustCompile(config.BootTestExpect), found)
+		cmd.Wait()
+		close(exited)
+	}()
+	if config.BootTestSSHPort != 0 {
+		go watchSSHBanner(ctx, fmt.Sprintf("127.0.0.1:%d", config.BootTestSSHPort), found)
+	}
+
+	select {
+	case what := <-found:
+		ui.Message(fmt.Sprintf("Image booted, found %s", what))
+		cancel()
+		<-exited
+		return nil
+	case <-exited:
+		if ctx.Err() != nil {
+			return fmt.Errorf("no login prompt or ssh banner after %s", config.BootTestTimeout)
+		}
+		return fmt.Errorf("qemu exited before the image booted, see the packer log for its output")
+	}
+}
+
+// renderBootTestTemplates returns the configuration with boot_test_cmdline and boot_test_args
+// rendered, with the address of the http_directory server from the guest.
+func renderBootTestTemplates(state multistep.StateBag) (*Config, error) {
+	config := *state.Get("config").(*Config)
+	port, _ := state.Get("http_port").(int)
+	ictx := config.ctx
+	ictx.Data = &httpTemplateData{HTTPIP: qemuUserHostIP, HTTPPort: port}
+
+	var err error
+	if config.BootTestCmdline, err = interpolate.Render(config.BootTestCmdline, &ictx); err != nil {
+		return nil, fmt.Errorf("error rendering boot_test_cmdline: %s", err)
+	}
+	config.BootTestArgs = make([]string, len(config.BootTestArgs))
+	for i, arg := range state.Get("config").(*Config).BootTestArgs {
+		if config.BootTestArgs[i], err = interpolate.Render(arg, &ictx); err != nil {
+			return nil, fmt.Errorf("error rendering boot_test_args: %s", err)
+		}
+	}
+	return &config, nil
+}
+
+// bootTestArgs returns the qemu-system arguments to boot the image from overlay.
+func bootTestArgs(config *Config, overlay string, root int) []string {
+	var args []string
+	var rootDev string
+	if strings.HasPrefix(config.BootTestMachine, "raspi") {
+		args = []string{"-M", config.BootTestMachine, "-drive", "if=sd,format=qcow2,file=" + overlay}
+		rootDev = fmt.Sprintf("/dev/mmcblk0p%d", root)
+	} else {
+		args = []string{"-M", config.BootTestMachine, "-m", "1G",
+			"-drive", "if=none,format=qcow2,id=disk,file=" + overlay, "-device", "virtio-blk-device,drive=disk"}
+		if config.BootTestMachine == "virt" && config.BootTestQemu == "qemu-system-aarch64" {
+			args = append(args, "-cpu", "cortex-a72")
+		}
+		rootDev = fmt.Sprintf("/dev/vda%d", root)
+	}
+	cmdline := config.BootTestCmdline
+	if cmdline == "" {
+		cmdline = fmt.Sprintf("root=%s rootwait console=ttyAMA0 panic=-1", rootDev)
+	}
+	args = append(args, "-kernel", config.BootTestKernel, "-append", cmdline,
+		"-nographic", "-no-reboot", "-monitor", "none", "-serial", "stdio")
+	if config.BootTestDtb != "" {
+		args = append(args, "-dtb", config.BootTestDtb)
+	}
+	return append(args, config.BootTestArgs...)
+}
+
+// watchConsole logs the console output and reports when expect matches it. login prompts
+// don't end with a new line, so the pending line is matched as well.
+func watchConsole(console io.Reader, expect *regexp.Regexp, found chan<- string) {
+	buf := make([]byte, 4096)
+	var pending string
+	matched := false
+	for {
+		n, err := console.Read(buf)
+		pending += string(buf[:n])
+		for {
+			i := strings.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			log.Printf("boot test console: %s", strings.TrimRight(pending[:i], "\r"))
+			if !matched && expect.MatchString(pending[:i]) {
+				matched = true
+				found <- fmt.Sprintf("%q on the console", expect)
+			}
+			pending = pending[i+1:]
+		}
+		if !matched && pending != "" && expect.MatchString(pending) {
+			matched = true
+			found <- fmt.Sprintf("%q on the console", expect)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// watchSSHBanner polls addr until it answers with an ssh banner.
+func watchSSHBanner(ctx context.Context, addr string, found chan<- string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		banner := make([]byte, 255)
+		n, _ := conn.Read(banner)
+		conn.Close()
+		if strings.HasPrefix(string(banner[:n]), "SSH-") {
+			found <- "an ssh banner on " + addr
+			return
+		}
+	}
+}
+
+func (s *stepBootTest) Cleanup(state multistep.StateBag) {}
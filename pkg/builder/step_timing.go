@@ -0,0 +1,109 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepTimings adds up how long the steps of a build took, by step name. The cleanups of all
+// steps count as "Cleanup".
+type stepTimings struct {
+	names     []string
+	durations map[string]time.Duration
+}
+
+func newStepTimings() *stepTimings {
+	return &stepTimings{durations: map[string]time.Duration{}}
+}
+
+func (t *stepTimings) add(name string, d time.Duration) {
+	if _, ok := t.durations[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.durations[name] += d
+}
+
+// JSON encodes the timings as an object of seconds.
+func (t *stepTimings) JSON() string {
+	seconds := map[string]float64{}
+	for name, d := range t.durations {
+		seconds[name] = d.Seconds()
+	}
+	data, err := json.Marshal(seconds)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (t *stepTimings) report(ui packer.Ui) {
+	var total time.Duration
+	var lines []string
+	for _, name := range t.names {
+		d := t.durations[name]
+		total += d
+		lines = append(lines, fmt.Sprintf("%-20s %v", name, d.Round(time.Millisecond)))
+	}
+	lines = append(lines, fmt.Sprintf("%-20s %v", "Total", total.Round(time.Millisecond)))
+	ui.Say("Step timings:")
+	ui.Message(strings.Join(lines, "\n"))
+}
+
+// timedStep records how long its step takes to run and clean up, and fails it when it runs for
+// longer than timeout, if set.
+type timedStep struct {
+	multistep.Step
+	name    string
+	timings *stepTimings
+	timeout time.Duration
+}
+
+func (s *timedStep) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	start := time.Now()
+	defer func() { s.timings.add(s.name, time.Since(start)) }()
+	if s.timeout <= 0 {
+		return s.Step.Run(ctx, state)
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	action := s.Step.Run(stepCtx, state)
+	if stepCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		ui := state.Get("ui").(packer.Ui)
+		err := fmt.Errorf("Step %s timed out after %v", s.name, s.timeout)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return action
+}
+
+func (s *timedStep) Cleanup(state multistep.StateBag) {
+	start := time.Now()
+	defer func() { s.timings.add("Cleanup", time.Since(start)) }()
+	s.Step.Cleanup(state)
+}
+
+func timeSteps(steps []multistep.Step, timings *stepTimings, timeout time.Duration) []multistep.Step {
+	timed := make([]multistep.Step, len(steps))
+	for i, step := range steps {
+		timed[i] = &timedStep{Step: step, name: stepName(step), timings: timings, timeout: timeout}
+	}
+	return timed
+}
+
+// stepName makes a name like CopyImage out of a step type like *builder.stepCopyImage.
+func stepName(step multistep.Step) string {
+	name := fmt.Sprintf("%T", step)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimPrefix(name, "step")
+	return strings.TrimPrefix(name, "Step")
+}
@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepSleep sleeps for d, or until its context is done.
+type stepSleep struct {
+	d       time.Duration
+	cleaned bool
+}
+
+func (s *stepSleep) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	select {
+	case <-time.After(s.d):
+		return multistep.ActionContinue
+	case <-ctx.Done():
+		return multistep.ActionHalt
+	}
+}
+
+func (s *stepSleep) Cleanup(state multistep.StateBag) { s.cleaned = true }
+
+func TestStepName(t *testing.T) {
+	for _, tc := range []struct {
+		step multistep.Step
+		want string
+	}{
+		{step: &stepCopyImage{}, want: "CopyImage"},
+		{step: &stepResume{}, want: "Resume"},
+		{step: &commonsteps.StepDownload{}, want: "Download"},
+		{step: &stepSleep{}, want: "Sleep"},
+	} {
+		if got := stepName(tc.step); got != tc.want {
+			t.Errorf("stepName(%T) = %s, want %s", tc.step, got, tc.want)
+		}
+	}
+}
+
+func TestTimedStep(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sleep   time.Duration
+		timeout time.Duration
+		want    multistep.StepAction
+	}{
+		{name: "no timeout", sleep: 10 * time.Millisecond, want: multistep.ActionContinue},
+		{name: "in time", sleep: 10 * time.Millisecond, timeout: time.Minute, want: multistep.ActionContinue},
+		{name: "timed out", sleep: time.Minute, timeout: 10 * time.Millisecond, want: multistep.ActionHalt},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			state := new(multistep.BasicStateBag)
+			state.Put("ui", &packer.BasicUi{Reader: new(bytes.Buffer), Writer: &out, ErrorWriter: &out})
+			timings := newStepTimings()
+			step := &stepSleep{d: tc.sleep}
+			timed := timeSteps([]multistep.Step{step}, timings, tc.timeout)[0]
+
+			if action := timed.Run(context.Background(), state); action != tc.want {
+				t.Fatalf("Run() = %v, want %v", action, tc.want)
+			}
+			err, failed := state.GetOk("error")
+			if timedOut := tc.want == multistep.ActionHalt; failed != timedOut {
+				t.Fatalf("error in state: %v, want %v", err, timedOut)
+			}
+			if failed && !strings.Contains(err.(error).Error(), "Step Sleep timed out") {
+				t.Fatalf("unexpected error %v", err)
+			}
+			timed.Cleanup(state)
+			if !step.cleaned {
+				t.Fatal("the step was not cleaned up")
+			}
+			if len(timings.names) != 2 || timings.names[0] != "Sleep" || timings.names[1] != "Cleanup" {
+				t.Fatalf("timings of %v, want Sleep and Cleanup", timings.names)
+			}
+			if d := timings.durations["Sleep"]; d < 10*time.Millisecond {
+				t.Fatalf("recorded %v, want at least 10ms", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packer_common_commonsteps "github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// torrentStopTimeout is how long, in seconds, a torrent download goes on without receiving
+// anything before it fails.
+const torrentStopTimeout = 300
+
+// isTorrentURL tells if a source url is a magnet link or a .torrent file, local or remote.
+func isTorrentURL(u string) bool {
+	if strings.HasPrefix(strings.ToLower(u), "magnet:") {
+		return true
+	}
+	if parsed, err := url.Parse(u); err == nil {
+		u = parsed.Path
+	}
+	return strings.HasSuffix(strings.ToLower(u), ".torrent")
+}
+
+// stepTorrentDownload downloads the torrent sources of the download step with aria2c, to the
+// packer cache, and points the download step to the downloaded image, which it then verifies
+// against iso_checksum. The largest file of the torrent is the image. Partial downloads are
+// resumed by the next builds. When a torrent fails, or aria2c isn't installed, the download step
+// falls back to the other urls. There is no torrent client in the builder itself.
+type stepTorrentDownload struct {
+	Download *packer_common_commonsteps.StepDownload
+	// keep the archive of rootfs archive sources, see keepArchive
+	KeepArchive bool
+}
+
+func (s *stepTorrentDownload) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	var urls []string
+	var image string
+	aria2c := lookHostTool("aria2c")
+	for _, source := range s.Download.Url {
+		if !isTorrentURL(source) {
+			urls = append(urls, source)
+			continue
+		}
+		if !aria2c {
+			ui.Message(fmt.Sprintf("Skipping torrent %s, install aria2c (package aria2) to download torrents", source))
+			continue
+		}
+		if image != "" {
+			continue
+		}
+		ui.Say(fmt.Sprintf("Downloading torrent %s", source))
+		var err error
+		if image, err = s.download(ctx, state, source); err != nil {
+			ui.Error(fmt.Sprintf("Torrent download of %s failed: %s", source, err))
+			continue
+		}
+		ui.Message(fmt.Sprintf("%s => %s", source, image))
+		u := "file://" + image
+		if s.KeepArchive {
+			u = keepArchive(u)
+		}
+		urls = append([]string{u}, urls...)
+	}
+	if len(urls) == 0 {
+		err := fmt.Errorf("Error downloading the image: all torrent downloads failed")
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.Download.Url = urls
+	return multistep.ActionContinue
+}
+
+// download downloads the torrent at source to the cache, unless a previous build did, and returns
+// the path of its image.
+func (s *stepTorrentDownload) download(ctx context.Context, state multistep.StateBag, source string) (string, error) {
+	dir, err := packer.CachePath(fmt.Sprintf("torrent-%x", sha1.Sum([]byte(source))))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	complete := filepath.Join(dir, ".packer-complete")
+	if _, err := os.Stat(complete); err == nil {
+		return largestFile(dir, ".torrent", ".aria2")
+	}
+
+	args := []string{
+		"aria2c", "--dir=" + shellQuote(dir), "--seed-time=0", "--continue=true", "--check-integrity=true",
+		fmt.Sprintf("--bt-stop-timeout=%d", torrentStopTimeout), "--summary-interval=0", "--console-log-level=warn",
+	}
+	if local := strings.TrimPrefix(source, "file://"); !strings.Contains(local, "://") && !strings.HasPrefix(strings.ToLower(local), "magnet:") {
+		args = append(args, "--torrent-file="+shellQuote(local))
+	} else {
+		args = append(args, shellQuote(source))
+	}
+	if err := runCommand(ctx, state, strings.Join(args, " ")); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(complete, nil, 0644); err != nil {
+		return "", err
+	}
+	return largestFile(dir, ".torrent", ".aria2")
+}
+
+// largestFile returns the largest file in dir, but for the ones with a skipped extension, which
+// is the image of downloads with a checksum or signature file besides it.
+func largestFile(dir string, skip ...string) (string, error) {
+	var image string
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name := strings.ToLower(info.Name())
+		for _, ext := range skip {
+			if strings.HasSuffix(name, ext) {
+				return nil
+			}
+		}
+		if info.Size() > size {
+			image, size = path, info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if image == "" {
+		return "", fmt.Errorf("no file was downloaded")
+	}
+	return image, nil
+}
+
+func (s *stepTorrentDownload) Cleanup(state multistep.StateBag) {}
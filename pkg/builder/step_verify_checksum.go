@@ -0,0 +1,109 @@
+package builder
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter/v2"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+	"golang.org/x/crypto/blake2b"
+)
+
+// checksum types go-getter doesn't know about, verified by stepVerifyChecksum instead.
+var blake2ChecksumPrefixes = []string{"blake2b:", "b2:"}
+
+func isBlake2Checksum(checksum string) bool {
+	for _, prefix := range blake2ChecksumPrefixes {
+		if strings.HasPrefix(strings.ToLower(checksum), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stepVerifyChecksum verifies the BLAKE2b checksum of the downloaded image. The checksum is
+// either `blake2b:<hex>` or `blake2b:file:<url>` of a b2sum file, `b2:` works as well. The hash
+// length is given by the checksum, so b2sum -l output works too.
+type stepVerifyChecksum struct {
+	FromKey  string
+	Checksum string
+	// the source url, to find the image in a checksum file
+	Url string
+}
+
+func (s *stepVerifyChecksum) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Verifying BLAKE2b checksum")
+	err := s.verify(ctx, imagefile)
+	if err != nil {
+		err := fmt.Errorf("Error verifying checksum: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepVerifyChecksum) verify(ctx context.Context, imagefile string) error {
+	expected := s.Checksum[strings.Index(s.Checksum, ":")+1:]
+	if strings.HasPrefix(expected, "file:") {
+		var err error
+		expected, err = s.fetchChecksum(ctx, strings.TrimPrefix(expected, "file:"))
+		if err != nil {
+			return err
+		}
+	}
+
+	want, err := hex.DecodeString(expected)
+	if err != nil || len(want) == 0 || len(want) > blake2b.Size {
+		return fmt.Errorf("invalid BLAKE2b checksum %q", expected)
+	}
+	hash, err := blake2b.New(len(want), nil)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(imagefile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+
+	if got := hash.Sum(nil); hex.EncodeToString(got) != hex.EncodeToString(want) {
+		return fmt.Errorf("checksum mismatch: expected %x, got %x", want, got)
+	}
+	return nil
+}
+
+func (s *stepVerifyChecksum) fetchChecksum(ctx context.Context, src string) (string, error) {
+	dir, err := ioutil.TempDir("", "packer-checksum")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "checksums")
+	if _, err := getter.GetFile(ctx, dst, src); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		return "", err
+	}
+	return utils.ParseChecksumFile(data, s.Url)
+}
+
+func (s *stepVerifyChecksum) Cleanup(state multistep.StateBag) {}
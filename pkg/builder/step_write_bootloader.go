@@ -0,0 +1,90 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// the bytes of the MBR partition table and its signature
+const mbrTableStart, mbrEnd = 446, 512
+
+// the bytes of the usual 128 GPT partition entries
+const gptEntriesSize = 128 * 128
+
+// stepWriteBootloader writes uboot_binaries to their offsets in the image, like the
+// idbloader.img and u-boot.itb of Rockchip boards. They must not overlap the partition
+// table or a partition.
+type stepWriteBootloader struct {
+	FromKey string
+}
+
+func (s *stepWriteBootloader) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Writing bootloader")
+	for _, blob := range config.UbootBinaries {
+		ui.Message(fmt.Sprintf("Writing %s at offset %d", blob.File, blob.offset))
+		if err := s.write(imagefile, blob); err != nil {
+			err := fmt.Errorf("Error writing %s: %s", blob.File, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepWriteBootloader) write(imagefile string, blob BootloaderImage) error {
+	data, err := ioutil.ReadFile(blob.File)
+	if err != nil {
+		return err
+	}
+	start, end := blob.offset, blob.offset+uint64(len(data))
+
+	f, err := os.OpenFile(imagefile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if end > uint64(stat.Size()) {
+		return fmt.Errorf("it ends after the end of the image")
+	}
+	if start < mbrEnd && end > mbrTableStart {
+		return fmt.Errorf("it overlaps the partition table")
+	}
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return err
+	}
+	// the primary GPT header and its 128 partition entries of 128 bytes follow the MBR
+	if table.Label == "gpt" && start < 2*table.SectorSize+gptEntriesSize && end > mbrEnd {
+		return fmt.Errorf("it overlaps the GPT partition entries")
+	}
+	for _, part := range table.Partitions {
+		partStart := part.Start * table.SectorSize
+		partEnd := (part.Start + part.Size) * table.SectorSize
+		if start < partEnd && end > partStart {
+			return fmt.Errorf("it overlaps partition %d", part.Number())
+		}
+	}
+
+	if _, err := f.WriteAt(data, int64(start)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (s *stepWriteBootloader) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,68 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/version"
+)
+
+// stepWriteBuildInfo writes build_info_file into the image, so devices can report the golden
+// image they run. it uses the os-release format, to be sourced by shell scripts.
+type stepWriteBuildInfo struct {
+	ChrootKey string
+}
+
+func (s *stepWriteBuildInfo) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	mountPath := state.Get(s.ChrootKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	checksum := config.ISOChecksum
+	if config.blake2Checksum != "" {
+		checksum = config.blake2Checksum
+	}
+	var source string
+	if len(config.ISOUrls) > 0 {
+		source = config.ISOUrls[0]
+	} else if config.SourceDevice != "" {
+		source = "device:" + config.SourceDevice
+	}
+	info := [][2]string{
+		{"BUILD_NAME", config.PackerBuildName},
+		{"BUILD_TIME", time.Now().UTC().Format(time.RFC3339)},
+		{"CONFIG_SHA256", config.configHash},
+		{"SOURCE_URL", source},
+		{"SOURCE_CHECKSUM", checksum},
+		{"PACKER_VERSION", config.PackerCoreVersion},
+		{"PLUGIN_VERSION", version.String()},
+	}
+	var content strings.Builder
+	for _, kv := range info {
+		fmt.Fprintf(&content, "%s=%s\n", kv[0], strconv.Quote(kv[1]))
+	}
+
+	path := filepath.Join(mountPath, config.BuildInfoFile)
+	ui.Say(fmt.Sprintf("Writing build info to %s", config.BuildInfoFile))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(content.String()), 0644)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error writing build info: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepWriteBuildInfo) Cleanup(state multistep.StateBag) {}
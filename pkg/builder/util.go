@@ -4,34 +4,179 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
 
 	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
 )
 
 func run(ctx context.Context, state multistep.StateBag, cmds string) error {
-	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
 	ui := state.Get("ui").(packer.Ui)
 
-	shellcmd, err := wrappedCommand(cmds)
-	if err != nil {
-		err := fmt.Errorf("Error creating command '%s': %s", cmds, err)
+	if err := runCommand(ctx, state, cmds); err != nil {
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return err
 	}
+	return nil
+}
+
+// runCommand is run without reporting errors, for commands that are allowed to fail.
+func runCommand(ctx context.Context, state multistep.StateBag, cmds string) error {
+	return runCommandTo(ctx, state, cmds, nil)
+}
+
+// runCommandOutput is runCommand, returning the output of the command.
+func runCommandOutput(ctx context.Context, state multistep.StateBag, cmds string) (string, error) {
+	stdout := new(bytes.Buffer)
+	err := runCommandTo(ctx, state, cmds, stdout)
+	return stdout.String(), err
+}
+
+// runCommandTo is runCommand, writing the output of the command to stdout.
+func runCommandTo(ctx context.Context, state multistep.StateBag, cmds string, stdout io.Writer) error {
+	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
+	if config, ok := state.GetOk("config"); ok && config.(*Config).StepTimeout > 0 {
+		// bounds the commands of cleanups too, which are not given a context
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.(*Config).StepTimeout)
+		defer cancel()
+	}
+
+	shellcmd, err := wrappedCommand(cmds)
+	if err != nil {
+		return fmt.Errorf("Error creating command '%s': %s", cmds, err)
+	}
 
 	stderr := new(bytes.Buffer)
 
 	cmd := packer_common_common.ShellCommand(shellcmd)
+	cmd.Stdout = stdout
 	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
-		err := fmt.Errorf(
+	if err := runContext(ctx, cmd); err != nil {
+		return fmt.Errorf(
 			"Error executing command '%s': %s\nStderr: %s", cmds, err, stderr.String())
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return err
 	}
 	return nil
 }
+
+// blkidFunc returns what blkid reports for a device. Steps run blkid with hostBlkid.
+type blkidFunc func(dev string) (*utils.BlkidInfo, error)
+
+// hostBlkid runs blkid like the other host commands, with command_wrapper and step_timeout.
+func hostBlkid(ctx context.Context, state multistep.StateBag) blkidFunc {
+	return func(dev string) (*utils.BlkidInfo, error) {
+		// exit code 2: nothing could be identified on the device
+		out, err := runCommandOutput(ctx, state, fmt.Sprintf("blkid -c /dev/null -o export %s || [ $? -eq 2 ]", dev))
+		if err != nil {
+			return nil, err
+		}
+		return utils.ParseBlkid([]byte(out))
+	}
+}
+
+// runContext runs cmd, killing it when ctx is done, as an interrupt cancels the context of
+// steps. Without a terminal, the command gets its own process group so what it started is
+// killed too. With one, it has to stay in the foreground to prompt, like sudo does, and the
+// interrupt reaches all of it anyway.
+func runContext(ctx context.Context, cmd *exec.Cmd) error {
+	ownGroup := !isTerminal(os.Stdin)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: ownGroup}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ownGroup {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		} else {
+			cmd.Process.Kill()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// runInChroot runs cmds with the shell of the chroot at chrootDir, with chroot_env exported.
+// Unlike provisioner commands, they aren't wrapped with chroot_command_wrapper.
+func runInChroot(ctx context.Context, state multistep.StateBag, chrootDir string, cmds string) error {
+	config := state.Get("config").(*Config)
+	cmds = chrootEnvPrefix(config.ChrootEnv) + cmds
+	if config.Rootless {
+		return run(ctx, state, prootCommand(chrootDir, prootQemu(state), chrootShellOf(state), cmds))
+	}
+	return run(ctx, state, chrootCommand(chrootDir, chrootShellOf(state), cmds))
+}
+
+// addArtifactFiles records files the build wrote next to the image, which Artifact.Files
+// returns after it.
+func addArtifactFiles(state multistep.StateBag, files ...string) {
+	written, _ := state.Get("artifact_files").([]string)
+	state.Put("artifact_files", append(written, files...))
+}
+
+// chrootCommand is the host command that runs cmds with shell in the chroot at root. cmds are
+// single quoted, so the host shell leaves the $ and backquotes of chroot_env to the chroot.
+func chrootCommand(root, shell, cmds string) string {
+	return fmt.Sprintf("chroot %s %s -c %s", root, shell, shellQuote(cmds))
+}
+
+// findCmdline returns the path of the kernel command line file in the boot partition
+// mounted under mountPath, or "" if there is none.
+func (c *Config) findCmdline(mountPath string) string {
+	for _, p := range c.cmdlineFilesOf(c.ImageType) {
+		p = filepath.Join(mountPath, p)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+func hasSystemd(mountPath string) bool {
+	for _, p := range []string{"/lib/systemd/systemd", "/usr/lib/systemd/systemd"} {
+		if _, err := os.Stat(filepath.Join(mountPath, p)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+var partitionNumberRegexp = regexp.MustCompile(`p([0-9]+)$`)
+
+// partitionNumber returns the partition number from a partition device name,
+// like /dev/mapper/loop0p2 or /dev/mmcblk0p2.
+func partitionNumber(dev string) (int, error) {
+	m := partitionNumberRegexp.FindStringSubmatch(dev)
+	if m == nil {
+		return 0, fmt.Errorf("can't find partition number of %s", dev)
+	}
+	return strconv.Atoi(m[1])
+}
+
+// resizedPartition returns the device of the partition stepResizeLastPart grew,
+// the last partition by default.
+func resizedPartition(state multistep.StateBag, partitions []string) string {
+	p := partitions[len(partitions)-1]
+	if resized, ok := state.GetOk("resized_partition"); ok {
+		for _, candidate := range partitions {
+			if n, err := partitionNumber(candidate); err == nil && n == resized.(int) {
+				p = candidate
+			}
+		}
+	}
+	return p
+}
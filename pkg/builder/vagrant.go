@@ -0,0 +1,334 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/version"
+)
+
+const (
+	// vagrantGuestEnv is set for the build in the VM, so it runs the build itself.
+	vagrantGuestEnv = "PACKER_ARM_IMAGE_VAGRANT_GUEST"
+	// vagrantDir holds the Vagrantfile and the state of the VM, in the template directory.
+	vagrantDir = ".packer-arm-image-vagrant"
+	// where the template directory is synced in the VM
+	vagrantSyncedDir = "/build"
+	// where the plugin is installed in the VM
+	vagrantPluginDir = "/opt/packer-arm-image"
+)
+
+// vagrantfile brings up a VM with packer, this plugin and the tools builds need. The provider
+// blocks of the other providers are ignored.
+var vagrantfile = template.Must(template.New("Vagrantfile").Parse(`# generated by packer-builder-arm-image
+Vagrant.configure("2") do |config|
+  config.vm.box = "{{.Box}}"
+  config.vm.synced_folder "{{.Dir}}", "` + vagrantSyncedDir + `"
+  config.vm.synced_folder ".", "/vagrant", disabled: true
+{{- range .Providers}}
+  config.vm.provider "{{.}}" do |p|
+    p.memory = {{$.Memory}}
+    p.cpus = {{$.Cpus}}
+  end
+{{- end}}
+  config.vm.provision "shell", inline: <<-SHELL
+    set -e
+    export DEBIAN_FRONTEND=noninteractive
+    apt-get update
+    apt-get install -y curl gnupg lsb-release
+    curl -fsSL https://apt.releases.hashicorp.com/gpg | gpg --dearmor --yes -o /usr/share/keyrings/hashicorp.gpg
+    echo "deb [signed-by=/usr/share/keyrings/hashicorp.gpg] https://apt.releases.hashicorp.com $(lsb_release -cs) main" > /etc/apt/sources.list.d/hashicorp.list
+    apt-get update
+    apt-get install -y packer kpartx qemu-user-static e2fsprogs dosfstools fdisk gdisk xz-utils
+    mkdir -p ` + vagrantPluginDir + `
+{{- if .Plugin}}
+    install -m 0755 "` + vagrantSyncedDir + `/{{.Plugin}}" ` + vagrantPluginDir + `/packer-plugin-arm-image
+{{- else}}
+    apt-get install -y golang-go git
+    GOBIN=/tmp/packer-arm-image GOPATH=/root/go go install github.com/solo-io/packer-builder-arm-image@{{.Version}}
+    install -m 0755 /tmp/packer-arm-image/packer-builder-arm-image ` + vagrantPluginDir + `/packer-plugin-arm-image
+{{- end}}
+  SHELL
+end
+`))
+
+var vagrantProviders = []string{"virtualbox", "vmware_desktop", "parallels", "libvirt", "qemu"}
+
+// vagrantHost tells if the build runs in a Vagrant VM, rather than on this host.
+func (c *Config) vagrantHost() bool {
+	return c.Vagrant && os.Getenv(vagrantGuestEnv) == ""
+}
+
+// prepareVagrant checks the vagrant options. The rest of the configuration is checked by the
+// build in the VM.
+func (b *Builder) prepareVagrant() error {
+	var errs *packer.MultiError
+	if _, err := exec.LookPath("vagrant"); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("vagrant not found, install it from https://www.vagrantup.com"))
+	}
+	if b.config.VagrantTemplate == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("vagrant_template, the template to build in the VM, is required with vagrant"))
+	}
+	for _, f := range []string{b.config.VagrantTemplate, b.config.VagrantPlugin} {
+		if f == "" {
+			continue
+		}
+		if filepath.IsAbs(f) || strings.HasPrefix(filepath.Clean(f), "..") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("%s must be in the current directory, which is synced to the VM", f))
+		} else if _, err := os.Stat(f); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+	if b.config.VagrantBox == "" {
+		b.config.VagrantBox = "bento/ubuntu-22.04"
+	}
+	if b.config.VagrantOnly == "" {
+		b.config.VagrantOnly = b.config.PackerBuildName
+	}
+	if b.config.VagrantMemory == 0 {
+		b.config.VagrantMemory = 4096
+	}
+	if b.config.VagrantCpus == 0 {
+		b.config.VagrantCpus = 2
+	}
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// runVagrant runs the build in a Vagrant VM, and returns the image it wrote to the synced
+// template directory.
+func (b *Builder) runVagrant(ctx context.Context, ui packer.Ui) (packer.Artifact, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	state := new(multistep.BasicStateBag)
+	state.Put("config", &b.config)
+	state.Put("ui", ui)
+
+	steps := []multistep.Step{
+		&stepVagrantUp{Dir: dir},
+		&stepVagrantBuild{Dir: dir},
+	}
+	b.runner = &multistep.BasicRunner{Steps: steps}
+	b.runner.Run(ctx, state)
+
+	if rawErr, ok := state.GetOk("error"); ok {
+		return nil, rawErr.(error)
+	}
+	if _, canceled := state.GetOk(multistep.StateCancelled); canceled {
+		return nil, errors.New("step canceled or halted")
+	}
+	return &Artifact{image: state.Get("imagefile").(string)}, nil
+}
+
+// stepVagrantUp writes the Vagrantfile and brings the VM up, provisioning it the first time.
+// The VM is halted once the build is done, or destroyed with vagrant_destroy.
+type stepVagrantUp struct {
+	// the template directory
+	Dir string
+}
+
+func (s *stepVagrantUp) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Bringing up the %s Vagrant VM", config.VagrantBox))
+	err := s.writeVagrantfile(config)
+	if err == nil {
+		args := []string{"up"}
+		if config.VagrantProvider != "" {
+			args = append(args, "--provider", config.VagrantProvider)
+		}
+		err = runVagrantCommand(ctx, s.Dir, func(line string) { ui.Message(line) }, args...)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error bringing up the Vagrant VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepVagrantUp) writeVagrantfile(config *Config) error {
+	if err := os.MkdirAll(filepath.Join(s.Dir, vagrantDir), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(s.Dir, vagrantDir, "Vagrantfile"))
+	if err != nil {
+		return err
+	}
+	ver := version.String()
+	if ver == "dev" {
+		ver = "latest"
+	}
+	err = vagrantfile.Execute(f, map[string]interface{}{
+		"Box":       config.VagrantBox,
+		"Dir":       s.Dir,
+		"Providers": vagrantProviders,
+		"Memory":    config.VagrantMemory,
+		"Cpus":      config.VagrantCpus,
+		"Plugin":    filepath.ToSlash(filepath.Clean(config.VagrantPlugin)),
+		"Version":   ver,
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *stepVagrantUp) Cleanup(state multistep.StateBag) {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	args := []string{"halt"}
+	if config.VagrantDestroy {
+		args = []string{"destroy", "--force"}
+	}
+	ui.Say(fmt.Sprintf("Running vagrant %s", args[0]))
+	if err := runVagrantCommand(context.Background(), s.Dir, func(line string) { ui.Message(line) }, args...); err != nil {
+		ui.Error(fmt.Sprintf("Error running vagrant %s: %s", args[0], err))
+	}
+}
+
+// stepVagrantBuild runs packer build in the VM, with vagrant_only and the user variables of this
+// build, and finds the image it wrote in the template directory.
+//
+// Produces:
+//
+//	imagefile string - The image, on this host
+type stepVagrantBuild struct {
+	Dir string
+}
+
+func (s *stepVagrantBuild) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	cmd := []string{"sudo", vagrantGuestEnv + "=1", "PACKER_PLUGIN_PATH=" + vagrantPluginDir,
+		"packer", "build", "-machine-readable", "-only=" + shellQuote(config.VagrantOnly)}
+	if config.PackerForce {
+		cmd = append(cmd, "-force")
+	}
+	vars := make([]string, 0, len(config.PackerUserVars))
+	for k := range config.PackerUserVars {
+		vars = append(vars, k)
+	}
+	sort.Strings(vars)
+	for _, k := range vars {
+		cmd = append(cmd, "-var", shellQuote(k+"="+config.PackerUserVars[k]))
+	}
+	cmd = append(cmd, shellQuote(filepath.ToSlash(filepath.Clean(config.VagrantTemplate))))
+
+	ui.Say(fmt.Sprintf("Building %s in the Vagrant VM", config.VagrantTemplate))
+	var image string
+	err := runVagrantCommand(ctx, s.Dir, func(line string) {
+		if f, ok := parseMachineReadable(line); ok {
+			switch {
+			case len(f) >= 4 && f[2] == "ui" && f[3] != "error":
+				ui.Message(f[len(f)-1])
+			case len(f) >= 4 && f[2] == "ui":
+				ui.Error(f[len(f)-1])
+			case len(f) >= 7 && f[2] == "artifact" && f[4] == "file" && image == "":
+				image = f[6]
+			}
+		}
+	}, "ssh", "--command", "cd "+vagrantSyncedDir+" && "+strings.Join(cmd, " "))
+	if err == nil {
+		image, err = s.hostPath(image)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error building in the Vagrant VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Say(fmt.Sprintf("The image is at %s", image))
+	state.Put("imagefile", image)
+	return multistep.ActionContinue
+}
+
+// hostPath returns the path on this host of an image the build in the VM wrote.
+func (s *stepVagrantBuild) hostPath(image string) (string, error) {
+	if image == "" {
+		return "", fmt.Errorf("the build in the VM reported no image")
+	}
+	if !strings.HasPrefix(image, "/") {
+		image = vagrantSyncedDir + "/" + image
+	}
+	rel := strings.TrimPrefix(image, vagrantSyncedDir+"/")
+	if rel == image {
+		return "", fmt.Errorf("the image %s is outside the synced template directory, make output_filename relative", image)
+	}
+	path := filepath.Join(s.Dir, filepath.FromSlash(rel))
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (s *stepVagrantBuild) Cleanup(state multistep.StateBag) {}
+
+// runVagrantCommand runs vagrant with the Vagrantfile of dir, calling output with the lines it
+// writes.
+func runVagrantCommand(ctx context.Context, dir string, output func(string), args ...string) error {
+	cmd := exec.CommandContext(ctx, "vagrant", args...)
+	cmd.Env = append(os.Environ(), "VAGRANT_CWD="+filepath.Join(dir, vagrantDir))
+	r, w := io.Pipe()
+	cmd.Stdout, cmd.Stderr = w, w
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			output(strings.TrimRight(scanner.Text(), "\r"))
+		}
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	err := cmd.Wait()
+	w.Close()
+	<-done
+	return err
+}
+
+// parseMachineReadable splits a line of packer -machine-readable output, like
+// 1612345678,arm-image,artifact,0,file,0,output/image.img, unescaping the fields.
+func parseMachineReadable(line string) ([]string, bool) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 3 {
+		return nil, false
+	}
+	for i, f := range fields {
+		f = strings.ReplaceAll(f, "%!(PACKER_COMMA)", ",")
+		fields[i] = strings.ReplaceAll(f, `\n`, "\n")
+	}
+	return fields, true
+}
+
+// checkLinuxHost returns an error on hosts builds can't run on, which need vagrant.
+func checkLinuxHost() error {
+	if runtime.GOOS == "linux" {
+		return nil
+	}
+	return fmt.Errorf("builds need a linux host, set vagrant to run them in a Vagrant VM on %s", runtime.GOOS)
+}
@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// wslVersion returns the version of WSL the host runs, or 0 when it's not a WSL distro. WSL1
+// kernels are named like 4.4.0-19041-Microsoft, WSL2 ones like 5.15.90.1-microsoft-standard-WSL2.
+func wslVersion() int {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return 0
+	}
+	switch {
+	case strings.Contains(string(release), "Microsoft"):
+		return 1
+	case strings.Contains(string(release), "microsoft"):
+		return 2
+	}
+	return 0
+}
+
+// wslAutomountRoot returns where WSL mounts the windows drives, /mnt/ unless /etc/wsl.conf
+// changes it.
+func wslAutomountRoot() string {
+	root := "/mnt/"
+	f, err := os.Open("/etc/wsl.conf")
+	if err != nil {
+		return root
+	}
+	defer f.Close()
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if section == "automount" && len(kv) == 2 && strings.TrimSpace(kv[0]) == "root" {
+			root = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			if !strings.HasSuffix(root, "/") {
+				root += "/"
+			}
+		}
+	}
+	return root
+}
+
+var (
+	windowsDrivePath = regexp.MustCompile(`^([A-Za-z]):[\\/]`)
+	// \\wsl$\<distro>\path and \\wsl.localhost\<distro>\path are the files of a distro
+	windowsWSLPath = regexp.MustCompile(`(?i)^[\\/]{2}(wsl\$|wsl\.localhost)[\\/][^\\/]+`)
+)
+
+// wslPath translates a windows path, like C:\Users\me\image.img, to its path in the distro,
+// like wslpath does. Other paths are returned as they are.
+func wslPath(p, automountRoot string) string {
+	if m := windowsDrivePath.FindStringSubmatch(p); m != nil {
+		return path.Join(automountRoot, strings.ToLower(m[1]), strings.ReplaceAll(p[len(m[0]):], `\`, "/"))
+	}
+	if m := windowsWSLPath.FindString(p); m != "" {
+		return path.Join("/", strings.ReplaceAll(p[len(m):], `\`, "/"))
+	}
+	return p
+}
+
+// wslURL translates the windows path of a url, bare or as a file: url like
+// file:///C:/images/image.img.
+func wslURL(u, automountRoot string) string {
+	if strings.HasPrefix(strings.ToLower(u), "file:") {
+		p := strings.TrimPrefix(u[len("file:"):], "//")
+		if translated := wslPath(strings.TrimPrefix(p, "/"), automountRoot); translated != strings.TrimPrefix(p, "/") {
+			return "file://" + translated
+		}
+		return u
+	}
+	return wslPath(u, automountRoot)
+}
+
+// prepareWSL adapts the configuration to WSL2 distros, which run builds with a few quirks:
+// windows paths are translated, and partitions are mapped with losetup unless udev runs, as
+// kpartx waits for it forever. It returns warnings about what builds do better elsewhere.
+func (b *Builder) prepareWSL() []string {
+	var warnings []string
+	root := wslAutomountRoot()
+	for i, u := range b.config.ISOUrls {
+		b.config.ISOUrls[i] = wslURL(u, root)
+	}
+	b.config.RawSingleISOUrl = wslURL(b.config.RawSingleISOUrl, root)
+	if strings.HasPrefix(strings.ToLower(b.config.ISOChecksum), "file:") {
+		b.config.ISOChecksum = wslURL(b.config.ISOChecksum, root)
+	} else if i := strings.Index(b.config.ISOChecksum, ":"); i > 0 {
+		b.config.ISOChecksum = b.config.ISOChecksum[:i+1] + wslURL(b.config.ISOChecksum[i+1:], root)
+	}
+	b.config.OutputFile = wslPath(b.config.OutputFile, root)
+	b.config.OutputDir = wslPath(b.config.OutputDir, root)
+	if strings.HasPrefix(b.config.OutputFile, root) {
+		warnings = append(warnings, fmt.Sprintf("output_filename %s is on a windows drive, which is much slower to "+
+			"build on and can't hold sparse files, consider an output in the distro and copying the image", b.config.OutputFile))
+	}
+
+	if b.config.PartitionMapper == "" && !udevRunning() {
+		b.config.PartitionMapper = MapperLosetup
+	}
+	return warnings
+}
+
+// udevRunning tells if udevd runs, which kpartx and device mapper wait for.
+func udevRunning() bool {
+	_, err := os.Stat("/run/udev/control")
+	return err == nil
+}
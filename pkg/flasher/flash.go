@@ -231,6 +231,9 @@ func (f *flasher) flash(ctx context.Context, input image.Image, device *utils.De
 	}
 
 	totaldata, err := utils.CopyWithProgress(ctx, f.ui, outputWriter, input)
+	if err != nil {
+		return nil, err
+	}
 
 	res := FlashResult{BytesWritten: uint64(totaldata)}
 	if checksummer != nil {
@@ -0,0 +1,142 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// BmapBlockSize is the block size of the bmap files we create, the one bmaptool uses.
+const BmapBlockSize = 4096
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Bmap is a bmaptool block map: the ranges of blocks of an image that hold data, so
+// flashing can skip the others.
+type Bmap struct {
+	ImageSize uint64
+	BlockSize uint64
+	Ranges    []BmapRange
+}
+
+// BmapRange is a range of mapped blocks, First and Last included.
+type BmapRange struct {
+	First, Last uint64
+	Sha256      string
+}
+
+func (b *Bmap) BlocksCount() uint64 {
+	return (b.ImageSize + b.BlockSize - 1) / b.BlockSize
+}
+
+func (b *Bmap) MappedBlocksCount() uint64 {
+	var n uint64
+	for _, r := range b.Ranges {
+		n += r.Last - r.First + 1
+	}
+	return n
+}
+
+// CreateBmap maps the blocks of the image that are not holes, like bmaptool create does.
+func CreateBmap(path string) (*Bmap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bmap{ImageSize: uint64(finfo.Size()), BlockSize: BmapBlockSize}
+	ranges, err := dataRanges(f, finfo.Size())
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		first := uint64(r[0]) / b.BlockSize
+		last := (uint64(r[1]) - 1) / b.BlockSize
+		if n := len(b.Ranges); n > 0 && b.Ranges[n-1].Last+1 >= first {
+			// data ranges not aligned to blocks can share one
+			b.Ranges[n-1].Last = last
+			continue
+		}
+		b.Ranges = append(b.Ranges, BmapRange{First: first, Last: last})
+	}
+
+	for i := range b.Ranges {
+		r := &b.Ranges[i]
+		h := sha256.New()
+		offset := int64(r.First * b.BlockSize)
+		length := int64((r.Last - r.First + 1) * b.BlockSize)
+		if offset+length > finfo.Size() {
+			length = finfo.Size() - offset
+		}
+		if _, err := io.Copy(h, io.NewSectionReader(f, offset, length)); err != nil {
+			return nil, err
+		}
+		r.Sha256 = hex.EncodeToString(h.Sum(nil))
+	}
+	return b, nil
+}
+
+// dataRanges lists the [start, end) byte ranges of f that hold data. Filesystems that
+// can't tell holes apart report the whole file.
+func dataRanges(f *os.File, size int64) ([][2]int64, error) {
+	var ranges [][2]int64
+	for offset := int64(0); offset < size; {
+		start, err := f.Seek(offset, seekData)
+		if err == syscall.ENXIO {
+			// no data after offset
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, [2]int64{start, end})
+		offset = end
+	}
+	return ranges, nil
+}
+
+// Marshal encodes the block map in the bmap 2.0 format, including its own checksum.
+func (b *Bmap) Marshal() []byte {
+	zeros := strings.Repeat("0", sha256.Size*2)
+
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" ?>\n")
+	buf.WriteString("<bmap version=\"2.0\">\n")
+	fmt.Fprintf(&buf, "    <ImageSize> %d </ImageSize>\n", b.ImageSize)
+	fmt.Fprintf(&buf, "    <BlockSize> %d </BlockSize>\n", b.BlockSize)
+	fmt.Fprintf(&buf, "    <BlocksCount> %d </BlocksCount>\n", b.BlocksCount())
+	fmt.Fprintf(&buf, "    <MappedBlocksCount> %d </MappedBlocksCount>\n", b.MappedBlocksCount())
+	buf.WriteString("    <ChecksumType> sha256 </ChecksumType>\n")
+	fmt.Fprintf(&buf, "    <BmapFileChecksum> %s </BmapFileChecksum>\n", zeros)
+	buf.WriteString("    <BlockMap>\n")
+	for _, r := range b.Ranges {
+		if r.First == r.Last {
+			fmt.Fprintf(&buf, "        <Range chksum=\"%s\"> %d </Range>\n", r.Sha256, r.First)
+		} else {
+			fmt.Fprintf(&buf, "        <Range chksum=\"%s\"> %d-%d </Range>\n", r.Sha256, r.First, r.Last)
+		}
+	}
+	buf.WriteString("    </BlockMap>\n")
+	buf.WriteString("</bmap>\n")
+
+	// the checksum is computed with its own field zeroed
+	sum := sha256.Sum256(buf.Bytes())
+	return bytes.Replace(buf.Bytes(), []byte(zeros), []byte(hex.EncodeToString(sum[:])), 1)
+}
@@ -0,0 +1,67 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestBmapMarshal(t *testing.T) {
+	b := &Bmap{ImageSize: 3*BmapBlockSize + 10, BlockSize: BmapBlockSize, Ranges: []BmapRange{
+		{First: 0, Last: 1, Sha256: strings.Repeat("a", 64)},
+		{First: 3, Last: 3, Sha256: strings.Repeat("b", 64)},
+	}}
+	data := b.Marshal()
+
+	for _, want := range []string{
+		"<BlocksCount> 4 </BlocksCount>",
+		"<MappedBlocksCount> 3 </MappedBlocksCount>",
+		`<Range chksum="` + strings.Repeat("a", 64) + `"> 0-1 </Range>`,
+		`<Range chksum="` + strings.Repeat("b", 64) + `"> 3 </Range>`,
+	} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("missing %q in\n%s", want, data)
+		}
+	}
+
+	m := regexp.MustCompile(`<BmapFileChecksum> ([0-9a-f]{64}) </BmapFileChecksum>`).FindSubmatch(data)
+	if m == nil {
+		t.Fatalf("no checksum in\n%s", data)
+	}
+	zeroed := bytes.Replace(data, m[1], bytes.Repeat([]byte("0"), 64), 1)
+	sum := sha256.Sum256(zeroed)
+	if hex.EncodeToString(sum[:]) != string(m[1]) {
+		t.Errorf("bad bmap checksum %s", m[1])
+	}
+}
+
+func TestCreateBmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "image")
+	data := bytes.Repeat([]byte{1}, BmapBlockSize+100)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := CreateBmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.BlocksCount() != 2 || b.MappedBlocksCount() != 2 || len(b.Ranges) != 1 {
+		t.Fatalf("unexpected block map %+v", b)
+	}
+	sum := sha256.Sum256(data)
+	if b.Ranges[0].Sha256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("bad range checksum %s", b.Ranges[0].Sha256)
+	}
+}
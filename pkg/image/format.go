@@ -0,0 +1,40 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// DiskFormat returns the virtual disk format of a file, as qemu-img names it: qcow2, vmdk,
+// vdi or vhdx. it returns "" for raw images.
+func DiskFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return diskFormat(header[:n]), nil
+}
+
+func diskFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("QFI\xfb")):
+		return "qcow2"
+	case bytes.HasPrefix(header, []byte("KDMV")), bytes.HasPrefix(header, []byte("COWD")),
+		bytes.HasPrefix(header, []byte("# Disk DescriptorFile")):
+		return "vmdk"
+	case bytes.HasPrefix(header, []byte("vhdxfile")):
+		return "vhdx"
+	case len(header) >= 68 && binary.LittleEndian.Uint32(header[64:]) == 0xbeda107f:
+		return "vdi"
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package image
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDiskFormat(t *testing.T) {
+	vdi := make([]byte, 512)
+	binary.LittleEndian.PutUint32(vdi[64:], 0xbeda107f)
+	mbr := make([]byte, 512)
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	formats := map[string][]byte{
+		"qcow2": []byte("QFI\xfb\x00\x00\x00\x03"),
+		"vmdk":  []byte("KDMV\x01\x00\x00\x00"),
+		"vhdx":  []byte("vhdxfile"),
+		"vdi":   vdi,
+		"":      mbr,
+	}
+	for expected, header := range formats {
+		if format := diskFormat(header); format != expected {
+			t.Errorf("expected %q, got %q", expected, format)
+		}
+	}
+	if format := diskFormat([]byte("QF")); format != "" {
+		t.Errorf("expected raw for a short file, got %q", format)
+	}
+}
@@ -2,6 +2,8 @@ package image
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"os"
@@ -63,13 +65,68 @@ func openImage(file *os.File) (Image, error) {
 		return nil, err
 	}
 	fsize := finfo.Size()
+	if finfo.Mode()&os.ModeDevice != 0 {
+		// block devices have no size, but can seek to their end
+		if fsize, err = file.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
 
 	ret := fileImage{ReadCloser: file, size: uint64(fsize)}
 	return &ret, nil
 
 }
 
+// IsRaw tells if fpath is a regular file Open returns as is: not an archive, compressed
+// or an Android sparse image.
+func IsRaw(fpath string) bool {
+	finfo, err := os.Stat(fpath)
+	if err != nil || !finfo.Mode().IsRegular() {
+		return false
+	}
+	if t, _ := filetype.MatchFile(fpath); t != filetype.Unknown {
+		switch t {
+		case matchers.TypeZip, matchers.TypeXz, matchers.TypeGz, matchers.TypeBz2:
+			return false
+		}
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	return !isZstd(br) && !isSparse(br)
+}
+
 func (s *imageOpener) Open(fpath string) (Image, error) {
+	img, err := s.open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return s.unsparse(img)
+}
+
+// unsparse expands Android sparse images, which can also be found inside an archive.
+func (s *imageOpener) unsparse(img Image) (Image, error) {
+	br := bufio.NewReader(img)
+	if !isSparse(br) {
+		return &multiCloser{br, []io.Closer{img}, img.SizeEstimate()}, nil
+	}
+
+	s.ui.Say("Image is an Android sparse image.")
+	r, err := newSparseReader(br)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	return &multiCloser{r, []io.Closer{img}, r.Size()}, nil
+}
+
+func (s *imageOpener) open(fpath string) (Image, error) {
 	t, _ := filetype.MatchFile(fpath)
 
 	f, err := os.Open(fpath)
@@ -77,6 +134,16 @@ func (s *imageOpener) Open(fpath string) (Image, error) {
 		return nil, err
 	}
 
+	zstd := isZstd(bufio.NewReader(f))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if zstd {
+		s.ui.Say("Image is a zstd file.")
+		return s.openzstd(f)
+	}
+
 	switch t {
 	case matchers.TypeZip:
 		s.ui.Say("Image is a zip file.")
@@ -145,6 +212,19 @@ func (s *imageOpener) openbzip(f *os.File) (Image, error) {
 	return uncompress(f, "bzcat", func(r io.Reader) (io.Reader, error) { r2 := bzip2.NewReader(r); return r2, nil })
 }
 
+// zstd, as Yocto compresses .wic.zst images, is only decompressed with zstdcat.
+func (s *imageOpener) openzstd(f *os.File) (Image, error) {
+	return uncompress(f, "zstdcat", func(r io.Reader) (io.Reader, error) {
+		return nil, errors.New("the image is compressed with zstd, install zstd to decompress it")
+	})
+}
+
+// isZstd tells if r starts with the magic number of a zstd frame, which filetype doesn't know.
+func isZstd(r *bufio.Reader) bool {
+	magic, err := r.Peek(4)
+	return err == nil && bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd})
+}
+
 func uncompress(f *os.File, fastcmd string, slowNewReader func(r io.Reader) (io.Reader, error)) (Image, error) {
 	defer func() {
 		if f != nil {
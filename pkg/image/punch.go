@@ -0,0 +1,73 @@
+package image
+
+import (
+	"os"
+)
+
+const punchBlockSize = 4096
+
+// PunchZeroes turns the blocks of a file that are all zeros into holes, without changing
+// its content, and returns the number of bytes freed that way.
+func PunchZeroes(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// only the data needs to be read, the holes are already there
+	ranges, err := dataRanges(f, finfo.Size())
+	if err != nil {
+		return 0, err
+	}
+
+	var punched int64
+	buf := make([]byte, punchBlockSize)
+	for _, r := range ranges {
+		start := r[0] - r[0]%punchBlockSize
+		var zeroStart int64 = -1
+		for offset := start; offset < r[1]; offset += punchBlockSize {
+			n, err := f.ReadAt(buf, offset)
+			if n == 0 && err != nil {
+				return punched, err
+			}
+			if isZero(buf[:n]) {
+				if zeroStart < 0 {
+					zeroStart = offset
+				}
+				continue
+			}
+			if zeroStart >= 0 {
+				if err := punch(f, zeroStart, offset-zeroStart); err != nil {
+					return punched, err
+				}
+				punched += offset - zeroStart
+				zeroStart = -1
+			}
+		}
+		if zeroStart >= 0 {
+			end := r[1]
+			if end > finfo.Size() {
+				end = finfo.Size()
+			}
+			if err := punch(f, zeroStart, end-zeroStart); err != nil {
+				return punched, err
+			}
+			punched += end - zeroStart
+		}
+	}
+	return punched, f.Sync()
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
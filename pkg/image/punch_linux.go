@@ -0,0 +1,11 @@
+package image
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func punch(f *os.File, offset, length int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
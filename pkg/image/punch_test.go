@@ -0,0 +1,42 @@
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPunchZeroes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "punch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "image")
+
+	var data []byte
+	data = append(data, []byte("header")...)
+	data = append(data, bytes.Repeat([]byte{0}, 3*punchBlockSize)...)
+	data = append(data, []byte("trailer")...)
+	data = append(data, bytes.Repeat([]byte{0}, punchBlockSize+5)...)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	punched, err := PunchZeroes(path)
+	if err != nil {
+		t.Skipf("can't punch holes here: %v", err)
+	}
+	if punched == 0 {
+		t.Errorf("no zero blocks were punched")
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("punching changed the file: %d bytes instead of %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,181 @@
+package image
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Android sparse image format, as produced by img2simg and fastboot tooling.
+// See system/core/libsparse/sparse_format.h in AOSP.
+const (
+	sparseMagic         = 0xed26ff3a
+	sparseHeaderSize    = 28
+	sparseChunkHdrSize  = 12
+	sparseChunkRaw      = 0xcac1
+	sparseChunkFill     = 0xcac2
+	sparseChunkDontCare = 0xcac3
+	sparseChunkCrc32    = 0xcac4
+)
+
+type sparseHeader struct {
+	Magic         uint32
+	MajorVersion  uint16
+	MinorVersion  uint16
+	FileHdrSize   uint16
+	ChunkHdrSize  uint16
+	BlockSize     uint32
+	TotalBlocks   uint32
+	TotalChunks   uint32
+	ImageChecksum uint32
+}
+
+type sparseChunkHeader struct {
+	ChunkType uint16
+	Reserved  uint16
+	ChunkSize uint32 // in blocks
+	TotalSize uint32 // in bytes, including this header
+}
+
+// sparseReader expands an Android sparse image to a raw image as it is read.
+type sparseReader struct {
+	r      io.Reader
+	hdr    sparseHeader
+	chunks uint32
+	// what's left of the current chunk
+	chunk io.Reader
+}
+
+// isSparse tells if the stream starts with the sparse image magic.
+func isSparse(r *bufio.Reader) bool {
+	magic, err := r.Peek(4)
+	return err == nil && binary.LittleEndian.Uint32(magic) == sparseMagic
+}
+
+func newSparseReader(r io.Reader) (*sparseReader, error) {
+	s := &sparseReader{r: r}
+	if err := binary.Read(r, binary.LittleEndian, &s.hdr); err != nil {
+		return nil, err
+	}
+	if s.hdr.Magic != sparseMagic {
+		return nil, errors.New("not a sparse image")
+	}
+	if s.hdr.MajorVersion != 1 {
+		return nil, fmt.Errorf("unsupported sparse image version %d.%d", s.hdr.MajorVersion, s.hdr.MinorVersion)
+	}
+	if s.hdr.FileHdrSize < sparseHeaderSize || s.hdr.ChunkHdrSize < sparseChunkHdrSize || s.hdr.BlockSize%4 != 0 {
+		return nil, errors.New("bad sparse image header")
+	}
+	if err := s.skip(int64(s.hdr.FileHdrSize - sparseHeaderSize)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Size is the size of the raw image.
+func (s *sparseReader) Size() uint64 {
+	return uint64(s.hdr.BlockSize) * uint64(s.hdr.TotalBlocks)
+}
+
+func (s *sparseReader) Read(p []byte) (int, error) {
+	for {
+		if s.chunk != nil {
+			n, err := s.chunk.Read(p)
+			if err == io.EOF {
+				s.chunk = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+		if s.chunks == s.hdr.TotalChunks {
+			return 0, io.EOF
+		}
+		if err := s.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *sparseReader) nextChunk() error {
+	var hdr sparseChunkHeader
+	if err := binary.Read(s.r, binary.LittleEndian, &hdr); err != nil {
+		return unexpectedEOF(err)
+	}
+	if err := s.skip(int64(s.hdr.ChunkHdrSize - sparseChunkHdrSize)); err != nil {
+		return err
+	}
+	s.chunks++
+
+	size := int64(hdr.ChunkSize) * int64(s.hdr.BlockSize)
+	dataSize := int64(hdr.TotalSize) - int64(s.hdr.ChunkHdrSize)
+	switch hdr.ChunkType {
+	case sparseChunkRaw:
+		if dataSize != size {
+			return fmt.Errorf("sparse raw chunk %d has %d bytes of data for %d bytes", s.chunks, dataSize, size)
+		}
+		s.chunk = &exactReader{io.LimitReader(s.r, size), size}
+	case sparseChunkFill:
+		if dataSize != 4 {
+			return fmt.Errorf("sparse fill chunk %d has %d bytes of data", s.chunks, dataSize)
+		}
+		var fill [4]byte
+		if _, err := io.ReadFull(s.r, fill[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		s.chunk = io.LimitReader(&fillReader{fill: fill}, size)
+	case sparseChunkDontCare:
+		s.chunk = io.LimitReader(&fillReader{}, size)
+	case sparseChunkCrc32:
+		return s.skip(dataSize)
+	default:
+		return fmt.Errorf("unknown sparse chunk type 0x%x", hdr.ChunkType)
+	}
+	return nil
+}
+
+func (s *sparseReader) skip(n int64) error {
+	_, err := io.CopyN(ioutil.Discard, s.r, n)
+	return unexpectedEOF(err)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// fillReader repeats a 4 byte pattern forever.
+type fillReader struct {
+	fill [4]byte
+	off  int
+}
+
+func (f *fillReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = f.fill[f.off]
+		f.off = (f.off + 1) % 4
+	}
+	return len(p), nil
+}
+
+// exactReader fails if the underlying reader ends before n bytes were read.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,77 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+func sparseImage(chunks ...interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, sparseHeader{
+		Magic:        sparseMagic,
+		MajorVersion: 1,
+		FileHdrSize:  sparseHeaderSize,
+		ChunkHdrSize: sparseChunkHdrSize,
+		BlockSize:    8,
+		TotalBlocks:  5,
+		TotalChunks:  uint32(len(chunks) / 2),
+	})
+	for i := 0; i < len(chunks); i += 2 {
+		hdr := chunks[i].(sparseChunkHeader)
+		binary.Write(&buf, binary.LittleEndian, hdr)
+		buf.Write(chunks[i+1].([]byte))
+	}
+	return buf.Bytes()
+}
+
+func TestSparse(t *testing.T) {
+	raw := []byte("abcdefghijklmnop")
+	data := sparseImage(
+		sparseChunkHeader{ChunkType: sparseChunkRaw, ChunkSize: 2, TotalSize: sparseChunkHdrSize + 16}, raw,
+		sparseChunkHeader{ChunkType: sparseChunkFill, ChunkSize: 1, TotalSize: sparseChunkHdrSize + 4}, []byte{1, 2, 3, 4},
+		sparseChunkHeader{ChunkType: sparseChunkCrc32, TotalSize: sparseChunkHdrSize + 4}, []byte{0, 0, 0, 0},
+		sparseChunkHeader{ChunkType: sparseChunkDontCare, ChunkSize: 2, TotalSize: sparseChunkHdrSize}, []byte{},
+	)
+
+	br := bufio.NewReader(bytes.NewReader(data))
+	if !isSparse(br) {
+		t.Fatal("expected sparse image")
+	}
+	r, err := newSparseReader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 40 {
+		t.Errorf("unexpected size %d", r.Size())
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(raw, 1, 2, 3, 4, 1, 2, 3, 4), make([]byte, 16)...)
+	if !bytes.Equal(out, expected) {
+		t.Errorf("unexpected raw image %v", out)
+	}
+}
+
+func TestSparseTruncated(t *testing.T) {
+	data := sparseImage(
+		sparseChunkHeader{ChunkType: sparseChunkRaw, ChunkSize: 2, TotalSize: sparseChunkHdrSize + 16}, []byte("abcd"),
+	)
+	r, err := newSparseReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestNotSparse(t *testing.T) {
+	if isSparse(bufio.NewReader(bytes.NewReader([]byte("not a sparse image")))) {
+		t.Error("unexpected sparse image")
+	}
+}
@@ -10,16 +10,36 @@ type KnownImageType string
 
 const (
 	RaspberryPi KnownImageType = "raspberrypi"
-	BeagleBone  KnownImageType = "beaglebone"
-	Kali        KnownImageType = "kali"
-	Unknown     KnownImageType = ""
+	// the 64-bit editions of Raspberry Pi OS
+	RaspberryPiArm64 KnownImageType = "raspberrypi-arm64"
+	BeagleBone       KnownImageType = "beaglebone"
+	Kali             KnownImageType = "kali"
+	Noobs            KnownImageType = "noobs"
+	// the aarch64 raw images of Fedora Server, Minimal and IoT
+	Fedora KnownImageType = "fedora"
+	// the aarch64 JeOS images of openSUSE Tumbleweed and Leap, with a btrfs root
+	OpenSUSE KnownImageType = "opensuse"
+	// the rootfs tarballs of Arch Linux ARM, see rootfs archives in the README
+	ArchLinuxArm   KnownImageType = "archlinuxarm"
+	ArchLinuxArm64 KnownImageType = "archlinuxarm-aarch64"
+	// the .wic images of OpenEmbedded and Yocto builds
+	Yocto      KnownImageType = "yocto"
+	YoctoArm64 KnownImageType = "yocto-aarch64"
+	// the sdcard.img images genimage makes for Buildroot
+	Buildroot      KnownImageType = "buildroot"
+	BuildrootArm64 KnownImageType = "buildroot-aarch64"
+	// Home Assistant OS, with read-only system slots and writable overlay and data partitions
+	HomeAssistant      KnownImageType = "haos"
+	HomeAssistantArm64 KnownImageType = "haos-aarch64"
+	Unknown            KnownImageType = ""
 )
 
 func GuessImageType(url string) KnownImageType {
-	if strings.Contains(url, "raspbian") {
-		return RaspberryPi
-	}
-	if strings.Contains(url, "raspios") {
+	if strings.Contains(url, "raspbian") || strings.Contains(url, "raspios") {
+		// like raspios_lite_arm64/ or 2023-05-03-raspios-bullseye-arm64-lite.img.xz
+		if strings.Contains(url, "arm64") || strings.Contains(url, "aarch64") {
+			return RaspberryPiArm64
+		}
 		return RaspberryPi
 	}
 
@@ -31,6 +51,42 @@ func GuessImageType(url string) KnownImageType {
 		return Kali
 	}
 
+	if strings.Contains(url, "fedora") || strings.Contains(url, "Fedora") {
+		return Fedora
+	}
+
+	if strings.Contains(url, "archlinuxarm") || strings.Contains(url, "ArchLinuxARM") {
+		// like ArchLinuxARM-rpi-aarch64-latest.tar.gz
+		if strings.Contains(url, "aarch64") {
+			return ArchLinuxArm64
+		}
+		return ArchLinuxArm
+	}
+
+	if strings.Contains(url, "haos_") || strings.Contains(url, "hassos") {
+		// like haos_rpi4-64-12.0.img.xz or haos_generic-aarch64-12.0.img.xz
+		if strings.Contains(url, "aarch64") || strings.Contains(url, "-64") {
+			return HomeAssistantArm64
+		}
+		return HomeAssistant
+	}
+
+	if strings.Contains(url, "buildroot") {
+		return Buildroot
+	}
+
+	if strings.Contains(url, ".wic") {
+		return Yocto
+	}
+
+	if strings.Contains(url, "opensuse") || strings.Contains(url, "openSUSE") {
+		return OpenSUSE
+	}
+
+	if strings.Contains(url, "noobs") || strings.Contains(url, "pinn") {
+		return Noobs
+	}
+
 	return ""
 
 }
@@ -69,6 +125,9 @@ func hasPotential(info os.FileInfo) bool {
 	if strings.HasSuffix(info.Name(), ".img") {
 		return true
 	}
+	if strings.HasSuffix(info.Name(), ".wic") {
+		return true
+	}
 	if strings.HasSuffix(info.Name(), ".iso") {
 		return true
 	}
@@ -0,0 +1,171 @@
+//go:generate mapstructure-to-hcl2 -type DeltaConfig
+
+package postprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+)
+
+const DeltaId = "solo-io.arm-image-delta"
+
+const (
+	DeltaXdelta3 = "xdelta3"
+	DeltaCasync  = "casync"
+)
+
+type DeltaConfig struct {
+	// The tool making the delta: xdelta3, for a patch from previous_image to the new image, or
+	// casync, for a chunk index of the new image whose chunks are shared with previous builds
+	// in casync_store. Defaults to xdelta3.
+	Tool string `mapstructure:"tool"`
+	// The image of the previous release, raw or compressed. Required with xdelta3.
+	PreviousImage string `mapstructure:"previous_image"`
+	// The casync chunk store to add the chunks of the image to. Defaults to default.castr in
+	// output_directory.
+	CasyncStore string `mapstructure:"casync_store"`
+	// Directory the delta is written to. Defaults to output-delta
+	OutputDir string `mapstructure:"output_directory"`
+}
+
+// Delta writes a binary delta of the image against a previous release, so devices download
+// what changed.
+type Delta struct {
+	config DeltaConfig
+}
+
+func NewDelta() packer.PostProcessor {
+	return &Delta{}
+}
+
+func (d *Delta) ConfigSpec() hcldec.ObjectSpec {
+	return d.config.FlatMapstructure().HCL2Spec()
+}
+
+func (d *Delta) Configure(cfgs ...interface{}) error {
+	err := config.Decode(&d.config, &config.DecodeOpts{
+		Interpolate:       true,
+		InterpolateFilter: &interpolate.RenderFilter{},
+	}, cfgs...)
+	if err != nil {
+		return err
+	}
+
+	if d.config.OutputDir == "" {
+		d.config.OutputDir = "output-delta"
+	}
+	switch d.config.Tool {
+	case "":
+		d.config.Tool = DeltaXdelta3
+		fallthrough
+	case DeltaXdelta3:
+		if d.config.PreviousImage == "" {
+			return errors.New("previous_image is required")
+		}
+		if _, err := os.Stat(d.config.PreviousImage); err != nil {
+			return fmt.Errorf("previous_image: %v", err)
+		}
+	case DeltaCasync:
+		if d.config.CasyncStore == "" {
+			d.config.CasyncStore = filepath.Join(d.config.OutputDir, "default.castr")
+		}
+	default:
+		return fmt.Errorf("tool must be xdelta3 or casync, not %q", d.config.Tool)
+	}
+	return nil
+}
+
+func (d *Delta) PostProcess(ctx context.Context, ui packer.Ui, ain packer.Artifact) (packer.Artifact, bool, bool, error) {
+	inputfile, err := imageOf(ain)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if err := os.MkdirAll(d.config.OutputDir, 0755); err != nil {
+		return nil, false, false, err
+	}
+
+	// the delta is of the raw images, whatever the compression of the artifacts is
+	newImage, err := d.rawImage(ctx, ui, inputfile)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if newImage != inputfile {
+		defer os.Remove(newImage)
+	}
+
+	imageName := filepath.Base(inputfile)
+	imageName = strings.TrimSuffix(imageName, filepath.Ext(imageName))
+	imageName = strings.TrimSuffix(imageName, ".img")
+
+	var out string
+	var cmd *exec.Cmd
+	if d.config.Tool == DeltaCasync {
+		out = filepath.Join(d.config.OutputDir, imageName+".caibx")
+		cmd = exec.CommandContext(ctx, "casync", "make", "--store="+d.config.CasyncStore, out, newImage)
+	} else {
+		previous, err := d.rawImage(ctx, ui, d.config.PreviousImage)
+		if err != nil {
+			return nil, false, false, err
+		}
+		if previous != d.config.PreviousImage {
+			defer os.Remove(previous)
+		}
+		out = filepath.Join(d.config.OutputDir, imageName+".xdelta")
+		cmd = exec.CommandContext(ctx, "xdelta3", "-e", "-f", "-9", "-S", "djw", "-s", previous, newImage, out)
+	}
+
+	ui.Say(fmt.Sprintf("Writing %s delta %s", d.config.Tool, out))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(out)
+		return nil, false, false, fmt.Errorf("error running %s, is it installed? %v: %s", d.config.Tool, err, strings.TrimSpace(string(output)))
+	}
+	return &DeltaArtifact{file: out}, true, false, nil
+}
+
+// rawImage returns imagefile, or a decompressed copy of it the caller removes.
+func (d *Delta) rawImage(ctx context.Context, ui packer.Ui, imagefile string) (string, error) {
+	if image.IsRaw(imagefile) {
+		return imagefile, nil
+	}
+	ui.Message(fmt.Sprintf("Decompressing %s", imagefile))
+	return decompressImage(ctx, ui, imagefile, d.config.OutputDir)
+}
+
+type DeltaArtifact struct {
+	file string
+}
+
+func (a *DeltaArtifact) BuilderId() string {
+	return DeltaId
+}
+
+func (a *DeltaArtifact) Files() []string {
+	return []string{a.file}
+}
+
+func (a *DeltaArtifact) Id() string {
+	return ""
+}
+
+func (a *DeltaArtifact) String() string {
+	return a.file
+}
+
+func (a *DeltaArtifact) State(name string) interface{} {
+	return nil
+}
+
+func (a *DeltaArtifact) Destroy() error {
+	return os.Remove(a.file)
+}
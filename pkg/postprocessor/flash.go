@@ -4,7 +4,6 @@ package postprocessor
 
 import (
 	"context"
-	"errors"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
@@ -43,11 +42,10 @@ func (f *Flasher) Configure(cfgs ...interface{}) error {
 }
 
 func (f *Flasher) PostProcess(ctx context.Context, ui packer.Ui, ain packer.Artifact) (a packer.Artifact, keep bool, forceOverride bool, err error) {
-	inputfiles := ain.Files()
-	if len(inputfiles) != 1 {
-		return nil, false, false, errors.New("ambiguous images")
+	imageToFlash, err := imageOf(ain)
+	if err != nil {
+		return nil, false, false, err
 	}
-	imageToFlash := inputfiles[0]
 
 	flashercfg := flasher.FlashConfig{
 		Image:          imageToFlash,
@@ -0,0 +1,21 @@
+package postprocessor
+
+import (
+	"errors"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/builder"
+)
+
+// imageOf returns the image of the artifact. Artifacts of the arm-image builder list it first,
+// before the manifest, bmap and other files of the build; other artifacts must have one file.
+func imageOf(ain packer.Artifact) (string, error) {
+	files := ain.Files()
+	if ain.BuilderId() == builder.BuilderId && len(files) > 0 {
+		return files[0], nil
+	}
+	if len(files) != 1 {
+		return "", errors.New("ambiguous images")
+	}
+	return files[0], nil
+}
@@ -0,0 +1,259 @@
+//go:generate mapstructure-to-hcl2 -type ImagerConfig
+
+package postprocessor
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+const ImagerId = "solo-io.arm-image-imager"
+
+type ImagerConfig struct {
+	// Name of the OS in the Raspberry Pi Imager menu. Required.
+	Name        string `mapstructure:"name"`
+	Description string `mapstructure:"description"`
+	// URL of the OS icon.
+	Icon    string `mapstructure:"icon"`
+	Website string `mapstructure:"website"`
+	// Where the zip file will be published, its name is appended to form the os_list url.
+	URLPrefix string `mapstructure:"url_prefix"`
+	// Defaults to the current date, formatted as YYYY-MM-DD
+	ReleaseDate string `mapstructure:"release_date"`
+	// Raspberry Pi Imager device tags the image is shown for, for example `["pi4-64bit", "pi5-64bit"]`.
+	Devices []string `mapstructure:"devices"`
+	// OS customization support: systemd, cloudinit or cloudinit-rpi. Leave empty if unsupported.
+	InitFormat string `mapstructure:"init_format"`
+	// Directory the zip file and os_list snippet are written to. Defaults to output-imager
+	OutputDir string `mapstructure:"output_directory"`
+	// A custom repository os_list json file to create or update with this image, replacing
+	// any previous entry with the same name.
+	OsListFile string `mapstructure:"os_list_file"`
+}
+
+type Imager struct {
+	config ImagerConfig
+}
+
+func NewImager() packer.PostProcessor {
+	return &Imager{}
+}
+
+func (i *Imager) ConfigSpec() hcldec.ObjectSpec {
+	return i.config.FlatMapstructure().HCL2Spec()
+}
+
+func (i *Imager) Configure(cfgs ...interface{}) error {
+	err := config.Decode(&i.config, &config.DecodeOpts{
+		Interpolate:       true,
+		InterpolateFilter: &interpolate.RenderFilter{},
+	}, cfgs...)
+	if err != nil {
+		return err
+	}
+
+	if i.config.Name == "" {
+		return errors.New("name is required")
+	}
+	if i.config.OutputDir == "" {
+		i.config.OutputDir = "output-imager"
+	}
+	if i.config.ReleaseDate == "" {
+		i.config.ReleaseDate = time.Now().Format("2006-01-02")
+	}
+	return nil
+}
+
+// imagerOS is an entry of the Raspberry Pi Imager os_list.
+type imagerOS struct {
+	Name                string   `json:"name"`
+	Description         string   `json:"description,omitempty"`
+	Icon                string   `json:"icon,omitempty"`
+	Website             string   `json:"website,omitempty"`
+	URL                 string   `json:"url"`
+	ReleaseDate         string   `json:"release_date"`
+	ExtractSize         int64    `json:"extract_size"`
+	ExtractSha256       string   `json:"extract_sha256"`
+	ImageDownloadSize   int64    `json:"image_download_size"`
+	ImageDownloadSha256 string   `json:"image_download_sha256"`
+	Devices             []string `json:"devices,omitempty"`
+	InitFormat          string   `json:"init_format,omitempty"`
+}
+
+func (i *Imager) PostProcess(ctx context.Context, ui packer.Ui, ain packer.Artifact) (packer.Artifact, bool, bool, error) {
+	inputfile, err := imageOf(ain)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	if err := os.MkdirAll(i.config.OutputDir, 0755); err != nil {
+		return nil, false, false, err
+	}
+
+	// the image inside the zip is uncompressed, whatever the artifact format is
+	imageName := strings.TrimSuffix(filepath.Base(inputfile), filepath.Ext(inputfile))
+	if filepath.Ext(imageName) != ".img" {
+		imageName += ".img"
+	}
+	zipPath := filepath.Join(i.config.OutputDir, strings.TrimSuffix(imageName, ".img")+".zip")
+
+	ui.Say(fmt.Sprintf("Packaging %s for Raspberry Pi Imager", zipPath))
+	entry, err := i.writeZip(ctx, ui, inputfile, imageName, zipPath)
+	if err != nil {
+		os.Remove(zipPath)
+		return nil, false, false, err
+	}
+
+	snippetPath := strings.TrimSuffix(zipPath, ".zip") + ".json"
+	data, err := json.MarshalIndent(map[string][]*imagerOS{"os_list": {entry}}, "", "  ")
+	if err != nil {
+		return nil, false, false, err
+	}
+	if err := ioutil.WriteFile(snippetPath, append(data, '\n'), 0644); err != nil {
+		return nil, false, false, err
+	}
+	files := []string{zipPath, snippetPath}
+
+	if i.config.OsListFile != "" {
+		ui.Message(fmt.Sprintf("Updating %s", i.config.OsListFile))
+		if err := updateOsList(i.config.OsListFile, entry); err != nil {
+			return nil, false, false, fmt.Errorf("error updating %s: %v", i.config.OsListFile, err)
+		}
+	}
+
+	return &ImagerArtifact{files: files}, true, false, nil
+}
+
+func (i *Imager) writeZip(ctx context.Context, ui packer.Ui, src, imageName, zipPath string) (*imagerOS, error) {
+	img, err := image.NewImageOpener(ui).Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	out, err := os.Create(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	downloadHash := sha256.New()
+	downloadSize := utils.NewProgressWriter()
+	zw := zip.NewWriter(io.MultiWriter(out, downloadHash, downloadSize))
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: imageName, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	extractHash := sha256.New()
+	extractSize, err := utils.CopyWithProgress(ctx, ui, io.MultiWriter(w, extractHash), img)
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+
+	url := filepath.Base(zipPath)
+	if i.config.URLPrefix != "" {
+		url = strings.TrimSuffix(i.config.URLPrefix, "/") + "/" + url
+	}
+	return &imagerOS{
+		Name:                i.config.Name,
+		Description:         i.config.Description,
+		Icon:                i.config.Icon,
+		Website:             i.config.Website,
+		URL:                 url,
+		ReleaseDate:         i.config.ReleaseDate,
+		ExtractSize:         extractSize,
+		ExtractSha256:       hex.EncodeToString(extractHash.Sum(nil)),
+		ImageDownloadSize:   int64(downloadSize.TotalData()),
+		ImageDownloadSha256: hex.EncodeToString(downloadHash.Sum(nil)),
+		Devices:             i.config.Devices,
+		InitFormat:          i.config.InitFormat,
+	}, nil
+}
+
+// updateOsList adds entry to an os_list file, keeping the fields and entries it doesn't know about.
+func updateOsList(path string, entry *imagerOS) error {
+	osList := map[string]interface{}{}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &osList); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var entries []interface{}
+	if existing, ok := osList["os_list"].([]interface{}); ok {
+		for _, e := range existing {
+			if m, ok := e.(map[string]interface{}); ok && m["name"] == entry.Name {
+				continue
+			}
+			entries = append(entries, e)
+		}
+	}
+	osList["os_list"] = append(entries, entry)
+
+	data, err = json.MarshalIndent(osList, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+type ImagerArtifact struct {
+	files []string
+}
+
+func (a *ImagerArtifact) BuilderId() string {
+	return ImagerId
+}
+
+func (a *ImagerArtifact) Files() []string {
+	return a.files
+}
+
+func (a *ImagerArtifact) Id() string {
+	return ""
+}
+
+func (a *ImagerArtifact) String() string {
+	return strings.Join(a.files, ", ")
+}
+
+func (a *ImagerArtifact) State(name string) interface{} {
+	return nil
+}
+
+func (a *ImagerArtifact) Destroy() error {
+	for _, f := range a.files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
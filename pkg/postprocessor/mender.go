@@ -0,0 +1,245 @@
+//go:generate mapstructure-to-hcl2 -type MenderConfig
+
+package postprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+const MenderId = "solo-io.arm-image-mender"
+
+type MenderConfig struct {
+	// The name of the Mender artifact, as devices report it once updated. Required.
+	ArtifactName string `mapstructure:"artifact_name"`
+	// The Mender device types the update installs on, for example `["raspberrypi4"]`. Required.
+	DeviceTypes []string `mapstructure:"device_types"`
+	// The number of the root partition in the image. Defaults to the rootfs file of
+	// export_partitions, or else the last ext4 partition.
+	Partition int `mapstructure:"partition"`
+	// The compression of the payload: gzip, lzma, zstd_better or none. Defaults to the one of
+	// mender-artifact.
+	Compression string `mapstructure:"compression"`
+	// A private key to sign the artifact with.
+	SigningKey string `mapstructure:"signing_key"`
+	// Directory the .mender file is written to. Defaults to output-mender
+	OutputDir string `mapstructure:"output_directory"`
+}
+
+// Mender packages the root filesystem of the image as a Mender rootfs-image update, with
+// mender-artifact.
+type Mender struct {
+	config MenderConfig
+}
+
+func NewMender() packer.PostProcessor {
+	return &Mender{}
+}
+
+func (m *Mender) ConfigSpec() hcldec.ObjectSpec {
+	return m.config.FlatMapstructure().HCL2Spec()
+}
+
+func (m *Mender) Configure(cfgs ...interface{}) error {
+	err := config.Decode(&m.config, &config.DecodeOpts{
+		Interpolate:       true,
+		InterpolateFilter: &interpolate.RenderFilter{},
+	}, cfgs...)
+	if err != nil {
+		return err
+	}
+
+	if m.config.ArtifactName == "" {
+		return errors.New("artifact_name is required")
+	}
+	if len(m.config.DeviceTypes) == 0 {
+		return errors.New("device_types is required")
+	}
+	if m.config.SigningKey != "" {
+		if _, err := os.Stat(m.config.SigningKey); err != nil {
+			return fmt.Errorf("signing_key: %v", err)
+		}
+	}
+	if m.config.OutputDir == "" {
+		m.config.OutputDir = "output-mender"
+	}
+	return nil
+}
+
+func (m *Mender) PostProcess(ctx context.Context, ui packer.Ui, ain packer.Artifact) (packer.Artifact, bool, bool, error) {
+	inputfile, err := imageOf(ain)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if err := os.MkdirAll(m.config.OutputDir, 0755); err != nil {
+		return nil, false, false, err
+	}
+
+	rootfs, err := m.rootfs(ctx, ui, ain, inputfile)
+	if err != nil {
+		return nil, false, false, fmt.Errorf("error finding the root filesystem: %v", err)
+	}
+	if rootfs != "" {
+		defer os.Remove(rootfs)
+	} else {
+		rootfs = exportedRootfs(ain)
+	}
+
+	imageName := filepath.Base(inputfile)
+	imageName = strings.TrimSuffix(imageName, filepath.Ext(imageName))
+	out := filepath.Join(m.config.OutputDir, strings.TrimSuffix(imageName, ".img")+".mender")
+
+	args := []string{"write", "rootfs-image", "--artifact-name", m.config.ArtifactName, "--file", rootfs, "--output-path", out}
+	for _, t := range m.config.DeviceTypes {
+		args = append(args, "--device-type", t)
+	}
+	if m.config.Compression != "" {
+		args = append(args, "--compression", m.config.Compression)
+	}
+	if m.config.SigningKey != "" {
+		args = append(args, "--key", m.config.SigningKey)
+	}
+
+	ui.Say(fmt.Sprintf("Writing Mender artifact %s", out))
+	cmd := exec.CommandContext(ctx, "mender-artifact", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(out)
+		return nil, false, false, fmt.Errorf("error running mender-artifact, is it installed? %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return &MenderArtifact{file: out}, true, false, nil
+}
+
+// exportedRootfs returns the root filesystem export_partitions wrote, if any.
+func exportedRootfs(ain packer.Artifact) string {
+	files, _ := ain.State("partition_files").([]string)
+	for _, f := range files {
+		if strings.Contains(filepath.Base(f), ".rootfs.") {
+			return f
+		}
+	}
+	return ""
+}
+
+// rootfs copies the root partition out of the image, to a temporary file. It returns "" to
+// use the rootfs export_partitions wrote.
+func (m *Mender) rootfs(ctx context.Context, ui packer.Ui, ain packer.Artifact, imagefile string) (string, error) {
+	if m.config.Partition == 0 && exportedRootfs(ain) != "" {
+		return "", nil
+	}
+
+	// the partitions of compressed images are read from a decompressed copy
+	if !image.IsRaw(imagefile) {
+		raw, err := decompressImage(ctx, ui, imagefile, m.config.OutputDir)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(raw)
+		imagefile = raw
+	}
+
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return "", err
+	}
+	var root *utils.Partition
+	for i, p := range table.Partitions {
+		if m.config.Partition != 0 {
+			if p.Number() == m.config.Partition {
+				root = &table.Partitions[i]
+			}
+			continue
+		}
+		info, err := utils.ProbeBlkid(imagefile, p.Start*table.SectorSize, p.Size*table.SectorSize)
+		if err == nil && info.Type() == "ext4" {
+			root = &table.Partitions[i]
+		}
+	}
+	if root == nil {
+		return "", fmt.Errorf("no root partition in %s, set partition", imagefile)
+	}
+
+	ui.Message(fmt.Sprintf("Using partition %d as the root filesystem", root.Number()))
+	dst, err := ioutil.TempFile(m.config.OutputDir, "rootfs-*.ext4")
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if err := copyPartition(ctx, ui, dst, imagefile, table, *root); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// copyPartition writes partition p of the raw image imagefile to dst.
+func copyPartition(ctx context.Context, ui packer.Ui, dst io.Writer, imagefile string, table *utils.PartitionTable, p utils.Partition) error {
+	src, err := os.Open(imagefile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	section := io.NewSectionReader(src, int64(p.Start*table.SectorSize), int64(p.Size*table.SectorSize))
+	_, err = utils.CopyWithProgress(ctx, ui, dst, section)
+	return err
+}
+
+// decompressImage writes the image of a compressed artifact to a temporary file in dir.
+func decompressImage(ctx context.Context, ui packer.Ui, imagefile, dir string) (string, error) {
+	img, err := image.NewImageOpener(ui).Open(imagefile)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	dst, err := ioutil.TempFile(dir, "image-*.img")
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := utils.CopyWithProgress(ctx, ui, dst, img); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+type MenderArtifact struct {
+	file string
+}
+
+func (a *MenderArtifact) BuilderId() string {
+	return MenderId
+}
+
+func (a *MenderArtifact) Files() []string {
+	return []string{a.file}
+}
+
+func (a *MenderArtifact) Id() string {
+	return ""
+}
+
+func (a *MenderArtifact) String() string {
+	return a.file
+}
+
+func (a *MenderArtifact) State(name string) interface{} {
+	return nil
+}
+
+func (a *MenderArtifact) Destroy() error {
+	return os.Remove(a.file)
+}
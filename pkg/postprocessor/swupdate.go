@@ -0,0 +1,374 @@
+//go:generate mapstructure-to-hcl2 -type SWUpdateConfig,SWUpdatePartition,SWUpdateFile
+
+package postprocessor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+const SWUpdateId = "solo-io.arm-image-swupdate"
+
+type SWUpdateConfig struct {
+	// The version of the software, as SWUpdate compares it. Required.
+	Version     string `mapstructure:"version"`
+	Description string `mapstructure:"description"`
+	// The hardware revisions the bundle installs on, for example `["1.0", "1.2"]`.
+	HardwareCompatibility []string `mapstructure:"hardware_compatibility"`
+	// Partitions of the image written to devices of the target.
+	Partitions []SWUpdatePartition `mapstructure:"partitions"`
+	// Files of the host installed on filesystems of the target.
+	Files []SWUpdateFile `mapstructure:"files"`
+	// A private RSA key to sign the sw-description with, with openssl. The bundle then has a
+	// sw-description.sig.
+	SigningKey string `mapstructure:"signing_key"`
+	// Directory the .swu file is written to. Defaults to output-swupdate
+	OutputDir string `mapstructure:"output_directory"`
+}
+
+type SWUpdatePartition struct {
+	// The number of the partition in the image. Required.
+	Partition int `mapstructure:"partition"`
+	// The device of the target the partition is written to, like /dev/mmcblk0p3. Required.
+	Device string `mapstructure:"device"`
+	// The name of the partition in the bundle. Defaults to partition<number>.img
+	Filename string `mapstructure:"filename"`
+}
+
+type SWUpdateFile struct {
+	// The file on the host. Required.
+	Source string `mapstructure:"source"`
+	// Where the file is installed on the target. Required.
+	Path string `mapstructure:"path"`
+	// The device and filesystem path is on. Without them, path is on the running system.
+	Device     string `mapstructure:"device"`
+	Filesystem string `mapstructure:"filesystem"`
+}
+
+// SWUpdate packages partitions of the image and files as an SWUpdate .swu bundle: a cpio
+// archive of a generated sw-description followed by the files it lists.
+type SWUpdate struct {
+	config SWUpdateConfig
+}
+
+func NewSWUpdate() packer.PostProcessor {
+	return &SWUpdate{}
+}
+
+func (s *SWUpdate) ConfigSpec() hcldec.ObjectSpec {
+	return s.config.FlatMapstructure().HCL2Spec()
+}
+
+func (s *SWUpdate) Configure(cfgs ...interface{}) error {
+	err := config.Decode(&s.config, &config.DecodeOpts{
+		Interpolate:       true,
+		InterpolateFilter: &interpolate.RenderFilter{},
+	}, cfgs...)
+	if err != nil {
+		return err
+	}
+
+	var errs *packer.MultiError
+	if s.config.Version == "" {
+		errs = packer.MultiErrorAppend(errs, errors.New("version is required"))
+	}
+	if len(s.config.Partitions) == 0 && len(s.config.Files) == 0 {
+		errs = packer.MultiErrorAppend(errs, errors.New("partitions or files are required"))
+	}
+	names := map[string]bool{"sw-description": true, "sw-description.sig": true}
+	for i := range s.config.Partitions {
+		p := &s.config.Partitions[i]
+		if p.Partition <= 0 || p.Device == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("partitions[%d]: partition and device are required", i))
+		}
+		if p.Filename == "" {
+			p.Filename = fmt.Sprintf("partition%d.img", p.Partition)
+		}
+		if names[p.Filename] {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("partitions[%d]: %s is already in the bundle", i, p.Filename))
+		}
+		names[p.Filename] = true
+	}
+	for i, f := range s.config.Files {
+		if f.Source == "" || f.Path == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("files[%d]: source and path are required", i))
+			continue
+		}
+		if _, err := os.Stat(f.Source); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("files[%d]: %v", i, err))
+		}
+		if name := filepath.Base(f.Source); names[name] {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("files[%d]: %s is already in the bundle", i, name))
+		} else {
+			names[name] = true
+		}
+	}
+	if s.config.SigningKey != "" {
+		if _, err := os.Stat(s.config.SigningKey); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("signing_key: %v", err))
+		}
+	}
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	if s.config.OutputDir == "" {
+		s.config.OutputDir = "output-swupdate"
+	}
+	return nil
+}
+
+// swuEntry is a file of the bundle, after sw-description.
+type swuEntry struct {
+	name   string
+	path   string
+	sha256 string
+}
+
+func (s *SWUpdate) PostProcess(ctx context.Context, ui packer.Ui, ain packer.Artifact) (packer.Artifact, bool, bool, error) {
+	inputfile, err := imageOf(ain)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if err := os.MkdirAll(s.config.OutputDir, 0755); err != nil {
+		return nil, false, false, err
+	}
+	tmp, err := ioutil.TempDir(s.config.OutputDir, "swupdate")
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer os.RemoveAll(tmp)
+
+	images, err := s.partitions(ctx, ui, inputfile, tmp)
+	if err != nil {
+		return nil, false, false, fmt.Errorf("error extracting partitions: %v", err)
+	}
+	var files []swuEntry
+	for _, f := range s.config.Files {
+		sum, err := sha256File(f.Source)
+		if err != nil {
+			return nil, false, false, err
+		}
+		files = append(files, swuEntry{name: filepath.Base(f.Source), path: f.Source, sha256: sum})
+	}
+
+	description := filepath.Join(tmp, "sw-description")
+	if err := ioutil.WriteFile(description, []byte(s.swDescription(images, files)), 0644); err != nil {
+		return nil, false, false, err
+	}
+	entries := []swuEntry{{name: "sw-description", path: description}}
+	if s.config.SigningKey != "" {
+		ui.Message("Signing sw-description")
+		sig := description + ".sig"
+		cmd := exec.CommandContext(ctx, "openssl", "dgst", "-sha256", "-sign", s.config.SigningKey, "-out", sig, description)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, false, false, fmt.Errorf("error signing sw-description: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+		entries = append(entries, swuEntry{name: "sw-description.sig", path: sig})
+	}
+	entries = append(entries, images...)
+	entries = append(entries, files...)
+
+	imageName := filepath.Base(inputfile)
+	imageName = strings.TrimSuffix(imageName, filepath.Ext(imageName))
+	out := filepath.Join(s.config.OutputDir, strings.TrimSuffix(imageName, ".img")+".swu")
+	ui.Say(fmt.Sprintf("Writing SWUpdate bundle %s", out))
+	if err := writeBundle(ctx, ui, out, entries); err != nil {
+		os.Remove(out)
+		return nil, false, false, err
+	}
+	return &SWUpdateArtifact{file: out}, true, false, nil
+}
+
+// partitions copies the partitions of the bundle out of the image, to dir.
+func (s *SWUpdate) partitions(ctx context.Context, ui packer.Ui, imagefile, dir string) ([]swuEntry, error) {
+	if len(s.config.Partitions) == 0 {
+		return nil, nil
+	}
+	if !image.IsRaw(imagefile) {
+		raw, err := decompressImage(ctx, ui, imagefile, dir)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(raw)
+		imagefile = raw
+	}
+	table, err := utils.ReadPartitionTable(imagefile)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []swuEntry
+	for _, p := range s.config.Partitions {
+		var part *utils.Partition
+		for i := range table.Partitions {
+			if table.Partitions[i].Number() == p.Partition {
+				part = &table.Partitions[i]
+			}
+		}
+		if part == nil {
+			return nil, fmt.Errorf("partition %d not found in %s", p.Partition, imagefile)
+		}
+
+		ui.Message(fmt.Sprintf("Adding partition %d as %s", p.Partition, p.Filename))
+		path := filepath.Join(dir, p.Filename)
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.New()
+		err = copyPartition(ctx, ui, io.MultiWriter(f, hash), imagefile, table, *part)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, swuEntry{name: p.Filename, path: path, sha256: hex.EncodeToString(hash.Sum(nil))})
+	}
+	return entries, nil
+}
+
+// swDescription returns the sw-description of the bundle, in libconfig syntax.
+func (s *SWUpdate) swDescription(images, files []swuEntry) string {
+	var b strings.Builder
+	b.WriteString("software =\n{\n")
+	fmt.Fprintf(&b, "\tversion = %s;\n", strconv.Quote(s.config.Version))
+	if s.config.Description != "" {
+		fmt.Fprintf(&b, "\tdescription = %s;\n", strconv.Quote(s.config.Description))
+	}
+	if len(s.config.HardwareCompatibility) > 0 {
+		var revisions []string
+		for _, r := range s.config.HardwareCompatibility {
+			revisions = append(revisions, strconv.Quote(r))
+		}
+		fmt.Fprintf(&b, "\thardware-compatibility: [ %s ];\n", strings.Join(revisions, ", "))
+	}
+
+	var sections []string
+	if len(images) > 0 {
+		var entries []string
+		for i, img := range images {
+			entries = append(entries, libconfigGroup([][2]string{
+				{"filename", img.name},
+				{"device", s.config.Partitions[i].Device},
+				{"sha256", img.sha256},
+			}))
+		}
+		sections = append(sections, "\timages: (\n"+strings.Join(entries, ",\n")+"\n\t);\n")
+	}
+	if len(files) > 0 {
+		var entries []string
+		for i, f := range files {
+			entries = append(entries, libconfigGroup([][2]string{
+				{"filename", f.name},
+				{"path", s.config.Files[i].Path},
+				{"device", s.config.Files[i].Device},
+				{"filesystem", s.config.Files[i].Filesystem},
+				{"sha256", f.sha256},
+			}))
+		}
+		sections = append(sections, "\tfiles: (\n"+strings.Join(entries, ",\n")+"\n\t);\n")
+	}
+	b.WriteString(strings.Join(sections, ""))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// libconfigGroup formats the settings with a value as a group of a list.
+func libconfigGroup(settings [][2]string) string {
+	var lines []string
+	for _, setting := range settings {
+		if setting[1] != "" {
+			lines = append(lines, fmt.Sprintf("\t\t\t%s = %s;", setting[0], strconv.Quote(setting[1])))
+		}
+	}
+	return "\t\t{\n" + strings.Join(lines, "\n") + "\n\t\t}"
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeBundle writes the entries to a cpio archive at out, sw-description first as SWUpdate
+// requires.
+func writeBundle(ctx context.Context, ui packer.Ui, out string, entries []swuEntry) error {
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	w := utils.NewCpioWriter(dst)
+	for _, e := range entries {
+		src, err := os.Open(e.path)
+		if err != nil {
+			return err
+		}
+		stat, err := src.Stat()
+		if err == nil {
+			err = w.WriteHeader(e.name, stat.Size(), 0644)
+		}
+		if err == nil {
+			_, err = utils.CopyWithProgress(ctx, ui, w, src)
+		}
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+type SWUpdateArtifact struct {
+	file string
+}
+
+func (a *SWUpdateArtifact) BuilderId() string {
+	return SWUpdateId
+}
+
+func (a *SWUpdateArtifact) Files() []string {
+	return []string{a.file}
+}
+
+func (a *SWUpdateArtifact) Id() string {
+	return ""
+}
+
+func (a *SWUpdateArtifact) String() string {
+	return a.file
+}
+
+func (a *SWUpdateArtifact) State(name string) interface{} {
+	return nil
+}
+
+func (a *SWUpdateArtifact) Destroy() error {
+	return os.Remove(a.file)
+}
@@ -0,0 +1,165 @@
+//go:generate mapstructure-to-hcl2 -type UploadConfig
+
+package postprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+const UploadId = "solo-io.arm-image-upload"
+
+// uploadStates are the files of the artifact state uploaded with the image, when the build
+// wrote them.
+var uploadStates = []string{"manifest", "bmap", "sbom", "provenance"}
+
+type UploadConfig struct {
+	// The bucket and prefix to upload to: s3://bucket/prefix, gs://bucket/prefix or
+	// azblob://account/container/prefix. Required.
+	Destination string `mapstructure:"destination"`
+	// The endpoint of an S3 compatible service, like https://minio.example.com. Optional.
+	Endpoint string `mapstructure:"endpoint"`
+	// Upload the manifest, bmap, SBOM and provenance of the build with the image. Defaults to true.
+	UploadMetadata config.Trilean `mapstructure:"upload_metadata"`
+}
+
+// Upload uploads the files of the artifact, the image first, to a cloud storage bucket with the
+// aws, gcloud or az cli, as the user they are logged in as.
+type Upload struct {
+	config UploadConfig
+	dest   *url.URL
+}
+
+func NewUpload() packer.PostProcessor {
+	return &Upload{}
+}
+
+func (u *Upload) ConfigSpec() hcldec.ObjectSpec {
+	return u.config.FlatMapstructure().HCL2Spec()
+}
+
+func (u *Upload) Configure(cfgs ...interface{}) error {
+	err := config.Decode(&u.config, &config.DecodeOpts{
+		Interpolate:       true,
+		InterpolateFilter: &interpolate.RenderFilter{},
+	}, cfgs...)
+	if err != nil {
+		return err
+	}
+
+	if u.config.Destination == "" {
+		return errors.New("destination is required")
+	}
+	if u.dest, err = url.Parse(u.config.Destination); err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+	switch u.dest.Scheme {
+	case "s3", "gs":
+	case "azblob":
+		if strings.Trim(u.dest.Path, "/") == "" {
+			return errors.New("azblob destinations are azblob://account/container/prefix")
+		}
+	default:
+		return fmt.Errorf("destination must be an s3://, gs:// or azblob:// url, not %q", u.config.Destination)
+	}
+	if u.dest.Host == "" {
+		return fmt.Errorf("destination %q has no bucket", u.config.Destination)
+	}
+	if u.config.Endpoint != "" && u.dest.Scheme != "s3" {
+		return errors.New("endpoint is only for s3 destinations")
+	}
+	return nil
+}
+
+func (u *Upload) PostProcess(ctx context.Context, ui packer.Ui, ain packer.Artifact) (packer.Artifact, bool, bool, error) {
+	files := ain.Files()
+	for _, name := range uploadStates {
+		file, ok := ain.State(name).(string)
+		if !ok || file == "" {
+			continue
+		}
+		i := 0
+		for i < len(files) && files[i] != file {
+			i++
+		}
+		if u.config.UploadMetadata.False() && i < len(files) {
+			files = append(files[:i:i], files[i+1:]...)
+		} else if !u.config.UploadMetadata.False() && i == len(files) {
+			files = append(files, file)
+		}
+	}
+
+	var urls []string
+	for _, file := range files {
+		dest := *u.dest
+		dest.Path = path.Join("/", u.dest.Path, filepath.Base(file))
+		ui.Say(fmt.Sprintf("Uploading %s to %s", file, dest.String()))
+		cmd := u.command(ctx, file, &dest)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, false, false, fmt.Errorf("error running %s, is it installed? %v: %s", cmd.Args[0], err, strings.TrimSpace(string(output)))
+		}
+		urls = append(urls, dest.String())
+	}
+	return &UploadArtifact{urls: urls}, true, false, nil
+}
+
+// command returns the command uploading file to dest.
+func (u *Upload) command(ctx context.Context, file string, dest *url.URL) *exec.Cmd {
+	switch dest.Scheme {
+	case "gs":
+		return exec.CommandContext(ctx, "gcloud", "storage", "cp", file, dest.String())
+	case "azblob":
+		parts := strings.SplitN(strings.TrimPrefix(dest.Path, "/"), "/", 2)
+		return exec.CommandContext(ctx, "az", "storage", "blob", "upload", "--auth-mode", "login", "--overwrite", "--no-progress",
+			"--account-name", dest.Host, "--container-name", parts[0], "--name", parts[1], "--file", file)
+	}
+	args := []string{"s3", "cp", "--only-show-errors"}
+	if u.config.Endpoint != "" {
+		args = append(args, "--endpoint-url", u.config.Endpoint)
+	}
+	return exec.CommandContext(ctx, "aws", append(args, file, dest.String())...)
+}
+
+// UploadArtifact is the urls of the uploaded files. Destroying it leaves them in the bucket.
+type UploadArtifact struct {
+	urls []string
+}
+
+func (a *UploadArtifact) BuilderId() string {
+	return UploadId
+}
+
+func (a *UploadArtifact) Files() []string {
+	return nil
+}
+
+func (a *UploadArtifact) Id() string {
+	return strings.Join(a.urls, ",")
+}
+
+func (a *UploadArtifact) String() string {
+	return strings.Join(a.urls, ", ")
+}
+
+// State exposes the urls of the uploaded files as urls, the image first.
+func (a *UploadArtifact) State(name string) interface{} {
+	if name == "urls" {
+		return a.urls
+	}
+	return nil
+}
+
+func (a *UploadArtifact) Destroy() error {
+	return nil
+}
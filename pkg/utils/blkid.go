@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// BlkidInfo holds the tags blkid reports for a device, like TYPE, UUID, LABEL, PARTLABEL and PARTUUID.
+type BlkidInfo struct {
+	Values map[string]string
+}
+
+func (b *BlkidInfo) Type() string  { return b.Values["TYPE"] }
+func (b *BlkidInfo) UUID() string  { return b.Values["UUID"] }
+func (b *BlkidInfo) Label() string { return b.Values["LABEL"] }
+
+// PartLabel returns the GPT partition name. low level probing reports it as PART_ENTRY_NAME.
+func (b *BlkidInfo) PartLabel() string {
+	if l, ok := b.Values["PARTLABEL"]; ok {
+		return l
+	}
+	return b.Values["PART_ENTRY_NAME"]
+}
+
+func (b *BlkidInfo) PartUUID() string {
+	if u, ok := b.Values["PARTUUID"]; ok {
+		return u
+	}
+	return b.Values["PART_ENTRY_UUID"]
+}
+
+func NewBlkidInfo(dev string) (*BlkidInfo, error) {
+	data, err := exec.Command("blkid", "-c", "/dev/null", "-o", "export", dev).Output()
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 2 {
+			// nothing could be identified on the device
+			return &BlkidInfo{Values: map[string]string{}}, nil
+		}
+		return nil, err
+	}
+	return ParseBlkid(data)
+}
+
+// ProbeBlkid probes the filesystem at offset of a file, like a partition of an image that
+// isn't mapped. size limits the probed area, in bytes.
+func ProbeBlkid(path string, offset, size uint64) (*BlkidInfo, error) {
+	data, err := exec.Command("blkid", "-p", "-c", "/dev/null", "-o", "export",
+		"-O", strconv.FormatUint(offset, 10), "-S", strconv.FormatUint(size, 10), path).Output()
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 2 {
+			return &BlkidInfo{Values: map[string]string{}}, nil
+		}
+		return nil, err
+	}
+	return ParseBlkid(data)
+}
+
+func ParseBlkid(data []byte) (*BlkidInfo, error) {
+	info := BlkidInfo{Values: make(map[string]string)}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		entries := strings.SplitN(line, "=", 2)
+		if len(entries) < 2 {
+			return nil, errors.New("unexpected blkid format")
+		}
+		info.Values[entries[0]] = entries[1]
+	}
+	return &info, nil
+}
@@ -0,0 +1,56 @@
+package utils
+
+import "testing"
+
+const RootBlkid = `
+DEVNAME=/dev/mapper/loop0p2
+LABEL=rootfs
+UUID=3857a514-b0f4-49ce-8430-34762068bb6f
+BLOCK_SIZE=4096
+TYPE=ext4
+PARTUUID=544c6228-02
+`
+
+const BootBlkidLowLevel = `
+LABEL_FATBOOT=boot
+LABEL=boot
+UUID=592B-C92C
+TYPE=vfat
+USAGE=filesystem
+PART_ENTRY_SCHEME=gpt
+PART_ENTRY_NAME=hassos-boot
+PART_ENTRY_UUID=b3dd0952-733c-4c88-8cba-cab9b8b4377f
+PART_ENTRY_NUMBER=1
+`
+
+func TestBlkid(t *testing.T) {
+	info, err := ParseBlkid([]byte(RootBlkid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type() != "ext4" || info.Label() != "rootfs" || info.PartUUID() != "544c6228-02" {
+		t.Errorf("unexpected blkid info %v", info.Values)
+	}
+	if info.PartLabel() != "" {
+		t.Errorf("unexpected part label %s", info.PartLabel())
+	}
+}
+
+func TestBlkidLowLevel(t *testing.T) {
+	info, err := ParseBlkid([]byte(BootBlkidLowLevel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PartLabel() != "hassos-boot" {
+		t.Errorf("unexpected part label %s", info.PartLabel())
+	}
+	if info.PartUUID() != "b3dd0952-733c-4c88-8cba-cab9b8b4377f" {
+		t.Errorf("unexpected part uuid %s", info.PartUUID())
+	}
+}
+
+func TestBlkidBadFormat(t *testing.T) {
+	if _, err := ParseBlkid([]byte("TYPE")); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var bsdChecksumRegexp = regexp.MustCompile(`^[A-Za-z0-9-]+ \((.+)\) = ([0-9a-fA-F]+)$`)
+
+// ParseChecksumFile returns the checksum of filename from a checksum file, in either the
+// GNU coreutils format (`<hash>  <file>`, as written by sha512sum and b2sum), or the BSD
+// format (`BLAKE2b (<file>) = <hash>`). A file with a single bare hash also works.
+func ParseChecksumFile(data []byte, filename string) (string, error) {
+	filename = filepath.Base(filename)
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	for _, line := range lines {
+		if m := bsdChecksumRegexp.FindStringSubmatch(line); m != nil {
+			if filepath.Base(m[1]) == filename {
+				return m[2], nil
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 1 && len(lines) == 1 {
+			return fields[0], nil
+		}
+		// binary mode files are prefixed with *
+		if len(fields) == 2 && filepath.Base(strings.TrimPrefix(fields[1], "*")) == filename {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s found", filename)
+}
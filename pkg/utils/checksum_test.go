@@ -0,0 +1,50 @@
+package utils
+
+import "testing"
+
+const B2sums = `
+# Arch Linux ARM
+4b0e3de0b7ee4a4c1d21ecbf8a2d2bb8e4e2b3f8bc4bd1c789b5d0d1b6bc6c1e1d2ad7b7a528c2a9e0a3e1673b0e70ea34b0a3d773ed2a9b879d48f8a7d0c2a3  ArchLinuxARM-rpi-aarch64-latest.tar.gz
+63c83bd0e713bd1b9322bea7fc22ad1337e8d40f0c3cd23b1fc6a9dba7a3deb6483d244f1e7b42d169e39a0cba8ba8f0e1a17eca2c36e4e4b5cc4b7435fe4b1e *ArchLinuxARM-rpi-armv7-latest.tar.gz
+`
+
+const BsdSums = `BLAKE2b (images/rootfs.img) = 1a2b3c
+BLAKE2b (boot.img) = 4d5e6f
+`
+
+func TestChecksumFile(t *testing.T) {
+	sum, err := ParseChecksumFile([]byte(B2sums), "http://example.com/ArchLinuxARM-rpi-armv7-latest.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != "63c83bd0e713bd1b9322bea7fc22ad1337e8d40f0c3cd23b1fc6a9dba7a3deb6483d244f1e7b42d169e39a0cba8ba8f0e1a17eca2c36e4e4b5cc4b7435fe4b1e" {
+		t.Errorf("unexpected checksum %s", sum)
+	}
+}
+
+func TestChecksumFileBsd(t *testing.T) {
+	sum, err := ParseChecksumFile([]byte(BsdSums), "rootfs.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != "1a2b3c" {
+		t.Errorf("unexpected checksum %s", sum)
+	}
+}
+
+func TestChecksumFileSingleHash(t *testing.T) {
+	sum, err := ParseChecksumFile([]byte("abcdef\n"), "image.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != "abcdef" {
+		t.Errorf("unexpected checksum %s", sum)
+	}
+}
+
+func TestChecksumFileMissing(t *testing.T) {
+	_, err := ParseChecksumFile([]byte(B2sums), "other.img")
+	if err == nil {
+		t.Error("expected error")
+	}
+}
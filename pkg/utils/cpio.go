@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const cpioTrailer = "TRAILER!!!"
+
+// CpioWriter writes a cpio archive in the "newc" format, the one of initramfs and SWUpdate
+// bundles. Only regular files are supported, and their size must be known before their data is
+// written.
+type CpioWriter struct {
+	w       io.Writer
+	ino     uint32
+	written int64
+	// bytes of the current file left to write
+	remaining int64
+}
+
+func NewCpioWriter(w io.Writer) *CpioWriter {
+	return &CpioWriter{w: w}
+}
+
+// WriteHeader starts a new regular file of size bytes, with mode permissions. Its data is
+// written with Write.
+func (c *CpioWriter) WriteHeader(name string, size int64, mode uint32) error {
+	if c.remaining != 0 {
+		return fmt.Errorf("%d bytes missing from the previous file", c.remaining)
+	}
+	if err := c.pad(); err != nil {
+		return err
+	}
+	c.ino++
+	return c.header(name, size, 0100000|mode&0777)
+}
+
+func (c *CpioWriter) header(name string, size int64, mode uint32) error {
+	if size > 0xffffffff {
+		return fmt.Errorf("%s is too large for a cpio archive", name)
+	}
+	// magic, ino, mode, uid, gid, nlink, mtime, filesize, devmajor, devminor, rdevmajor,
+	// rdevminor, namesize and check, then the name, nul terminated
+	hdr := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+		c.ino, mode, 0, 0, 1, 0, size, 0, 0, 0, 0, len(name)+1, 0, name)
+	if _, err := c.write([]byte(hdr)); err != nil {
+		return err
+	}
+	if err := c.pad(); err != nil {
+		return err
+	}
+	c.remaining = size
+	return nil
+}
+
+func (c *CpioWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.remaining {
+		return 0, errors.New("write past the size of the file")
+	}
+	n, err := c.write(p)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *CpioWriter) write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// pad aligns the archive to 4 bytes, as headers and file data are.
+func (c *CpioWriter) pad() error {
+	if n := (4 - c.written%4) % 4; n != 0 {
+		_, err := c.write(make([]byte, n))
+		return err
+	}
+	return nil
+}
+
+// Close writes the trailer of the archive. It doesn't close the underlying writer.
+func (c *CpioWriter) Close() error {
+	if c.remaining != 0 {
+		return fmt.Errorf("%d bytes missing from the last file", c.remaining)
+	}
+	if err := c.pad(); err != nil {
+		return err
+	}
+	c.ino = 0
+	if err := c.header(cpioTrailer, 0, 0); err != nil {
+		return err
+	}
+	return c.pad()
+}
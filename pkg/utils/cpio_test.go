@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCpioWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCpioWriter(&buf)
+	if err := w.WriteHeader("sw-description", 5, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader("rootfs.ext4", 2, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err == nil {
+		t.Error("expected writing past the size to fail")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("expected closing with missing bytes to fail")
+	}
+	w.Write([]byte("ab"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	// 110 bytes of header, the name and its nul padded to 128, then hello padded to 136
+	if !strings.HasPrefix(out, "07070100000001000081a4") || out[110:125] != "sw-description\x00" || out[128:133] != "hello" {
+		t.Errorf("unexpected first file %q", out[:136])
+	}
+	if !strings.HasPrefix(out[136:], "07070100000002000081a4") {
+		t.Errorf("unexpected second header %q", out[136:160])
+	}
+	if !strings.Contains(out, "TRAILER!!!\x00") || len(out)%4 != 0 {
+		t.Errorf("unexpected trailer %q", out[len(out)-20:])
+	}
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Ext2Superblock holds the superblock fields dumpe2fs -h reports, like "Block count" and "Block size".
+type Ext2Superblock map[string]string
+
+// ParseDumpe2fs parses the "Field name:   value" lines of dumpe2fs -h. other lines, like the
+// version banner, are ignored.
+func ParseDumpe2fs(data []byte) Ext2Superblock {
+	sb := Ext2Superblock{}
+	for _, line := range strings.Split(string(data), "\n") {
+		entries := strings.SplitN(line, ":", 2)
+		if len(entries) < 2 {
+			continue
+		}
+		sb[strings.TrimSpace(entries[0])] = strings.TrimSpace(entries[1])
+	}
+	return sb
+}
+
+func (sb Ext2Superblock) uint(field string) (uint64, error) {
+	value, ok := sb[field]
+	if !ok {
+		return 0, fmt.Errorf("no %s in dumpe2fs output", field)
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func (sb Ext2Superblock) BlockSize() (uint64, error)  { return sb.uint("Block size") }
+func (sb Ext2Superblock) BlockCount() (uint64, error) { return sb.uint("Block count") }
+
+// Size returns the size of the filesystem in bytes.
+func (sb Ext2Superblock) Size() (uint64, error) {
+	size, err := sb.BlockSize()
+	if err != nil {
+		return 0, err
+	}
+	count, err := sb.BlockCount()
+	if err != nil {
+		return 0, err
+	}
+	return size * count, nil
+}
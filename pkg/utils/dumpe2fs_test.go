@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+const RootfsDumpe2fs = `dumpe2fs 1.46.2 (28-Feb-2021)
+Filesystem volume name:   rootfs
+Last mounted on:          /
+Filesystem UUID:          a4e8d4e6-1f7c-4d63-9d0e-2b7e4d3a9c1e
+Filesystem features:      has_journal ext_attr resize_inode dir_index filetype extent flex_bg
+Block count:              454912
+Free blocks:              102301
+Block size:               4096
+Last write time:          Tue May  3 10:12:45 2022
+`
+
+func TestDumpe2fs(t *testing.T) {
+	sb := ParseDumpe2fs([]byte(RootfsDumpe2fs))
+	if sb["Filesystem volume name"] != "rootfs" {
+		t.Errorf("unexpected volume name %q", sb["Filesystem volume name"])
+	}
+	if sb["Last write time"] != "Tue May  3 10:12:45 2022" {
+		t.Errorf("unexpected last write time %q", sb["Last write time"])
+	}
+	size, err := sb.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 454912*4096 {
+		t.Errorf("unexpected size %d", size)
+	}
+}
+
+func TestDumpe2fsMissingField(t *testing.T) {
+	sb := ParseDumpe2fs([]byte("Block count: 100\n"))
+	if _, err := sb.Size(); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FstabEntry is one mount line of /etc/fstab.
+type FstabEntry struct {
+	Spec    string
+	File    string
+	VfsType string
+	MntOps  string
+	Freq    string
+	PassNo  string
+}
+
+func (e FstabEntry) String() string {
+	return strings.Join([]string{e.Spec, e.File, e.VfsType, e.MntOps, e.Freq, e.PassNo}, "\t")
+}
+
+// Option returns the value of the mount option name, like subvol for subvol=/@/home. ok is
+// false when the entry doesn't have the option.
+func (e FstabEntry) Option(name string) (value string, ok bool) {
+	for _, opt := range strings.Split(e.MntOps, ",") {
+		if opt == name {
+			return "", true
+		}
+		if strings.HasPrefix(opt, name+"=") {
+			return strings.TrimPrefix(opt, name+"="), true
+		}
+	}
+	return "", false
+}
+
+// ParseFstabLine parses a single fstab line. ok is false for blank lines and comments.
+func ParseFstabLine(line string) (entry FstabEntry, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return FstabEntry{}, false, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 6 {
+		return FstabEntry{}, false, fmt.Errorf("unexpected fstab line %q", line)
+	}
+	// missing trailing fields take their defaults
+	defaults := []string{"", "", "auto", "defaults", "0", "0"}
+	fields = append(fields, defaults[len(fields):]...)
+	return FstabEntry{
+		Spec:    fields[0],
+		File:    fields[1],
+		VfsType: fields[2],
+		MntOps:  fields[3],
+		Freq:    fields[4],
+		PassNo:  fields[5],
+	}, true, nil
+}
+
+func ParseFstab(data []byte) ([]FstabEntry, error) {
+	var entries []FstabEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		entry, ok, err := ParseFstabLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// FilterFstab removes the entries for which remove returns true, keeping the
+// rest of the file, including comments, as is.
+func FilterFstab(data []byte, remove func(FstabEntry) bool) ([]byte, error) {
+	return UpdateFstab(data, func(e *FstabEntry) bool { return !remove(*e) })
+}
+
+// UpdateFstab calls update on every entry. Entries it changes are rewritten and
+// entries it returns false for are removed, other lines are kept as is.
+func UpdateFstab(data []byte, update func(*FstabEntry) bool) ([]byte, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	var out strings.Builder
+	for _, line := range lines {
+		entry, ok, err := ParseFstabLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			out.WriteString(line)
+			continue
+		}
+		orig := entry
+		if !update(&entry) {
+			continue
+		}
+		if entry != orig {
+			line = entry.String() + "\n"
+		}
+		out.WriteString(line)
+	}
+	return []byte(out.String()), nil
+}
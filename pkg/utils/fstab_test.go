@@ -0,0 +1,88 @@
+package utils
+
+import "testing"
+
+const RaspiosFstab = `proc            /proc           proc    defaults          0       0
+PARTUUID=544c6228-01  /boot           vfat    defaults          0       2
+PARTUUID=544c6228-02  /               ext4    defaults,noatime  0       1
+# swap partition
+UUID=d2a5a1b6-2bbb-4a69-a4a8-4a0ea8e3c1f2 none swap sw
+`
+
+func TestFstab(t *testing.T) {
+	entries, err := ParseFstab([]byte(RaspiosFstab))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	if entries[2].Spec != "PARTUUID=544c6228-02" || entries[2].File != "/" || entries[2].MntOps != "defaults,noatime" {
+		t.Errorf("unexpected root entry %v", entries[2])
+	}
+	if entries[3].VfsType != "swap" || entries[3].PassNo != "0" {
+		t.Errorf("unexpected swap entry %v", entries[3])
+	}
+}
+
+func TestFstabOption(t *testing.T) {
+	entry := FstabEntry{MntOps: "noatime,subvol=/@/home,compress=zstd:1,nofail"}
+	if v, ok := entry.Option("subvol"); !ok || v != "/@/home" {
+		t.Errorf("unexpected subvol %q %v", v, ok)
+	}
+	if v, ok := entry.Option("nofail"); !ok || v != "" {
+		t.Errorf("unexpected nofail %q %v", v, ok)
+	}
+	if _, ok := entry.Option("compress=zstd"); ok {
+		t.Error("expected no compress=zstd option")
+	}
+	if _, ok := entry.Option("subvolid"); ok {
+		t.Error("expected no subvolid option")
+	}
+}
+
+func TestFstabBadFormat(t *testing.T) {
+	_, err := ParseFstab([]byte("/dev/sda1\n"))
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestFilterFstab(t *testing.T) {
+	data, err := FilterFstab([]byte(RaspiosFstab), func(e FstabEntry) bool { return e.VfsType == "swap" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ParseFstab(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected 3 entries, got %d", len(entries))
+	}
+	if len(data) != len(RaspiosFstab)-len("UUID=d2a5a1b6-2bbb-4a69-a4a8-4a0ea8e3c1f2 none swap sw\n") {
+		t.Errorf("unexpected filtered fstab %q", data)
+	}
+}
+
+func TestUpdateFstab(t *testing.T) {
+	data, err := UpdateFstab([]byte(RaspiosFstab), func(e *FstabEntry) bool {
+		if e.File == "/" {
+			e.Spec = "/dev/mapper/cryptroot"
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ParseFstab(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[2].Spec != "/dev/mapper/cryptroot" || entries[2].MntOps != "defaults,noatime" {
+		t.Errorf("unexpected fstab %q", data)
+	}
+	if entries[1].Spec != "PARTUUID=544c6228-01" {
+		t.Errorf("unexpected boot entry %v", entries[1])
+	}
+}
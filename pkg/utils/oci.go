@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// OCIPlatform is the platform of an image, like linux/arm64 or linux/arm/v7.
+type OCIPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParseOCIPlatform parses a platform in the os/architecture[/variant] form of docker --platform.
+func ParseOCIPlatform(platform string) (OCIPlatform, bool) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return OCIPlatform{}, false
+	}
+	p := OCIPlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, true
+}
+
+func (p OCIPlatform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *OCIPlatform      `json:"platform,omitempty"`
+}
+
+// WriteOCILayout writes an OCI image layout to dir, of a single layer image with the
+// filesystem of the tar archive layer. index.json lists only this image, tagged ref.
+func WriteOCILayout(dir string, layer io.Reader, ref string, platform OCIPlatform) error {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return err
+	}
+
+	layerDesc, diffID, err := writeLayerBlob(dir, layer)
+	if err != nil {
+		return err
+	}
+
+	config := map[string]interface{}{
+		"created":      time.Now().UTC().Format(time.RFC3339),
+		"os":           platform.OS,
+		"architecture": platform.Architecture,
+		"config":       map[string]interface{}{},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}},
+	}
+	if platform.Variant != "" {
+		config["variant"] = platform.Variant
+	}
+	configDesc, err := writeJSONBlob(dir, ociConfigType, config)
+	if err != nil {
+		return err
+	}
+
+	manifestDesc, err := writeJSONBlob(dir, ociManifestType, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"config":        configDesc,
+		"layers":        []ociDescriptor{layerDesc},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc.Platform = &platform
+	if ref != "" {
+		manifestDesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": ref}
+	}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644)
+}
+
+// writeLayerBlob writes the gzip compressed layer to the blobs of dir. It returns the
+// descriptor of the blob, and the digest of the uncompressed layer.
+func writeLayerBlob(dir string, layer io.Reader) (ociDescriptor, string, error) {
+	f, err := ioutil.TempFile(filepath.Join(dir, "blobs", "sha256"), "layer")
+	if err != nil {
+		return ociDescriptor{}, "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	compressed := sha256.New()
+	size := NewProgressWriter()
+	gz := gzip.NewWriter(io.MultiWriter(f, compressed, size))
+	uncompressed := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(gz, uncompressed), layer); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	if err := f.Close(); err != nil {
+		return ociDescriptor{}, "", err
+	}
+
+	desc := ociDescriptor{MediaType: ociLayerType, Digest: digest(compressed), Size: int64(size.TotalData())}
+	if err := os.Rename(f.Name(), blobPath(dir, desc.Digest)); err != nil {
+		return ociDescriptor{}, "", err
+	}
+	return desc, digest(uncompressed), nil
+}
+
+func writeJSONBlob(dir, mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	h := sha256.New()
+	h.Write(data)
+	desc := ociDescriptor{MediaType: mediaType, Digest: digest(h), Size: int64(len(data))}
+	return desc, ioutil.WriteFile(blobPath(dir, desc.Digest), data, 0644)
+}
+
+func digest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func blobPath(dir, digest string) string {
+	return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseOCIPlatform(t *testing.T) {
+	p, ok := ParseOCIPlatform("linux/arm/v7")
+	if !ok || p.OS != "linux" || p.Architecture != "arm" || p.Variant != "v7" || p.String() != "linux/arm/v7" {
+		t.Errorf("unexpected platform %+v", p)
+	}
+	for _, invalid := range []string{"arm64", "linux/", "linux/arm/v7/x"} {
+		if _, ok := ParseOCIPlatform(invalid); ok {
+			t.Errorf("expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func TestWriteOCILayout(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	tw.WriteHeader(&tar.Header{Name: "./etc/hostname", Mode: 0644, Size: 4})
+	tw.Write([]byte("acme"))
+	tw.Close()
+	diffID := sha256.Sum256(layer.Bytes())
+
+	dir, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := WriteOCILayout(dir, &layer, "1.2", OCIPlatform{OS: "linux", Architecture: "arm64"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	readJSON(t, filepath.Join(dir, "index.json"), &index)
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations["org.opencontainers.image.ref.name"] != "1.2" ||
+		index.Manifests[0].Platform.Architecture != "arm64" {
+		t.Fatalf("unexpected index %+v", index)
+	}
+	var manifest struct {
+		Config ociDescriptor   `json:"config"`
+		Layers []ociDescriptor `json:"layers"`
+	}
+	readJSON(t, blobPath(dir, index.Manifests[0].Digest), &manifest)
+	var config struct {
+		Architecture string `json:"architecture"`
+		RootFS       struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	readJSON(t, blobPath(dir, manifest.Config.Digest), &config)
+	if config.Architecture != "arm64" || len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != "sha256:"+hex.EncodeToString(diffID[:]) {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("unexpected layers %+v", manifest.Layers)
+	}
+	data, err := ioutil.ReadFile(blobPath(dir, manifest.Layers[0].Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(data); "sha256:"+hex.EncodeToString(sum[:]) != manifest.Layers[0].Digest || int64(len(data)) != manifest.Layers[0].Size {
+		t.Errorf("layer blob doesn't match its descriptor %+v", manifest.Layers[0])
+	}
+}
+
+func readJSON(t *testing.T, path string, v interface{}) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OsRelease holds the variables of an os-release file, see os-release(5).
+type OsRelease map[string]string
+
+func (o OsRelease) ID() string { return o["ID"] }
+
+// IDLike returns ID_LIKE, the space separated ids of the distributions this one derives from.
+func (o OsRelease) IDLike() []string { return strings.Fields(o["ID_LIKE"]) }
+
+// Is tells if the distribution is id, or derives from it.
+func (o OsRelease) Is(id string) bool {
+	if o.ID() == id {
+		return true
+	}
+	for _, like := range o.IDLike() {
+		if like == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOsRelease parses the VAR=value lines of an os-release file. values may be
+// quoted with double or single quotes.
+func ParseOsRelease(data []byte) (OsRelease, error) {
+	release := OsRelease{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries := strings.SplitN(line, "=", 2)
+		if len(entries) < 2 || entries[0] == "" {
+			return nil, fmt.Errorf("unexpected os-release format on line %d", i+1)
+		}
+		value := entries[1]
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad quoting on line %d: %v", i+1, err)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("bad quoting on line %d", i+1)
+			}
+			value = value[1 : len(value)-1]
+		}
+		release[entries[0]] = value
+	}
+	return release, nil
+}
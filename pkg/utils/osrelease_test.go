@@ -0,0 +1,47 @@
+package utils
+
+import "testing"
+
+const RaspiosOsRelease = `PRETTY_NAME="Raspbian GNU/Linux 11 (bullseye)"
+NAME="Raspbian GNU/Linux"
+VERSION_ID="11"
+VERSION="11 (bullseye)"
+VERSION_CODENAME=bullseye
+ID=raspbian
+ID_LIKE=debian
+HOME_URL="http://www.raspbian.org/"
+`
+
+func TestOsRelease(t *testing.T) {
+	release, err := ParseOsRelease([]byte(RaspiosOsRelease))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if release.ID() != "raspbian" {
+		t.Errorf("unexpected id %q", release.ID())
+	}
+	if release["PRETTY_NAME"] != "Raspbian GNU/Linux 11 (bullseye)" {
+		t.Errorf("unexpected pretty name %q", release["PRETTY_NAME"])
+	}
+	if !release.Is("debian") || release.Is("fedora") {
+		t.Errorf("unexpected ID_LIKE %v", release.IDLike())
+	}
+}
+
+func TestOsReleaseSingleQuotes(t *testing.T) {
+	release, err := ParseOsRelease([]byte("# comment\nNAME='Kali GNU/Linux'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if release["NAME"] != "Kali GNU/Linux" {
+		t.Errorf("unexpected name %q", release["NAME"])
+	}
+}
+
+func TestOsReleaseBadFormat(t *testing.T) {
+	for _, data := range []string{"NAME\n", `NAME="unterminated` + "\n"} {
+		if _, err := ParseOsRelease([]byte(data)); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
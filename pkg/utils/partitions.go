@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// ReadPartitionTable reads the MBR or GPT partition table of a disk image, like sfdisk --json
+// reports it, with the sector size of the image. Logical partitions of MBR extended partitions
+// follow the primary ones, numbered from 5.
+func ReadPartitionTable(path string) (*PartitionTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sectorSize, err := SectorSize(f)
+	if err != nil {
+		return nil, err
+	}
+	table := &PartitionTable{Device: path, Unit: "sectors", SectorSize: sectorSize}
+
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	entries := mbrEntries(mbr)
+	if len(entries) > 0 && entries[0].kind == 0xee {
+		table.Label = "gpt"
+		return table, readGPT(f, table)
+	}
+
+	table.Label = "dos"
+	table.ID = fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(mbr[440:]))
+	var logical []Partition
+	for i, e := range entries {
+		if e.kind == 0 {
+			continue
+		}
+		table.Partitions = append(table.Partitions, e.partition(path, i+1))
+		if extendedTypes[e.kind] && logical == nil {
+			if logical, err = readLogical(f, path, sectorSize, e.start); err != nil {
+				return nil, err
+			}
+		}
+	}
+	table.Partitions = append(table.Partitions, logical...)
+	return table, nil
+}
+
+// SectorSize returns the logical sector size of a disk image, 512 or 4096. Images don't record
+// it: GPT images have their header in the second sector, and MBR partitions start with a known
+// filesystem at a multiple of it. It defaults to 512.
+func SectorSize(r io.ReaderAt) (uint64, error) {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return 0, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return 0, fmt.Errorf("no partition table")
+	}
+	entries := mbrEntries(mbr)
+	if len(entries) > 0 && entries[0].kind == 0xee {
+		for _, size := range []uint64{512, 4096} {
+			if hasMagic(r, int64(size), []byte("EFI PART")) {
+				return size, nil
+			}
+		}
+		return 0, fmt.Errorf("no GPT header")
+	}
+	for _, e := range entries {
+		if e.kind == 0 || extendedTypes[e.kind] {
+			continue
+		}
+		for _, size := range []uint64{512, 4096} {
+			if hasFilesystem(r, int64(e.start*size)) {
+				return size, nil
+			}
+		}
+	}
+	return 512, nil
+}
+
+var extendedTypes = map[byte]bool{0x05: true, 0x0f: true, 0x85: true}
+
+type mbrEntry struct {
+	bootable    bool
+	kind        byte
+	start, size uint64
+}
+
+func (e mbrEntry) partition(path string, number int) Partition {
+	return Partition{
+		Node:     partitionNode(path, number),
+		Start:    e.start,
+		Size:     e.size,
+		Type:     fmt.Sprintf("%x", e.kind),
+		Bootable: e.bootable,
+	}
+}
+
+// partitionNode names partition number of path like sfdisk: image1, or image2p1 when path ends
+// with a digit.
+func partitionNode(path string, number int) string {
+	if path != "" && path[len(path)-1] >= '0' && path[len(path)-1] <= '9' {
+		return fmt.Sprintf("%sp%d", path, number)
+	}
+	return fmt.Sprintf("%s%d", path, number)
+}
+
+// mbrEntries returns the 4 entries of the partition table of an MBR or EBR sector.
+func mbrEntries(sector []byte) []mbrEntry {
+	if sector[510] != 0x55 || sector[511] != 0xaa {
+		return nil
+	}
+	entries := make([]mbrEntry, 4)
+	for i := range entries {
+		b := sector[446+16*i : 446+16*(i+1)]
+		entries[i] = mbrEntry{
+			bootable: b[0] == 0x80,
+			kind:     b[4],
+			start:    uint64(binary.LittleEndian.Uint32(b[8:])),
+			size:     uint64(binary.LittleEndian.Uint32(b[12:])),
+		}
+	}
+	return entries
+}
+
+// readLogical follows the chain of EBRs of the extended partition at start. Their first entry
+// is a logical partition relative to the EBR, the second links the next EBR relative to start.
+func readLogical(r io.ReaderAt, path string, sectorSize, start uint64) ([]Partition, error) {
+	var partitions []Partition
+	ebr := make([]byte, 512)
+	for next := start; ; {
+		if _, err := r.ReadAt(ebr, int64(next*sectorSize)); err != nil {
+			return nil, fmt.Errorf("error reading the extended boot record at sector %d: %s", next, err)
+		}
+		entries := mbrEntries(ebr)
+		if entries == nil || entries[0].kind == 0 {
+			return partitions, nil
+		}
+		p := entries[0].partition(path, 5+len(partitions))
+		p.Start += next
+		partitions = append(partitions, p)
+		if len(partitions) > 128 {
+			return nil, fmt.Errorf("too many logical partitions")
+		}
+		if entries[1].kind == 0 {
+			return partitions, nil
+		}
+		next = start + entries[1].start
+	}
+}
+
+// readGPT reads the partition entries of the primary GPT header.
+func readGPT(r io.ReaderAt, table *PartitionTable) error {
+	header := make([]byte, 92)
+	if _, err := r.ReadAt(header, int64(table.SectorSize)); err != nil {
+		return err
+	}
+	table.ID = guidString(header[56:72])
+	entriesLBA := binary.LittleEndian.Uint64(header[72:])
+	count := binary.LittleEndian.Uint32(header[80:])
+	entrySize := binary.LittleEndian.Uint32(header[84:])
+	if entrySize < 128 || count > 1024 {
+		return fmt.Errorf("bad GPT header: %d partition entries of %d bytes", count, entrySize)
+	}
+
+	entries := make([]byte, int(count*entrySize))
+	if _, err := r.ReadAt(entries, int64(entriesLBA*table.SectorSize)); err != nil {
+		return err
+	}
+	for i := 0; i < int(count); i++ {
+		e := entries[i*int(entrySize) : (i+1)*int(entrySize)]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			continue
+		}
+		first, last := binary.LittleEndian.Uint64(e[32:]), binary.LittleEndian.Uint64(e[40:])
+		name := make([]uint16, 36)
+		for j := range name {
+			name[j] = binary.LittleEndian.Uint16(e[56+2*j:])
+		}
+		table.Partitions = append(table.Partitions, Partition{
+			Node:  partitionNode(table.Device, i+1),
+			Start: first,
+			Size:  last - first + 1,
+			Type:  guidString(e[:16]),
+			UUID:  guidString(e[16:32]),
+			Name:  strings.TrimRight(string(utf16.Decode(name)), "\x00"),
+		})
+	}
+	return nil
+}
+
+// guidString formats a GUID stored with its first 3 fields little endian, like sfdisk does.
+func guidString(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+func hasMagic(r io.ReaderAt, offset int64, magic []byte) bool {
+	b := make([]byte, len(magic))
+	if _, err := r.ReadAt(b, offset); err != nil {
+		return false
+	}
+	return bytes.Equal(b, magic)
+}
+
+// hasFilesystem looks for the signature of a filesystem images commonly have at offset.
+func hasFilesystem(r io.ReaderAt, offset int64) bool {
+	return hasMagic(r, offset+1080, []byte{0x53, 0xef}) || // ext
+		hasMagic(r, offset+510, []byte{0x55, 0xaa}) || // FAT
+		hasMagic(r, offset, []byte("XFSB")) ||
+		hasMagic(r, offset, []byte("hsqs")) || // squashfs
+		hasMagic(r, offset, []byte("LUKS\xba\xbe")) ||
+		hasMagic(r, offset+0x10040, []byte("_BHRfS_M")) || // btrfs
+		hasMagic(r, offset+4086, []byte("SWAPSPACE2"))
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeImage writes an image of size bytes with the raw byte ranges of parts at their offset,
+// in a temporary directory.
+func writeImage(t *testing.T, name string, size int64, parts map[int64][]byte) string {
+	dir, err := ioutil.TempDir("", "partitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for offset, data := range parts {
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// mbrSector returns a boot sector with entries of type, start and size.
+func mbrSector(entries ...[3]uint32) []byte {
+	b := make([]byte, 512)
+	binary.LittleEndian.PutUint32(b[440:], 0x544c6228)
+	for i, e := range entries {
+		entry := b[446+16*i:]
+		entry[4] = byte(e[0])
+		binary.LittleEndian.PutUint32(entry[8:], e[1])
+		binary.LittleEndian.PutUint32(entry[12:], e[2])
+	}
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func TestReadPartitionTableDos(t *testing.T) {
+	path := writeImage(t, "image", 64<<20, map[int64][]byte{
+		0:                mbrSector([3]uint32{0x0c, 2048, 8192}, [3]uint32{0x83, 10240, 20480}),
+		10240*512 + 1080: {0x53, 0xef},
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+	table, err := ReadPartitionTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Label != "dos" || table.ID != "0x544c6228" || table.SectorSize != 512 || len(table.Partitions) != 2 {
+		t.Fatalf("unexpected table %+v", table)
+	}
+	p := table.Partitions[1]
+	if p.Number() != 2 || p.Start != 10240 || p.Size != 20480 || p.Type != "83" {
+		t.Errorf("unexpected partition %+v", p)
+	}
+}
+
+func TestReadPartitionTable4K(t *testing.T) {
+	path := writeImage(t, "image2", 64<<20, map[int64][]byte{
+		0:                mbrSector([3]uint32{0x0c, 256, 1024}, [3]uint32{0x83, 1280, 4096}),
+		256*4096 + 510:   {0x55, 0xaa},
+		1280*4096 + 1080: {0x53, 0xef},
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+	table, err := ReadPartitionTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.SectorSize != 4096 {
+		t.Fatalf("expected 4096 byte sectors, got %d", table.SectorSize)
+	}
+	if p := table.Partitions[0]; p.Node != path+"p1" || p.Number() != 1 {
+		t.Errorf("unexpected partition %+v", p)
+	}
+}
+
+func TestReadPartitionTableLogical(t *testing.T) {
+	path := writeImage(t, "image", 64<<20, map[int64][]byte{
+		0: mbrSector([3]uint32{0x0c, 2048, 8192}, [3]uint32{0x05, 10240, 40960}),
+		// logical partitions 2048 sectors after their EBR, the second EBR at 20480 in the extended partition
+		10240 * 512: mbrSector([3]uint32{0x83, 2048, 8192}, [3]uint32{0x05, 20480, 20480}),
+		30720 * 512: mbrSector([3]uint32{0x82, 2048, 4096}),
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+	table, err := ReadPartitionTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.Partitions) != 4 {
+		t.Fatalf("expected 4 partitions, got %+v", table.Partitions)
+	}
+	if p := table.Partitions[2]; p.Number() != 5 || p.Start != 12288 || p.Type != "83" {
+		t.Errorf("unexpected partition %+v", p)
+	}
+	if p := table.Partitions[3]; p.Number() != 6 || p.Start != 32768 || p.Size != 4096 {
+		t.Errorf("unexpected partition %+v", p)
+	}
+}
+
+func TestReadPartitionTableGpt(t *testing.T) {
+	header := make([]byte, 92)
+	copy(header, "EFI PART")
+	copy(header[56:], []byte{0x8e, 0x1f, 0x7b, 0x9b, 0x16, 0x7a, 0x7c, 0x4e, 0x9f, 0x34, 0x0c, 0x5c, 0x3e, 0x0d, 0x7a, 0x10})
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+
+	entry := make([]byte, 128)
+	// the EFI system partition type
+	copy(entry, []byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b})
+	copy(entry[16:], []byte{0x4c, 0x3b, 0x2a, 0x0f, 0x6e, 0x5d, 0x70, 0x4f, 0x81, 0x92, 0xa3, 0xb4, 0xc5, 0xd6, 0xe7, 0xf8})
+	binary.LittleEndian.PutUint64(entry[32:], 8192)
+	binary.LittleEndian.PutUint64(entry[40:], 8192+524288-1)
+	for i, c := range "EFI" {
+		binary.LittleEndian.PutUint16(entry[56+2*i:], uint16(c))
+	}
+
+	path := writeImage(t, "image", 512<<20, map[int64][]byte{
+		0:    mbrSector([3]uint32{0xee, 1, 0xffffffff}),
+		512:  header,
+		1024: entry,
+	})
+	defer os.RemoveAll(filepath.Dir(path))
+	table, err := ReadPartitionTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Label != "gpt" || table.ID != "9B7B1F8E-7A16-4E7C-9F34-0C5C3E0D7A10" || len(table.Partitions) != 1 {
+		t.Fatalf("unexpected table %+v", table)
+	}
+	p := table.Partitions[0]
+	if p.Number() != 1 || p.Start != 8192 || p.Size != 524288 || p.Name != "EFI" ||
+		p.Type != "C12A7328-F81F-11D2-BA4B-00A0C93EC93B" || p.UUID != "0F2A3B4C-5D6E-4F70-8192-A3B4C5D6E7F8" {
+		t.Errorf("unexpected partition %+v", p)
+	}
+	if uuid := table.PartUUID(1); uuid != "0f2a3b4c-5d6e-4f70-8192-a3b4c5d6e7f8" {
+		t.Errorf("unexpected PARTUUID %s", uuid)
+	}
+}
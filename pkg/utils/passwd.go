@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LookupID returns the id of name in a passwd or group file, the third field of its line.
+// Numeric names are ids already.
+func LookupID(data []byte, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		return strconv.Atoi(fields[2])
+	}
+	return 0, fmt.Errorf("%s not found", name)
+}
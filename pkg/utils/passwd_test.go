@@ -0,0 +1,23 @@
+package utils
+
+import "testing"
+
+const imagePasswd = `root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+pi:x:1000:1000:,,,:/home/pi:/bin/bash
+`
+
+func TestLookupID(t *testing.T) {
+	for name, expected := range map[string]int{"root": 0, "pi": 1000, "1001": 1001} {
+		id, err := LookupID([]byte(imagePasswd), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != expected {
+			t.Errorf("expected id %d for %s, got %d", expected, name, id)
+		}
+	}
+	if _, err := LookupID([]byte(imagePasswd), "nobody"); err == nil {
+		t.Error("expected a not found error")
+	}
+}
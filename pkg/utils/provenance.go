@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+)
+
+const (
+	// InTotoStatementType is the _type of in-toto v1 statements.
+	InTotoStatementType = "https://in-toto.io/Statement/v1"
+	// InTotoPayloadType is the DSSE payload type of in-toto statements.
+	InTotoPayloadType = "application/vnd.in-toto+json"
+	// SlsaProvenanceType is the predicate type of SLSA v1 provenance.
+	SlsaProvenanceType = "https://slsa.dev/provenance/v1"
+)
+
+// InTotoStatement is an in-toto attestation about the subjects, see
+// https://github.com/in-toto/attestation/blob/main/spec/v1/statement.md
+type InTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []InTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     interface{}     `json:"predicate"`
+}
+
+type InTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// SlsaProvenance is the predicate of SLSA v1 provenance, see https://slsa.dev/spec/v1.0/provenance
+type SlsaProvenance struct {
+	BuildDefinition SlsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      SlsaRunDetails      `json:"runDetails"`
+}
+
+type SlsaBuildDefinition struct {
+	BuildType            string                   `json:"buildType"`
+	ExternalParameters   map[string]interface{}   `json:"externalParameters"`
+	InternalParameters   map[string]interface{}   `json:"internalParameters,omitempty"`
+	ResolvedDependencies []SlsaResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+type SlsaResourceDescriptor struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type SlsaRunDetails struct {
+	Builder  SlsaBuilder       `json:"builder"`
+	Metadata SlsaBuildMetadata `json:"metadata"`
+}
+
+type SlsaBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type SlsaBuildMetadata struct {
+	InvocationID string `json:"invocationId,omitempty"`
+	StartedOn    string `json:"startedOn,omitempty"`
+	FinishedOn   string `json:"finishedOn,omitempty"`
+}
+
+// DsseEnvelope is a signed payload, see https://github.com/secure-systems-lab/dsse
+type DsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []DsseSignature `json:"signatures"`
+}
+
+type DsseSignature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   string `json:"sig"`
+}
+
+// dssePAE is the pre-authentication encoding of a payload, what is signed.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return append([]byte(fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))), payload...)
+}
+
+// NewDsseEnvelope returns the envelope of payload, signed by signer unless it is nil.
+func NewDsseEnvelope(payloadType string, payload []byte, signer crypto.Signer) (*DsseEnvelope, error) {
+	env := &DsseEnvelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []DsseSignature{},
+	}
+	if signer == nil {
+		return env, nil
+	}
+	message, opts := dssePAE(payloadType, payload), crypto.Hash(0)
+	if _, ok := signer.Public().(ed25519.PublicKey); !ok {
+		digest := sha256.Sum256(message)
+		message, opts = digest[:], crypto.SHA256
+	}
+	sig, err := signer.Sign(rand.Reader, message, opts)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := KeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	env.Signatures = append(env.Signatures, DsseSignature{KeyID: keyID, Sig: base64.StdEncoding.EncodeToString(sig)})
+	return env, nil
+}
+
+// Verify checks the envelope has a valid signature by pub.
+func (e *DsseEnvelope) Verify(pub crypto.PublicKey) error {
+	payload, err := base64.StdEncoding.DecodeString(e.Payload)
+	if err != nil {
+		return err
+	}
+	message := dssePAE(e.PayloadType, payload)
+	digest := sha256.Sum256(message)
+	for _, s := range e.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		var ok bool
+		switch pub := pub.(type) {
+		case ed25519.PublicKey:
+			ok = ed25519.Verify(pub, message, sig)
+		case *ecdsa.PublicKey:
+			ok = ecdsa.VerifyASN1(pub, digest[:], sig)
+		case *rsa.PublicKey:
+			ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+		default:
+			return fmt.Errorf("unsupported key type %T", pub)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature")
+}
+
+// KeyID returns the hex sha256 of the DER encoding of a public key.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ParsePrivateKey parses a PEM ed25519, ECDSA or RSA private key, in PKCS #8, SEC 1 or
+// PKCS #1 form, like openssl genpkey writes them.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if block.Headers["Proc-Type"] != "" {
+		return nil, fmt.Errorf("encrypted keys are not supported")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+}
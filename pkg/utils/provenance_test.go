@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestDssePAE(t *testing.T) {
+	// the example of the DSSE protocol
+	pae := dssePAE("http://example.com/HelloWorld", []byte("hello world"))
+	if string(pae) != "DSSEv1 29 http://example.com/HelloWorld 11 hello world" {
+		t.Errorf("unexpected PAE %q", pae)
+	}
+}
+
+func TestDsseEnvelope(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []interface{}{edKey, ecKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, err := NewDsseEnvelope(InTotoPayloadType, []byte(`{"_type":"x"}`), signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Signatures) != 1 || env.Signatures[0].KeyID == "" {
+			t.Fatalf("unexpected signatures %+v", env.Signatures)
+		}
+		if err := env.Verify(signer.Public()); err != nil {
+			t.Errorf("%T: %v", key, err)
+		}
+		env.Payload = "e30="
+		if err := env.Verify(signer.Public()); err == nil {
+			t.Errorf("%T: expected a tampered payload to fail", key)
+		}
+	}
+}
+
+func TestDsseEnvelopeUnsigned(t *testing.T) {
+	env, err := NewDsseEnvelope(InTotoPayloadType, []byte("{}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Payload != "e30=" || env.Signatures == nil || len(env.Signatures) != 0 {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+}
+
+func TestParsePrivateKeyErrors(t *testing.T) {
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("expected an error without PEM data")
+	}
+	if _, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}})); err == nil {
+		t.Error("expected an error for a certificate")
+	}
+}
@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Package is a package installed in an image, as its package manager lists it.
+type Package struct {
+	// the package type of purls: deb, rpm or apk
+	Type    string
+	Name    string
+	Version string
+	Arch    string
+	// the license the package declares, rpm and apk packages only
+	License string
+}
+
+// Purl returns the package url of the package, like pkg:deb/debian/curl@7.74.0-1.3?arch=arm64,
+// distro being the id of the distribution.
+func (p Package) Purl(distro string) string {
+	purl := fmt.Sprintf("pkg:%s/%s/%s@%s", p.Type, purlEscape(distro), purlEscape(p.Name), purlEscape(p.Version))
+	if p.Arch != "" {
+		purl += "?arch=" + purlEscape(p.Arch)
+	}
+	return purl
+}
+
+func purlEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// DpkgQueryFormat is the format of the dpkg-query -W output ParseDpkgPackages parses.
+const DpkgQueryFormat = `${db:Status-Abbrev}\t${Package}\t${Version}\t${Architecture}\n`
+
+// ParseDpkgPackages parses the output of dpkg-query -W -f DpkgQueryFormat. Packages that are
+// removed but not purged are skipped.
+func ParseDpkgPackages(out []byte) ([]Package, error) {
+	var packages []Package
+	for i, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected dpkg-query output on line %d: %q", i+1, line)
+		}
+		if !strings.HasPrefix(fields[0], "ii") && !strings.HasPrefix(fields[0], "hi") {
+			continue
+		}
+		packages = append(packages, Package{Type: "deb", Name: fields[1], Version: fields[2], Arch: fields[3]})
+	}
+	return packages, nil
+}
+
+// RpmQueryFormat is the query format of the rpm -qa output ParseRpmPackages parses.
+const RpmQueryFormat = `%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{ARCH}\t%{LICENSE}\n`
+
+// ParseRpmPackages parses the output of rpm -qa --queryformat RpmQueryFormat. The gpg-pubkey
+// pseudo packages of imported keys are skipped.
+func ParseRpmPackages(out []byte) ([]Package, error) {
+	var packages []Package
+	for i, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected rpm output on line %d: %q", i+1, line)
+		}
+		if fields[0] == "gpg-pubkey" {
+			continue
+		}
+		arch := fields[2]
+		if arch == "(none)" {
+			arch = ""
+		}
+		packages = append(packages, Package{Type: "rpm", Name: fields[0], Version: fields[1], Arch: arch, License: fields[3]})
+	}
+	return packages, nil
+}
+
+// apkListLine is a line of apk list --installed, like
+// busybox-1.36.1-r5 aarch64 {busybox} (GPL-2.0-only) [installed]
+var apkListLine = regexp.MustCompile(`^(\S+)-([^-\s]+-r[0-9]+) (\S+) \{[^}]*\} \((.*)\) \[installed\]`)
+
+// ParseApkPackages parses the output of apk list --installed.
+func ParseApkPackages(out []byte) ([]Package, error) {
+	var packages []Package
+	for i, line := range strings.Split(string(out), "\n") {
+		if line == "" || strings.HasPrefix(line, "WARNING") {
+			continue
+		}
+		m := apkListLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("unexpected apk output on line %d: %q", i+1, line)
+		}
+		packages = append(packages, Package{Type: "apk", Name: m[1], Version: m[2], Arch: m[3], License: m[4]})
+	}
+	return packages, nil
+}
+
+// Sbom is a software bill of materials of the packages of an image.
+type Sbom struct {
+	// the name of the image, usually the name of the build
+	Name string
+	// a UUID identifying this document
+	Serial  string
+	Created time.Time
+	// the tool creating the document, and its version
+	Tool        string
+	ToolVersion string
+	// the os-release of the image, for the distribution of purls
+	Os       OsRelease
+	Packages []Package
+}
+
+func (s *Sbom) distro() string {
+	if id := s.Os.ID(); id != "" {
+		return id
+	}
+	return "unknown"
+}
+
+type spdxDocument struct {
+	SpdxVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	LicenseComments  string            `json:"licenseComments,omitempty"`
+	CopyrightText    string            `json:"copyrightText"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SpdxElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSpdxElement string `json:"relatedSpdxElement"`
+}
+
+// SPDX returns the SBOM as an SPDX 2.3 JSON document. The image is a package containing the
+// others. Licenses are not always SPDX expressions, so they are license comments.
+func (s *Sbom) SPDX() ([]byte, error) {
+	doc := spdxDocument{
+		SpdxVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              s.Name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/%s-%s", url.PathEscape(s.Name), s.Serial),
+		CreationInfo: spdxCreationInfo{
+			Created:  s.Created.UTC().Format(time.RFC3339),
+			Creators: []string{fmt.Sprintf("Tool: %s-%s", s.Tool, s.ToolVersion)},
+		},
+		Packages: []spdxPackage{{
+			Name:             s.Name,
+			SPDXID:           "SPDXRef-Image",
+			VersionInfo:      s.Os["VERSION_ID"],
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			PrimaryPurpose:   "OPERATING-SYSTEM",
+		}},
+		Relationships: []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"}},
+	}
+	for i, p := range s.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             p.Name,
+			SPDXID:           id,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			LicenseComments:  p.License,
+			CopyrightText:    "NOASSERTION",
+			ExternalRefs:     []spdxExternalRef{{"PACKAGE-MANAGER", "purl", p.Purl(s.distro())}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", id})
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+type cycloneDxDocument struct {
+	BomFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDxMetadata    `json:"metadata"`
+	Components   []cycloneDxComponent `json:"components"`
+}
+
+type cycloneDxMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cycloneDxTool    `json:"tools"`
+	Component cycloneDxComponent `json:"component"`
+}
+
+type cycloneDxTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cycloneDxComponent struct {
+	Type     string             `json:"type"`
+	BomRef   string             `json:"bom-ref,omitempty"`
+	Name     string             `json:"name"`
+	Version  string             `json:"version,omitempty"`
+	Purl     string             `json:"purl,omitempty"`
+	Licenses []cycloneDxLicense `json:"licenses,omitempty"`
+}
+
+type cycloneDxLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+// CycloneDX returns the SBOM as a CycloneDX 1.5 JSON document, the image being the component
+// it describes.
+func (s *Sbom) CycloneDX() ([]byte, error) {
+	doc := cycloneDxDocument{
+		BomFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + s.Serial,
+		Version:      1,
+		Metadata: cycloneDxMetadata{
+			Timestamp: s.Created.UTC().Format(time.RFC3339),
+			Tools:     []cycloneDxTool{{s.Tool, s.ToolVersion}},
+			Component: cycloneDxComponent{Type: "operating-system", Name: s.Name, Version: s.Os["VERSION_ID"]},
+		},
+		Components: []cycloneDxComponent{},
+	}
+	for _, p := range s.Packages {
+		c := cycloneDxComponent{Type: "library", Name: p.Name, Version: p.Version, Purl: p.Purl(s.distro())}
+		c.BomRef = c.Purl
+		if p.License != "" {
+			var l cycloneDxLicense
+			l.License.Name = p.License
+			c.Licenses = []cycloneDxLicense{l}
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
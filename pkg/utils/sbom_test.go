@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseDpkgPackages(t *testing.T) {
+	out := "ii \tcurl\t7.74.0-1.3+deb11u7\tarm64\nrc \told\t1.0\tarm64\nhi \tlibc6\t2.31-13\tarm64\n"
+	packages, err := ParseDpkgPackages([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 2 || packages[0].Name != "curl" || packages[1].Name != "libc6" {
+		t.Fatalf("unexpected packages %+v", packages)
+	}
+	if purl := packages[0].Purl("debian"); purl != "pkg:deb/debian/curl@7.74.0-1.3%2Bdeb11u7?arch=arm64" {
+		t.Errorf("unexpected purl %s", purl)
+	}
+	if _, err := ParseDpkgPackages([]byte("ii curl\n")); err == nil {
+		t.Error("expected an error for a bad line")
+	}
+}
+
+func TestParseRpmPackages(t *testing.T) {
+	out := "bash\t5.1.8-6.el9\taarch64\tGPLv3+\ngpg-pubkey\t8483c65d-5ccc5b19\t(none)\tpubkey\nperl-IO\t0:1.43-481.el9\taarch64\tGPL+ or Artistic\n"
+	packages, err := ParseRpmPackages([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 2 || packages[1].Version != "0:1.43-481.el9" || packages[1].License != "GPL+ or Artistic" {
+		t.Fatalf("unexpected packages %+v", packages)
+	}
+	if purl := packages[1].Purl("rocky"); purl != "pkg:rpm/rocky/perl-IO@0%3A1.43-481.el9?arch=aarch64" {
+		t.Errorf("unexpected purl %s", purl)
+	}
+}
+
+func TestParseApkPackages(t *testing.T) {
+	out := "WARNING: opening /var/cache/apk: No such file or directory\n" +
+		"busybox-1.36.1-r5 aarch64 {busybox} (GPL-2.0-only) [installed]\n" +
+		"ca-certificates-bundle-20230506-r0 aarch64 {ca-certificates} (MPL-2.0 AND MIT) [installed]\n"
+	packages, err := ParseApkPackages([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 2 {
+		t.Fatalf("unexpected packages %+v", packages)
+	}
+	p := packages[1]
+	if p.Name != "ca-certificates-bundle" || p.Version != "20230506-r0" || p.Arch != "aarch64" || p.License != "MPL-2.0 AND MIT" {
+		t.Errorf("unexpected package %+v", p)
+	}
+}
+
+func testSbom() *Sbom {
+	return &Sbom{
+		Name:        "raspios",
+		Serial:      "3f2a1c9e-4b7d-4e2a-9c1f-0d8e6b5a7c31",
+		Created:     time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC),
+		Tool:        "packer-builder-arm-image",
+		ToolVersion: "0.2.7",
+		Os:          OsRelease{"ID": "raspbian", "VERSION_ID": "11"},
+		Packages: []Package{
+			{Type: "deb", Name: "curl", Version: "7.74.0-1.3", Arch: "armhf"},
+			{Type: "deb", Name: "bash", Version: "5.1-2", Arch: "armhf", License: "GPL-3.0"},
+		},
+	}
+}
+
+func TestSbomSPDX(t *testing.T) {
+	data, err := testSbom().SPDX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc spdxDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.SpdxVersion != "SPDX-2.3" || doc.CreationInfo.Created != "2023-05-01T12:00:00Z" ||
+		doc.DocumentNamespace != "https://spdx.org/spdxdocs/raspios-3f2a1c9e-4b7d-4e2a-9c1f-0d8e6b5a7c31" {
+		t.Errorf("unexpected document %+v", doc)
+	}
+	if len(doc.Packages) != 3 || doc.Packages[1].ExternalRefs[0].ReferenceLocator != "pkg:deb/raspbian/curl@7.74.0-1.3?arch=armhf" {
+		t.Fatalf("unexpected packages %+v", doc.Packages)
+	}
+	if len(doc.Relationships) != 3 || doc.Relationships[2] != (spdxRelationship{"SPDXRef-Image", "CONTAINS", "SPDXRef-Package-2"}) {
+		t.Errorf("unexpected relationships %+v", doc.Relationships)
+	}
+}
+
+func TestSbomCycloneDX(t *testing.T) {
+	data, err := testSbom().CycloneDX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc cycloneDxDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.BomFormat != "CycloneDX" || doc.SerialNumber != "urn:uuid:3f2a1c9e-4b7d-4e2a-9c1f-0d8e6b5a7c31" ||
+		doc.Metadata.Component.Type != "operating-system" {
+		t.Errorf("unexpected document %+v", doc)
+	}
+	if len(doc.Components) != 2 || doc.Components[1].BomRef != "pkg:deb/raspbian/bash@5.1-2?arch=armhf" ||
+		doc.Components[1].Licenses[0].License.Name != "GPL-3.0" || doc.Components[0].Licenses != nil {
+		t.Errorf("unexpected components %+v", doc.Components)
+	}
+}
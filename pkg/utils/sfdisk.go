@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PartitionTable is the partition table sfdisk --json reports. start and size are in sectors.
+type PartitionTable struct {
+	// dos or gpt
+	Label      string      `json:"label"`
+	ID         string      `json:"id"`
+	Device     string      `json:"device"`
+	Unit       string      `json:"unit"`
+	SectorSize uint64      `json:"sectorsize"`
+	Partitions []Partition `json:"partitions"`
+}
+
+type Partition struct {
+	Node  string `json:"node"`
+	Start uint64 `json:"start"`
+	Size  uint64 `json:"size"`
+	// the MBR type in hex, like "c", or the GPT type GUID
+	Type     string `json:"type"`
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	Bootable bool   `json:"bootable"`
+}
+
+// ParseSfdiskJSON parses the output of sfdisk --json.
+func ParseSfdiskJSON(data []byte) (*PartitionTable, error) {
+	var out struct {
+		PartitionTable *PartitionTable `json:"partitiontable"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	if out.PartitionTable == nil {
+		return nil, fmt.Errorf("no partitiontable in sfdisk output")
+	}
+	if out.PartitionTable.SectorSize == 0 {
+		out.PartitionTable.SectorSize = 512
+	}
+	return out.PartitionTable, nil
+}
+
+// PartUUID returns the PARTUUID of the n-th entry of Partitions, as the kernel and blkid
+// report it. dos partitions get the disk id and their number, like 544c6228-02.
+func (t *PartitionTable) PartUUID(number int) string {
+	if t.Label == "dos" {
+		return fmt.Sprintf("%s-%02x", strings.TrimPrefix(strings.ToLower(t.ID), "0x"), number)
+	}
+	for _, p := range t.Partitions {
+		if partitionNodeNumber(p.Node) == number {
+			return strings.ToLower(p.UUID)
+		}
+	}
+	return ""
+}
+
+// Number returns the number of a partition from its node, like 2 for image2 or /dev/sda2.
+func (p Partition) Number() int {
+	return partitionNodeNumber(p.Node)
+}
+
+func partitionNodeNumber(node string) int {
+	i := len(node)
+	for i > 0 && node[i-1] >= '0' && node[i-1] <= '9' {
+		i--
+	}
+	n := 0
+	fmt.Sscan(node[i:], &n)
+	return n
+}
@@ -0,0 +1,84 @@
+package utils
+
+import "testing"
+
+const RaspiosSfdisk = `{
+   "partitiontable": {
+      "label": "dos",
+      "id": "0x544c6228",
+      "device": "image",
+      "unit": "sectors",
+      "sectorsize": 512,
+      "partitions": [
+         {
+            "node": "image1",
+            "start": 8192,
+            "size": 524288,
+            "type": "c"
+         },{
+            "node": "image2",
+            "start": 532480,
+            "size": 3309568,
+            "type": "83"
+         }
+      ]
+   }
+}`
+
+const GptSfdisk = `{
+   "partitiontable": {
+      "label": "gpt",
+      "id": "9B7B1F8E-7A16-4E7C-9F34-0C5C3E0D7A10",
+      "device": "image",
+      "unit": "sectors",
+      "firstlba": 34,
+      "lastlba": 3842014,
+      "sectorsize": 512,
+      "partitions": [
+         {
+            "node": "image1",
+            "start": 8192,
+            "size": 524288,
+            "type": "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+            "uuid": "0F2A3B4C-5D6E-4F70-8192-A3B4C5D6E7F8",
+            "name": "EFI"
+         }
+      ]
+   }
+}`
+
+func TestSfdiskDos(t *testing.T) {
+	table, err := ParseSfdiskJSON([]byte(RaspiosSfdisk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Label != "dos" || len(table.Partitions) != 2 {
+		t.Fatalf("unexpected table %v", table)
+	}
+	p := table.Partitions[1]
+	if p.Number() != 2 || p.Start != 532480 || p.Type != "83" {
+		t.Errorf("unexpected partition %v", p)
+	}
+	if uuid := table.PartUUID(2); uuid != "544c6228-02" {
+		t.Errorf("unexpected PARTUUID %q", uuid)
+	}
+}
+
+func TestSfdiskGpt(t *testing.T) {
+	table, err := ParseSfdiskJSON([]byte(GptSfdisk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Partitions[0].Name != "EFI" {
+		t.Errorf("unexpected partition %v", table.Partitions[0])
+	}
+	if uuid := table.PartUUID(1); uuid != "0f2a3b4c-5d6e-4f70-8192-a3b4c5d6e7f8" {
+		t.Errorf("unexpected PARTUUID %q", uuid)
+	}
+}
+
+func TestSfdiskBadFormat(t *testing.T) {
+	if _, err := ParseSfdiskJSON([]byte(`{"foo": 1}`)); err == nil {
+		t.Error("expected error")
+	}
+}
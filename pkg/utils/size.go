@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KIB": 1 << 10,
+	"KB":  1000,
+	"M":   1 << 20,
+	"MIB": 1 << 20,
+	"MB":  1000 * 1000,
+	"G":   1 << 30,
+	"GIB": 1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"T":   1 << 40,
+	"TIB": 1 << 40,
+	"TB":  1000 * 1000 * 1000 * 1000,
+}
+
+// ParseSize parses a size in bytes, with an optional unit like "8G" or "512MiB".
+// K, M, G and T and their KiB forms are powers of 1024, KB, MB, GB and TB powers of 1000,
+// as used for sd card capacities.
+func ParseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	multiplier, ok := sizeUnits[unit]
+	if number == "" || !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if !strings.Contains(number, ".") {
+		n, err := strconv.ParseUint(number, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size %q: %v", s, err)
+		}
+		if n > ^uint64(0)/multiplier {
+			return 0, fmt.Errorf("size %q is too large", s)
+		}
+		return n * multiplier, nil
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	return uint64(f * float64(multiplier)), nil
+}
@@ -0,0 +1,39 @@
+package utils
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]uint64{
+		"4096":     4096,
+		"512K":     512 << 10,
+		"8G":       8 << 30,
+		"8GiB":     8 << 30,
+		"8GB":      8000000000,
+		"1.5g":     3 << 29,
+		"100 MB":   100000000,
+		"2T":       2 << 40,
+		" 16M ":    16 << 20,
+		"1024b":    1024,
+		"0":        0,
+		"3.5 MiB":  7 << 19,
+		"12345678": 12345678,
+	}
+	for s, expected := range sizes {
+		size, err := ParseSize(s)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", s, err)
+			continue
+		}
+		if size != expected {
+			t.Errorf("expected %q to be %d, got %d", s, expected, size)
+		}
+	}
+}
+
+func TestParseSizeInvalid(t *testing.T) {
+	for _, s := range []string{"", "G", "8X", "-1G", "1.2.3M", "99999999999999999999", "20000000T"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
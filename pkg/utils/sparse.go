@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"os"
+)
+
+const sparseBlockSize = 4096
+
+// SparseWriter writes to a file, skipping the blocks that are all zeros so they are left
+// as holes. Close sets the size of the file, as a trailing hole is never written.
+type SparseWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func NewSparseWriter(f *os.File) *SparseWriter {
+	return &SparseWriter{f: f}
+}
+
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// keep the chunks aligned to blocks, whatever size the writes are
+		n := sparseBlockSize - int(w.offset%sparseBlockSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		chunk := p[:n]
+		if !isZero(chunk) {
+			if _, err := w.f.WriteAt(chunk, w.offset); err != nil {
+				return written, err
+			}
+		}
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close sets the size of the file to what was written. It doesn't close the file.
+func (w *SparseWriter) Close() error {
+	return w.f.Truncate(w.offset)
+}
+
+// isZero tells if b only holds zeros.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
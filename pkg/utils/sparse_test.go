@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSparseWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var data []byte
+	data = append(data, bytes.Repeat([]byte{0}, 3*sparseBlockSize+7)...)
+	data = append(data, []byte("data in the middle")...)
+	data = append(data, bytes.Repeat([]byte{0}, 2*sparseBlockSize)...)
+
+	// odd sized writes, not aligned to blocks
+	w := NewSparseWriter(f)
+	if _, err := io.CopyBuffer(w, struct{ io.Reader }{bytes.NewReader(data)}, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("sparse file differs from what was written: %d bytes instead of %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const squashfsMagic = 0x73717368
+
+// the mksquashfs -comp names of the compressors of the superblock
+var squashfsCompressors = map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+
+// SquashfsSuperblock holds the fields of a squashfs 4.0 superblock needed to repack it alike.
+type SquashfsSuperblock struct {
+	BlockSize uint32
+	// the mksquashfs -comp name, like xz or zstd
+	Compression string
+	// the size of the filesystem in bytes
+	BytesUsed uint64
+}
+
+// ReadSquashfsSuperblock reads the superblock of the squashfs filesystem at offset.
+func ReadSquashfsSuperblock(r io.ReaderAt, offset int64) (*SquashfsSuperblock, error) {
+	buf := make([]byte, 96)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(buf) != squashfsMagic {
+		return nil, fmt.Errorf("no squashfs superblock")
+	}
+	if major := binary.LittleEndian.Uint16(buf[28:]); major != 4 {
+		return nil, fmt.Errorf("unsupported squashfs version %d", major)
+	}
+	id := binary.LittleEndian.Uint16(buf[20:])
+	comp, ok := squashfsCompressors[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown squashfs compression %d", id)
+	}
+	return &SquashfsSuperblock{
+		BlockSize:   binary.LittleEndian.Uint32(buf[12:]),
+		Compression: comp,
+		BytesUsed:   binary.LittleEndian.Uint64(buf[40:]),
+	}, nil
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func squashfsSuperblock(compression uint16) []byte {
+	buf := make([]byte, 4096)
+	sb := buf[1024:]
+	binary.LittleEndian.PutUint32(sb, squashfsMagic)
+	binary.LittleEndian.PutUint32(sb[12:], 131072)
+	binary.LittleEndian.PutUint16(sb[20:], compression)
+	binary.LittleEndian.PutUint16(sb[28:], 4)
+	binary.LittleEndian.PutUint64(sb[40:], 94371840)
+	return buf
+}
+
+func TestReadSquashfsSuperblock(t *testing.T) {
+	sb, err := ReadSquashfsSuperblock(bytes.NewReader(squashfsSuperblock(6)), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Compression != "zstd" || sb.BlockSize != 131072 || sb.BytesUsed != 94371840 {
+		t.Errorf("unexpected superblock %+v", sb)
+	}
+
+	if _, err := ReadSquashfsSuperblock(bytes.NewReader(squashfsSuperblock(9)), 1024); err == nil {
+		t.Error("expected an unknown compression error")
+	}
+	if _, err := ReadSquashfsSuperblock(bytes.NewReader(squashfsSuperblock(4)), 0); err == nil {
+		t.Error("expected a missing superblock error")
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+// UbootEnv returns a u-boot environment of size bytes (CONFIG_ENV_SIZE) holding vars, as
+// mkenvimage writes it for a non redundant environment: the CRC32 of the data, then the
+// nul terminated name=value pairs, padded with zeros.
+func UbootEnv(vars map[string]string, size int) ([]byte, error) {
+	var names []string
+	for name := range vars {
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.Contains(vars[name], "\x00") {
+			return nil, fmt.Errorf("invalid u-boot environment variable %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	env := make([]byte, size)
+	data := env[4:]
+	offset := 0
+	for _, name := range names {
+		pair := name + "=" + vars[name] + "\x00"
+		// the environment ends with an empty pair
+		if offset+len(pair)+1 > len(data) {
+			return nil, fmt.Errorf("the u-boot environment doesn't fit in %d bytes", size)
+		}
+		offset += copy(data[offset:], pair)
+	}
+	binary.LittleEndian.PutUint32(env, crc32.ChecksumIEEE(data))
+	return env, nil
+}
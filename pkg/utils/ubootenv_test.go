@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func TestUbootEnv(t *testing.T) {
+	env, err := UbootEnv(map[string]string{"slot": "a", "bootlimit": "3"}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 64 {
+		t.Fatalf("expected 64 bytes, got %d", len(env))
+	}
+	if got := string(env[4:23]); got != "bootlimit=3\x00slot=a\x00" {
+		t.Errorf("unexpected variables %q", got)
+	}
+	if binary.LittleEndian.Uint32(env) != crc32.ChecksumIEEE(env[4:]) {
+		t.Error("the CRC doesn't match the data")
+	}
+
+	if _, err := UbootEnv(map[string]string{"bootcmd": "run distro_bootcmd"}, 16); err == nil {
+		t.Error("expected an environment too large error")
+	}
+	if _, err := UbootEnv(map[string]string{"a=b": "c"}, 64); err == nil {
+		t.Error("expected an invalid name error")
+	}
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WksPartition is a part line of an OpenEmbedded kickstart (.wks) file, see
+// https://docs.yoctoproject.org/ref-manual/kickstart.html
+type WksPartition struct {
+	// the mount point, swap, or "" for partitions that aren't mounted
+	Mountpoint string
+	Fstype     string
+	Label      string
+	PartName   string
+	Source     string
+	// --no-table partitions are written to the image without a partition table entry, like
+	// bootloaders at fixed offsets
+	NoTable bool
+	// the number of the partition in the table of the image, 0 for --no-table partitions
+	Number int
+}
+
+// Wks is the layout of a .wic image, as its .wks file describes it.
+type Wks struct {
+	// the --ptable of the bootloader line: msdos or gpt
+	PartitionTable string
+	Partitions     []WksPartition
+}
+
+// Root returns the partition mounted at /, or nil.
+func (w *Wks) Root() *WksPartition {
+	for i, p := range w.Partitions {
+		if p.Mountpoint == "/" {
+			return &w.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// ParseWks parses the part and bootloader lines of a .wks file, and numbers the partitions
+// like wic does.
+func ParseWks(data []byte) (*Wks, error) {
+	wks := &Wks{PartitionTable: "msdos"}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitWksLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		opts, args := wksOptions(fields[1:])
+		switch fields[0] {
+		case "part", "partition":
+			p := WksPartition{
+				Fstype:   opts["fstype"],
+				Label:    opts["label"],
+				PartName: opts["part-name"],
+				Source:   opts["source"],
+			}
+			_, p.NoTable = opts["no-table"]
+			if len(args) > 0 {
+				p.Mountpoint = args[0]
+			}
+			wks.Partitions = append(wks.Partitions, p)
+		case "bootloader":
+			if ptable := opts["ptable"]; ptable != "" {
+				wks.PartitionTable = ptable
+			}
+		case "include":
+			return nil, fmt.Errorf("line %d: include is not supported, use the expanded .wks of the build", i+1)
+		}
+	}
+
+	var inTable int
+	for _, p := range wks.Partitions {
+		if !p.NoTable {
+			inTable++
+		}
+	}
+	number := 0
+	for i := range wks.Partitions {
+		p := &wks.Partitions[i]
+		if p.NoTable {
+			continue
+		}
+		number++
+		// with more than 4 partitions, the 4th MBR entry is the extended partition and the
+		// partitions from the 4th on are logical ones, numbered from 5
+		if wks.PartitionTable == "msdos" && inTable > 4 && number == 4 {
+			number++
+		}
+		p.Number = number
+	}
+	return wks, nil
+}
+
+// wksOptions splits the --name=value, --name value and --flag options of a line from its
+// arguments. Options without a value map to "".
+func wksOptions(fields []string) (map[string]string, []string) {
+	opts := make(map[string]string)
+	var args []string
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if !strings.HasPrefix(f, "--") {
+			args = append(args, f)
+			continue
+		}
+		name := strings.TrimPrefix(f, "--")
+		if kv := strings.SplitN(name, "=", 2); len(kv) == 2 {
+			opts[kv[0]] = kv[1]
+		} else if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "--") && wksValueOptions[name] {
+			opts[name] = fields[i+1]
+			i++
+		} else {
+			opts[name] = ""
+		}
+	}
+	return opts, args
+}
+
+// the options of part and bootloader lines that take a value, which can follow them after a space
+var wksValueOptions = map[string]bool{
+	"align": true, "extra-space": true, "fsoptions": true, "fstype": true, "label": true,
+	"mkfs-extraopts": true, "offset": true, "ondisk": true, "ondrive": true, "overhead-factor": true,
+	"part-name": true, "part-type": true, "size": true, "fixed-size": true, "source": true,
+	"sourceparams": true, "system-id": true, "uuid": true, "fsuuid": true, "ptable": true,
+	"append": true, "configfile": true, "timeout": true, "exclude-path": true, "include-path": true,
+}
+
+// splitWksLine splits line on spaces, keeping double or single quoted strings together.
+func splitWksLine(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	inField := false
+	for _, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inField = c, true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
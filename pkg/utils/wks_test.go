@@ -0,0 +1,82 @@
+package utils
+
+import "testing"
+
+const RaspberrypiWks = `# short-description: Create Raspberry Pi SD card image
+part /boot --source bootimg-partition --ondisk mmcblk0 --fstype=vfat --label boot --active --align 4096 --size 20
+part / --source rootfs --ondisk mmcblk0 --fstype=ext4 --label root --align 4096
+`
+
+func TestParseWks(t *testing.T) {
+	wks, err := ParseWks([]byte(RaspberrypiWks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wks.PartitionTable != "msdos" || len(wks.Partitions) != 2 {
+		t.Fatalf("unexpected layout %+v", wks)
+	}
+	boot := wks.Partitions[0]
+	if boot.Mountpoint != "/boot" || boot.Fstype != "vfat" || boot.Label != "boot" || boot.Number != 1 {
+		t.Errorf("unexpected boot partition %+v", boot)
+	}
+	if root := wks.Root(); root == nil || root.Number != 2 || root.Source != "rootfs" {
+		t.Errorf("unexpected root partition %+v", root)
+	}
+}
+
+func TestParseWksNumbers(t *testing.T) {
+	wks, err := ParseWks([]byte(`bootloader --ptable msdos --append="console=ttyS0 rootwait"
+part --source rawcopy --sourceparams="file=u-boot.imx" --ondisk mmcblk --no-table --align 1
+part /boot --source bootimg-partition --fstype=vfat --label boot --size 64
+part / --source rootfs --fstype=ext4 --label rootA
+part --fstype=ext4 --label rootB --size 1024
+part swap --fstype=swap --size 256
+part /data --fstype=ext4 --label data --size 512
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	for _, p := range wks.Partitions {
+		numbers = append(numbers, p.Number)
+	}
+	// the logical partitions are numbered from 5
+	expected := []int{0, 1, 2, 3, 5, 6}
+	if len(numbers) != len(expected) {
+		t.Fatalf("expected numbers %v, got %v", expected, numbers)
+	}
+	for i := range expected {
+		if numbers[i] != expected[i] {
+			t.Errorf("expected numbers %v, got %v", expected, numbers)
+			break
+		}
+	}
+	if wks.Partitions[3].Mountpoint != "" || wks.Partitions[4].Mountpoint != "swap" {
+		t.Errorf("unexpected mount points %+v", wks.Partitions)
+	}
+}
+
+func TestParseWksGpt(t *testing.T) {
+	wks, err := ParseWks([]byte(`bootloader --ptable gpt
+part /boot --fstype=vfat --part-name "EFI System" --label efi
+part --fstype=ext4 --label a
+part --fstype=ext4 --label b
+part --fstype=ext4 --label c
+part / --fstype=ext4 --label root
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wks.Partitions[0].PartName != "EFI System" {
+		t.Errorf("unexpected part name %q", wks.Partitions[0].PartName)
+	}
+	if root := wks.Root(); root.Number != 5 {
+		t.Errorf("expected root partition 5, got %d", root.Number)
+	}
+}
+
+func TestParseWksUnterminatedQuote(t *testing.T) {
+	if _, err := ParseWks([]byte(`part / --sourceparams="file=rootfs`)); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,19 @@
+// Package version holds the version of the plugin.
+package version
+
+import "runtime/debug"
+
+// Version is set when building releases, with
+// -ldflags "-X github.com/solo-io/packer-builder-arm-image/pkg/version.Version=v0.1.6"
+var Version = ""
+
+// String returns Version, or the module version go recorded for go install builds, or "dev".
+func String() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}